@@ -11,7 +11,7 @@ import (
 type Bios struct {
 	// TODO: Make a custom interface that also has this
 	Out io.Writer
-	In  io.Writer
+	In  io.Reader
 
 	cpu *cpu.CPU
 }
@@ -60,6 +60,68 @@ func (dos *Bios) Int13(c *cpu.CPU, intnum int) {
 	}
 }
 
+// Location of the BIOS data area and the fields in it used by go86.
+const (
+	biosDataSeg       = 0x0040
+	biosTimerCount    = 0x006C
+	biosTimerOverflow = 0x0070
+)
+
+// Number of timer ticks in a day, the count wraps to zero at midnight.
+const ticksPerDay = 0x1800B0
+
+// Dummy interrupt handler (IRET) in the BIOS ROM, used for vectors like the
+// user timer tick (INT 1Ch) which a program may hook.
+const (
+	dummyIntSeg = 0xF000
+	dummyIntOff = 0xFF53
+)
+
+func (bios *Bios) timerCount(c *cpu.CPU) uint32 {
+	lo := uint32(c.Mem.GetMem16(biosDataSeg, biosTimerCount))
+	hi := uint32(c.Mem.GetMem16(biosDataSeg, biosTimerCount+2))
+	return hi<<16 | lo
+}
+
+func (bios *Bios) setTimerCount(c *cpu.CPU, count uint32) {
+	c.Mem.SetMem16(biosDataSeg, biosTimerCount, uint16(count))
+	c.Mem.SetMem16(biosDataSeg, biosTimerCount+2, uint16(count>>16))
+}
+
+// Int08 handles IRQ 0 from the PIT, counting ticks since midnight in the
+// BIOS data area and then calling the user timer tick, INT 1Ch.
+func (bios *Bios) Int08(c *cpu.CPU, intnum int) {
+	count := bios.timerCount(c) + 1
+	if count >= ticksPerDay {
+		count = 0
+		c.Mem.SetMem8(biosDataSeg, biosTimerOverflow, 1)
+	}
+	bios.setTimerCount(c, count)
+
+	// EOI now, the INT 1Ch handler runs after we return.
+	c.Ports.Out8(0x20, 0x20)
+	c.Interrupt(0x1C)
+}
+
+// Int1A handles the time of day services.
+func (bios *Bios) Int1A(c *cpu.CPU, intnum int) {
+	log.V(3).Infof("Bios.int%02x: [AX: %04X]", intnum, c.Regs.GetReg16(cpu.AX))
+	switch ah := c.Regs.GetReg8(cpu.AH); ah {
+	case 0x00: // Get system time
+		count := bios.timerCount(c)
+		c.Regs.SetReg16(cpu.CX, uint(count>>16))
+		c.Regs.SetReg16(cpu.DX, uint(count&0xFFFF))
+		c.Regs.SetReg8(cpu.AL, uint(c.Mem.GetMem8(biosDataSeg, biosTimerOverflow)))
+		c.Mem.SetMem8(biosDataSeg, biosTimerOverflow, 0)
+	case 0x01: // Set system time
+		count := uint32(c.Regs.GetReg16(cpu.CX))<<16 | uint32(c.Regs.GetReg16(cpu.DX))
+		bios.setTimerCount(c, count)
+		c.Mem.SetMem8(biosDataSeg, biosTimerOverflow, 0)
+	default:
+		log.Warningf("Unhandled BIOS Interrupt Code: [%02x]\n", ah)
+	}
+}
+
 func NewBios(cpu *cpu.CPU) *Bios {
 	bios := &Bios{
 		Out: os.Stdout,
@@ -67,8 +129,48 @@ func NewBios(cpu *cpu.CPU) *Bios {
 		cpu: cpu,
 	}
 
+	cpu.Intrs[0x08] = (*bios).Int08
 	cpu.Intrs[0x10] = (*bios).Int10
 	cpu.Intrs[0x13] = (*bios).Int13
+	cpu.Intrs[0x1A] = (*bios).Int1A
+
+	// Only machines with interrupt hardware go through POST, a bare CPU
+	// (like the zed test harness) expects low memory to be left alone.
+	if cpu.PIC != nil {
+		bios.post()
+	}
 
 	return bios
 }
+
+// Does the parts of the power on self test which set up hardware and low
+// memory.
+func (bios *Bios) post() {
+	bios.initPIC()
+	bios.initPIT()
+
+	mem := bios.cpu.Mem
+	mem.SetMem8(dummyIntSeg, dummyIntOff, 0xCF) // IRET
+	mem.SetMem16(0, 0x1C*4, dummyIntOff)
+	mem.SetMem16(0, 0x1C*4+2, dummyIntSeg)
+	bios.setTimerCount(bios.cpu, 0)
+}
+
+// Programs the 8259 PIC the way the PC BIOS does during POST: edge
+// triggered, single PIC, IRQ 0-7 on vectors 08h-0Fh with the timer and
+// keyboard unmasked.
+func (bios *Bios) initPIC() {
+	ports := bios.cpu.Ports
+	ports.Out8(0x20, 0x13) // ICW1: edge triggered, single, ICW4 needed
+	ports.Out8(0x21, 0x08) // ICW2: vector base 08h
+	ports.Out8(0x21, 0x01) // ICW4: 8086 mode, normal EOI
+	ports.Out8(0x21, 0xFC) // OCW1: unmask IRQ 0 and 1
+}
+
+// Programs PIT channel 0 as an 18.2 Hz square wave for the time of day tick.
+func (bios *Bios) initPIT() {
+	ports := bios.cpu.Ports
+	ports.Out8(0x43, 0x36) // Channel 0, LSB then MSB, mode 3, binary
+	ports.Out8(0x40, 0x00) // Count of 0 is 65536
+	ports.Out8(0x40, 0x00)
+}
@@ -5,11 +5,16 @@ import (
 	"flag"
 	"fmt"
 
+	cpu "go86.org/go86/cpu"
+	disasm "go86.org/go86/disasm"
 	dos "go86.org/go86/dos"
-	"golang.org/x/arch/x86/x86asm"
 )
 
-var help = flag.Bool("help", false, "--help means show help")
+var (
+	help   = flag.Bool("help", false, "--help means show help")
+	syntax = flag.String("syntax", "intel", "Assembler syntax to write.  Values are: intel, nasm, masm")
+	model  = flag.String("cpu", "80186", "CPU model whose instructions to decode.  Values are: 8086, 8088, 80186, V20, V30")
+)
 
 func main() {
 	flag.Parse()
@@ -22,33 +27,54 @@ func main() {
 		flag.Usage()
 		return
 	}
+	s, err := disasm.ParseSyntax(*syntax)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	m, err := cpu.ParseModel(*model)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
 	fmt.Print("Hello: " + flag.Arg(0) + "\n")
 	exe, err := dos.ReadExeFromFile(flag.Arg(0))
 	if err != nil {
 		fmt.Printf("Failed to read file header from: '%s'; error: %s\n", flag.Arg(0), err)
 		return
 	}
-	fmt.Println("Exe Header Information:")
-	fmt.Printf("CS:   %X\n", exe.Hdr.CS)
-	fmt.Printf("SS:   %X\n", exe.Hdr.SS)
-	fmt.Printf("IP:   %X\n", exe.Hdr.IP)
-	for i := 0; i < int(exe.Hdr.NumRelos); i++ {
-		r := exe.Hdr.Relos[i]
-		fmt.Printf("Relo: %04X:%04X\n", r.Segment, r.Offset)
-
+	// COM files are loaded at 100h, EXEs at the start of their segment.
+	org := uint16(0)
+	if exe.Etype == dos.COM {
+		org = 0x100
+	} else {
+		fmt.Println("Exe Header Information:")
+		fmt.Printf("CS:   %X\n", exe.Hdr.CS)
+		fmt.Printf("SS:   %X\n", exe.Hdr.SS)
+		fmt.Printf("IP:   %X\n", exe.Hdr.IP)
+		for i := 0; i < int(exe.Hdr.NumRelos); i++ {
+			r := exe.Hdr.Relos[i]
+			fmt.Printf("Relo: %04X:%04X\n", r.Segment, r.Offset)
+		}
 	}
 
+	d := &disasm.Disassembler{Syntax: s, Model: m}
+	d.Symbols = disasm.Labels(m, exe.Data, org, nil)
+
 	pos := 0
 	raw := exe.Data
 	for len(raw) > 0 {
-		inst, err := x86asm.Decode(raw, 16)
+		ip := org + uint16(pos)
+		text, n, err := d.Disasm(raw, ip)
 		if err != nil {
+			fmt.Printf("%08X: [%-10s] %v\n", ip, hex.EncodeToString(raw), err)
 			return
 		}
-		cur := raw[:inst.Len]
-		fmt.Printf("%08X: [%-10s] %v\n", pos, hex.EncodeToString(cur), inst)
-		raw = raw[inst.Len:]
-		pos += inst.Len
-
+		if label, ok := d.Symbols[ip]; ok {
+			fmt.Printf("%s:\n", label)
+		}
+		fmt.Printf("%08X: [%-10s] %s\n", ip, hex.EncodeToString(raw[:n]), text)
+		raw = raw[n:]
+		pos += n
 	}
 }
@@ -1,16 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
 
 	glog "github.com/golang/glog"
-	bios "go86.org/go86/bios"
+	go86 "go86.org/go86"
 	zed "go86.org/go86/cmd/go86/zed"
 	cpu "go86.org/go86/cpu"
 	deb "go86.org/go86/debugger"
+	devices "go86.org/go86/devices"
 	dos "go86.org/go86/dos"
 )
 
@@ -21,56 +25,152 @@ var (
 	instcmd      = flag.NewFlagSet("inst", flag.ExitOnError)
 	zedcmd       = flag.NewFlagSet("zed", flag.ExitOnError)
 	runForceType = runcmd.Bool("image", false, "load binary as binary image instead of COM or EXE")
+	runModel     = runcmd.String("cpu", "80186", "CPU model to emulate.  Values are: 8086, 8088, 80186, V20, V30")
+	runFPU       = runcmd.Bool("fpu", true, "emulate an 8087 coprocessor, -fpu=false to run without one")
+	runMounts    mountFlags
+	runEnv       envFlags
+	clock        = runcmd.String("clock", "inst", "Time source for the timer.  Values are: inst (instruction count), cycles, wall")
+	clockHz      = runcmd.Uint64("hz", 0, "CPU clock rate in Hz, i.e. 4772727.  The emulation is paced at it, and -clock cycles turns cycles into time at it.  0 runs as fast as possible, with cycles at the PC's 4.77MHz")
 )
 
+func init() {
+	runcmd.Var(&runMounts, "mount", "mount a host directory as a DOS drive, i.e. C=./work.  May be repeated")
+	runcmd.Var(&runEnv, "env", "set a DOS environment variable, i.e. PATH=C:\\BIN.  May be repeated")
+	// inst runs a machine too, so it takes the same clock flags
+	for _, name := range []string{"clock", "hz"} {
+		f := runcmd.Lookup(name)
+		instcmd.Var(f.Value, f.Name, f.Usage)
+	}
+}
+
+// Host directories to mount, from -mount.
+type mountFlags []string
+
+func (f *mountFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *mountFlags) Set(s string) error {
+	if _, _, err := dos.ParseMount(s); err != nil {
+		return err
+	}
+	*f = append(*f, s)
+	return nil
+}
+
+// DOS environment variables, from -env.
+type envFlags []string
+
+func (f *envFlags) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *envFlags) Set(s string) error {
+	if name, _, ok := strings.Cut(s, "="); !ok || name == "" {
+		return fmt.Errorf("invalid environment variable, expected <name>=<value>: '%s'", s)
+	}
+	*f = append(*f, s)
+	return nil
+}
+
+// Options for the machine from the flags.
+func machineOptions() ([]go86.Option, error) {
+	opts := []go86.Option{go86.WithClockHz(*clockHz)}
+	switch *clock {
+	case "inst":
+	case "wall":
+		opts = append(opts, go86.WithClock(func(*cpu.CPU) devices.Clock { return devices.NewWallClock() }))
+	case "cycles":
+		opts = append(opts, go86.WithClock(func(c *cpu.CPU) devices.Clock {
+			cc := devices.NewCycleClock(c)
+			if *clockHz != 0 {
+				cc.CPUHz = *clockHz
+			}
+			return cc
+		}))
+	default:
+		return nil, fmt.Errorf("unknown clock: '%s', expected inst, cycles or wall", *clock)
+	}
+	return opts, nil
+}
+
 func doinst(opcodes string) bool {
+	opts, err := machineOptions()
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
 	fmt.Printf("OpCodes: [%s]\n\n", opcodes)
 	d, err := hex.DecodeString(opcodes)
 	if err != nil {
 		return false
 	}
 
-	cs := uint(0x1000)
-	c := cpu.NewCpu(1024 * 1024)
-	bios.NewBios(c)
-	dos.NewDos(c)
-	copy(c.Mem.At(cs, 0), d)
-	c.Regs.SetSeg16(cpu.CS, 0x1000)
-	c.Regs.SetSeg16(cpu.DS, 0x1000)
-	c.Ip = 0
-	c.Run()
+	m := go86.New(opts...)
+	m.LoadBinary(0x1000, d)
+	m.Run(context.Background())
 	return true
 }
 
-func dorun(filename string) bool {
+// Runs a DOS program with the command line arguments args, returning its
+// return code.
+func dorun(filename string, args []string) (int, bool) {
 	exe, err := dos.ReadExeFromFile(filename)
 	if err != nil {
 		fmt.Printf("Failed to read file header from: '%s'; error: %s\n", filename, err)
-		return false
+		return 0, false
 	}
 
 	if *runForceType {
 		exe.Etype = dos.IMAGE
 	}
 
-	c := cpu.NewCpu(1024 * 1024)
-	bios.NewBios(c)
-	di := dos.NewDos(c)
-	_, err = di.Load(exe)
+	model, err := cpu.ParseModel(*runModel)
 	if err != nil {
 		fmt.Println(err)
-		return false
+		return 0, false
+	}
+
+	opts, err := machineOptions()
+	if err != nil {
+		fmt.Println(err)
+		return 0, false
+	}
+	opts = append(opts, go86.WithModel(model))
+	if !*runFPU {
+		opts = append(opts, go86.WithFPU(nil))
+	}
+	if runEnv != nil {
+		opts = append(opts, go86.WithEnv(runEnv...))
+	}
+	m := go86.New(opts...)
+	for _, mount := range runMounts {
+		letter, dir, _ := dos.ParseMount(mount)
+		if err := m.Mount(letter, dir); err != nil {
+			fmt.Println(err)
+			return 0, false
+		}
+	}
+	if err := m.Load(exe, args...); err != nil {
+		fmt.Println(err)
+		return 0, false
 	}
 
 	if *dbg == "gdb" || *dbg == "lame" {
 		request := make(chan deb.DebuggerRequest)
 		response := make(chan deb.DebuggerResponse, 5)
-		deb.EnableDebugger(c, *port, *dbg, request, response)
+		deb.EnableDebugger(m.CPU, *port, *dbg, request, response)
 
 	}
-	c.Run()
-	fmt.Println("")
-	return true
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	code, err := m.Run(ctx)
+	if err != nil {
+		fmt.Println(err)
+		return 0, false
+	}
+	glog.Infof("Program exited: [%v, return code %d]", m.Dos.TermKind, code)
+	return code, true
 }
 
 func showHelp() {
@@ -109,13 +209,15 @@ func main() {
 	case "run":
 		runcmd.Parse(args[1:])
 		if runcmd.NArg() < 1 {
-			fmt.Print("Go86\n\nUsage: go86 run <DOS EXE>.\n")
+			fmt.Print("Go86\n\nUsage: go86 run <DOS EXE> [arguments].\n")
 			showHelp()
 			os.Exit(1)
 		}
-		if !dorun(runcmd.Arg(0)) {
+		code, ok := dorun(runcmd.Arg(0), runcmd.Args()[1:])
+		if !ok {
 			os.Exit(1)
 		}
+		os.Exit(code)
 	case "inst":
 		// Example inst (hello world):
 		// 8D161500B409CD21B87F00BA010002C2B44CCD21000A0D48656C6C6F20576F726C640D0A0A0A24
@@ -149,7 +251,7 @@ func main() {
 				instcmd.PrintDefaults()
 				os.Exit(0)
 			case "run":
-				fmt.Println("run [executable] - execute DOS executable")
+				fmt.Println("run [executable] [arguments] - execute DOS executable")
 				runcmd.PrintDefaults()
 				os.Exit(0)
 			}
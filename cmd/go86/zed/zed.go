@@ -1,6 +1,7 @@
 package zed
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
@@ -9,7 +10,7 @@ import (
 	"slices"
 	"strings"
 
-	bios "go86.org/go86/bios"
+	go86 "go86.org/go86"
 	cpu "go86.org/go86/cpu"
 	dos "go86.org/go86/dos"
 )
@@ -88,18 +89,15 @@ func zedFile(filename string, resultsFileName string) error {
 	// These are binary images not COM files, so no PSP needed nor wanted.
 	exe.Etype = dos.IMAGE
 
-	c := cpu.NewCpu(1024 * 1024)
-	bios.NewBios(c)
-	dos.NewDos(c)
-	c.Flags.ReplaceAllFlags(0x02)
-	cs := uint(0x1000)
-	copy(c.Mem.At(cs, 0), exe.Data)
-	c.Regs.SetSeg16(cpu.CS, cs)
-	c.Regs.SetSeg16(cpu.DS, 0x0000)
+	// A bare CPU, the results cover low memory.
+	m := go86.New(go86.WithDevices(false))
+	m.CPU.Flags.ReplaceAllFlags(0x02)
+	m.LoadBinary(0x1000, exe.Data)
+	m.CPU.Regs.SetSeg16(cpu.DS, 0x0000)
 
-	c.Run()
+	m.Run(context.Background())
 
-	return zedValidate(c, resultsFileName)
+	return zedValidate(m.CPU, resultsFileName)
 }
 
 func zedValidate(c *cpu.CPU, resultsFileName string) error {
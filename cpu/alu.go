@@ -125,64 +125,183 @@ func (cpu *CPU) sbb(inst *Inst, leftop, rightop Operand) error {
 	return nil
 }
 
-// SHR - Logical Shift Right
-func (cpu *CPU) shr(inst *Inst, leftop, rightop Operand) error {
+// Count used by the shift and rotate instructions.  The 80186 only uses the
+// low 5 bits of the count, the 8086 uses all of it.
+func (cpu *CPU) shiftCount(count uint) uint {
+	if cpu.MaskShiftCount {
+		return count & 0x1F
+	}
+	return count & 0xFF
+}
+
+// Reads the operands of a shift or rotate, count is 0 when there is nothing
+// to do and the flags must be left alone.
+func (cpu *CPU) shiftOperands(inst *Inst, leftop, rightop Operand) (left, count uint, err error) {
 	left, right, err := ParseTwoOperands(cpu, inst, leftop, rightop)
 	if err != nil {
+		return 0, 0, err
+	}
+	return left, cpu.shiftCount(right), nil
+}
+
+func topBit(val uint, bits int) bool {
+	return val&(1<<(bits-1)) != 0
+}
+
+// SHR - Logical Shift Right
+func (cpu *CPU) shr(inst *Inst, leftop, rightop Operand) error {
+	left, count, err := cpu.shiftOperands(inst, leftop, rightop)
+	if err != nil || count == 0 {
 		return err
 	}
+	bits := leftop.Bits()
 
-	cf := (left>>(right-1))&1 == 1
-	result := left >> right
+	cf := (left>>(count-1))&1 == 1
+	result := left >> count
 
 	leftop.SetByOperand(cpu, inst, cpu.Mem, cpu.Regs, result)
-	cpu.Flags.SetFlagsZSP(result, leftop.Bits())
+	cpu.Flags.SetFlagsZSP(result, bits)
 	cpu.Flags.SetFlagIf(CarryFlag, cf)
+	// Top bit of the value before the last shift.
+	cpu.Flags.SetFlagIf(OverflowFlag, topBit(left>>(count-1), bits))
 
 	return nil
 }
 
 // SAR - Arithmetic Shift Right
 func (cpu *CPU) sar(inst *Inst, leftop, rightop Operand) error {
-	left, right, err := ParseTwoOperands(cpu, inst, leftop, rightop)
-	if err != nil {
+	left, count, err := cpu.shiftOperands(inst, leftop, rightop)
+	if err != nil || count == 0 {
 		return err
 	}
+	bits := leftop.Bits()
 
-	cf := (left>>(right-1))&1 == 1
-	// >> preserves signs on int types in golang
-	var result uint
-	switch leftop.Bits() {
+	// Sign extend so >> fills with the sign bit.
+	var signed int
+	switch bits {
 	case 8:
-		topbit := uint(left & 0x80)
-		result = uint(int8(left)>>right) | topbit
+		signed = int(int8(left))
 	case 16:
-		topbit := uint(left & 0x8000)
-		result = uint(int16(left)>>right) | topbit
+		signed = int(int16(left))
 	default:
 		return fmt.Errorf("incorrect bits for left operand: %#v", leftop)
 	}
+	cf := (signed>>(count-1))&1 == 1
+	result := uint(signed>>count) & (1<<bits - 1)
 
 	leftop.SetByOperand(cpu, inst, cpu.Mem, cpu.Regs, result)
-	cpu.Flags.SetFlagsZSP(result, leftop.Bits())
+	cpu.Flags.SetFlagsZSP(result, bits)
 	cpu.Flags.SetFlagIf(CarryFlag, cf)
+	cpu.Flags.ClearFlag(OverflowFlag)
 
 	return nil
 }
 
 // SHL - Logical Shift Left
 func (cpu *CPU) shl(inst *Inst, leftop, rightop Operand) error {
-	left, right, err := ParseTwoOperands(cpu, inst, leftop, rightop)
-	if err != nil {
+	left, count, err := cpu.shiftOperands(inst, leftop, rightop)
+	if err != nil || count == 0 {
+		return err
+	}
+	bits := leftop.Bits()
+
+	cf := topBit(left<<(count-1), bits)
+	result := (left << count) & (1<<bits - 1)
+
+	leftop.SetByOperand(cpu, inst, cpu.Mem, cpu.Regs, result)
+	cpu.Flags.SetFlagsZSP(result, bits)
+	cpu.Flags.SetFlagIf(CarryFlag, cf)
+	cpu.Flags.SetFlagIf(OverflowFlag, topBit(result, bits) != cf)
+
+	return nil
+}
+
+// ROL - Rotate Left
+func (cpu *CPU) rol(inst *Inst, leftop, rightop Operand) error {
+	left, count, err := cpu.shiftOperands(inst, leftop, rightop)
+	if err != nil || count == 0 {
 		return err
 	}
+	bits := uint(leftop.Bits())
+
+	n := count % bits
+	result := (left<<n | left>>(bits-n)) & (1<<bits - 1)
+
+	leftop.SetByOperand(cpu, inst, cpu.Mem, cpu.Regs, result)
+	cf := result&1 == 1
+	cpu.Flags.SetFlagIf(CarryFlag, cf)
+	cpu.Flags.SetFlagIf(OverflowFlag, topBit(result, int(bits)) != cf)
+
+	return nil
+}
+
+// ROR - Rotate Right
+func (cpu *CPU) ror(inst *Inst, leftop, rightop Operand) error {
+	left, count, err := cpu.shiftOperands(inst, leftop, rightop)
+	if err != nil || count == 0 {
+		return err
+	}
+	bits := uint(leftop.Bits())
+
+	n := count % bits
+	result := (left>>n | left<<(bits-n)) & (1<<bits - 1)
+
+	leftop.SetByOperand(cpu, inst, cpu.Mem, cpu.Regs, result)
+	cpu.Flags.SetFlagIf(CarryFlag, topBit(result, int(bits)))
+	cpu.Flags.SetFlagIf(OverflowFlag, topBit(result, int(bits)) != topBit(result, int(bits)-1))
+
+	return nil
+}
+
+// RCL - Rotate through Carry Left
+func (cpu *CPU) rcl(inst *Inst, leftop, rightop Operand) error {
+	left, count, err := cpu.shiftOperands(inst, leftop, rightop)
+	if err != nil || count == 0 {
+		return err
+	}
+	bits := leftop.Bits()
+
+	// The carry flag is an extra bit, so the rotate repeats every bits+1.
+	result := left
+	cf := cpu.Flags.IsEnabled(CarryFlag)
+	for i := count % uint(bits+1); i > 0; i-- {
+		out := topBit(result, bits)
+		result = (result << 1) & (1<<bits - 1)
+		if cf {
+			result |= 1
+		}
+		cf = out
+	}
+
+	leftop.SetByOperand(cpu, inst, cpu.Mem, cpu.Regs, result)
+	cpu.Flags.SetFlagIf(CarryFlag, cf)
+	cpu.Flags.SetFlagIf(OverflowFlag, topBit(result, bits) != cf)
+
+	return nil
+}
 
-	cf := (left<<(right-1))&(1<<(leftop.Bits()-1)) != 0
-	result := left << right
+// RCR - Rotate through Carry Right
+func (cpu *CPU) rcr(inst *Inst, leftop, rightop Operand) error {
+	left, count, err := cpu.shiftOperands(inst, leftop, rightop)
+	if err != nil || count == 0 {
+		return err
+	}
+	bits := leftop.Bits()
+
+	result := left
+	cf := cpu.Flags.IsEnabled(CarryFlag)
+	for i := count % uint(bits+1); i > 0; i-- {
+		out := result&1 == 1
+		result >>= 1
+		if cf {
+			result |= 1 << (bits - 1)
+		}
+		cf = out
+	}
 
 	leftop.SetByOperand(cpu, inst, cpu.Mem, cpu.Regs, result)
-	cpu.Flags.SetFlagsZSP(result, leftop.Bits())
 	cpu.Flags.SetFlagIf(CarryFlag, cf)
+	cpu.Flags.SetFlagIf(OverflowFlag, topBit(result, bits) != topBit(result, bits-1))
 
 	return nil
 }
@@ -213,38 +332,60 @@ func (cpu *CPU) mul(inst *Inst, op Operand) error {
 		cpu.Regs.SetReg16(DX, dx)
 	}
 	// If AH or DX contain values, both the carry flag
-	// and overflow flags should be set.  ZSP are undefined.
+	// and overflow flags should be set.  ZSP are undefined, the 80186 sets
+	// them from the low half of the result and clears AF.
 	cpu.Flags.SetFlagIf(CarryFlag|OverflowFlag, cf)
+	cpu.Flags.SetFlagsZSP(result&(1<<op.Bits()-1), op.Bits())
+	cpu.Flags.ClearFlag(AdjustFlag)
 	return nil
 }
 
 // IMUL - Signed Multiply
+// always called for grp3
 func (cpu *CPU) imul(inst *Inst, op Operand) error {
-	left := cpu.Regs.GetReg16(AX)
-	if op.Bits() == 8 {
-		left &= 0x00ff
-	}
 	right, err := op.GetByOperand(cpu, inst, cpu.Mem, cpu.Regs)
 	if err != nil {
 		return err
 	}
 
-	result := int(left) * int(right)
-
-	// if bits is 16, then DX gets the top 16 bits of result.
-	// If AH or DX contain values, both the carry flag
-	// and overflow flags should be set.  ZSP are undefined.
-	cpu.Regs.SetReg16(AX, uint(result))
+	// CF and OF are set when the upper half is more than the sign extension
+	// of the lower half.  ZSP are undefined, set like MUL does.
+	var result int
 	switch op.Bits() {
 	case 8:
-		cf := (result & 0xff00) != 0
-		cpu.Flags.SetFlagIf(CarryFlag|OverflowFlag, cf)
+		result = int(int8(cpu.Regs.GetReg8(AL))) * int(int8(right))
+		cpu.Regs.SetReg16(AX, uint(result)&0xFFFF)
+		cpu.Flags.SetFlagIf(CarryFlag|OverflowFlag, result != int(int8(result)))
 	case 16:
-		cf := (result & 0xffff0000) != 0
-		cpu.Flags.SetFlagIf(CarryFlag|OverflowFlag, cf)
-		dx := uint(result&0xffff0000) >> 16
-		cpu.Regs.SetReg16(DX, dx)
+		result = int(int16(cpu.Regs.GetReg16(AX))) * int(int16(right))
+		cpu.Regs.SetReg16(AX, uint(result)&0xFFFF)
+		cpu.Regs.SetReg16(DX, uint(result>>16)&0xFFFF)
+		cpu.Flags.SetFlagIf(CarryFlag|OverflowFlag, result != int(int16(result)))
 	}
+	cpu.Flags.SetFlagsZSP(uint(result)&(1<<op.Bits()-1), op.Bits())
+	cpu.Flags.ClearFlag(AdjustFlag)
+	return nil
+}
+
+// IMUL - Signed Multiply, three operand form of the 80186.  Gv = Ev * imm
+func (cpu *CPU) imulImm(inst *Inst, immop Operand) error {
+	left := inst.ModRM.GetRm16(cpu, inst)
+	imm, err := immop.GetByOperand(cpu, inst, cpu.Mem, cpu.Regs)
+	if err != nil {
+		return err
+	}
+	var right int
+	if immop.Bits() == 8 {
+		right = int(int8(imm))
+	} else {
+		right = int(int16(imm))
+	}
+
+	result := int(int16(left)) * right
+	inst.ModRM.SetR16(cpu, uint(result)&0xFFFF)
+	cpu.Flags.SetFlagIf(CarryFlag|OverflowFlag, result != int(int16(result)))
+	cpu.Flags.SetFlagsZSP(uint(result)&0xFFFF, 16)
+	cpu.Flags.ClearFlag(AdjustFlag)
 	return nil
 }
 
@@ -304,30 +445,109 @@ func (cpu *CPU) idiv(inst *Inst, op Operand) error {
 	return nil
 }
 
+// DAA - Decimal Adjust after Addition
+func (cpu *CPU) daa() error {
+	old := cpu.Regs.GetReg8(AL)
+	cf := cpu.Flags.IsEnabled(CarryFlag)
+	al := old
+	var adjust uint
+	if al&0x0F > 9 || cpu.Flags.IsEnabled(AdjustFlag) {
+		adjust = 0x06
+	}
+	if old > 0x99 || cf {
+		adjust |= 0x60
+		cf = true
+	}
+	al = (al + adjust) & 0xFF
+	cpu.Regs.SetReg8(AL, al)
+	cpu.Flags.SetFlagsAdd8(al, adjust, old)
+	cpu.Flags.SetFlagIf(AdjustFlag, adjust&0x06 != 0)
+	cpu.Flags.SetFlagIf(CarryFlag, cf)
+	return nil
+}
+
+// DAS - Decimal Adjust after Subtraction
+func (cpu *CPU) das() error {
+	old := cpu.Regs.GetReg8(AL)
+	cf := cpu.Flags.IsEnabled(CarryFlag)
+	al := old
+	var adjust uint
+	if al&0x0F > 9 || cpu.Flags.IsEnabled(AdjustFlag) {
+		adjust = 0x06
+	}
+	if old > 0x99 || cf {
+		adjust |= 0x60
+		cf = true
+	}
+	al = (al - adjust) & 0xFF
+	cpu.Regs.SetReg8(AL, al)
+	cpu.Flags.SetFlagsZSP(al, 8)
+	// Real silicon leaves OF clear even when the subtraction overflows.
+	cpu.Flags.ClearFlag(OverflowFlag)
+	cpu.Flags.SetFlagIf(AdjustFlag, adjust&0x06 != 0)
+	cpu.Flags.SetFlagIf(CarryFlag, cf)
+	return nil
+}
+
+// AAA - ASCII Adjust after Addition
+func (cpu *CPU) aaa() error {
+	al := cpu.Regs.GetReg8(AL)
+	adjust := al&0x0F > 9 || cpu.Flags.IsEnabled(AdjustFlag)
+	if adjust {
+		// Separately, AL doesn't carry into AH.
+		cpu.Regs.SetReg8(AL, (al+6)&0xFF)
+		cpu.Regs.SetReg8(AH, (cpu.Regs.GetReg8(AH)+1)&0xFF)
+	}
+	// The undefined flags follow the masked result.
+	result := cpu.Regs.GetReg8(AL) & 0x0F
+	cpu.Regs.SetReg8(AL, result)
+	cpu.Flags.SetFlagsZSP(result, 8)
+	cpu.Flags.SetFlagIf(AdjustFlag, adjust)
+	cpu.Flags.SetFlagIf(CarryFlag, adjust)
+	return nil
+}
+
+// AAS - ASCII Adjust after Subtraction
+func (cpu *CPU) aas() error {
+	al := cpu.Regs.GetReg8(AL)
+	adjust := al&0x0F > 9 || cpu.Flags.IsEnabled(AdjustFlag)
+	if adjust {
+		// Separately, AL doesn't carry into AH.
+		cpu.Regs.SetReg8(AL, (al-6)&0xFF)
+		cpu.Regs.SetReg8(AH, (cpu.Regs.GetReg8(AH)-1)&0xFF)
+	}
+	// The undefined flags follow the masked result.
+	result := cpu.Regs.GetReg8(AL) & 0x0F
+	cpu.Regs.SetReg8(AL, result)
+	cpu.Flags.SetFlagsZSP(result, 8)
+	cpu.Flags.SetFlagIf(AdjustFlag, adjust)
+	cpu.Flags.SetFlagIf(CarryFlag, adjust)
+	return nil
+}
+
 // AAD - ASCII Adjust for Data
 func (cpu *CPU) aad(inst *Inst) error {
-	im, err := inst.Fetch8()
-	if err != nil {
-		return err
-	}
+	im := uint8(inst.Imm)
 	al := cpu.Regs.GetReg8(AL)
 	ah := cpu.Regs.GetReg8(AH)
 	// AL := (tempAL + (tempAH ∗ imm8)) AND FFH;
 	// AH := 0;
 	al = (al + ah*uint(im)) & 0xff
 	cpu.Regs.SetReg16(AX, al)
+	cpu.Flags.SetFlagsZSP(al, 8)
+	// Undefined, the 80186 clears them.
+	cpu.Flags.ClearFlag(OverflowFlag | AdjustFlag | CarryFlag)
 	return nil
 }
 
 // AAM - Adjust for Multiplication
 func (cpu *CPU) aam(inst *Inst) error {
-	im, err := inst.Fetch8()
-	if err != nil {
-		return err
-	}
+	im := uint8(inst.Imm)
 	al := cpu.Regs.GetReg8(AL)
 	ah := al / uint(im)
 	al = al % uint(im)
 	cpu.Regs.SetReg16(AX, (ah&0xff)<<8|(al&0xff))
+	cpu.Flags.SetFlagsZSP(al, 8)
+	cpu.Flags.ClearFlag(OverflowFlag | AdjustFlag | CarryFlag)
 	return nil
 }
@@ -0,0 +1,242 @@
+package go86
+
+// Translated code.  Runs of instructions up to a transfer of control are
+// decoded once into a block, along with the handler each one runs, and kept
+// by linear address.  RunOnce then takes instructions from the block rather
+// than decoding them again and going through the big switch in execute.
+//
+// Writes to a page holding translated code throw away the blocks in it.
+// While instructions come from blocks the prefetch queue is left empty, as
+// it would only hold a copy of memory.  If code writes to the bytes the
+// queue would have held, the queue is filled from memory before the write
+// so the CPU carries on with the old bytes like the real one does.
+
+const (
+	// Translated code is tracked in pages this big.
+	codePageShift = 8
+	// Most instructions in a block.
+	maxBlockInsts = 64
+	// Bytes past the end of a block the prefetch queue can read.
+	maxPrefetch = 6
+)
+
+type cachedInst struct {
+	inst *Inst
+	// Linear address of the first byte.
+	addr uint
+	run  func(cpu *CPU) error
+}
+
+type block struct {
+	insts []cachedInst
+	// Set once a write hits the block.
+	invalid bool
+}
+
+type blockCache struct {
+	blocks map[uint]*block
+	// Blocks with code, or bytes the queue reads, in each page.
+	pages map[uint][]*block
+}
+
+func newBlockCache() *blockCache {
+	return &blockCache{blocks: map[uint]*block{}, pages: map[uint][]*block{}}
+}
+
+// WithBlockCache turns the translated code cache on or off, it is on by
+// default.
+func WithBlockCache(on bool) Option {
+	return func(cpu *CPU) {
+		cpu.SetBlockCache(on)
+	}
+}
+
+// SetBlockCache turns the translated code cache on or off.
+func (cpu *CPU) SetBlockCache(on bool) {
+	cpu.clearBlocks()
+	if !on {
+		cpu.blocks = nil
+		cpu.Mem.codePages = nil
+		cpu.Mem.codeWritten = nil
+		return
+	}
+	cpu.blocks = newBlockCache()
+	cpu.Mem.codePages = make([]bool, (len(cpu.Mem.mem)>>codePageShift)+1)
+	cpu.Mem.codeWritten = cpu.codeWritten
+}
+
+// Throws away all the translated code, for when the model changes.
+func (cpu *CPU) clearBlocks() {
+	cpu.block = nil
+	if cpu.blocks == nil {
+		return
+	}
+	for _, b := range cpu.blocks.blocks {
+		b.invalid = true
+	}
+	cpu.blocks = newBlockCache()
+	clear(cpu.Mem.codePages)
+}
+
+// The next instruction from translated code, nil if it has to be decoded
+// from the prefetch queue.
+func (cpu *CPU) nextCached() *cachedInst {
+	if cpu.blocks == nil || len(cpu.queue) != 0 {
+		return nil
+	}
+	addr := cpu.linearIp()
+	b := cpu.block
+	if b == nil || b.invalid || cpu.blockPos >= len(b.insts) || b.insts[cpu.blockPos].addr != addr {
+		if b = cpu.blocks.blocks[addr]; b == nil {
+			if b = cpu.translate(addr); b == nil {
+				cpu.block = nil
+				return nil
+			}
+		}
+		cpu.block, cpu.blockPos = b, 0
+	}
+	ci := &b.insts[cpu.blockPos]
+	if uint(cpu.Ip)+uint(ci.inst.Len) > 0x10000 {
+		// Reached through a segment where it wraps around
+		cpu.block = nil
+		return nil
+	}
+	cpu.blockPos++
+	return ci
+}
+
+// Decodes the block starting at CS:IP, which is at addr.  Returns nil if
+// the first instruction can't be decoded from memory.
+func (cpu *CPU) translate(addr uint) *block {
+	b := &block{}
+	ip := uint(cpu.Ip)
+	end := addr
+	for len(b.insts) < maxBlockInsts {
+		inst, err := cpu.Model.Decode(cpu.Mem.AtAbs(int(end)))
+		if err != nil || ip+uint(inst.Len) > 0x10000 {
+			// Off the end of memory or the segment
+			break
+		}
+		b.insts = append(b.insts, cachedInst{inst, end, handlerFor(inst)})
+		ip += uint(inst.Len)
+		end += uint(inst.Len)
+		if endsBlock(inst) {
+			break
+		}
+	}
+	if len(b.insts) == 0 {
+		return nil
+	}
+
+	c := cpu.blocks
+	c.blocks[addr] = b
+	for page := addr >> codePageShift; page <= (end+maxPrefetch-1)>>codePageShift && page < uint(len(cpu.Mem.codePages)); page++ {
+		c.pages[page] = append(c.pages[page], b)
+		cpu.Mem.codePages[page] = true
+	}
+	return b
+}
+
+// Instructions after which execution doesn't carry straight on.
+func endsBlock(inst *Inst) bool {
+	switch op := inst.OpCode; {
+	case flushesQueue(inst):
+		return true
+	case op >= 0x70 && op <= 0x7F, op >= 0xE0 && op <= 0xE3:
+		// Jcc, LOOP and JCXZ
+		return true
+	case op == 0xF4, op == 0x0F, inst.Name == "--":
+		// HLT, POP CS and invalid opcodes
+		return true
+	}
+	return false
+}
+
+// Called by Memory before a write from start up to end hits a page with
+// translated code in it.
+func (cpu *CPU) codeWritten(start, end uint) {
+	if cpu.queueInMem && len(cpu.queue) == 0 && cap(cpu.queue) > 0 {
+		// Would the queue have had these bytes in it?
+		next := cpu.linearIp()
+		if start < next+uint(cap(cpu.queue)) && end > next {
+			cpu.fillQueue()
+			cpu.queueInMem = false
+		}
+	}
+
+	page := start >> codePageShift
+	c := cpu.blocks
+	for _, b := range c.pages[page] {
+		b.invalid = true
+		if c.blocks[b.insts[0].addr] == b {
+			delete(c.blocks, b.insts[0].addr)
+		}
+	}
+	delete(c.pages, page)
+	cpu.Mem.codePages[page] = false
+}
+
+// Once the queue only holds what is in memory anyway it can go, so the next
+// instruction comes from translated code again.
+func (cpu *CPU) dropQueue() {
+	if cpu.blocks == nil || len(cpu.queue) == 0 || cpu.queueAddr != cpu.linearIp() {
+		return
+	}
+	for i, b := range cpu.queue {
+		if cpu.Mem.AbsMem8(int((cpu.queueAddr+uint(i))&cpu.Mem.addrMask)) != b {
+			return
+		}
+	}
+	cpu.flushQueue()
+	cpu.queueInMem = true
+}
+
+// ALU instructions in opcode order, 00-3F with the register and
+// accumulator forms.
+var aluOps = [8]func(cpu *CPU, inst *Inst, leftop, rightop Operand) error{
+	(*CPU).add, (*CPU).or, (*CPU).adc, (*CPU).sbb,
+	(*CPU).and, (*CPU).sub, (*CPU).xor, (*CPU).cmp,
+}
+
+var jumps8 = [16]func(cpu *CPU, inst *Inst) error{
+	(*CPU).jo8, (*CPU).jno8, (*CPU).jb8, (*CPU).jnb8,
+	(*CPU).jz8, (*CPU).jnz8, (*CPU).jbe8, (*CPU).ja8,
+	(*CPU).js8, (*CPU).jns8, (*CPU).jpe8, (*CPU).jpo8,
+	(*CPU).jl8, (*CPU).jge8, (*CPU).jle8, (*CPU).jg8,
+}
+
+// Picks the handler for a decoded instruction, with the operands worked out
+// for the common ones.  The rest go through execute.
+func handlerFor(inst *Inst) func(cpu *CPU) error {
+	op := inst.OpCode
+	switch {
+	case op < 0x40 && op&7 < 6:
+		alu, ops := aluOps[op>>3], StandardOperands[op&7]
+		return func(cpu *CPU) error { return alu(cpu, inst, ops.Left, ops.Right) }
+	case op >= 0x40 && op <= 0x47:
+		reg := Reg(op - 0x40)
+		return func(cpu *CPU) error { cpu.Regs.Inc16(reg, 1); return nil }
+	case op >= 0x48 && op <= 0x4F:
+		reg := Reg(op - 0x48)
+		return func(cpu *CPU) error { cpu.Regs.Dec16(reg, 1); return nil }
+	case op >= 0x50 && op <= 0x57 && op != 0x54:
+		reg := Reg(op - 0x50)
+		return func(cpu *CPU) error { cpu.Regs.PushReg16(reg, cpu.Mem); return nil }
+	case op >= 0x58 && op <= 0x5F:
+		reg := Reg(op - 0x58)
+		return func(cpu *CPU) error { cpu.Regs.PopReg16(reg, cpu.Mem); return nil }
+	case op >= 0x70 && op <= 0x7F:
+		jcc := jumps8[op-0x70]
+		return func(cpu *CPU) error { return jcc(cpu, inst) }
+	case op >= 0x88 && op <= 0x8B:
+		ops := StandardOperands[op-0x88]
+		return func(cpu *CPU) error { return cpu.mov(inst, ops.Left, ops.Right) }
+	case op >= 0xB0 && op <= 0xB7:
+		reg := Reg8(op - 0xB0)
+		return func(cpu *CPU) error { return cpu.movRegIb(inst, reg) }
+	case op >= 0xB8 && op <= 0xBF:
+		reg := Reg(op - 0xB8)
+		return func(cpu *CPU) error { return cpu.movRegIv(inst, reg) }
+	}
+	return (*CPU).execute
+}
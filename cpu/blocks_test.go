@@ -0,0 +1,112 @@
+package go86
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestBlockCacheReuse(t *testing.T) {
+	// MOV CX,100; L: INC AX; LOOP L
+	cpu := SetupCPU(t, "B964004090E2FC")
+	for i := 0; i < 1+3*100; i++ {
+		assert.NilError(t, cpu.RunOnce())
+	}
+	assert.Equal(t, cpu.Regs.AX(), uint(100))
+	assert.Equal(t, cpu.Ip, uint16(7))
+	// The block at the start and the loop
+	assert.Equal(t, len(cpu.blocks.blocks), 2)
+}
+
+func TestBlockCacheSelfModifying(t *testing.T) {
+	// L: INC AX; MOV BYTE [0000],48; JMP L rewrites the INC AX to DEC AX,
+	// too far back for the queue to hide it.
+	for _, on := range []bool{true, false} {
+		cpu := SetupCPU(t, "40C606000048EBF8")
+		cpu.SetBlockCache(on)
+		cpu.Regs.SetSeg16(DS, DEFAULT_CS)
+		for i := 0; i < 3*3; i++ {
+			assert.NilError(t, cpu.RunOnce())
+		}
+		// +1 -1 -1
+		assert.Equal(t, cpu.Regs.AX(), uint(0xFFFF), "cache %v", on)
+	}
+}
+
+func TestBlockCacheCopy(t *testing.T) {
+	// INC AX; JMP $-3
+	cpu := SetupCPU(t, "40EBFD")
+	for i := 0; i < 4; i++ {
+		assert.NilError(t, cpu.RunOnce())
+	}
+	// Loading a program over the code throws it away, DEC AX
+	cpu.Mem.Copy(DEFAULT_CS, 0, []byte{0x48})
+	for i := 0; i < 4; i++ {
+		assert.NilError(t, cpu.RunOnce())
+	}
+	assert.Equal(t, cpu.Regs.AX(), uint(0))
+}
+
+func TestBlockCacheModel(t *testing.T) {
+	// PUSHA on the 80186 is JO on the 8086
+	cpu := SetupCPU(t, "6002")
+	assert.NilError(t, cpu.RunOnce())
+	assert.Equal(t, cpu.Ip, uint16(1))
+
+	cpu.Ip = 0
+	cpu.SetModel(Model8086)
+	assert.NilError(t, cpu.RunOnce())
+	assert.Equal(t, cpu.Ip, uint16(2))
+}
+
+// Runs a COM file from testdata/dos over and over, with just enough of DOS
+// and the BIOS for it to print and exit.
+func benchmarkCOM(b *testing.B, name string, cache bool) {
+	image, err := os.ReadFile("../testdata/dos/" + name)
+	assert.NilError(b, err)
+
+	cpu := NewCpu(1024*1024, WithBlockCache(cache))
+	const psp = 0x1000
+	cpu.Mem.Copy(psp, 0x100, image)
+	// INT 20h at the start of the PSP for a RET to land on
+	cpu.Mem.Copy(psp, 0, []byte{0xCD, 0x20})
+	start := func() {
+		for _, seg := range []SReg{CS, DS, ES, SS} {
+			cpu.Regs.SetSeg16(seg, psp)
+		}
+		cpu.Regs.SetReg16(SP, 0xFFFE)
+		cpu.Mem.SetMem16(psp, 0xFFFE, 0)
+		cpu.Ip = 0x100
+		cpu.Running = true
+	}
+	exit := func(cpu *CPU, _ int) { cpu.Running = false }
+	cpu.Intrs[0x10] = func(*CPU, int) {}
+	cpu.Intrs[0x20] = exit
+	cpu.Intrs[0x21] = func(cpu *CPU, n int) {
+		if cpu.Regs.GetReg8(AH) == 0x4C {
+			exit(cpu, n)
+		}
+	}
+
+	start()
+	b.ResetTimer()
+	began := time.Now()
+	for i := 0; i < b.N; i++ {
+		if err := cpu.RunOnce(); err != nil {
+			b.Fatal(err)
+		}
+		if !cpu.Running {
+			start()
+		}
+	}
+	b.ReportMetric(float64(b.N)/time.Since(began).Seconds(), "inst/s")
+}
+
+func BenchmarkBlockCache(b *testing.B) {
+	for _, name := range []string{"hello.com", "jmps.com", "addof.com"} {
+		b.Run(name+"/uncached", func(b *testing.B) { benchmarkCOM(b, name, false) })
+		b.Run(name+"/cached", func(b *testing.B) { benchmarkCOM(b, name, true) })
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"strings"
 
 	log "github.com/golang/glog"
-	"golang.org/x/arch/x86/x86asm"
 )
 
 // Debugger is an interface for debugging the CPU.
@@ -15,8 +14,16 @@ type Debugger interface {
 	Intr() bool
 }
 
+// Device is emulated hardware which runs alongside the CPU.
+type Device interface {
+	// Tick is called after every instruction the CPU executes.
+	Tick()
+}
+
 // Represents the state of an 8086 CPU.
 type CPU struct {
+	// Which CPU is emulated, use SetModel to change it.
+	Model Model
 	// Pointer to the system
 	Mem *Memory
 	// CPU Flags (overflow, zero, etc)
@@ -31,16 +38,78 @@ type CPU struct {
 	Running bool
 	// Interrupt map for interrupts which do not exist as 8086 code contained
 	// within the CPU's memory.
-	Intrs    map[int]func(*CPU, int)
+	Intrs map[int]func(*CPU, int)
+	// I/O bus used by IN/OUT and INS/OUTS.
+	Ports *Ports
+	// Source of hardware interrupts, nil if there is none.
+	PIC InterruptController
+	// 8087 coprocessor, nil if the socket is empty.
+	FPU *FPU
+	// Devices which are ticked after every instruction.
+	Devices  []Device
 	Debugger Debugger
+	// Writes out instructions for the trace log, the disasm package has one.
+	// Without it only the mnemonic is logged.
+	Disasm func(inst *Inst, ip uint16) string
+
+	// Number of instructions executed.
+	Instructions uint64
+	// Number of clock cycles the executed instructions would have taken.
+	Cycles uint64
+	// Clock rate to pace the emulation at in Hz, i.e. 4770000 for an IBM PC.
+	// Zero runs as fast as possible.
+	ClockHz uint64
+	// Mask shift and rotate counts to 5 bits like the 80186 does.
+	MaskShiftCount bool
+	// Set for the 8088's 8-bit data bus where every word transfer takes
+	// an extra bus cycle.
+	Bus8 bool
+
+	// Set by instructions which inhibit interrupts until after the next
+	// instruction has executed.
+	intShadow bool
+	// Set by NMI until the interrupt is taken.
+	nmiPending bool
+	// Iterations of the last REP prefixed string instruction.
+	repCount uint64
+	// IP of the first byte, including prefixes, of the current instruction.
+	instIp uint16
+	// Where the entry points for the handlers in Intrs are, once
+	// InstallIntrs has put them in memory.
+	intrSeg, intrBase uint
+	intrsInstalled    bool
+	// Prefetched instruction bytes starting at the linear address queueAddr,
+	// the capacity is the size of the queue.
+	queue     []byte
+	queueAddr uint
+	// The queue would hold the bytes in memory at CS:IP, but it is left
+	// empty as the instructions come from translated code.
+	queueInMem bool
+
+	// Translated code, nil when it is turned off.
+	blocks *blockCache
+	// Block the last instruction came from and where the next one is.
+	block    *block
+	blockPos int
+	peekBuf  [32]byte
 }
 
-func NewCpu(size int) *CPU {
+// NewCpu creates an 80186 and 8087 with size bytes of memory, opts may pick
+// another model or leave out the FPU.
+func NewCpu(size int, opts ...Option) *CPU {
 	m := NewMemory(size)
 	log.Infof("NewCPU Memory Size : %d\n", size)
-	return &CPU{Mem: m, Intrs: make(map[int]func(*CPU, int)),
+	cpu := &CPU{Mem: m, Intrs: make(map[int]func(*CPU, int)),
+		Ports:   NewPorts(),
 		Regs:    &Registers{},
+		FPU:     NewFPU(),
 		Running: true}
+	cpu.SetModel(Model80186)
+	cpu.SetBlockCache(true)
+	for _, opt := range opts {
+		opt(cpu)
+	}
+	return cpu
 }
 
 func CpuString(c *CPU) string {
@@ -56,29 +125,34 @@ func CpuString(c *CPU) string {
 	return fmt.Sprintf("%s\n%s", l1, l2)
 }
 
-func (cpu *CPU) verboseLogState(origIp uint) error {
-	opcodes := cpu.Mem.At(cpu.Regs.CS(), origIp)[:cpu.Inst.Len]
+func (cpu *CPU) verboseLogState() {
+	if cpu.Inst == nil {
+		return
+	}
+	opcodes := cpu.Mem.At(cpu.Regs.CS(), uint(cpu.instIp))[:cpu.Inst.Len]
 
-	inst, err := x86asm.Decode(opcodes, 16)
-	if err != nil {
-		log.V(4).Infof("Error decoding at offset %v\n", err)
-		return err
+	disasm := cpu.Inst.Name
+	if cpu.Disasm != nil {
+		disasm = cpu.Disasm(cpu.Inst, cpu.instIp)
 	}
-	disasm := inst.String()
 
 	log.V(4).Infof("[%04X:%04X]: [%-8s] %-20s\n%s\n",
 		cpu.Regs.CS(),
-		origIp,
+		cpu.instIp,
 		strings.ToUpper(hex.EncodeToString(opcodes)),
 		disasm,
 		CpuString(cpu))
-	return nil
 }
 
 func (cpu *CPU) Run() {
-	for cpu.Running {
-		origIp := uint(cpu.Ip)
+	cpu.RunUntil(nil)
+}
 
+// RunUntil runs until the CPU halts or stop, which is asked before every
+// instruction, returns true.  A nil stop runs until the CPU halts.
+func (cpu *CPU) RunUntil(stop func() bool) {
+	pace := newPacer(cpu)
+	for cpu.Running && (stop == nil || !stop()) {
 		err := cpu.RunOnce()
 		if err != nil {
 			log.Warningf("Error running CPU: %v\n", err)
@@ -87,8 +161,9 @@ func (cpu *CPU) Run() {
 		}
 
 		if log.V(4) {
-			cpu.verboseLogState(origIp)
+			cpu.verboseLogState()
 		}
+		pace.wait()
 	}
 	log.Info("CPU stopped")
 }
@@ -99,9 +174,6 @@ func (cpu *CPU) Halt() {
 }
 
 func (cpu *CPU) HandleGrpOne(inst *Inst, left, right Operand) error {
-	if err := inst.FetchModRM(); err != nil {
-		return err
-	}
 	// modrm.Reg is an opcode extension
 	switch inst.ModRM.Reg {
 	case 0:
@@ -127,9 +199,6 @@ func (cpu *CPU) HandleGrpOne(inst *Inst, left, right Operand) error {
 }
 
 func (cpu *CPU) HandleGrpOneSignExtended(inst *Inst, left, right Operand) error {
-	if err := inst.FetchModRM(); err != nil {
-		return err
-	}
 	// modrm.Reg is an opcode extension
 	switch inst.ModRM.Reg {
 	case 0:
@@ -154,21 +223,16 @@ func (cpu *CPU) HandleGrpOneSignExtended(inst *Inst, left, right Operand) error
 }
 
 func (cpu *CPU) HandleGrpTwo(inst *Inst, left, right Operand) error {
-	if err := inst.FetchModRM(); err != nil {
-		return err
-	}
 	// modrm.Reg is an opcode extension
 	switch inst.ModRM.Reg {
-	/*
-		case 0:
-			return cpu.rol(left, right)
-		case 1:
-			return cpu.ror(left, right)
-		case 2:
-			return cpu.rcl(left, right)
-		case 3:
-			return cpu.rcr(left, right)
-	*/
+	case 0:
+		return cpu.rol(inst, left, right)
+	case 1:
+		return cpu.ror(inst, left, right)
+	case 2:
+		return cpu.rcl(inst, left, right)
+	case 3:
+		return cpu.rcr(inst, left, right)
 	case 4:
 		return cpu.shl(inst, left, right)
 	case 5:
@@ -181,9 +245,6 @@ func (cpu *CPU) HandleGrpTwo(inst *Inst, left, right Operand) error {
 }
 
 func (cpu *CPU) HandleGrpThree(inst *Inst, left, right Operand) error {
-	if err := inst.FetchModRM(); err != nil {
-		return err
-	}
 	// modrm.Reg is an opcode extension
 	switch inst.ModRM.Reg {
 	case 0:
@@ -207,9 +268,6 @@ func (cpu *CPU) HandleGrpThree(inst *Inst, left, right Operand) error {
 
 // FE only has 0 and 1 and is 8 bit
 func (cpu *CPU) HandleFE(inst *Inst) error {
-	if err := inst.FetchModRM(); err != nil {
-		return err
-	}
 	// modrm.Reg is an opcode extension
 	switch inst.ModRM.Reg {
 	case 0:
@@ -227,9 +285,6 @@ func (cpu *CPU) HandleFE(inst *Inst) error {
 
 // Ev is the only operand here
 func (cpu *CPU) HandleFF(inst *Inst) error {
-	if err := inst.FetchModRM(); err != nil {
-		return err
-	}
 	// modrm.Reg is an opcode extension
 	switch inst.ModRM.Reg {
 	case 0:
@@ -262,20 +317,58 @@ func (cpu *CPU) RunOnce() error {
 	// Clean the previous instruction (and modrm byte) if it was set on the last iteration
 	cpu.Inst = nil
 
+	cpu.checkInterrupts()
+
 	cs := cpu.Regs.CS()
 	ip := uint(cpu.Ip)
+	cpu.instIp = cpu.Ip
 
 	var err error
-	if cpu.Inst, err = Decode(cpu.Mem.At(cs, ip), cpu); err != nil {
+	run := (*CPU).execute
+	ci := cpu.nextCached()
+	if ci != nil {
+		cpu.Inst, run = ci.inst, ci.run
+	} else if cpu.Inst, err = cpu.Model.Decode(cpu.peekQueued()); err != nil {
 		return fmt.Errorf("failed to decode instruction at CS:IP %04x:%04x: %v", cs, ip, err)
 	}
 
+	if cpu.Mem.hookPages != nil {
+		cpu.Mem.fetched(cs, ip, cpu.Inst.Len)
+	}
 	if cpu.Debugger != nil {
 		cpu.Debugger.Step()
 	}
 	// Increment IP *after* the debugger
-	cpu.Ip += uint16(cpu.Inst.Len)
+	if ci != nil {
+		cpu.Ip += uint16(cpu.Inst.Len)
+		cpu.queueInMem = true
+	} else {
+		for i := 0; i < cpu.Inst.Len; i++ {
+			cpu.fetchQueued()
+		}
+	}
 
+	var shiftCount uint
+	if op := cpu.Inst.OpCode; op == 0xD2 || op == 0xD3 {
+		shiftCount = cpu.Regs.GetReg8(CL)
+	}
+	cpu.repCount = 0
+	err = run(cpu)
+	cpu.Instructions++
+	next := uint16(ip) + uint16(cpu.Inst.Len)
+	if cpu.Ip != next || flushesQueue(cpu.Inst) {
+		cpu.flushQueue()
+	}
+	cpu.dropQueue()
+	cpu.Cycles += cpu.instCycles(cpu.Inst, shiftCount, next)
+	for _, d := range cpu.Devices {
+		d.Tick()
+	}
+	return err
+}
+
+// execute runs the current instruction, IP has already been moved past it.
+func (cpu *CPU) execute() error {
 	switch cpu.Inst.OpCode {
 
 	// ADD - Add
@@ -297,12 +390,24 @@ func (cpu *CPU) RunOnce() error {
 
 	case 0x0E:
 		cpu.Regs.Push16(cpu.Mem, uint16(cpu.Regs.CS()))
+	case 0x0F:
+		switch {
+		case cpu.Model.Has186() && !cpu.Model.IsNEC():
+			return cpu.invalidOpcode()
+		case cpu.Model.IsNEC():
+			return fmt.Errorf("unhandled NEC extended opcode: 0f")
+		}
+		// POP CS on the 8086 and 8088
+		val := cpu.Regs.Pop16(cpu.Mem)
+		cpu.Regs.SetSeg16(CS, uint(val))
+		cpu.flushQueue()
 
 	case 0x16:
 		cpu.Regs.Push16(cpu.Mem, uint16(cpu.Regs.SS()))
 	case 0x17:
 		val := cpu.Regs.Pop16(cpu.Mem)
 		cpu.Regs.SetSeg16(SS, uint(val))
+		cpu.intShadow = true
 
 	// ADC
 	case 0x10, 0x11, 0x12, 0x13, 0x14, 0x15:
@@ -324,21 +429,29 @@ func (cpu *CPU) RunOnce() error {
 	case 0x20, 0x21, 0x22, 0x23, 0x24, 0x25:
 		op := StandardOperands[cpu.Inst.OpCode-0x20]
 		return cpu.and(cpu.Inst, op.Left, op.Right)
+	case 0x27: // DAA
+		return cpu.daa()
 
 	// SUB - Subtract
 	case 0x28, 0x29, 0x2A, 0x2B, 0x2C, 0x2D:
 		op := StandardOperands[cpu.Inst.OpCode-0x28]
 		return cpu.sub(cpu.Inst, op.Left, op.Right)
+	case 0x2F: // DAS
+		return cpu.das()
 
 	// XOR - Logical Exclusive OR
 	case 0x30, 0x31, 0x32, 0x33, 0x34, 0x35:
 		op := StandardOperands[cpu.Inst.OpCode-0x30]
 		return cpu.xor(cpu.Inst, op.Left, op.Right)
+	case 0x37: // AAA
+		return cpu.aaa()
 
 	// CMP - Compare
 	case 0x38, 0x39, 0x3A, 0x3B, 0x3C, 0x3D:
 		op := StandardOperands[cpu.Inst.OpCode-0x38]
 		return cpu.cmp(cpu.Inst, op.Left, op.Right)
+	case 0x3F: // AAS
+		return cpu.aas()
 
 	// Increment/Decrement registers
 	case 0x40, 0x41, 0x42, 0x43, 0x44, 0x45, 0x46, 0x47:
@@ -347,25 +460,53 @@ func (cpu *CPU) RunOnce() error {
 		cpu.Regs.Dec16(Reg(cpu.Inst.OpCode-0x48), 1)
 
 	// Push and pop registers
-	case 0x50, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57:
+	case 0x54:
+		// Before the 80286 PUSH SP pushes the decremented value.
+		cpu.Regs.Push16(cpu.Mem, uint16(cpu.Regs.GetReg16(SP)-2))
+	case 0x50, 0x51, 0x52, 0x53, 0x55, 0x56, 0x57:
 		cpu.Regs.PushReg16(Reg(cpu.Inst.OpCode-0x50), cpu.Mem)
 	case 0x58, 0x59, 0x5A, 0x5B, 0x5C, 0x5D, 0x5E, 0x5F:
 		cpu.Regs.PopReg16(Reg(cpu.Inst.OpCode-0x58), cpu.Mem)
 
-	case 0x68:
-		imm16, err := cpu.Inst.Fetch16()
-		if err != nil {
-			return err
+	// 80186 PUSHA/POPA/BOUND
+	case 0x60:
+		cpu.pusha()
+	case 0x61:
+		cpu.popa()
+	case 0x62:
+		return cpu.bound(cpu.Inst)
+	case 0x63, 0x64, 0x65, 0x66, 0x67:
+		if cpu.Model.IsNEC() {
+			return fmt.Errorf("unhandled NEC OpCode: %x", cpu.Inst.OpCode)
 		}
+		return cpu.invalidOpcode()
+
+	case 0x68:
+		imm16 := uint16(cpu.Inst.Imm)
 		cpu.Regs.Push16(cpu.Mem, imm16)
 		return nil
 	case 0x6A:
-		imm8, err := cpu.Inst.Fetch8()
-		if err != nil {
-			return err
-		}
-		cpu.Regs.Push16(cpu.Mem, uint16(imm8))
+		imm8 := uint8(cpu.Inst.Imm)
+		// Sign extended to a word.
+		cpu.Regs.Push16(cpu.Mem, uint16(int8(imm8)))
 		return nil
+
+	// IMUL Gv Ev imm
+	case 0x69:
+		return cpu.imulImm(cpu.Inst, Iv)
+	case 0x6B:
+		return cpu.imulImm(cpu.Inst, Ib)
+
+	// INS/OUTS - String I/O
+	case 0x6C:
+		return cpu.ins(cpu.Inst, 8)
+	case 0x6D:
+		return cpu.ins(cpu.Inst, 16)
+	case 0x6E:
+		return cpu.outs(cpu.Inst, 8)
+	case 0x6F:
+		return cpu.outs(cpu.Inst, 16)
+
 	// Jumps
 	case 0x70:
 		return cpu.jo8(cpu.Inst)
@@ -435,7 +576,11 @@ func (cpu *CPU) RunOnce() error {
 	case 0x8D:
 		return cpu.leaGvM(cpu.Inst)
 	case 0x8E:
-		return cpu.mov(cpu.Inst, Sw, Ew)
+		err := cpu.mov(cpu.Inst, Sw, Ew)
+		if SReg(cpu.Inst.ModRM.Reg) == SS {
+			cpu.intShadow = true
+		}
+		return err
 	case 0x8F:
 		return cpu.popEv(cpu.Inst)
 
@@ -465,8 +610,9 @@ func (cpu *CPU) RunOnce() error {
 		cpu.Regs.SetReg16(DX, value>>16)
 	case 0x9A:
 		return cpu.callFar(cpu.Inst)
-	case 0x9B:
-		return fmt.Errorf("WAIT [0x98] not handled")
+	case 0x9B: // WAIT
+		// FPU instructions finish before the next one starts, so there is
+		// never anything to wait for.
 	case 0x9C: // PUSHF
 		cpu.Regs.Push16(cpu.Mem, uint16(cpu.Flags.Value()))
 	case 0x9D: // POPF
@@ -488,10 +634,15 @@ func (cpu *CPU) RunOnce() error {
 	case 0xA3:
 		return cpu.mov(cpu.Inst, Ov, RegAX)
 
+	// String operations
+	case 0xA4:
+		return cpu.movs(cpu.Inst, 8)
+	case 0xA5:
+		return cpu.movs(cpu.Inst, 16)
 	case 0xA6:
-		return cpu.cmps(8)
+		return cpu.cmps(cpu.Inst, 8)
 	case 0xA7:
-		return cpu.cmps(16)
+		return cpu.cmps(cpu.Inst, 16)
 
 	case 0xA8:
 		return cpu.test(cpu.Inst, RegAL, Ib)
@@ -523,10 +674,7 @@ func (cpu *CPU) RunOnce() error {
 	case 0xC1: // GRP2
 		return cpu.HandleGrpTwo(cpu.Inst, Ev, Ib)
 	case 0xC2:
-		imm16, err := cpu.Inst.Fetch16()
-		if err != nil {
-			return err
-		}
+		imm16 := uint16(cpu.Inst.Imm)
 		return cpu.retNear(uint(imm16))
 	case 0xC3:
 		return cpu.retNear(0)
@@ -537,26 +685,21 @@ func (cpu *CPU) RunOnce() error {
 		return cpu.lesLds(cpu.Inst, DS)
 
 	case 0xC6:
-		if err := cpu.Inst.FetchModRM(); err != nil {
-			return err
-		}
 		if cpu.Inst.ModRM.Reg != 0 {
 			return fmt.Errorf("unexpected reg value for opcode 0xC6: '%x'", cpu.Inst.ModRM.Reg)
 		}
 		return cpu.mov(cpu.Inst, Eb, Ib)
 	case 0xC7:
-		if err := cpu.Inst.FetchModRM(); err != nil {
-			return err
-		}
 		if cpu.Inst.ModRM.Reg != 0 {
 			return fmt.Errorf("unexpected reg value for opcode 0xC6: '%x'", cpu.Inst.ModRM.Reg)
 		}
 		return cpu.mov(cpu.Inst, Ev, Iv)
+	case 0xC8:
+		return cpu.enter(cpu.Inst)
+	case 0xC9:
+		cpu.leave()
 	case 0xCA:
-		imm16, err := cpu.Inst.Fetch16()
-		if err != nil {
-			return err
-		}
+		imm16 := uint16(cpu.Inst.Imm)
 		return cpu.retFar(uint(imm16))
 	case 0xCB:
 		return cpu.retFar(0)
@@ -565,10 +708,7 @@ func (cpu *CPU) RunOnce() error {
 		return cpu.int(0x03)
 
 	case 0xCD:
-		imm8, err := cpu.Inst.Fetch8()
-		if err != nil {
-			return err
-		}
+		imm8 := uint8(cpu.Inst.Imm)
 		return cpu.int(int(imm8))
 
 	case 0xCE: // INTO
@@ -594,6 +734,8 @@ func (cpu *CPU) RunOnce() error {
 		return cpu.aam(cpu.Inst)
 	case 0xD5: // AAD
 		return cpu.aad(cpu.Inst)
+	case 0xD8, 0xD9, 0xDA, 0xDB, 0xDC, 0xDD, 0xDE, 0xDF: // ESC
+		return cpu.esc(cpu.Inst)
 
 		// LOOP
 	case 0xE0:
@@ -603,6 +745,16 @@ func (cpu *CPU) RunOnce() error {
 	case 0xE2:
 		return cpu.loop(cpu.Inst)
 
+	// IN/OUT - Port I/O
+	case 0xE4:
+		return cpu.inIb(cpu.Inst, 8)
+	case 0xE5:
+		return cpu.inIb(cpu.Inst, 16)
+	case 0xE6:
+		return cpu.outIb(cpu.Inst, 8)
+	case 0xE7:
+		return cpu.outIb(cpu.Inst, 16)
+
 	case 0xE8:
 		return cpu.callNear(cpu.Inst)
 	// JMP
@@ -615,6 +767,15 @@ func (cpu *CPU) RunOnce() error {
 	case 0xEB:
 		return cpu.jmprel8(cpu.Inst)
 
+	case 0xEC:
+		return cpu.in(uint16(cpu.Regs.GetReg16(DX)), 8)
+	case 0xED:
+		return cpu.in(uint16(cpu.Regs.GetReg16(DX)), 16)
+	case 0xEE:
+		return cpu.out(uint16(cpu.Regs.GetReg16(DX)), 8)
+	case 0xEF:
+		return cpu.out(uint16(cpu.Regs.GetReg16(DX)), 16)
+
 	case 0xF4: // HLT
 		cpu.Running = false
 		return nil
@@ -638,9 +799,10 @@ func (cpu *CPU) RunOnce() error {
 		cpu.Flags.ClearFlag(IF)
 		return nil
 
-	// STI - Set Interrupt Flag
+	// STI - Set Interrupt Flag, takes effect after the next instruction
 	case 0xFB:
 		cpu.Flags.SetFlags(IF)
+		cpu.intShadow = true
 		return nil
 
 	case 0xFC: // CLD
@@ -664,15 +826,13 @@ func (cpu *CPU) RunOnce() error {
 // Fetch8 reads an 8-bit value from memory at the current instruction pointer
 // and increments the instruction pointer by 1.
 func (cpu *CPU) Fetch8() (uint8, error) {
-	x := cpu.Mem.GetMem8(cpu.Regs.CS(), uint(cpu.Ip))
-	cpu.Ip++
-	return x, nil
+	return cpu.fetchQueued(), nil
 }
 
 // Fetch16 reads a 16-bit value from memory at the current instruction pointer
 // and increments the instruction pointer by 2.
 func (cpu *CPU) Fetch16() (uint16, error) {
-	x := cpu.Mem.GetMem16(cpu.Regs.CS(), uint(cpu.Ip))
-	cpu.Ip += 2
-	return x, nil
+	lo := cpu.fetchQueued()
+	hi := cpu.fetchQueued()
+	return uint16(hi)<<8 | uint16(lo), nil
 }
@@ -172,6 +172,28 @@ func TestCPU(t *testing.T) {
 		// SHR (abbreviated)
 		{"SHR/ALimm8", "C0E802", []h{regval8{AL, 0x8}}, []w{regval8{AL, 0x2}}, ""},
 		{"SHR/AXimm16", "C1E802", []h{regval16{AX, 0x8}}, []w{regval16{AX, 0x2}}, ""},
+		{"SHR/AL1/OF", "D0E8", []h{regval8{AL, 0x81}}, []w{regval8{AL, 0x40}}, "CO"},
+		{"SHL/AL1/OF", "D0E0", []h{regval8{AL, 0x41}}, []w{regval8{AL, 0x82}}, "cO"},
+		{"SHL/ALCL/zero", "D2E0", []h{regval8{AL, 0x41}, regval8{CL, 0}, flagval{CF, true}}, []w{regval8{AL, 0x41}}, "C"},
+		{"SHL/ALCL/masked", "D2E0", []h{regval8{AL, 0x41}, regval8{CL, 0x21}}, []w{regval8{AL, 0x82}}, "c"},
+		// DAA/DAS/AAA/AAS
+		{"DAA", "27", []h{regval8{AL, 0x1B}}, []w{regval8{AL, 0x21}}, "cAo"},
+		{"DAA/carry", "27", []h{regval8{AL, 0x9A}}, []w{regval8{AL, 0x00}}, "CAZP"},
+		{"DAS", "2F", []h{regval8{AL, 0xAC}}, []w{regval8{AL, 0x46}}, "CAo"},
+		{"AAA", "37", []h{regval16{AX, 0x000A}}, []w{regval16{AX, 0x0100}}, "CAZP"},
+		{"AAA/none", "37", []h{regval16{AX, 0x0509}}, []w{regval16{AX, 0x0509}}, "ca"},
+		{"AAS", "3F", []h{regval16{AX, 0x020A}}, []w{regval16{AX, 0x0104}}, "CA"},
+		{"AAS/AF", "3F", []h{regval16{AX, 0x0200}, flagval{AF, true}}, []w{regval16{AX, 0x010A}}, "CA"},
+		// ROL/ROR/RCL/RCR
+		{"ROL/AL1", "D0C0", []h{regval8{AL, 0x81}}, []w{regval8{AL, 0x03}}, "CO"},
+		{"ROL/AXimm", "C1C004", []h{regval16{AX, 0x1234}}, []w{regval16{AX, 0x2341}}, "CO"},
+		{"ROR/AL1", "D0C8", []h{regval8{AL, 0x01}}, []w{regval8{AL, 0x80}}, "CO"},
+		{"ROR/AXCL", "D3C8", []h{regval16{AX, 0x1234}, regval8{CL, 4}}, []w{regval16{AX, 0x4123}}, "cO"},
+		{"RCL/AL1", "D0D0", []h{regval8{AL, 0x80}, flagval{CF, true}}, []w{regval8{AL, 0x01}}, "CO"},
+		{"RCL/ALCL9", "D2D0", []h{regval8{AL, 0x55}, regval8{CL, 9}}, []w{regval8{AL, 0x55}}, "c"},
+		{"RCR/AL1", "D0D8", []h{regval8{AL, 0x01}}, []w{regval8{AL, 0x00}}, "Co"},
+		{"RCR/AXimm", "C1D802", []h{regval16{AX, 0x0003}, flagval{CF, true}}, []w{regval16{AX, 0xC000}}, "Co"},
+		{"RCR/Mem8", "D01E0001", []h{memval8{DEFAULT_DS, 0x100, 0x02}, flagval{CF, true}}, []w{memval8{DEFAULT_DS, 0x100, 0x81}}, "cO"},
 		{"SHR/AXimm16/NEG", "C1E80200", []h{regval16{AX, 0x80}}, []w{regval16{AX, 0x20}}, ""},
 		// NEG (abbreviated)
 		{"NEG/AL", "F6D8", []h{regval8{AL, 0xFF}}, []w{regval8{AL, 0x01}}, ""},
@@ -430,6 +452,70 @@ func TestCPU(t *testing.T) {
 				sregval{ES, DEFAULT_ES}, regval16{DI, 0},
 				memval8{DEFAULT_DS, 0, 42}, memval8{DEFAULT_ES, 0, 42}},
 			[]w{}, "Z"},
+		{"CMPSW/NE", "A7",
+			[]h{regval16{SI, 0}, regval16{DI, 0},
+				memval16{DEFAULT_DS, 0, 0x0100}, memval16{DEFAULT_ES, 0, 0x0200}},
+			[]w{regval16{SI, 2}, regval16{DI, 2}}, "zC"},
+		{"CMPSB/REPE", "F3A6",
+			[]h{regval16{SI, 0}, regval16{DI, 0}, regval16{CX, 4},
+				memval16{DEFAULT_DS, 0, 0x2211}, memval16{DEFAULT_ES, 0, 0x3311}},
+			[]w{regval16{SI, 2}, regval16{DI, 2}, regval16{CX, 2}}, "z"},
+		{"MOVSB", "A4",
+			[]h{regval16{SI, 0}, regval16{DI, 0x10}, memval8{DEFAULT_DS, 0, 0x42}},
+			[]w{memval8{DEFAULT_ES, 0x10, 0x42}, regval16{SI, 1}, regval16{DI, 0x11}}, ""},
+		{"MOVSW/STD", "A5",
+			[]h{regval16{SI, 0x10}, regval16{DI, 0x20}, memval16{DEFAULT_DS, 0x10, 0x1234}, flagval{DF, true}},
+			[]w{memval16{DEFAULT_ES, 0x20, 0x1234}, regval16{SI, 0x0E}, regval16{DI, 0x1E}}, ""},
+		{"MOVSB/CS", "2EA4",
+			[]h{regval16{SI, 0}, regval16{DI, 0}},
+			[]w{memval8{DEFAULT_ES, 0, 0x2E}}, ""},
+		{"MOVSW/REP", "F3A5",
+			[]h{regval16{SI, 0}, regval16{DI, 0}, regval16{CX, 2},
+				memval16{DEFAULT_DS, 0, 0x1111}, memval16{DEFAULT_DS, 2, 0x2222}},
+			[]w{memval16{DEFAULT_ES, 0, 0x1111}, memval16{DEFAULT_ES, 2, 0x2222}, regval16{CX, 0}, regval16{SI, 4}}, ""},
+		// REPNE only changes how compares stop, here it just repeats.
+		{"STOSB/REPNE", "F2AA",
+			[]h{regval8{AL, 0x21}, regval16{DI, 0}, regval16{CX, 3}, flagval{ZF, true}},
+			[]w{memval8{DEFAULT_ES, 2, 0x21}, regval16{DI, 3}, regval16{CX, 0}}, ""},
+		{"LODSB/REP", "F3AC",
+			[]h{regval16{SI, 0}, regval16{CX, 3}, memval8{DEFAULT_DS, 2, 0x33}},
+			[]w{regval8{AL, 0x33}, regval16{SI, 3}, regval16{CX, 0}}, ""},
+
+		// 80186
+		{"PUSHA", "60",
+			[]h{regval16{AX, 1}, regval16{CX, 2}, regval16{DX, 3}, regval16{BX, 4},
+				regval16{BP, 6}, regval16{SI, 7}, regval16{DI, 8}},
+			[]w{popval{8}, popval{7}, popval{6}, popval{0xFF}, popval{4}, popval{3}, popval{2}, popval{1}}, ""},
+		{"POPA", "61",
+			[]h{pushval16{1}, pushval16{2}, pushval16{3}, pushval16{4},
+				pushval16{0x1234}, pushval16{6}, pushval16{7}, pushval16{8}},
+			[]w{regval16{AX, 1}, regval16{CX, 2}, regval16{DX, 3}, regval16{BX, 4},
+				regval16{SP, 0xFF}, regval16{BP, 6}, regval16{SI, 7}, regval16{DI, 8}}, ""},
+		{"PUSH/IMM8/NEG", "6AFE", []h{}, []w{popval{0xFFFE}}, ""},
+		{"IMUL/69", "69C3E803", []h{regval16{BX, 3}}, []w{regval16{AX, 3000}}, "co"},
+		{"IMUL/6B/NEG", "6BC3FE", []h{regval16{BX, 5}}, []w{regval16{AX, 0xFFF6}}, "co"},
+		{"IMUL/6B/OF", "6BC304", []h{regval16{BX, 0x4000}}, []w{regval16{AX, 0}}, "CO"},
+		{"IMUL/6B/Mem", "6B070A", []h{memval16{DEFAULT_DS, 0, 0xFFFF}}, []w{regval16{AX, 0xFFF6}}, "co"},
+		{"IMUL/F7", "F7EB", []h{regval16{AX, 0xFFFF}, regval16{BX, 2}},
+			[]w{regval16{AX, 0xFFFE}, regval16{DX, 0xFFFF}}, "co"},
+		{"IMUL/F6/OF", "F6EB", []h{regval8{AL, 0x80}, regval8{BL, 2}}, []w{regval16{AX, 0xFF00}}, "CO"},
+		{"ENTER", "C8040000", []h{regval16{BP, 0x1234}},
+			[]w{regval16{BP, 0xFD}, regval16{SP, 0xF9}, memval16{DEFAULT_SS, 0xFD, 0x1234}}, ""},
+		{"ENTER/NESTED", "C8000002", []h{regval16{BP, 0x80}, memval16{DEFAULT_SS, 0x7E, 0xAAAA}},
+			[]w{regval16{BP, 0xFD}, regval16{SP, 0xF9},
+				memval16{DEFAULT_SS, 0xFB, 0xAAAA}, memval16{DEFAULT_SS, 0xF9, 0xFD}}, ""},
+		{"LEAVE", "C9", []h{regval16{BP, 0x80}, memval16{DEFAULT_SS, 0x80, 0x1234}},
+			[]w{regval16{SP, 0x82}, regval16{BP, 0x1234}}, ""},
+		{"BOUND/IN", "623E0001",
+			[]h{regval16{DI, 5}, memval16{DEFAULT_DS, 0x100, 0xFFFF}, memval16{DEFAULT_DS, 0x102, 10}},
+			[]w{ipval{4}}, ""},
+		{"BOUND/OUT", "623E0001",
+			[]h{regval16{DI, 11}, memval16{DEFAULT_DS, 0x100, 0xFFFF}, memval16{DEFAULT_DS, 0x102, 10},
+				memval16{0, 0x14, 0x1111}, memval16{0, 0x16, 0x3000}},
+			[]w{ipval{0x1111}, sregval{CS, 0x3000}, popval{0}, popval{DEFAULT_CS}}, ""},
+		{"BOUND/REG", "62C7",
+			[]h{memval16{0, 0x18, 0x2222}, memval16{0, 0x1A, 0x3000}},
+			[]w{ipval{0x2222}, sregval{CS, 0x3000}, popval{0}}, ""},
 
 		// TODO
 	}
@@ -35,19 +35,12 @@ func (cpu *CPU) mov(inst *Inst, leftop, rightop Operand) error {
 
 // leaGvM - Load Effective Address
 func (cpu *CPU) leaGvM(inst *Inst) error {
-	if err := inst.FetchModRM(); err != nil {
-		return err
-	}
 	offset := inst.ModRM.effectiveAddressOffset16(cpu)
 	cpu.Regs.SetReg16(Reg(inst.ModRM.Reg), offset)
 	return nil
 }
 
 func (cpu *CPU) lesLds(inst *Inst, esds SReg) error {
-	if err := inst.FetchModRM(); err != nil {
-		return err
-	}
-
 	seg, off, err := inst.ModRM.GetMemoryLocation(cpu, inst)
 	if err != nil {
 		return err
@@ -62,9 +55,6 @@ func (cpu *CPU) lesLds(inst *Inst, esds SReg) error {
 
 // popEv - Pop
 func (cpu *CPU) popEv(inst *Inst) error {
-	if err := inst.FetchModRM(); err != nil {
-		return err
-	}
 	value := cpu.Regs.Pop16(cpu.Mem)
 	inst.ModRM.SetRm16(cpu, inst, uint(value))
 	return nil
@@ -74,19 +64,66 @@ func (cpu *CPU) popEv(inst *Inst) error {
 
 // movALIb - Move
 func (cpu *CPU) movRegIb(inst *Inst, reg Reg8) error {
-	value, err := inst.Fetch8()
-	if err != nil {
-		return err
-	}
+	value := uint8(inst.Imm)
 	cpu.Regs.SetReg8(reg, uint(value))
 	return nil
 }
 
 func (cpu *CPU) movRegIv(inst *Inst, reg Reg) error {
-	value, err := inst.Fetch16()
-	if err != nil {
-		return err
-	}
+	value := uint16(inst.Imm)
 	cpu.Regs.SetReg16(reg, uint(value))
 	return nil
 }
+
+// PUSHA - Push All General Registers
+func (cpu *CPU) pusha() {
+	// The value of SP before the first push is stored.
+	sp := cpu.Regs.GetReg16(SP)
+	for _, reg := range []Reg{AX, CX, DX, BX} {
+		cpu.Regs.PushReg16(reg, cpu.Mem)
+	}
+	cpu.Regs.Push16(cpu.Mem, uint16(sp))
+	for _, reg := range []Reg{BP, SI, DI} {
+		cpu.Regs.PushReg16(reg, cpu.Mem)
+	}
+}
+
+// POPA - Pop All General Registers
+func (cpu *CPU) popa() {
+	for _, reg := range []Reg{DI, SI, BP} {
+		cpu.Regs.PopReg16(reg, cpu.Mem)
+	}
+	// The stored SP is skipped.
+	cpu.Regs.Pop16(cpu.Mem)
+	for _, reg := range []Reg{BX, DX, CX, AX} {
+		cpu.Regs.PopReg16(reg, cpu.Mem)
+	}
+}
+
+// ENTER - Make Stack Frame for Procedure Parameters
+func (cpu *CPU) enter(inst *Inst) error {
+	size := uint16(inst.Imm)
+	level := uint8(inst.Imm2)
+	level &= 0x1F
+
+	cpu.Regs.PushReg16(BP, cpu.Mem)
+	frame := cpu.Regs.GetReg16(SP)
+	if level > 0 {
+		// Copy the frame pointers of the enclosing procedures.
+		bp := cpu.Regs.GetReg16(BP)
+		for i := uint8(1); i < level; i++ {
+			bp = (bp - 2) & 0xFFFF
+			cpu.Regs.Push16(cpu.Mem, cpu.Mem.GetMem16(cpu.Regs.SS(), bp))
+		}
+		cpu.Regs.Push16(cpu.Mem, uint16(frame))
+	}
+	cpu.Regs.SetReg16(BP, frame)
+	cpu.Regs.Dec16(SP, uint(size))
+	return nil
+}
+
+// LEAVE - High Level Procedure Exit
+func (cpu *CPU) leave() {
+	cpu.Regs.SetReg16(SP, cpu.Regs.GetReg16(BP))
+	cpu.Regs.PopReg16(BP, cpu.Mem)
+}
@@ -0,0 +1,272 @@
+package go86
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// Float80 is the 80-bit extended precision format used inside the 8087.
+// Unlike float32 and float64 the integer bit of the mantissa is explicit.
+type Float80 struct {
+	// Mantissa with the integer bit in bit 63.
+	Mant uint64
+	// Sign in bit 15 and the biased exponent in bits 0-14.
+	SExp uint16
+}
+
+const (
+	f80Bias   = 16383
+	f80MaxExp = 0x7FFF
+	f80Int    = 1 << 63
+	// Set in the mantissa of a quiet NaN
+	f80Quiet = 1 << 62
+)
+
+var (
+	// QNaN returned by masked invalid operations.
+	f80Indefinite = Float80{0xC000000000000000, 0xFFFF}
+	f80One        = Float80{f80Int, f80Bias}
+)
+
+func (f Float80) Sign() bool {
+	return f.SExp&0x8000 != 0
+}
+
+func (f Float80) exp() int {
+	return int(f.SExp & f80MaxExp)
+}
+
+func (f Float80) IsNaN() bool {
+	return f.exp() == f80MaxExp && f.Mant<<1 != 0
+}
+
+func (f Float80) isSNaN() bool {
+	return f.IsNaN() && f.Mant&f80Quiet == 0
+}
+
+func (f Float80) IsInf() bool {
+	return f.exp() == f80MaxExp && f.Mant<<1 == 0
+}
+
+func (f Float80) IsZero() bool {
+	return f.exp() != f80MaxExp && f.Mant == 0
+}
+
+func (f Float80) isDenormal() bool {
+	return f.exp() == 0 && f.Mant != 0
+}
+
+func (f Float80) neg() Float80 {
+	f.SExp ^= 0x8000
+	return f
+}
+
+func (f Float80) abs() Float80 {
+	f.SExp &^= 0x8000
+	return f
+}
+
+func f80Inf(neg bool) Float80 {
+	return Float80{f80Int, f80MaxExp}.withSign(neg)
+}
+
+func f80Zero(neg bool) Float80 {
+	return Float80{}.withSign(neg)
+}
+
+func (f Float80) withSign(neg bool) Float80 {
+	f.SExp &^= 0x8000
+	if neg {
+		f.SExp |= 0x8000
+	}
+	return f
+}
+
+// Big returns the value of f, which must not be a NaN.
+func (f Float80) Big() *big.Float {
+	if f.IsInf() {
+		return new(big.Float).SetInf(f.Sign())
+	}
+	e := f.exp()
+	if e == 0 {
+		// Denormals have the same exponent as the smallest normal.
+		e = 1
+	}
+	x := new(big.Float).SetUint64(f.Mant)
+	x.SetMantExp(x, e-f80Bias-63)
+	if f.Sign() {
+		x.Neg(x)
+	}
+	return x
+}
+
+// Float64 is the nearest float64 to f, for showing it to people.
+func (f Float80) Float64() float64 {
+	if f.IsNaN() {
+		return math.NaN()
+	}
+	v, _ := f.Big().Float64()
+	return v
+}
+
+func (f Float80) String() string {
+	return fmt.Sprintf("%04X:%016X (%g)", f.SExp, f.Mant, f.Float64())
+}
+
+// Converts x, already rounded to the extended format, to a Float80.
+func float80FromBig(x *big.Float) Float80 {
+	neg := x.Signbit()
+	if x.IsInf() {
+		return f80Inf(neg)
+	}
+	if x.Sign() == 0 {
+		return f80Zero(neg)
+	}
+	e := x.MantExp(nil)
+	be := e - 1 + f80Bias
+	if e < extended.emin {
+		e = extended.emin
+		be = 0
+	}
+	m := new(big.Float).Abs(x)
+	m.SetMantExp(m, 64-e)
+	mant, _ := m.Uint64()
+	return Float80{mant, uint16(be)}.withSign(neg)
+}
+
+// Binary floating point formats the 8087 converts to and from.  A value is
+// m * 2^e with 0.5 <= m < 1 as returned by big.Float.MantExp.
+type floatFormat struct {
+	mbits int
+	emin  int
+	emax  int
+}
+
+var (
+	single   = floatFormat{24, -125, 128}
+	double   = floatFormat{53, -1021, 1024}
+	extended = floatFormat{64, -16381, 16384}
+)
+
+// Rounds x to the format with at most prec bits of mantissa, returning the
+// exceptions raised.  Overflow gives the masked response, infinity or the
+// largest finite value depending on the rounding mode, and tiny results are
+// denormalized.
+func (ff floatFormat) round(x *big.Float, prec int, mode big.RoundingMode) (*big.Float, uint16) {
+	if x.IsInf() || x.Sign() == 0 {
+		return x, 0
+	}
+	if x.MantExp(nil) < ff.emin {
+		// Denormals have a fixed lowest bit of 2^(emin-mbits)
+		n, exact := roundInt(new(big.Float).SetMantExp(x, ff.mbits-ff.emin), mode)
+		r := new(big.Float).SetInt(n)
+		r.SetMantExp(r, ff.emin-ff.mbits)
+		if x.Signbit() && r.Sign() == 0 {
+			r.Neg(r)
+		}
+		if exact {
+			return r, 0
+		}
+		return r, fpuUE | fpuPE
+	}
+
+	var exc uint16
+	r := new(big.Float).SetPrec(uint(prec)).SetMode(mode).Set(x)
+	if r.Acc() != big.Exact {
+		exc |= fpuPE
+	}
+	if r.MantExp(nil) > ff.emax {
+		exc |= fpuOE | fpuPE
+		r = ff.overflow(x.Signbit(), prec, mode)
+	}
+	return r, exc
+}
+
+// Masked response to overflow, rounding away from zero gives infinity and
+// towards it the largest finite value.
+func (ff floatFormat) overflow(neg bool, prec int, mode big.RoundingMode) *big.Float {
+	if mode == big.ToNearestEven ||
+		(mode == big.ToPositiveInf && !neg) || (mode == big.ToNegativeInf && neg) {
+		return new(big.Float).SetInf(neg)
+	}
+	n := new(big.Int).Lsh(big.NewInt(1), uint(prec))
+	n.Sub(n, big.NewInt(1))
+	r := new(big.Float).SetInt(n)
+	r.SetMantExp(r, ff.emax-prec)
+	if neg {
+		r.Neg(r)
+	}
+	return r
+}
+
+// Rounds x to an integer in the direction given by mode, exact is false if
+// x had a fraction.
+func roundInt(x *big.Float, mode big.RoundingMode) (n *big.Int, exact bool) {
+	n, acc := x.Int(nil)
+	if acc == big.Exact {
+		return n, true
+	}
+	away := false
+	switch mode {
+	case big.ToNegativeInf:
+		away = x.Signbit()
+	case big.ToPositiveInf:
+		away = !x.Signbit()
+	case big.ToNearestEven:
+		frac := new(big.Float).Sub(x, new(big.Float).SetInt(n))
+		frac.Abs(frac)
+		switch frac.Cmp(big.NewFloat(0.5)) {
+		case 1:
+			away = true
+		case 0:
+			away = n.Bit(0) == 1
+		}
+	}
+	if away {
+		if x.Signbit() {
+			n.Sub(n, big.NewInt(1))
+		} else {
+			n.Add(n, big.NewInt(1))
+		}
+	}
+	return n, false
+}
+
+// Converts a float32 or float64 with mbits of mantissa (excluding the hidden
+// bit) and an exponent bias to extended precision.
+func float80FromBits(bits uint64, mbits, ebits int) Float80 {
+	bias := 1<<(ebits-1) - 1
+	neg := bits>>(mbits+ebits) != 0
+	e := int(bits>>mbits) & (1<<ebits - 1)
+	frac := bits & (1<<mbits - 1)
+	switch {
+	case e == 1<<ebits-1 && frac == 0:
+		return f80Inf(neg)
+	case e == 1<<ebits-1:
+		return Float80{f80Int | frac<<(63-mbits), f80MaxExp}.withSign(neg)
+	case e == 0 && frac == 0:
+		return f80Zero(neg)
+	}
+	var x *big.Float
+	if e == 0 {
+		x = new(big.Float).SetUint64(frac)
+		x.SetMantExp(x, 1-bias-mbits)
+	} else {
+		x = new(big.Float).SetUint64(1<<mbits | frac)
+		x.SetMantExp(x, e-bias-mbits)
+	}
+	if neg {
+		x.Neg(x)
+	}
+	return float80FromBig(x)
+}
+
+// NaN payloads carry over to and from the shorter formats.
+func (f Float80) nanBits(mbits, ebits int) uint64 {
+	var sign uint64
+	if f.Sign() {
+		sign = 1 << (mbits + ebits)
+	}
+	return sign | (1<<ebits-1)<<mbits | (f.Mant&^f80Int)>>(63-mbits)
+}
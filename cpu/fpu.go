@@ -0,0 +1,1113 @@
+package go86
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/big"
+
+	log "github.com/golang/glog"
+)
+
+// Status word bits
+const (
+	// Exceptions: invalid operation, denormal operand, zero divide, overflow,
+	// underflow and precision.
+	fpuIE = 0x0001
+	fpuDE = 0x0002
+	fpuZE = 0x0004
+	fpuOE = 0x0008
+	fpuUE = 0x0010
+	fpuPE = 0x0020
+	// Interrupt request, an unmasked exception is pending.
+	fpuIR = 0x0080
+	fpuC0 = 0x0100
+	fpuC1 = 0x0200
+	fpuC2 = 0x0400
+	fpuC3 = 0x4000
+
+	fpuExceptions = 0x003F
+	fpuCC         = fpuC0 | fpuC1 | fpuC2 | fpuC3
+)
+
+// Control word bits, the low 6 bits mask the matching exceptions.
+const (
+	// Interrupt enable mask, only the 8087 has it.
+	fpuIEM = 0x0080
+)
+
+// Tags for each register in the tag word.
+const (
+	tagValid = iota
+	tagZero
+	tagSpecial
+	tagEmpty
+)
+
+// FPU is an 8087 numeric coprocessor.  It watches the instruction stream
+// for the ESC opcodes (D8-DF) and executes them; exceptions which aren't
+// masked are signaled on its INT line, which the PC wires to the NMI.
+type FPU struct {
+	Control uint16
+	Status  uint16
+	Tag     uint16
+	// Physical registers, ST(0) is Regs[top].
+	Regs [8]Float80
+
+	// Last non-control instruction and its memory operand, as saved by
+	// FSTENV.
+	instAddr uint32
+	opcode   uint16
+	operAddr uint32
+}
+
+// NewFPU returns an 8087 in its initialized state.
+func NewFPU() *FPU {
+	f := &FPU{}
+	f.finit()
+	return f
+}
+
+func (f *FPU) finit() {
+	f.Control = 0x03FF
+	f.Status = 0
+	f.Tag = 0xFFFF
+	f.instAddr = 0
+	f.opcode = 0
+	f.operAddr = 0
+}
+
+func (f *FPU) top() int {
+	return int(f.Status>>11) & 7
+}
+
+func (f *FPU) setTop(top int) {
+	f.Status = f.Status&^0x3800 | uint16(top&7)<<11
+}
+
+func (f *FPU) phys(i int) int {
+	return (f.top() + i) & 7
+}
+
+func (f *FPU) tag(phys int) int {
+	return int(f.Tag>>(2*phys)) & 3
+}
+
+func (f *FPU) setTag(phys int, tag int) {
+	f.Tag = f.Tag&^(3<<(2*phys)) | uint16(tag)<<(2*phys)
+}
+
+func (f *FPU) isEmpty(i int) bool {
+	return f.tag(f.phys(i)) == tagEmpty
+}
+
+func tagFor(v Float80) int {
+	switch {
+	case v.IsZero():
+		return tagZero
+	case v.exp() == f80MaxExp, v.exp() == 0, v.Mant&f80Int == 0:
+		return tagSpecial
+	}
+	return tagValid
+}
+
+// ST returns ST(i).
+func (f *FPU) ST(i int) Float80 {
+	return f.Regs[f.phys(i)]
+}
+
+func (f *FPU) setST(i int, v Float80) {
+	p := f.phys(i)
+	f.Regs[p] = v
+	f.setTag(p, tagFor(v))
+}
+
+// ST(i) as an operand.  Reading an empty register is an invalid operation,
+// ok is false if that is unmasked and the instruction must stop.
+func (f *FPU) get(i int) (v Float80, ok bool) {
+	if f.isEmpty(i) {
+		return f80Indefinite, f.raise(fpuIE) == 0
+	}
+	return f.ST(i), true
+}
+
+func (f *FPU) push(v Float80) {
+	if !f.isEmpty(-1) {
+		// Stack overflow
+		if f.raise(fpuIE) != 0 {
+			return
+		}
+		v = f80Indefinite
+	}
+	f.setTop(f.top() - 1)
+	f.setST(0, v)
+}
+
+func (f *FPU) pop() {
+	f.setTag(f.phys(0), tagEmpty)
+	f.setTop(f.top() + 1)
+}
+
+// Records exceptions in the status word, returning the ones which are
+// unmasked.
+func (f *FPU) raise(exc uint16) uint16 {
+	f.Status |= exc
+	return exc &^ f.Control & fpuExceptions
+}
+
+// Masked invalid operation gives the indefinite NaN, ok is false if it is
+// unmasked.
+func (f *FPU) invalid() (Float80, bool) {
+	return f80Indefinite, f.raise(fpuIE) == 0
+}
+
+// Raises the denormal exception for denormal operands, false if it is
+// unmasked.
+func (f *FPU) checkDenormal(vals ...Float80) bool {
+	for _, v := range vals {
+		if v.isDenormal() && f.raise(fpuDE) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// An operation on NaNs gives the NaN with the larger mantissa, quieted.
+// Signaling NaNs are invalid operations.
+func (f *FPU) nanResult(vals ...Float80) (Float80, bool) {
+	var r Float80
+	snan := false
+	for _, v := range vals {
+		if !v.IsNaN() {
+			continue
+		}
+		snan = snan || v.isSNaN()
+		if !r.IsNaN() || v.Mant > r.Mant {
+			r = v
+		}
+	}
+	if snan && f.raise(fpuIE) != 0 {
+		return r, false
+	}
+	r.Mant |= f80Quiet
+	return r, true
+}
+
+// Precision in bits selected by the control word.
+func (f *FPU) precision() int {
+	switch (f.Control >> 8) & 3 {
+	case 0:
+		return 24
+	case 2:
+		return 53
+	}
+	return 64
+}
+
+func (f *FPU) roundingMode() big.RoundingMode {
+	switch (f.Control >> 10) & 3 {
+	case 1:
+		return big.ToNegativeInf
+	case 2:
+		return big.ToPositiveInf
+	case 3:
+		return big.ToZero
+	}
+	return big.ToNearestEven
+}
+
+// Empty result for the arithmetic to round into.
+func (f *FPU) newResult() *big.Float {
+	return new(big.Float).SetPrec(uint(f.precision())).SetMode(f.roundingMode())
+}
+
+// Rounds a result to extended precision.  Results with unmasked exceptions,
+// other than precision, aren't stored.
+func (f *FPU) result(x *big.Float) (Float80, bool) {
+	r, exc := extended.round(x, f.precision(), f.roundingMode())
+	return float80FromBig(r), f.raise(exc)&^fpuPE == 0
+}
+
+// The arithmetic opcodes, from the reg field of D8.
+const (
+	fadd  = 0
+	fmul  = 1
+	fcom  = 2
+	fcomp = 3
+	fsub  = 4
+	fsubr = 5
+	fdiv  = 6
+	fdivr = 7
+)
+
+func (f *FPU) arith(op uint8, a, b Float80) (Float80, bool) {
+	if op == fsubr || op == fdivr {
+		a, b = b, a
+		op--
+	}
+	if a.IsNaN() || b.IsNaN() {
+		return f.nanResult(a, b)
+	}
+	if !f.checkDenormal(a, b) {
+		return Float80{}, false
+	}
+	switch op {
+	case fadd, fsub:
+		if a.IsInf() && b.IsInf() && (a.Sign() != b.Sign()) == (op == fadd) {
+			return f.invalid()
+		}
+	case fmul:
+		if (a.IsInf() && b.IsZero()) || (a.IsZero() && b.IsInf()) {
+			return f.invalid()
+		}
+	case fdiv:
+		if (a.IsInf() && b.IsInf()) || (a.IsZero() && b.IsZero()) {
+			return f.invalid()
+		}
+		if b.IsZero() && !a.IsInf() {
+			return f80Inf(a.Sign() != b.Sign()), f.raise(fpuZE) == 0
+		}
+	}
+
+	x, y := a.Big(), b.Big()
+	z := f.newResult()
+	switch op {
+	case fadd:
+		z.Add(x, y)
+	case fsub:
+		z.Sub(x, y)
+	case fmul:
+		z.Mul(x, y)
+	case fdiv:
+		z.Quo(x, y)
+	}
+	return f.result(z)
+}
+
+// Sets the condition codes from comparing a with b, NaNs are unordered.
+func (f *FPU) compare(a, b Float80) bool {
+	f.Status &^= fpuCC
+	if a.IsNaN() || b.IsNaN() {
+		f.Status |= fpuC0 | fpuC2 | fpuC3
+		return f.raise(fpuIE) == 0
+	}
+	if !f.checkDenormal(a, b) {
+		return false
+	}
+	switch a.Big().Cmp(b.Big()) {
+	case -1:
+		f.Status |= fpuC0
+	case 0:
+		f.Status |= fpuC3
+	}
+	return true
+}
+
+// Executes an arithmetic opcode with ST(0) and another operand, storing the
+// result in ST(0).
+func (f *FPU) arithST0(op uint8, b Float80) {
+	a, ok := f.get(0)
+	if !ok {
+		return
+	}
+	switch op {
+	case fcom:
+		f.compare(a, b)
+	case fcomp:
+		if f.compare(a, b) {
+			f.pop()
+		}
+	default:
+		if r, ok := f.arith(op, a, b); ok {
+			f.setST(0, r)
+		}
+	}
+}
+
+// FPU exceptions go to the CPU as an NMI, unless the interrupt enable mask
+// is set.
+func (cpu *CPU) fpuCheckException() {
+	f := cpu.FPU
+	if f.Status&^f.Control&fpuExceptions == 0 || f.Status&fpuIR != 0 {
+		return
+	}
+	f.Status |= fpuIR
+	if f.Control&fpuIEM == 0 {
+		log.V(4).Infof("FPU exception, status %04X control %04X", f.Status, f.Control)
+		cpu.NMI()
+	}
+}
+
+// ESC opcodes, D8-DF.  With no FPU fitted the instruction is decoded and
+// ignored, like an 8086 with an empty coprocessor socket.
+func (cpu *CPU) esc(inst *Inst) error {
+	if cpu.FPU == nil {
+		return nil
+	}
+	err := cpu.fpuExec(inst)
+	cpu.fpuCheckException()
+	return err
+}
+
+func (cpu *CPU) fpuExec(inst *Inst) error {
+	f := cpu.FPU
+	m := inst.ModRM
+	esc := inst.OpCode & 7
+	var seg, off uint
+	if m.Mod != 3 {
+		seg, off, _ = m.GetMemoryLocation(cpu, inst)
+	}
+	if !isFpuControl(esc, m) {
+		f.instAddr = uint32(cpu.Regs.CS()*0x10+uint(cpu.instIp)) & 0xFFFFF
+		f.opcode = uint16(esc)<<8 | uint16(m.Mod<<6|m.Reg<<3|m.Rm)
+		if m.Mod != 3 {
+			f.operAddr = uint32(seg*0x10+off) & 0xFFFFF
+		}
+	}
+
+	if m.Mod == 3 {
+		return cpu.fpuExecReg(esc, m.Reg, int(m.Rm))
+	}
+	mem := fpuMem{cpu.Mem, seg, off}
+	op := m.Reg
+	switch esc {
+	case 0: // D8: arithmetic with m32real
+		if v, ok := f.loadReal(mem.read(4), single); ok {
+			f.arithST0(op, v)
+		}
+	case 2: // DA: arithmetic with m32int
+		f.arithST0(op, float80FromInt(int64(int32(binary.LittleEndian.Uint32(mem.read(4))))))
+	case 4: // DC: arithmetic with m64real
+		if v, ok := f.loadReal(mem.read(8), double); ok {
+			f.arithST0(op, v)
+		}
+	case 6: // DE: arithmetic with m16int
+		f.arithST0(op, float80FromInt(int64(int16(binary.LittleEndian.Uint16(mem.read(2))))))
+
+	case 1: // D9
+		switch op {
+		case 0: // FLD m32real
+			if v, ok := f.loadReal(mem.read(4), single); ok {
+				f.push(v)
+			}
+		case 2, 3: // FST, FSTP m32real
+			f.storeReal(mem, single, op == 3)
+		case 4: // FLDENV
+			f.loadEnv(mem)
+		case 5: // FLDCW
+			f.Control = mem.read16(0)
+		case 6: // FSTENV
+			f.storeEnv(mem)
+			f.Control |= fpuExceptions
+		case 7: // FSTCW
+			mem.write16(0, f.Control)
+		default:
+			return fmt.Errorf("unhandled FPU opcode: D9 /%x", op)
+		}
+	case 3: // DB
+		switch op {
+		case 0: // FILD m32int
+			f.push(float80FromInt(int64(int32(binary.LittleEndian.Uint32(mem.read(4))))))
+		case 2, 3: // FIST, FISTP m32int
+			f.storeInt(mem, 32, op == 3)
+		case 5: // FLD m80real
+			b := mem.read(10)
+			f.push(Float80{binary.LittleEndian.Uint64(b), binary.LittleEndian.Uint16(b[8:])})
+		case 7: // FSTP m80real
+			if v, ok := f.get(0); ok {
+				b := make([]byte, 10)
+				binary.LittleEndian.PutUint64(b, v.Mant)
+				binary.LittleEndian.PutUint16(b[8:], v.SExp)
+				mem.write(b)
+				f.pop()
+			}
+		default:
+			return fmt.Errorf("unhandled FPU opcode: DB /%x", op)
+		}
+	case 5: // DD
+		switch op {
+		case 0: // FLD m64real
+			if v, ok := f.loadReal(mem.read(8), double); ok {
+				f.push(v)
+			}
+		case 2, 3: // FST, FSTP m64real
+			f.storeReal(mem, double, op == 3)
+		case 4: // FRSTOR
+			f.loadEnv(mem)
+			for i := 0; i < 8; i++ {
+				b := mem.at(14 + 10*i).read(10)
+				f.Regs[f.phys(i)] = Float80{binary.LittleEndian.Uint64(b), binary.LittleEndian.Uint16(b[8:])}
+			}
+		case 6: // FSAVE
+			f.storeEnv(mem)
+			for i := 0; i < 8; i++ {
+				v := f.ST(i)
+				b := make([]byte, 10)
+				binary.LittleEndian.PutUint64(b, v.Mant)
+				binary.LittleEndian.PutUint16(b[8:], v.SExp)
+				mem.at(14 + 10*i).write(b)
+			}
+			f.finit()
+		case 7: // FSTSW
+			mem.write16(0, f.Status)
+		default:
+			return fmt.Errorf("unhandled FPU opcode: DD /%x", op)
+		}
+	case 7: // DF
+		switch op {
+		case 0: // FILD m16int
+			f.push(float80FromInt(int64(int16(mem.read16(0)))))
+		case 2, 3: // FIST, FISTP m16int
+			f.storeInt(mem, 16, op == 3)
+		case 4: // FBLD
+			f.push(float80FromBCD(mem.read(10)))
+		case 5: // FILD m64int
+			f.push(float80FromInt(int64(binary.LittleEndian.Uint64(mem.read(8)))))
+		case 6: // FBSTP
+			f.storeBCD(mem)
+		case 7: // FISTP m64int
+			f.storeInt(mem, 64, true)
+		default:
+			return fmt.Errorf("unhandled FPU opcode: DF /%x", op)
+		}
+	}
+	return nil
+}
+
+// Register forms of the ESC opcodes
+func (cpu *CPU) fpuExecReg(esc uint8, op uint8, i int) error {
+	f := cpu.FPU
+	switch esc {
+	case 0: // D8: ST(0) = ST(0) op ST(i)
+		if b, ok := f.get(i); ok {
+			f.arithST0(op, b)
+		}
+	case 4, 6: // DC, DE: ST(i) = ST(i) op ST(0), DE pops
+		if esc == 6 && op == 3 && i != 1 {
+			return fmt.Errorf("unhandled FPU opcode: DE %02X", 0xD8+i)
+		}
+		a, ok := f.get(i)
+		if !ok {
+			return nil
+		}
+		b, ok := f.get(0)
+		if !ok {
+			return nil
+		}
+		switch op {
+		case fcom, fcomp:
+			if !f.compare(b, a) {
+				return nil
+			}
+			if op == fcomp {
+				f.pop()
+			}
+			if esc == 6 && op == fcomp {
+				// FCOMPP
+				f.pop()
+			}
+			return nil
+		case fsub, fsubr, fdiv, fdivr:
+			// The reverse forms swap round when the result goes to ST(i)
+			op ^= 1
+		}
+		r, ok := f.arith(op, a, b)
+		if !ok {
+			return nil
+		}
+		f.setST(i, r)
+		if esc == 6 {
+			f.pop()
+		}
+	case 1: // D9
+		return f.execD9(op, i)
+	case 3: // DB
+		if op != 4 {
+			return fmt.Errorf("unhandled FPU opcode: DB /%x", op)
+		}
+		switch i {
+		case 0: // FENI
+			f.Control &^= fpuIEM
+		case 1: // FDISI
+			f.Control |= fpuIEM
+		case 2: // FCLEX
+			f.Status &^= fpuExceptions | fpuIR | 0x8000
+		case 3: // FINIT
+			f.finit()
+		default:
+			return fmt.Errorf("unhandled FPU opcode: DB %02X", 0xE0+i)
+		}
+	case 5: // DD
+		switch op {
+		case 0: // FFREE
+			f.setTag(f.phys(i), tagEmpty)
+		case 2, 3: // FST, FSTP ST(i)
+			v, ok := f.get(0)
+			if !ok {
+				return nil
+			}
+			f.setST(i, v)
+			if op == 3 {
+				f.pop()
+			}
+		default:
+			return fmt.Errorf("unhandled FPU opcode: DD /%x", op)
+		}
+	default:
+		return fmt.Errorf("unhandled FPU opcode: %02X /%x", 0xD8+esc, op)
+	}
+	return nil
+}
+
+func (f *FPU) execD9(op uint8, i int) error {
+	switch op {
+	case 0: // FLD ST(i)
+		if v, ok := f.get(i); ok {
+			f.push(v)
+		}
+		return nil
+	case 1: // FXCH
+		a, ok := f.get(0)
+		if !ok {
+			return nil
+		}
+		b, ok := f.get(i)
+		if !ok {
+			return nil
+		}
+		f.setST(0, b)
+		f.setST(i, a)
+		return nil
+	case 2:
+		if i == 0 {
+			// FNOP
+			return nil
+		}
+	case 4:
+		return f.execD9E0(i)
+	case 5:
+		if c, ok := fpuConstants[i]; ok {
+			// FLD1, FLDL2T, FLDL2E, FLDPI, FLDLG2, FLDLN2, FLDZ
+			f.push(c)
+			return nil
+		}
+	case 6:
+		return f.execD9F0(i)
+	case 7:
+		return f.execD9F8(i)
+	}
+	return fmt.Errorf("unhandled FPU opcode: D9 %02X", 0xC0|op<<3|uint8(i))
+}
+
+var fpuConstants = map[int]Float80{
+	0: f80One,
+	1: {0xD49A784BCD1B8AFE, 0x4000},
+	2: {0xB8AA3B295C17F0BC, 0x3FFF},
+	3: {0xC90FDAA22168C235, 0x4000},
+	4: {0x9A209A84FBCFF799, 0x3FFD},
+	5: {0xB17217F7D1CF79AC, 0x3FFE},
+	6: {},
+}
+
+// D9 E0-E7
+func (f *FPU) execD9E0(i int) error {
+	if i == 5 {
+		// FXAM, classifies ST(0) and doesn't care if it is empty.
+		f.fxam()
+		return nil
+	}
+	v, ok := f.get(0)
+	if !ok {
+		return nil
+	}
+	switch i {
+	case 0: // FCHS
+		f.setST(0, v.neg())
+	case 1: // FABS
+		f.setST(0, v.abs())
+	case 4: // FTST
+		f.compare(v, Float80{})
+	default:
+		return fmt.Errorf("unhandled FPU opcode: D9 %02X", 0xE0+i)
+	}
+	return nil
+}
+
+func (f *FPU) fxam() {
+	f.Status &^= fpuCC
+	v := f.ST(0)
+	if v.Sign() {
+		f.Status |= fpuC1
+	}
+	switch {
+	case f.isEmpty(0):
+		f.Status |= fpuC3 | fpuC0
+	case v.IsNaN():
+		f.Status |= fpuC0
+	case v.IsInf():
+		f.Status |= fpuC2 | fpuC0
+	case v.IsZero():
+		f.Status |= fpuC3
+	case v.isDenormal():
+		f.Status |= fpuC3 | fpuC2
+	case v.Mant&f80Int == 0:
+		// Unnormal
+	default:
+		f.Status |= fpuC2
+	}
+}
+
+// D9 F0-F7
+func (f *FPU) execD9F0(i int) error {
+	switch i {
+	case 0: // F2XM1
+		f.unary(func(x float64) float64 { return math.Expm1(x * math.Ln2) })
+	case 1: // FYL2X
+		f.binaryPop(func(x, y float64) float64 { return y * math.Log2(x) })
+	case 2: // FPTAN, leaves y/x as ST(1)/ST(0)
+		if f.unary(math.Tan) {
+			f.push(f80One)
+		}
+	case 3: // FPATAN
+		f.binaryPop(func(x, y float64) float64 { return math.Atan2(y, x) })
+	case 4: // FXTRACT, ST(0) becomes the exponent and the significand is pushed
+		v, ok := f.get(0)
+		if !ok || !f.checkDenormal(v) {
+			return nil
+		}
+		var e, sig Float80
+		switch {
+		case v.IsNaN():
+			e, ok = f.nanResult(v)
+			sig = e
+		case v.IsInf():
+			e, sig = f80Inf(false), v
+		case v.IsZero():
+			e, sig = f80Inf(true), v
+			ok = f.raise(fpuZE) == 0
+		default:
+			x := v.Big()
+			exp := x.MantExp(x)
+			x.SetMantExp(x, 1)
+			e, sig = float80FromInt(int64(exp-1)), float80FromBig(x)
+		}
+		if ok {
+			f.setST(0, e)
+			f.push(sig)
+		}
+	case 6: // FDECSTP
+		f.setTop(f.top() - 1)
+	case 7: // FINCSTP
+		f.setTop(f.top() + 1)
+	default:
+		return fmt.Errorf("unhandled FPU opcode: D9 %02X", 0xF0+i)
+	}
+	return nil
+}
+
+// D9 F8-FF
+func (f *FPU) execD9F8(i int) error {
+	switch i {
+	case 0: // FPREM
+		f.fprem()
+	case 1: // FYL2XP1
+		f.binaryPop(func(x, y float64) float64 { return y * math.Log2(1+x) })
+	case 2: // FSQRT
+		v, ok := f.get(0)
+		if !ok || !f.checkDenormal(v) {
+			return nil
+		}
+		var r Float80
+		switch {
+		case v.IsNaN():
+			r, ok = f.nanResult(v)
+		case v.IsZero(), v.IsInf() && !v.Sign():
+			r = v
+		case v.Sign():
+			r, ok = f.invalid()
+		default:
+			r, ok = f.result(f.newResult().Sqrt(v.Big()))
+		}
+		if ok {
+			f.setST(0, r)
+		}
+	case 4: // FRNDINT
+		v, ok := f.get(0)
+		if !ok {
+			return nil
+		}
+		if v.IsNaN() {
+			v, ok = f.nanResult(v)
+		} else if !v.IsInf() && !v.IsZero() {
+			n, exact := roundInt(v.Big(), f.roundingMode())
+			if !exact {
+				f.raise(fpuPE)
+			}
+			r := float80FromBig(new(big.Float).SetInt(n))
+			v = r.withSign(v.Sign())
+		}
+		if ok {
+			f.setST(0, v)
+		}
+	case 5: // FSCALE
+		a, ok := f.get(0)
+		if !ok {
+			return nil
+		}
+		b, ok := f.get(1)
+		if !ok {
+			return nil
+		}
+		var r Float80
+		switch {
+		case a.IsNaN() || b.IsNaN():
+			r, ok = f.nanResult(a, b)
+		case b.IsInf():
+			r, ok = f.invalid()
+		case a.IsInf() || a.IsZero():
+			r = a
+		default:
+			n, _ := b.Big().Int64()
+			if n > 1<<16 {
+				n = 1 << 16
+			} else if n < -(1 << 16) {
+				n = -(1 << 16)
+			}
+			x := a.Big()
+			r, ok = f.result(x.SetMantExp(x, int(n)))
+		}
+		if ok {
+			f.setST(0, r)
+		}
+	default:
+		return fmt.Errorf("unhandled FPU opcode: D9 %02X", 0xF8+i)
+	}
+	return nil
+}
+
+// The 8087's transcendental functions are calculated in float64, which is
+// closer than most programs of its era care about.
+func (f *FPU) fromFloat64(v float64) (Float80, bool) {
+	if math.IsNaN(v) {
+		return f.invalid()
+	}
+	if math.IsInf(v, 0) {
+		return f80Inf(v < 0), f.raise(fpuZE) == 0
+	}
+	return f.result(big.NewFloat(v))
+}
+
+// ST(0) = fn(ST(0)), false if an exception stopped it.
+func (f *FPU) unary(fn func(float64) float64) bool {
+	v, ok := f.get(0)
+	if !ok || !f.checkDenormal(v) {
+		return false
+	}
+	if v.IsNaN() {
+		v, ok = f.nanResult(v)
+	} else {
+		v, ok = f.fromFloat64(fn(v.Float64()))
+	}
+	if ok {
+		f.setST(0, v)
+	}
+	return ok
+}
+
+// ST(1) = fn(ST(0), ST(1)) and pop.
+func (f *FPU) binaryPop(fn func(x, y float64) float64) {
+	x, ok := f.get(0)
+	if !ok {
+		return
+	}
+	y, ok := f.get(1)
+	if !ok || !f.checkDenormal(x, y) {
+		return
+	}
+	var r Float80
+	if x.IsNaN() || y.IsNaN() {
+		r, ok = f.nanResult(x, y)
+	} else {
+		r, ok = f.fromFloat64(fn(x.Float64(), y.Float64()))
+	}
+	if ok {
+		f.setST(1, r)
+		f.pop()
+	}
+}
+
+// FPREM, the partial remainder of ST(0) / ST(1) truncating the quotient.
+// Each run reduces the exponent by at most 63, C2 is set if the remainder
+// isn't finished and C0, C3, C1 hold the low bits of the quotient.
+func (f *FPU) fprem() {
+	a, ok := f.get(0)
+	if !ok {
+		return
+	}
+	b, ok := f.get(1)
+	if !ok || !f.checkDenormal(a, b) {
+		return
+	}
+	var r Float80
+	switch {
+	case a.IsNaN() || b.IsNaN():
+		r, ok = f.nanResult(a, b)
+	case a.IsInf() || b.IsZero():
+		r, ok = f.invalid()
+	case a.IsZero() || b.IsInf():
+		r = a
+	default:
+		// |a| = ma * 2^ea, |b| = mb * 2^eb with integer mantissas
+		ma, ea := bigMantExp(a)
+		mb, eb := bigMantExp(b)
+		shift := 0
+		if d := ea - eb; d >= 64 {
+			shift = d - 32
+		}
+		base := min(ea, eb+shift)
+		x := new(big.Int).Lsh(ma, uint(ea-base))
+		y := new(big.Int).Lsh(mb, uint(eb+shift-base))
+		q, rem := new(big.Int).QuoRem(x, y, new(big.Int))
+		z := new(big.Float).SetInt(rem)
+		z.SetMantExp(z, base)
+		if a.Sign() {
+			z.Neg(z)
+		}
+		r = float80FromBig(z)
+		if rem.Sign() == 0 {
+			r = r.withSign(a.Sign())
+		}
+		f.Status &^= fpuCC
+		if shift != 0 {
+			f.Status |= fpuC2
+		} else {
+			if q.Bit(2) == 1 {
+				f.Status |= fpuC0
+			}
+			if q.Bit(1) == 1 {
+				f.Status |= fpuC3
+			}
+			if q.Bit(0) == 1 {
+				f.Status |= fpuC1
+			}
+		}
+	}
+	if ok {
+		f.setST(0, r)
+	}
+}
+
+// |v| as an integer mantissa and exponent.
+func bigMantExp(v Float80) (*big.Int, int) {
+	e := v.exp()
+	if e == 0 {
+		e = 1
+	}
+	return new(big.Int).SetUint64(v.Mant), e - f80Bias - 63
+}
+
+func float80FromInt(n int64) Float80 {
+	return float80FromBig(new(big.Float).SetInt64(n))
+}
+
+// Converts a float32 or float64 in memory, loading a denormal raises the
+// denormal exception.
+func (f *FPU) loadReal(b []byte, ff floatFormat) (Float80, bool) {
+	var v Float80
+	denormal := false
+	if ff == single {
+		bits := binary.LittleEndian.Uint32(b)
+		v = float80FromBits(uint64(bits), 23, 8)
+		denormal = bits&0x7F800000 == 0 && bits&0x7FFFFF != 0
+	} else {
+		bits := binary.LittleEndian.Uint64(b)
+		v = float80FromBits(bits, 52, 11)
+		denormal = bits&0x7FF0000000000000 == 0 && bits&0xFFFFFFFFFFFFF != 0
+	}
+	if denormal && f.raise(fpuDE) != 0 {
+		return v, false
+	}
+	return v, true
+}
+
+func (f *FPU) storeReal(mem fpuMem, ff floatFormat, pop bool) {
+	v, ok := f.get(0)
+	if !ok {
+		return
+	}
+	var bits uint64
+	mbits, ebits := 52, 11
+	if ff == single {
+		mbits, ebits = 23, 8
+	}
+	switch {
+	case v.IsNaN():
+		if v.isSNaN() && f.raise(fpuIE) != 0 {
+			return
+		}
+		v.Mant |= f80Quiet
+		bits = v.nanBits(mbits, ebits)
+	default:
+		prec := min(f.precision(), ff.mbits)
+		r, exc := ff.round(v.Big(), prec, f.roundingMode())
+		if f.raise(exc)&^fpuPE != 0 {
+			return
+		}
+		if ff == single {
+			x, _ := r.Float32()
+			bits = uint64(math.Float32bits(x))
+		} else {
+			x, _ := r.Float64()
+			bits = math.Float64bits(x)
+		}
+	}
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, bits)
+	mem.write(b[:(mbits+ebits+1)/8])
+	if pop {
+		f.pop()
+	}
+}
+
+// FIST, out of range values store the integer indefinite, the most negative
+// value.
+func (f *FPU) storeInt(mem fpuMem, size int, pop bool) {
+	v, ok := f.get(0)
+	if !ok {
+		return
+	}
+	indefinite := int64(-1) << (size - 1)
+	n, valid := indefinite, false
+	if !v.IsNaN() && !v.IsInf() {
+		i, exact := roundInt(v.Big(), f.roundingMode())
+		if i.IsInt64() && i.Int64() >= indefinite && i.Int64() <= -(indefinite+1) {
+			n, valid = i.Int64(), true
+			if !exact {
+				f.raise(fpuPE)
+			}
+		}
+	}
+	if !valid && f.raise(fpuIE) != 0 {
+		return
+	}
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(n))
+	mem.write(b[:size/8])
+	if pop {
+		f.pop()
+	}
+}
+
+// Packed BCD has 18 digits, two per byte with the least significant first,
+// and the sign in the top bit of the tenth byte.
+func float80FromBCD(b []byte) Float80 {
+	var n int64
+	for i := 8; i >= 0; i-- {
+		n = n*100 + int64(b[i]>>4)*10 + int64(b[i]&0xF)
+	}
+	v := float80FromInt(n)
+	return v.withSign(b[9]&0x80 != 0)
+}
+
+func (f *FPU) storeBCD(mem fpuMem) {
+	v, ok := f.get(0)
+	if !ok {
+		return
+	}
+	b := make([]byte, 10)
+	var n *big.Int
+	if !v.IsNaN() && !v.IsInf() {
+		var exact bool
+		n, exact = roundInt(v.Big(), f.roundingMode())
+		if !exact {
+			f.raise(fpuPE)
+		}
+	}
+	if n == nil || new(big.Int).Abs(n).Cmp(big.NewInt(999999999999999999)) > 0 {
+		if f.raise(fpuIE) != 0 {
+			return
+		}
+		// BCD indefinite
+		b[7], b[8], b[9] = 0xC0, 0xFF, 0xFF
+	} else {
+		u := new(big.Int).Abs(n).Uint64()
+		for i := 0; i < 9; i++ {
+			b[i] = byte(u%10) | byte(u/10%10)<<4
+			u /= 100
+		}
+		if v.Sign() {
+			b[9] = 0x80
+		}
+	}
+	mem.write(b)
+	f.pop()
+}
+
+// The 14 byte real mode environment.
+func (f *FPU) storeEnv(mem fpuMem) {
+	mem.write16(0, f.Control)
+	mem.write16(2, f.Status)
+	mem.write16(4, f.Tag)
+	mem.write16(6, uint16(f.instAddr))
+	mem.write16(8, uint16(f.instAddr>>16)<<12|f.opcode&0x7FF)
+	mem.write16(10, uint16(f.operAddr))
+	mem.write16(12, uint16(f.operAddr>>16)<<12)
+}
+
+func (f *FPU) loadEnv(mem fpuMem) {
+	f.Control = mem.read16(0)
+	f.Status = mem.read16(2)
+	f.Tag = mem.read16(4)
+	f.instAddr = uint32(mem.read16(6)) | uint32(mem.read16(8)>>12)<<16
+	f.opcode = mem.read16(8) & 0x7FF
+	f.operAddr = uint32(mem.read16(10)) | uint32(mem.read16(12)>>12)<<16
+}
+
+// Control instructions don't change the saved instruction and operand
+// pointers.
+func isFpuControl(esc uint8, m *ModRM) bool {
+	switch esc {
+	case 1:
+		return m.Mod != 3 && m.Reg >= 4
+	case 3:
+		return m.Mod == 3 && m.Reg == 4
+	case 5:
+		return m.Mod != 3 && m.Reg >= 4
+	}
+	return false
+}
+
+// Memory operand of an FPU instruction, offsets wrap within the segment.
+type fpuMem struct {
+	mem *Memory
+	seg uint
+	off uint
+}
+
+func (m fpuMem) at(n int) fpuMem {
+	return fpuMem{m.mem, m.seg, (m.off + uint(n)) & 0xFFFF}
+}
+
+func (m fpuMem) read(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = m.mem.GetMem8(m.seg, (m.off+uint(i))&0xFFFF)
+	}
+	return b
+}
+
+func (m fpuMem) write(b []byte) {
+	for i, v := range b {
+		m.mem.SetMem8(m.seg, (m.off+uint(i))&0xFFFF, v)
+	}
+}
+
+func (m fpuMem) read16(n int) uint16 {
+	return binary.LittleEndian.Uint16(m.at(n).read(2))
+}
+
+func (m fpuMem) write16(n int, v uint16) {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, v)
+	m.at(n).write(b)
+}
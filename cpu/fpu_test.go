@@ -0,0 +1,229 @@
+package go86
+
+import (
+	"encoding/binary"
+	"math"
+	"strings"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// Runs the instructions, one per string, and returns the CPU.
+func runFPUCode(t *testing.T, setup func(*CPU), code ...string) *CPU {
+	cpu := SetupCPU(t, strings.Join(code, ""))
+	if setup != nil {
+		setup(cpu)
+	}
+	for range code {
+		assert.NilError(t, cpu.RunOnce())
+	}
+	return cpu
+}
+
+func setMem64(cpu *CPU, off uint, v uint64) {
+	binary.LittleEndian.PutUint64(cpu.Mem.At(DEFAULT_DS, off), v)
+}
+
+func getMem64(cpu *CPU, off uint) uint64 {
+	return binary.LittleEndian.Uint64(cpu.Mem.At(DEFAULT_DS, off))
+}
+
+func TestFPUDetect(t *testing.T) {
+	code := []string{
+		"DBE3",     // FNINIT
+		"D93E0000", // FNSTCW [0000]
+	}
+	preset := func(cpu *CPU) { cpu.Mem.SetMem16(DEFAULT_DS, 0, 0x5A5A) }
+
+	cpu := runFPUCode(t, preset, code...)
+	assert.Equal(t, cpu.Mem.GetMem16(DEFAULT_DS, 0), uint16(0x03FF))
+
+	cpu = runFPUCode(t, func(c *CPU) { preset(c); c.FPU = nil }, code...)
+	assert.Equal(t, cpu.Mem.GetMem16(DEFAULT_DS, 0), uint16(0x5A5A))
+	assert.Equal(t, cpu.Ip, uint16(6))
+}
+
+func TestFPUAdd(t *testing.T) {
+	cpu := runFPUCode(t, nil,
+		"D9E8",     // FLD1
+		"D9E8",     // FLD1
+		"DEC1",     // FADDP ST(1),ST
+		"DD1E0000", // FSTP QWORD [0000]
+	)
+	assert.Equal(t, math.Float64frombits(getMem64(cpu, 0)), 2.0)
+	assert.Equal(t, cpu.FPU.Tag, uint16(0xFFFF))
+}
+
+func TestFPUExtendedPrecision(t *testing.T) {
+	// 1 + 2^-60 needs more than a float64's mantissa.
+	cpu := runFPUCode(t, func(c *CPU) {
+		setMem64(c, 0x10, 1<<63)
+		c.Mem.SetMem16(DEFAULT_DS, 0x18, f80Bias-60)
+	},
+		"D9E8",     // FLD1
+		"DB2E1000", // FLD TWORD [0010]
+		"DEC1",     // FADDP ST(1),ST
+		"DB3E2000", // FSTP TWORD [0020]
+	)
+	assert.Equal(t, getMem64(cpu, 0x20), uint64(0x8000000000000008))
+	assert.Equal(t, cpu.Mem.GetMem16(DEFAULT_DS, 0x28), uint16(f80Bias))
+}
+
+func TestFPUIntegerRounding(t *testing.T) {
+	tests := []struct {
+		descr   string
+		control uint16
+		want    uint16
+	}{
+		{"nearest even", 0x037F, 4},
+		{"down", 0x077F, 3},
+		{"up", 0x0B7F, 4},
+		{"chop", 0x0F7F, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.descr, func(t *testing.T) {
+			cpu := runFPUCode(t, func(c *CPU) {
+				c.Mem.SetMem16(DEFAULT_DS, 0, 7)
+				c.Mem.SetMem16(DEFAULT_DS, 2, 2)
+				c.Mem.SetMem16(DEFAULT_DS, 6, test.control)
+			},
+				"D92E0600", // FLDCW [0006]
+				"DF060000", // FILD WORD [0000]
+				"DF060200", // FILD WORD [0002]
+				"DEF9",     // FDIVP ST(1),ST
+				"DF1E0400", // FISTP WORD [0004]
+			)
+			assert.Equal(t, cpu.Mem.GetMem16(DEFAULT_DS, 4), test.want)
+			assert.Equal(t, cpu.FPU.Status&fpuPE, uint16(fpuPE))
+		})
+	}
+}
+
+func TestFPUCompare(t *testing.T) {
+	cpu := runFPUCode(t, nil,
+		"D9E8",     // FLD1
+		"D9EE",     // FLDZ
+		"DED9",     // FCOMPP
+		"DD3E0000", // FSTSW [0000]
+	)
+	assert.Equal(t, cpu.Mem.GetMem16(DEFAULT_DS, 0)&fpuCC, uint16(fpuC0))
+	assert.Equal(t, cpu.FPU.top(), 0)
+}
+
+func TestFPUMaskedExceptions(t *testing.T) {
+	cpu := runFPUCode(t, nil,
+		"D9E8",     // FLD1
+		"D9EE",     // FLDZ
+		"DEF9",     // FDIVP ST(1),ST
+		"D8C1",     // FADD ST,ST(1) with ST(1) empty
+		"DD3E0000", // FSTSW [0000]
+	)
+	assert.Equal(t, cpu.FPU.Status&fpuExceptions, uint16(fpuZE|fpuIE))
+	assert.Equal(t, cpu.FPU.ST(0), f80Indefinite)
+	assert.Assert(t, !cpu.nmiPending)
+}
+
+func TestFPUExceptionNMI(t *testing.T) {
+	cpu := runFPUCode(t, func(c *CPU) {
+		// Zero divide unmasked
+		c.Mem.SetMem16(DEFAULT_DS, 0, 0x037B)
+	},
+		"D92E0000", // FLDCW [0000]
+		"D9E8",     // FLD1
+		"D9EE",     // FLDZ
+		"DEF9",     // FDIVP ST(1),ST
+	)
+	// The result isn't stored
+	assert.Equal(t, cpu.FPU.ST(0), Float80{})
+	assert.Equal(t, cpu.FPU.ST(1), f80One)
+	assert.Equal(t, cpu.FPU.Status&(fpuZE|fpuIR), uint16(fpuZE|fpuIR))
+	assert.Assert(t, cpu.nmiPending)
+
+	// FDISI holds the interrupt off
+	cpu = runFPUCode(t, func(c *CPU) {
+		c.Mem.SetMem16(DEFAULT_DS, 0, 0x037B)
+	},
+		"D92E0000", // FLDCW [0000]
+		"DBE1",     // FDISI
+		"D9E8",     // FLD1
+		"D9EE",     // FLDZ
+		"DEF9",     // FDIVP ST(1),ST
+	)
+	assert.Assert(t, !cpu.nmiPending)
+}
+
+func TestFPUStoreSingle(t *testing.T) {
+	cpu := runFPUCode(t, func(c *CPU) {
+		setMem64(c, 0, math.Float64bits(0.1))
+	},
+		"DD060000", // FLD QWORD [0000]
+		"D91E1000", // FSTP DWORD [0010]
+	)
+	got := binary.LittleEndian.Uint32(cpu.Mem.At(DEFAULT_DS, 0x10))
+	assert.Equal(t, got, math.Float32bits(0.1))
+	assert.Equal(t, cpu.FPU.Status&fpuExceptions, uint16(fpuPE))
+}
+
+func TestFPUBCD(t *testing.T) {
+	bcd := []byte{0x78, 0x56, 0x34, 0x12, 0x90, 0x78, 0x56, 0x34, 0x12, 0x80}
+	cpu := runFPUCode(t, func(c *CPU) {
+		copy(c.Mem.At(DEFAULT_DS, 0), bcd)
+	},
+		"DF260000", // FBLD [0000]
+		"DF361000", // FBSTP [0010]
+	)
+	assert.DeepEqual(t, cpu.Mem.At(DEFAULT_DS, 0x10)[:10], bcd)
+}
+
+func TestFPUConstants(t *testing.T) {
+	cpu := runFPUCode(t, nil,
+		"D9EB",     // FLDPI
+		"DD1E0000", // FSTP QWORD [0000]
+		"D9E8",     // FLD1
+		"D9E8",     // FLD1
+		"DEC1",     // FADDP ST(1),ST
+		"D9FA",     // FSQRT
+		"DD1E0800", // FSTP QWORD [0008]
+	)
+	assert.Equal(t, math.Float64frombits(getMem64(cpu, 0)), math.Pi)
+	assert.Equal(t, math.Float64frombits(getMem64(cpu, 8)), math.Sqrt2)
+}
+
+func TestFPUPartialRemainder(t *testing.T) {
+	cpu := runFPUCode(t, func(c *CPU) {
+		c.Mem.SetMem16(DEFAULT_DS, 0, 3)
+		c.Mem.SetMem16(DEFAULT_DS, 2, 10)
+	},
+		"DF060000", // FILD WORD [0000]
+		"DF060200", // FILD WORD [0002]
+		"D9F8",     // FPREM
+		"DF1E0400", // FISTP WORD [0004]
+	)
+	assert.Equal(t, cpu.Mem.GetMem16(DEFAULT_DS, 4), uint16(1))
+	// Quotient of 3
+	assert.Equal(t, cpu.FPU.Status&fpuCC, uint16(fpuC3|fpuC1))
+}
+
+func TestFPUSaveRestore(t *testing.T) {
+	cpu := runFPUCode(t, nil,
+		"D9EB",     // FLDPI
+		"DD361000", // FSAVE [0010]
+		"D9E8",     // FLD1
+		"DD261000", // FRSTOR [0010]
+	)
+	assert.Equal(t, cpu.FPU.ST(0), fpuConstants[3])
+	assert.Equal(t, cpu.FPU.top(), 7)
+	// Instruction pointer and opcode of the FLDPI
+	assert.Equal(t, cpu.Mem.GetMem16(DEFAULT_DS, 0x10+6), uint16(DEFAULT_CS*0x10))
+	assert.Equal(t, cpu.Mem.GetMem16(DEFAULT_DS, 0x10+8), uint16(0x1EB))
+}
+
+func TestFloat80FromBits(t *testing.T) {
+	for _, v := range []float64{1, -2.5, 0.1, math.MaxFloat64, 5e-324, math.Inf(-1)} {
+		f := float80FromBits(math.Float64bits(v), 52, 11)
+		assert.Equal(t, f.Float64(), v)
+	}
+	assert.Assert(t, float80FromBits(math.Float64bits(math.NaN()), 52, 11).IsNaN())
+	assert.Equal(t, float80FromBits(uint64(math.Float32bits(float32(math.Copysign(0, -1)))), 23, 8), f80Zero(true))
+}
@@ -0,0 +1,96 @@
+package go86
+
+// Access is a kind of memory access a hook can watch for.
+type Access uint8
+
+const (
+	AccessRead Access = 1 << iota
+	AccessWrite
+	// Instruction bytes as the CPU runs them
+	AccessFetch
+
+	AccessAll = AccessRead | AccessWrite | AccessFetch
+)
+
+func (a Access) String() string {
+	s := ""
+	for _, k := range []struct {
+		a    Access
+		name string
+	}{{AccessRead, "r"}, {AccessWrite, "w"}, {AccessFetch, "x"}} {
+		if a&k.a != 0 {
+			s += k.name
+		}
+	}
+	return s
+}
+
+// MemHook is called with the physical address, the kind of access and the
+// byte read, written or fetched.  Reads and fetches have already happened
+// and writes have already landed.
+type MemHook func(addr uint, access Access, val uint8)
+
+type memHook struct {
+	id         int
+	start, end uint
+	access     Access
+	fn         MemHook
+}
+
+// AddHook calls fn for the kinds of access in access to the physical
+// addresses [start, end), returning an id for RemoveHook.  Hooks see what
+// the CPU does through GetMem8, SetMem8 and the like, and Copy.  Bulk
+// access with At and debugger reads with AbsMem8 aren't seen.
+func (m *Memory) AddHook(start, end uint, access Access, fn MemHook) int {
+	m.nextHookId++
+	m.hooks = append(m.hooks, memHook{m.nextHookId, start, end, access, fn})
+	m.mapHooks()
+	return m.nextHookId
+}
+
+// RemoveHook removes the hook AddHook returned id for.
+func (m *Memory) RemoveHook(id int) bool {
+	for i, h := range m.hooks {
+		if h.id == id {
+			m.hooks = append(m.hooks[:i], m.hooks[i+1:]...)
+			m.mapHooks()
+			return true
+		}
+	}
+	return false
+}
+
+// Works out which pages have hooks for which kinds of access.  With no
+// hooks hookPages is nil, and checking it is all memory accesses cost.
+func (m *Memory) mapHooks() {
+	if len(m.hooks) == 0 {
+		m.hookPages = nil
+		return
+	}
+	m.hookPages = make([]Access, (a20OpenMask>>regionPageShift)+1)
+	for _, h := range m.hooks {
+		for page := h.start >> regionPageShift; page<<regionPageShift < h.end && page < uint(len(m.hookPages)); page++ {
+			m.hookPages[page] |= h.access
+		}
+	}
+}
+
+// Calls the hooks watching access at pos.
+func (m *Memory) runHooks(pos uint, access Access, val uint8) {
+	if m.hookPages[pos>>regionPageShift]&access == 0 {
+		return
+	}
+	for _, h := range m.hooks {
+		if h.access&access != 0 && pos >= h.start && pos < h.end {
+			h.fn(pos, access, val)
+		}
+	}
+}
+
+// Tells the fetch hooks about the n bytes of an instruction at seg:off.
+func (m *Memory) fetched(seg uint, off uint, n int) {
+	for i := 0; i < n; i++ {
+		pos := m.Addr(seg, off+uint(i))
+		m.runHooks(pos, AccessFetch, m.read8(pos))
+	}
+}
@@ -1,7 +1,8 @@
 package go86
 
 import (
-	"fmt"
+	"errors"
+	"strings"
 )
 
 // CpuInstructionReader is an interface for reading CPU instructions.
@@ -10,6 +11,8 @@ type CpuInstructionReader interface {
 	Fetch16() (uint16, error)
 }
 
+// Inst is a fully decoded instruction.  Once Decode returns it nothing
+// changes it, so it can be shared and cached.
 type Inst struct {
 	OpCode             uint8
 	Lock               bool
@@ -17,125 +20,188 @@ type Inst struct {
 	Rep                bool
 	HasSegmentOverride bool
 	SegmentOverride    SReg
-	Len                int
+	// Length in bytes including prefixes.
+	Len int
+	// Number of prefix bytes before the opcode.
+	Prefixes int
 
-	// Current ModRM byte (if exists)
+	// Mnemonic, with the groups resolved using the ModRM reg field.
+	Name string
+	// Operands as in the OpcodeTable
+	Args []Operand
+
+	// ModRM byte and displacement, nil if the opcode doesn't have one.
 	ModRM *ModRM
 
-	// Current Imm8 that didn't come from ModRM
-	Imm8 *uint
-	// Current Imm16 that didn't come from ModRM
-	Imm16 *uint
-	// Actual reader
-	reader CpuInstructionReader
+	// Immediates in the order they appear.  Only far pointers (offset and
+	// then segment) and ENTER have a second one.  Relative jumps and
+	// sign-extended bytes are not extended.
+	Imm  uint
+	Imm2 uint
 }
 
-func ImmValue(val uint) *uint {
-	result := val
-	return &result
+var errTruncated = errors.New("instruction truncated")
+
+// Reads instruction bytes from a slice.
+type byteReader struct {
+	src []byte
+	pos int
 }
 
-func (inst *Inst) FetchModRM() error {
-	if inst.ModRM != nil {
-		// Initially panic here to clean it up and then just guard against it
-		// once we're sure it's safe or to make the api easier
-		// to use
-		panic("modrm already parsed")
+func (r *byteReader) Fetch8() (uint8, error) {
+	if r.pos >= len(r.src) {
+		return 0, errTruncated
 	}
-	b, err := inst.Fetch8()
+	b := r.src[r.pos]
+	r.pos++
+	return b, nil
+}
+
+func (r *byteReader) Fetch16() (uint16, error) {
+	lo, err := r.Fetch8()
 	if err != nil {
-		return err
+		return 0, err
 	}
+	hi, err := r.Fetch8()
+	return uint16(hi)<<8 | uint16(lo), err
+}
 
-	if inst.ModRM, err = NewModRM(inst, b); err != nil {
-		return err
-	}
-	return nil
+// How to decode each opcode, built from OpcodeTable.
+type opcodeDesc struct {
+	name  string
+	args  []Operand
+	modrm bool
 }
 
-func (inst *Inst) Fetch8() (uint8, error) {
-	inst.Len += 1
-	return inst.reader.Fetch8()
+var decodeTable = func() (table [256]opcodeDesc) {
+	for i, info := range OpcodeTable {
+		table[i] = parseOpcodeName(info.Name)
+	}
+	return table
+}()
+
+// The 8086 runs 0F as POP CS.
+var popCSDesc = opcodeDesc{name: "POP", args: []Operand{SegCS}}
+
+func parseOpcodeName(s string) opcodeDesc {
+	fields := strings.Fields(s)
+	d := opcodeDesc{name: fields[0]}
+	for _, code := range fields[1:] {
+		op := operandForCode(code)
+		d.args = append(d.args, op)
+		d.modrm = d.modrm || op.HasModRM()
+	}
+	return d
 }
 
-func (inst *Inst) Fetch16() (uint16, error) {
-	inst.Len += 2
-	return inst.reader.Fetch16()
+// Mnemonics for the opcodes which use the ModRM reg field as an extension.
+var groupNames = map[string][8]string{
+	"GRP1":  {"ADD", "OR", "ADC", "SBB", "AND", "SUB", "XOR", "CMP"},
+	"GRP2":  {"ROL", "ROR", "RCL", "RCR", "SHL", "SHR", "SHL", "SAR"},
+	"GRP3a": {"TEST", "TEST", "NOT", "NEG", "MUL", "IMUL", "DIV", "IDIV"},
+	"GRP3b": {"TEST", "TEST", "NOT", "NEG", "MUL", "IMUL", "DIV", "IDIV"},
+	"GRP4":  {"INC", "DEC", "--", "--", "--", "--", "--", "--"},
+	"GRP5":  {"INC", "DEC", "CALL", "CALL", "JMP", "JMP", "PUSH", "--"},
 }
 
-func (inst *Inst) GetImm16(cpu *CPU) (uint, error) {
-	if inst.Imm16 == nil {
-		imm16, err := inst.Fetch16()
-		if err != nil {
-			return 0, err
-		}
-		inst.Imm16 = ImmValue(uint(imm16))
-	}
-	return *inst.Imm16, nil
+// Decode decodes the leading bytes in src as a single instruction for the
+// 80186.
+func Decode(src []byte) (*Inst, error) {
+	return Model80186.Decode(src)
 }
 
-func (inst *Inst) GetImm8(cpu *CPU) (uint, error) {
-	if inst.Imm8 == nil {
-		imm8, err := inst.Fetch8()
+// Decode decodes the leading bytes in src as a single instruction for the
+// model, which decides what some opcodes mean.  src is only read.
+func (m Model) Decode(src []byte) (*Inst, error) {
+	inst := &Inst{}
+	r := &byteReader{src: src}
+	var op uint8
+prefixes:
+	for {
+		b, err := r.Fetch8()
 		if err != nil {
-			return 0, err
+			return nil, err
 		}
-		inst.Imm8 = ImmValue(uint(imm8))
-	}
-	return *inst.Imm8, nil
-}
-
-// Decode decodes the leading bytes in src as a single instruction.
-// The mode arguments specifies the assumed processor mode:
-func Decode(src []byte, reader CpuInstructionReader) (*Inst, error) {
-	inst := &Inst{
-		reader: reader,
-	}
-	for i, b := range src {
 		switch b {
 		// Prefix group 1
 		case 0xF0:
 			inst.Lock = true
-			inst.Len++
 		case 0xF2:
+			// The last repeat prefix wins.
 			inst.RepNe = true
-			inst.Len++
+			inst.Rep = false
 		case 0xF3:
 			inst.Rep = true
-			inst.Len++
+			inst.RepNe = false
 
 		// Prefix group 2
 		case 0x2E: // CS segment override
 			inst.HasSegmentOverride = true
 			inst.SegmentOverride = CS
-			inst.Len++
 		case 0x36: // SS segment override
 			inst.HasSegmentOverride = true
 			inst.SegmentOverride = SS
-			inst.Len++
 		case 0x3E: // DS segment override
 			inst.HasSegmentOverride = true
 			inst.SegmentOverride = DS
-			inst.Len++
 		case 0x26: // ES segment override
 			inst.HasSegmentOverride = true
 			inst.SegmentOverride = ES
-			inst.Len++
-			/*
-				Skip till 386 support
-				case 0x0F: // Multi byte opcodes
-				case 0x64: // FS segment override
-					inst.SegmentOverride = FS
-				case 0x65: // GS segment override
-					inst.SegmentOverride = GS
-				case 0x2E: // Branch not taken
-				case 0x3E: // Branch taken
-			*/
 		default:
-			inst.Len++
-			inst.OpCode = src[i]
-			return inst, nil
+			op = b
+			break prefixes
+		}
+	}
+	inst.Prefixes = r.pos - 1
+	inst.OpCode = m.aliasOpcode(op)
+
+	desc := &decodeTable[inst.OpCode]
+	if inst.OpCode == 0x0F && !m.Has186() {
+		desc = &popCSDesc
+	}
+	inst.Name = desc.name
+	inst.Args = desc.args
+
+	if desc.modrm {
+		b, err := r.Fetch8()
+		if err != nil {
+			return nil, err
+		}
+		if inst.ModRM, err = NewModRM(r, b); err != nil {
+			return nil, err
+		}
+		if names, ok := groupNames[inst.Name]; ok {
+			inst.Name = names[inst.ModRM.Reg]
+			if (inst.OpCode == 0xF6 || inst.OpCode == 0xF7) && inst.ModRM.Reg < 2 {
+				// TEST has an immediate the rest of group 3 doesn't
+				imm := Ib
+				if inst.OpCode == 0xF7 {
+					imm = Iv
+				}
+				inst.Args = []Operand{inst.Args[0], imm}
+			}
+		}
+	}
+
+	imms := []*uint{&inst.Imm, &inst.Imm2}
+	for _, arg := range inst.Args {
+		for n := arg.imm; n > 0; n -= 2 {
+			var v uint16
+			var err error
+			if n == 1 {
+				var b uint8
+				b, err = r.Fetch8()
+				v = uint16(b)
+			} else {
+				v, err = r.Fetch16()
+			}
+			if err != nil {
+				return nil, err
+			}
+			*imms[0] = uint(v)
+			imms = imms[1:]
 		}
 	}
-	return inst, fmt.Errorf("unable to decode instructions")
+	inst.Len = r.pos
+	return inst, nil
 }
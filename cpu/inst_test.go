@@ -0,0 +1,99 @@
+package go86
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		descr string
+		bytes string
+		name  string
+		len   int
+		imm   uint
+		imm2  uint
+		args  []Operand
+	}{
+		{"ADD Eb Gb", "00D8", "ADD", 2, 0, 0, []Operand{Eb, Gb}},
+		{"ADD AX Iv", "053412", "ADD", 3, 0x1234, 0, []Operand{RegAX, Iv}},
+		{"MOV AX,[BX+disp16]", "8B873412", "MOV", 4, 0, 0, []Operand{Gv, Ev}},
+		{"MOV [disp16],imm16", "C70634127856", "MOV", 6, 0x5678, 0, []Operand{Ev, Iv}},
+		{"GRP1 sign extended", "83C0FF", "ADD", 3, 0xFF, 0, []Operand{Ev, Ib}},
+		{"GRP1 CMP", "807F0105", "CMP", 4, 5, 0, []Operand{Eb, Ib}},
+		{"TEST Eb Ib", "F6C001", "TEST", 3, 1, 0, []Operand{Eb, Ib}},
+		{"TEST Ev Iv", "F7C03412", "TEST", 4, 0x1234, 0, []Operand{Ev, Iv}},
+		{"NOT has no immediate", "F7D0", "NOT", 2, 0, 0, []Operand{Ev}},
+		{"JMP far", "EA34127856", "JMP", 5, 0x1234, 0x5678, []Operand{Ap}},
+		{"ENTER", "C8100002", "ENTER", 4, 0x10, 2, []Operand{Iw, Ib}},
+		{"MOV AL,[moffs]", "A03412", "MOV", 3, 0x1234, 0, []Operand{RegAL, Ob}},
+		{"MOV [moffs],AX", "A33412", "MOV", 3, 0x1234, 0, []Operand{Ov, RegAX}},
+		{"JZ", "74FE", "JZ", 2, 0xFE, 0, []Operand{Jb}},
+		{"CALL rel16", "E80010", "CALL", 3, 0x1000, 0, []Operand{Jv}},
+		{"CALL far indirect", "FF1E3412", "CALL", 4, 0, 0, []Operand{Ev}},
+		{"SHL Ev,imm8", "C1E003", "SHL", 3, 3, 0, []Operand{Ev, Ib}},
+		{"IMUL Gv Ev Ib", "6BC305", "IMUL", 3, 5, 0, []Operand{Gv, Ev, Ib}},
+		{"IN AL,DX", "EC", "IN", 1, 0, 0, []Operand{RegAL, RegDX}},
+		{"AAM", "D40A", "AAM", 2, 10, 0, []Operand{I0}},
+		{"ESC", "DD1E0000", "ESC", 4, 0, 0, []Operand{M}},
+		{"prefixes", "F32EA5", "MOVSW", 3, 0, 0, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.descr, func(t *testing.T) {
+			src, err := hex.DecodeString(test.bytes)
+			assert.NilError(t, err)
+			// Trailing bytes aren't part of the instruction.
+			inst, err := Decode(append(src, 0x90, 0x90))
+			assert.NilError(t, err)
+			assert.Equal(t, inst.Name, test.name)
+			assert.Equal(t, inst.Len, test.len)
+			assert.Equal(t, inst.Imm, test.imm)
+			assert.Equal(t, inst.Imm2, test.imm2)
+			assert.Equal(t, len(inst.Args), len(test.args))
+			for i, arg := range test.args {
+				assert.Equal(t, inst.Args[i], arg)
+			}
+		})
+	}
+}
+
+func TestDecodeModRM(t *testing.T) {
+	// MOV AX,ES:[BP+DI-2]
+	inst, err := Decode([]byte{0x26, 0x8B, 0x43, 0xFE})
+	assert.NilError(t, err)
+	assert.Equal(t, inst.Prefixes, 1)
+	assert.Equal(t, inst.OpCode, uint8(0x8B))
+	assert.Assert(t, inst.HasSegmentOverride)
+	assert.Equal(t, inst.SegmentOverride, ES)
+	assert.Equal(t, inst.ModRM.Mod, uint8(1))
+	assert.Equal(t, inst.ModRM.Rm, uint8(3))
+	assert.Equal(t, inst.ModRM.Disp8, int8(-2))
+}
+
+func TestDecodeModel(t *testing.T) {
+	// PUSHA on the 80186, JO on the 8086
+	inst, err := Model8086.Decode([]byte{0x60, 0x02})
+	assert.NilError(t, err)
+	assert.Equal(t, inst.OpCode, uint8(0x70))
+	assert.Equal(t, inst.Name, "JO")
+	assert.Equal(t, inst.Len, 2)
+
+	inst, err = Model80186.Decode([]byte{0x60, 0x02})
+	assert.NilError(t, err)
+	assert.Equal(t, inst.Name, "PUSHA")
+	assert.Equal(t, inst.Len, 1)
+
+	inst, err = Model8086.Decode([]byte{0x0F})
+	assert.NilError(t, err)
+	assert.Equal(t, inst.Name, "POP")
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	for _, src := range []string{"", "F3", "8B", "8B87", "8B8734", "B834", "EA341278"} {
+		b, _ := hex.DecodeString(src)
+		_, err := Decode(b)
+		assert.ErrorIs(t, err, errTruncated, src)
+	}
+}
@@ -0,0 +1,140 @@
+package go86
+
+import (
+	log "github.com/golang/glog"
+)
+
+// InterruptController is the source of hardware (maskable) interrupts
+// delivered to the CPU, normally an 8259 PIC.
+type InterruptController interface {
+	// Pending returns true when an interrupt request is waiting to be
+	// acknowledged by the CPU.
+	Pending() bool
+	// Acknowledge accepts the highest priority interrupt request and
+	// returns the interrupt vector to call.
+	Acknowledge() int
+}
+
+// Interrupt calls interrupt vector intrno as if an INT instruction had been
+// executed at the current CS:IP.
+func (cpu *CPU) Interrupt(intrno int) error {
+	return cpu.int(intrno)
+}
+
+// IntrEntry is where the entry point for the handler in Intrs for intrno
+// is, an INT and an IRET for its vector to point at.  Programs which hook
+// the vector chain to the entry point to reach the Go handler.
+func (cpu *CPU) IntrEntry(intrno int) (uint, uint) {
+	return cpu.intrSeg, cpu.intrBase + uint(intrno)*4
+}
+
+// InstallIntrs puts the entry points for the handlers in Intrs in the
+// memory at seg:base, 4 bytes for each interrupt, and points the vectors
+// which aren't set yet at them.
+func (cpu *CPU) InstallIntrs(seg, base uint) {
+	cpu.intrSeg, cpu.intrBase, cpu.intrsInstalled = seg, base, true
+	for intrno := range cpu.Intrs {
+		seg, off := cpu.IntrEntry(intrno)
+		cpu.Mem.Copy(seg, off, []byte{0xCD, uint8(intrno), 0xCF}) // INT intrno, IRET
+		vec := uint(intrno * 4)
+		if cpu.Mem.GetMem16(0, vec) == 0 && cpu.Mem.GetMem16(0, vec+2) == 0 {
+			cpu.Mem.SetMem16(0, vec, uint16(off))
+			cpu.Mem.SetMem16(0, vec+2, uint16(seg))
+		}
+	}
+}
+
+// Whether the vector for intrno still goes to the Go handler, it is not set
+// or points at the handler's entry point.
+func (cpu *CPU) intrVectorNative(intrno int) bool {
+	off := uint(cpu.Mem.GetMem16(0, uint(intrno*4)))
+	seg := uint(cpu.Mem.GetMem16(0, uint(intrno*4)+2))
+	if seg == 0 && off == 0 {
+		return true
+	}
+	entrySeg, entryOff := cpu.IntrEntry(intrno)
+	return cpu.intrsInstalled && seg == entrySeg && off == entryOff
+}
+
+// Whether the INT being executed is the one at the entry point for intrno.
+func (cpu *CPU) atIntrEntry(intrno int) bool {
+	seg, off := cpu.IntrEntry(intrno)
+	return cpu.intrsInstalled && cpu.Intrs[intrno] != nil && cpu.Regs.CS() == seg && uint(cpu.instIp) == off
+}
+
+// Calls the Go handler for a program which chained to its entry point.  The
+// IRET after it returns with the FLAGS the program's caller pushed, so the
+// handler's flags go there, all but IF and TF.
+func (cpu *CPU) callIntrEntry(intrno int) {
+	log.V(4).Infof("Call Internal Interrupt # 0x%X from its entry point", intrno)
+	cpu.Intrs[intrno](cpu, intrno)
+	if seg, off := cpu.IntrEntry(intrno); cpu.Regs.CS() != seg || uint(cpu.Ip) != off+2 {
+		// The handler went somewhere else, like a child process.
+		return
+	}
+	ss, sp := cpu.Regs.SS(), uint(cpu.Regs.GetReg16(SP))
+	keep := uint16(InterruptFlag | TrapFlag)
+	pushed := cpu.Mem.GetMem16(ss, (sp+4)&0xFFFF)
+	cpu.Mem.SetMem16(ss, (sp+4)&0xFFFF, pushed&keep|uint16(cpu.Flags.Value())&^keep)
+}
+
+// Transfers control to the handler for interrupt vector intrno.  Handlers
+// registered in Intrs are called directly while their vectors go to them,
+// otherwise FLAGS, CS and IP are pushed and CS:IP is loaded from the
+// interrupt vector table.
+func (cpu *CPU) interrupt(intrno int) {
+	if handler := cpu.Intrs[intrno]; handler != nil && cpu.intrVectorNative(intrno) {
+		log.V(4).Infof("Call Internal Interrupt # 0x%X", intrno)
+		handler(cpu, intrno)
+		return
+	}
+
+	// Call memory based x86 interrupt code
+	cpu.Regs.Push16(cpu.Mem, uint16(cpu.Flags.Value()))
+	cpu.Regs.PushSeg16(CS, cpu.Mem)
+	cpu.Regs.Push16(cpu.Mem, cpu.Ip)
+	cpu.Flags.ClearFlag(InterruptFlag | TrapFlag)
+
+	// Update CS:IP from interrupt table
+	cpu.Ip = cpu.Mem.GetMem16(0x0000, uint(intrno*4))
+	cs := cpu.Mem.GetMem16(0x0000, 2+uint(intrno*4))
+	cpu.Regs.SetSeg16(CS, uint(cs))
+}
+
+// NMI raises the non-maskable interrupt, INT 2 is taken before the next
+// instruction whatever IF is.
+func (cpu *CPU) NMI() {
+	cpu.nmiPending = true
+}
+
+// Is there a hardware interrupt which would be taken now.
+func (cpu *CPU) interruptPending() bool {
+	if cpu.nmiPending {
+		return true
+	}
+	return cpu.PIC != nil && cpu.Flags.IsEnabled(InterruptFlag) && cpu.PIC.Pending()
+}
+
+// Delivers a pending hardware interrupt between instructions.  Interrupts
+// are held off while IF is clear and for one instruction after the
+// instructions which set up an interrupt shadow (MOV SS, POP SS and STI).
+func (cpu *CPU) checkInterrupts() {
+	if cpu.intShadow {
+		cpu.intShadow = false
+		return
+	}
+	if !cpu.interruptPending() {
+		return
+	}
+	if cpu.nmiPending {
+		cpu.nmiPending = false
+		log.V(4).Infof("NMI at [%04X:%04X]", cpu.Regs.CS(), cpu.Ip)
+		cpu.Cycles += intrAckCycles
+		cpu.interrupt(2)
+		return
+	}
+	vector := cpu.PIC.Acknowledge()
+	log.V(4).Infof("Hardware Interrupt # 0x%X at [%04X:%04X]", vector, cpu.Regs.CS(), cpu.Ip)
+	cpu.Cycles += intrAckCycles
+	cpu.interrupt(vector)
+}
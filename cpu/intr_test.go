@@ -0,0 +1,168 @@
+package go86
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// Interrupt controller which always has vector 0x40 pending until acked.
+type fakePIC struct {
+	pending bool
+	acked   int
+}
+
+func (p *fakePIC) Pending() bool {
+	return p.pending
+}
+
+func (p *fakePIC) Acknowledge() int {
+	p.pending = false
+	p.acked++
+	return 0x40
+}
+
+func setupIntrCPU(t *testing.T, opcodes string) (*CPU, *fakePIC) {
+	cpu := SetupCPU(t, opcodes)
+	pic := &fakePIC{}
+	cpu.PIC = pic
+	cpu.Flags.SetFlags(InterruptFlag)
+	cpu.Mem.SetMem16(0, 0x40*4, 0x1234)
+	cpu.Mem.SetMem16(0, 0x40*4+2, 0x3000)
+	return cpu, pic
+}
+
+func TestIntrDelivery(t *testing.T) {
+	cpu, pic := setupIntrCPU(t, "90")
+	cpu.Flags.SetFlags(TrapFlag)
+	pic.pending = true
+	assert.NilError(t, cpu.RunOnce())
+	assert.Equal(t, pic.acked, 1)
+	assert.Equal(t, cpu.Regs.CS(), uint(0x3000))
+	assert.Assert(t, !cpu.Flags.IsEnabled(InterruptFlag))
+	assert.Assert(t, !cpu.Flags.IsEnabled(TrapFlag))
+	// Pushed IP, CS, Flags
+	assert.Equal(t, cpu.Regs.Pop16(cpu.Mem), uint16(0))
+	assert.Equal(t, cpu.Regs.Pop16(cpu.Mem), uint16(DEFAULT_CS))
+	assert.Assert(t, cpu.Regs.Pop16(cpu.Mem)&uint16(InterruptFlag) != 0)
+}
+
+func TestIntrMaskedByIF(t *testing.T) {
+	cpu, pic := setupIntrCPU(t, "90")
+	cpu.Flags.ClearFlag(InterruptFlag)
+	pic.pending = true
+	assert.NilError(t, cpu.RunOnce())
+	assert.Equal(t, pic.acked, 0)
+	assert.Equal(t, cpu.Ip, uint16(1))
+}
+
+func TestIntrShadow(t *testing.T) {
+	tests := []struct {
+		descr   string
+		opcodes string
+	}{
+		{"POP/SS", "179090"},
+		{"MOV/SS", "8ED09090"},
+		{"STI", "FB9090"},
+	}
+	for _, test := range tests {
+		t.Run(test.descr, func(t *testing.T) {
+			cpu, pic := setupIntrCPU(t, test.opcodes)
+			assert.NilError(t, cpu.RunOnce())
+			pic.pending = true
+			shadowed := cpu.Ip
+			assert.NilError(t, cpu.RunOnce())
+			assert.Equal(t, pic.acked, 0)
+			assert.Equal(t, cpu.Ip, shadowed+1)
+			assert.NilError(t, cpu.RunOnce())
+			assert.Equal(t, pic.acked, 1)
+		})
+	}
+}
+
+func TestIntrSoftwareClearsIF(t *testing.T) {
+	cpu, _ := setupIntrCPU(t, "CD40")
+	assert.NilError(t, cpu.RunOnce())
+	assert.Equal(t, cpu.Ip, uint16(0x1234))
+	assert.Equal(t, cpu.Regs.CS(), uint(0x3000))
+	assert.Assert(t, !cpu.Flags.IsEnabled(InterruptFlag))
+}
+
+func TestIntrRestartsRep(t *testing.T) {
+	// ES: REP MOVSB
+	cpu, pic := setupIntrCPU(t, "26F3A4")
+	// Handler is just an IRET.
+	cpu.Mem.SetMem8(0x3000, 0x1234, 0xCF)
+	cpu.Regs.SetReg16(CX, 4)
+	cpu.Regs.SetReg16(DI, 0x10)
+	cpu.Mem.SetMem16(DEFAULT_ES, 0, 0x2211)
+	cpu.Mem.SetMem16(DEFAULT_ES, 2, 0x4433)
+	pic.pending = true
+	// Like following an STI so the first iteration runs.
+	cpu.intShadow = true
+
+	assert.NilError(t, cpu.RunOnce())
+	assert.Equal(t, cpu.Regs.CX(), uint(3))
+	assert.Equal(t, cpu.Ip, uint16(0))
+
+	// Interrupt, IRET back to the prefix and then finish the copy.
+	assert.NilError(t, cpu.RunOnce())
+	assert.Equal(t, pic.acked, 1)
+	assert.Equal(t, cpu.Ip, uint16(0))
+	assert.NilError(t, cpu.RunOnce())
+	assert.Equal(t, cpu.Regs.CX(), uint(0))
+	assert.Equal(t, cpu.Ip, uint16(3))
+	assert.Equal(t, cpu.Mem.GetMem16(DEFAULT_ES, 0x10), uint16(0x2211))
+	assert.Equal(t, cpu.Mem.GetMem16(DEFAULT_ES, 0x12), uint16(0x4433))
+}
+
+func TestIntrNMI(t *testing.T) {
+	cpu := SetupCPU(t, "90")
+	cpu.Mem.SetMem16(0, 2*4, 0x1234)
+	cpu.Mem.SetMem16(0, 2*4+2, 0x3000)
+	// Handler is a NOP
+	cpu.Mem.SetMem8(0x3000, 0x1234, 0x90)
+	cpu.NMI()
+	// IF is clear, NMI is taken anyway.
+	assert.NilError(t, cpu.RunOnce())
+	assert.Equal(t, cpu.Ip, uint16(0x1235))
+	assert.Equal(t, cpu.Regs.CS(), uint(0x3000))
+	assert.Assert(t, !cpu.nmiPending)
+}
+
+func TestIntrHooked(t *testing.T) {
+	cpu := SetupCPU(t, "CD50")
+	calls := 0
+	cpu.Intrs[0x50] = func(cpu *CPU, _ int) {
+		calls++
+		cpu.Flags.SetFlags(CarryFlag)
+	}
+	cpu.InstallIntrs(0x0070, 0x100)
+	seg, off := cpu.IntrEntry(0x50)
+	assert.Equal(t, seg, uint(0x0070))
+	assert.Equal(t, off, uint(0x240))
+	assert.Equal(t, cpu.Mem.GetMem16(0, 0x50*4), uint16(0x240))
+	assert.Equal(t, cpu.Mem.GetMem16(0, 0x50*4+2), uint16(0x0070))
+	assert.NilError(t, cpu.RunOnce())
+	assert.Equal(t, calls, 1)
+	assert.Equal(t, cpu.Ip, uint16(2))
+
+	// Hooked by a JMP FAR to the entry point
+	cpu.Mem.Copy(0x3000, 0, []byte{0xEA, 0x40, 0x02, 0x70, 0x00})
+	cpu.Mem.SetMem16(0, 0x50*4, 0)
+	cpu.Mem.SetMem16(0, 0x50*4+2, 0x3000)
+	cpu.Ip = 0
+	cpu.Flags.ClearFlag(CarryFlag)
+	cpu.Flags.SetFlags(InterruptFlag)
+	assert.NilError(t, cpu.RunOnce())
+	assert.Equal(t, cpu.Regs.CS(), uint(0x3000))
+	assert.Equal(t, calls, 1)
+	for i := 0; i < 3; i++ {
+		assert.NilError(t, cpu.RunOnce())
+	}
+	assert.Equal(t, calls, 2)
+	assert.Equal(t, cpu.Regs.CS(), uint(DEFAULT_CS))
+	assert.Equal(t, cpu.Ip, uint16(2))
+	assert.Assert(t, cpu.Flags.IsEnabled(CarryFlag))
+	assert.Assert(t, cpu.Flags.IsEnabled(InterruptFlag))
+}
@@ -0,0 +1,150 @@
+package go86
+
+import (
+	"fmt"
+
+	log "github.com/golang/glog"
+)
+
+// PortHandler services I/O port accesses for a device.  Any of the functions
+// may be nil.  When In16 or Out16 is nil a 16-bit access is split into two
+// 8-bit accesses on consecutive ports, low byte first, like the 8-bit bus on
+// the 8088 does.
+type PortHandler struct {
+	In8   func(port uint16) uint8
+	Out8  func(port uint16, val uint8)
+	In16  func(port uint16) uint16
+	Out16 func(port uint16, val uint16)
+}
+
+// A range of ports [Start, End] claimed by a device.
+type portRange struct {
+	Start   uint16
+	End     uint16
+	Handler PortHandler
+}
+
+// Ports is the I/O bus of the CPU.  Devices register handlers for a range
+// of ports, unclaimed ports read back as 0xFF (like a floating ISA bus) and
+// writes to them are dropped.
+type Ports struct {
+	ranges []portRange
+}
+
+func NewPorts() *Ports {
+	return &Ports{}
+}
+
+// Register claims the ports [start, end] for handler.  It is an error to
+// claim a port which is already claimed by another device.
+func (p *Ports) Register(start, end uint16, handler PortHandler) error {
+	if end < start {
+		return fmt.Errorf("invalid port range: [0x%04X, 0x%04X]", start, end)
+	}
+	for _, r := range p.ranges {
+		if start <= r.End && r.Start <= end {
+			return fmt.Errorf("port range [0x%04X, 0x%04X] overlaps [0x%04X, 0x%04X]",
+				start, end, r.Start, r.End)
+		}
+	}
+	p.ranges = append(p.ranges, portRange{Start: start, End: end, Handler: handler})
+	return nil
+}
+
+// Unregister releases the range of ports starting at start.
+func (p *Ports) Unregister(start uint16) bool {
+	for i, r := range p.ranges {
+		if r.Start == start {
+			p.ranges = append(p.ranges[:i], p.ranges[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Ports) find(port uint16) *PortHandler {
+	for i := range p.ranges {
+		if port >= p.ranges[i].Start && port <= p.ranges[i].End {
+			return &p.ranges[i].Handler
+		}
+	}
+	return nil
+}
+
+// In8 reads a byte from port.
+func (p *Ports) In8(port uint16) uint8 {
+	h := p.find(port)
+	if h == nil || h.In8 == nil {
+		log.Warningf("IN from unclaimed port: 0x%04X", port)
+		return 0xFF
+	}
+	return h.In8(port)
+}
+
+// Out8 writes a byte to port.
+func (p *Ports) Out8(port uint16, val uint8) {
+	h := p.find(port)
+	if h == nil || h.Out8 == nil {
+		log.Warningf("OUT to unclaimed port: 0x%04X [0x%02X]", port, val)
+		return
+	}
+	h.Out8(port, val)
+}
+
+// In16 reads a word from port.
+func (p *Ports) In16(port uint16) uint16 {
+	if h := p.find(port); h != nil && h.In16 != nil {
+		return h.In16(port)
+	}
+	lo := p.In8(port)
+	hi := p.In8(port + 1)
+	return uint16(hi)<<8 | uint16(lo)
+}
+
+// Out16 writes a word to port.
+func (p *Ports) Out16(port uint16, val uint16) {
+	if h := p.find(port); h != nil && h.Out16 != nil {
+		h.Out16(port, val)
+		return
+	}
+	p.Out8(port, uint8(val))
+	p.Out8(port+1, uint8(val>>8))
+}
+
+// IN - Input from Port
+func (cpu *CPU) in(port uint16, bit int) error {
+	switch bit {
+	case 8:
+		cpu.Regs.SetReg8(AL, uint(cpu.Ports.In8(port)))
+	case 16:
+		cpu.Regs.SetReg16(AX, uint(cpu.Ports.In16(port)))
+	default:
+		return fmt.Errorf("unknown bits: %d", bit)
+	}
+	return nil
+}
+
+// OUT - Output to Port
+func (cpu *CPU) out(port uint16, bit int) error {
+	switch bit {
+	case 8:
+		cpu.Ports.Out8(port, uint8(cpu.Regs.GetReg8(AL)))
+	case 16:
+		cpu.Ports.Out16(port, uint16(cpu.Regs.GetReg16(AX)))
+	default:
+		return fmt.Errorf("unknown bits: %d", bit)
+	}
+	return nil
+}
+
+// inIb - IN AL/AX, imm8
+func (cpu *CPU) inIb(inst *Inst, bit int) error {
+	port := uint8(inst.Imm)
+	return cpu.in(uint16(port), bit)
+}
+
+// outIb - OUT imm8, AL/AX
+func (cpu *CPU) outIb(inst *Inst, bit int) error {
+	port := uint8(inst.Imm)
+	return cpu.out(uint16(port), bit)
+}
@@ -0,0 +1,148 @@
+package go86
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// A device with a single latch register per port.
+type latchDevice struct {
+	regs map[uint16]uint8
+}
+
+func newLatchDevice() *latchDevice {
+	return &latchDevice{regs: make(map[uint16]uint8)}
+}
+
+func (d *latchDevice) handler() PortHandler {
+	return PortHandler{
+		In8:  func(port uint16) uint8 { return d.regs[port] },
+		Out8: func(port uint16, val uint8) { d.regs[port] = val },
+	}
+}
+
+func TestPortsUnclaimed(t *testing.T) {
+	p := NewPorts()
+	assert.Equal(t, p.In8(0x60), uint8(0xFF))
+	assert.Equal(t, p.In16(0x60), uint16(0xFFFF))
+	// Must not panic
+	p.Out8(0x60, 0x12)
+	p.Out16(0x60, 0x1234)
+}
+
+func TestPortsRegisterOverlap(t *testing.T) {
+	p := NewPorts()
+	assert.NilError(t, p.Register(0x20, 0x21, PortHandler{}))
+	assert.Assert(t, p.Register(0x21, 0x22, PortHandler{}) != nil)
+	assert.Assert(t, p.Register(0x10, 0x30, PortHandler{}) != nil)
+	assert.Assert(t, p.Register(0x40, 0x3F, PortHandler{}) != nil)
+	assert.NilError(t, p.Register(0x22, 0x22, PortHandler{}))
+
+	assert.Assert(t, p.Unregister(0x20))
+	assert.Assert(t, !p.Unregister(0x20))
+	assert.NilError(t, p.Register(0x20, 0x21, PortHandler{}))
+}
+
+func TestPorts16SplitsInto8(t *testing.T) {
+	p := NewPorts()
+	d := newLatchDevice()
+	assert.NilError(t, p.Register(0x300, 0x301, d.handler()))
+
+	p.Out16(0x300, 0xBEEF)
+	assert.Equal(t, d.regs[0x300], uint8(0xEF))
+	assert.Equal(t, d.regs[0x301], uint8(0xBE))
+	assert.Equal(t, p.In16(0x300), uint16(0xBEEF))
+}
+
+func TestPorts16Handler(t *testing.T) {
+	p := NewPorts()
+	var got uint16
+	assert.NilError(t, p.Register(0x1F0, 0x1F0, PortHandler{
+		In16:  func(port uint16) uint16 { return 0xCAFE },
+		Out16: func(port uint16, val uint16) { got = val },
+	}))
+	p.Out16(0x1F0, 0x1234)
+	assert.Equal(t, got, uint16(0x1234))
+	assert.Equal(t, p.In16(0x1F0), uint16(0xCAFE))
+}
+
+func TestCPUPortIO(t *testing.T) {
+	tests := []struct {
+		descr   string
+		opcodes string
+		setup   func(c *CPU)
+		check   func(t *testing.T, c *CPU, d *latchDevice)
+	}{
+		{"IN/AL/Ib", "E461", func(c *CPU) {}, func(t *testing.T, c *CPU, d *latchDevice) {
+			assert.Equal(t, c.Regs.GetReg8(AL), uint(0x42))
+		}},
+		{"IN/AX/Ib", "E560", func(c *CPU) {}, func(t *testing.T, c *CPU, d *latchDevice) {
+			assert.Equal(t, c.Regs.GetReg16(AX), uint(0x4221))
+		}},
+		{"IN/AL/DX", "EC", func(c *CPU) { c.Regs.SetReg16(DX, 0x60) }, func(t *testing.T, c *CPU, d *latchDevice) {
+			assert.Equal(t, c.Regs.GetReg8(AL), uint(0x21))
+		}},
+		{"IN/AL/DX/Unclaimed", "EC", func(c *CPU) { c.Regs.SetReg16(DX, 0x3F8) }, func(t *testing.T, c *CPU, d *latchDevice) {
+			assert.Equal(t, c.Regs.GetReg8(AL), uint(0xFF))
+		}},
+		{"OUT/Ib/AL", "E662", func(c *CPU) { c.Regs.SetReg8(AL, 0x99) }, func(t *testing.T, c *CPU, d *latchDevice) {
+			assert.Equal(t, d.regs[0x62], uint8(0x99))
+		}},
+		{"OUT/DX/AX", "EF", func(c *CPU) { c.Regs.SetReg16(DX, 0x62); c.Regs.SetReg16(AX, 0xABCD) },
+			func(t *testing.T, c *CPU, d *latchDevice) {
+				assert.Equal(t, d.regs[0x62], uint8(0xCD))
+				assert.Equal(t, d.regs[0x63], uint8(0xAB))
+			}},
+		{"INSB", "6C", func(c *CPU) { c.Regs.SetReg16(DX, 0x61); c.Regs.SetReg16(DI, 0x10) },
+			func(t *testing.T, c *CPU, d *latchDevice) {
+				assert.Equal(t, c.Mem.GetMem8(DEFAULT_ES, 0x10), uint8(0x42))
+				assert.Equal(t, c.Regs.GetReg16(DI), uint(0x11))
+			}},
+		{"REP/INSW", "F36D", func(c *CPU) {
+			c.Regs.SetReg16(DX, 0x60)
+			c.Regs.SetReg16(DI, 0x10)
+			c.Regs.SetReg16(CX, 3)
+		}, func(t *testing.T, c *CPU, d *latchDevice) {
+			for i := uint(0); i < 3; i++ {
+				assert.Equal(t, c.Mem.GetMem16(DEFAULT_ES, 0x10+i*2), uint16(0x4221))
+			}
+			assert.Equal(t, c.Regs.GetReg16(DI), uint(0x16))
+			assert.Equal(t, c.Regs.GetReg16(CX), uint(0))
+		}},
+		{"OUTSB/ES", "266E", func(c *CPU) {
+			c.Regs.SetReg16(DX, 0x62)
+			c.Regs.SetReg16(SI, 0x20)
+			c.Mem.SetMem8(DEFAULT_ES, 0x20, 0x77)
+		}, func(t *testing.T, c *CPU, d *latchDevice) {
+			assert.Equal(t, d.regs[0x62], uint8(0x77))
+			assert.Equal(t, c.Regs.GetReg16(SI), uint(0x21))
+		}},
+		{"REP/OUTSB/STD", "F36E", func(c *CPU) {
+			c.Regs.SetReg16(DX, 0x62)
+			c.Regs.SetReg16(SI, 0x21)
+			c.Regs.SetReg16(CX, 2)
+			c.Flags.SetFlags(DirectionFlag)
+			c.Mem.SetMem8(DEFAULT_DS, 0x20, 0x01)
+			c.Mem.SetMem8(DEFAULT_DS, 0x21, 0x02)
+		}, func(t *testing.T, c *CPU, d *latchDevice) {
+			// Last byte written wins
+			assert.Equal(t, d.regs[0x62], uint8(0x01))
+			assert.Equal(t, c.Regs.GetReg16(SI), uint(0x1F))
+			assert.Equal(t, c.Regs.GetReg16(CX), uint(0))
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.descr, func(t *testing.T) {
+			c := SetupCPU(t, test.opcodes)
+			d := newLatchDevice()
+			d.regs[0x60] = 0x21
+			d.regs[0x61] = 0x42
+			assert.NilError(t, c.Ports.Register(0x60, 0x63, d.handler()))
+			test.setup(c)
+			assert.NilError(t, c.RunOnce())
+			test.check(t, c, d)
+		})
+	}
+}
@@ -1,20 +1,177 @@
 package go86
 
 import (
-	"encoding/binary"
+	"fmt"
 
 	"github.com/golang/glog"
 )
 
+// Memory is the physical address space.  Addresses are 20 bits and wrap
+// around at 1 MiB like the 8086 unless the A20 gate is opened.  Regions of
+// it can be mapped as ROM or handed to devices, and addresses past the end
+// of RAM read as 0xFF with writes to them dropped.
 type Memory struct {
 	mem  []byte
 	size int
+	// Physical addresses are masked with this.
+	addrMask uint
+
+	regions []Region
+	// Pages with a region in them, nil if there are none.
+	regionPages []bool
+
+	hooks      []memHook
+	nextHookId int
+	// Kinds of access hooked in each page, nil if there are no hooks.
+	hookPages []Access
+
+	// Pages holding translated code, nil if nothing is translated.  Writes
+	// to them call codeWritten with the bytes from start up to end in the
+	// page before the memory changes.
+	codePages   []bool
+	codeWritten func(start, end uint)
+}
+
+const (
+	// Regions are found through pages this big.
+	regionPageShift = 12
+	// Wraps at 1 MiB
+	a20Mask = 0xFFFFF
+	// With A20 open FFFF:FFFF reaches 10FFEFh
+	a20OpenMask = 0x1FFFFF
+)
+
+// Region is part of the address space which isn't plain RAM.
+type Region struct {
+	// Physical addresses [Start, End)
+	Start, End uint
+	// Writes are dropped, for ROM.
+	ReadOnly bool
+	// Device callbacks with the physical address, nil uses the RAM behind
+	// the region.
+	Read  func(addr uint) uint8
+	Write func(addr uint, val uint8)
 }
 
 func NewMemory(size int) *Memory {
 	return &Memory{
-		size: size,
-		mem:  make([]byte, size),
+		size:     size,
+		mem:      make([]byte, size),
+		addrMask: a20Mask,
+	}
+}
+
+// SetA20 opens or closes the A20 gate.  Closed, addresses wrap around at
+// 1 MiB as on the 8086, open the 64K above it is there too.
+func (m *Memory) SetA20(open bool) {
+	m.addrMask = a20Mask
+	if open {
+		m.addrMask = a20OpenMask
+	}
+}
+
+// A20 is true if the A20 gate is open.
+func (m *Memory) A20() bool {
+	return m.addrMask == a20OpenMask
+}
+
+// Addr is the physical address of seg:off.
+func (m *Memory) Addr(seg uint, off uint) uint {
+	return (seg*0x10 + off&0xFFFF) & m.addrMask
+}
+
+// MapRegion maps r into the address space.  It is an error for it to
+// overlap a region which is already mapped.
+func (m *Memory) MapRegion(r Region) error {
+	if r.End <= r.Start {
+		return fmt.Errorf("invalid memory region: [0x%05X, 0x%05X)", r.Start, r.End)
+	}
+	for _, o := range m.regions {
+		if r.Start < o.End && o.Start < r.End {
+			return fmt.Errorf("memory region [0x%05X, 0x%05X) overlaps [0x%05X, 0x%05X)",
+				r.Start, r.End, o.Start, o.End)
+		}
+	}
+	m.regions = append(m.regions, r)
+	m.mapPages()
+	return nil
+}
+
+// UnmapRegion removes the region starting at start.
+func (m *Memory) UnmapRegion(start uint) bool {
+	for i, r := range m.regions {
+		if r.Start == start {
+			m.regions = append(m.regions[:i], m.regions[i+1:]...)
+			m.mapPages()
+			return true
+		}
+	}
+	return false
+}
+
+// MapROM loads data at start and makes it read only.
+func (m *Memory) MapROM(start uint, data []byte) error {
+	if err := m.MapRegion(Region{Start: start, End: start + uint(len(data)), ReadOnly: true}); err != nil {
+		return err
+	}
+	if start < uint(len(m.mem)) {
+		copy(m.mem[start:], data)
+	}
+	return nil
+}
+
+func (m *Memory) mapPages() {
+	if len(m.regions) == 0 {
+		m.regionPages = nil
+		return
+	}
+	m.regionPages = make([]bool, (a20OpenMask>>regionPageShift)+1)
+	for _, r := range m.regions {
+		for page := r.Start >> regionPageShift; page<<regionPageShift < r.End && page < uint(len(m.regionPages)); page++ {
+			m.regionPages[page] = true
+		}
+	}
+}
+
+// The region at pos, nil for RAM.
+func (m *Memory) region(pos uint) *Region {
+	if m.regionPages == nil || !m.regionPages[pos>>regionPageShift] {
+		return nil
+	}
+	for i := range m.regions {
+		if r := &m.regions[i]; pos >= r.Start && pos < r.End {
+			return r
+		}
+	}
+	return nil
+}
+
+// Reads the byte at physical address pos.
+func (m *Memory) read8(pos uint) uint8 {
+	if r := m.region(pos); r != nil && r.Read != nil {
+		return r.Read(pos)
+	}
+	if pos >= uint(len(m.mem)) {
+		// Nothing there, the bus floats high.
+		return 0xFF
+	}
+	return m.mem[pos]
+}
+
+// Writes the byte at physical address pos, translated code has already
+// been told.
+func (m *Memory) store8(pos uint, val uint8) {
+	if r := m.region(pos); r != nil {
+		if r.Write != nil {
+			r.Write(pos, val)
+			return
+		}
+		if r.ReadOnly {
+			return
+		}
+	}
+	if pos < uint(len(m.mem)) {
+		m.mem[pos] = val
 	}
 }
 
@@ -22,47 +179,106 @@ func (m *Memory) GetMem8(seg uint, off uint) uint8 {
 	if off >= 0x10000 {
 		glog.Warning("GetMem8: off >= 0x100: ", off)
 	}
-	pos := ((seg * 0x10) + (off & 0xffff))
-
-	return m.mem[pos]
+	pos := m.Addr(seg, off)
+	v := m.read8(pos)
+	if m.hookPages != nil {
+		m.runHooks(pos, AccessRead, v)
+	}
+	return v
 }
 
+// At is the RAM from seg:off to the end, for reading and writing in bulk.
+// It doesn't wrap around or see regions, and is empty past the end of RAM.
 func (m *Memory) At(seg uint, off uint) []uint8 {
 	if off >= 0x10000 {
 		glog.Warning("GetMem8: off >= 0x100: ", off)
 	}
-	pos := ((seg * 0x10) + (off & 0xffff))
-	return m.mem[pos:]
+	return m.AtAbs(int(m.Addr(seg, off)))
 }
 
+// AtAbs is the RAM from the physical address pos to the end.
 func (m *Memory) AtAbs(pos int) []uint8 {
+	if pos >= len(m.mem) {
+		return nil
+	}
 	return m.mem[pos:]
 }
 
+// AbsMem8 reads the byte at physical address pos.
 func (m *Memory) AbsMem8(pos int) uint8 {
-	return m.mem[pos]
+	return m.read8(uint(pos))
 }
 
 func (m *Memory) SetMem8(seg uint, off uint, val uint8) {
 	if off >= 0x10000 {
 		glog.Warning("GetMem8: off >= 0x100: ", off)
 	}
-	pos := ((seg * 0x10) + (off & 0xffff))
-	m.mem[pos] = val
+	pos := m.Addr(seg, off)
+	m.checkCode(pos, 1)
+	m.store8(pos, val)
+	if m.hookPages != nil {
+		m.runHooks(pos, AccessWrite, val)
+	}
 }
 
+// GetMem16 reads a word, at offset FFFF the high byte comes from the start
+// of the segment.
 func (m *Memory) GetMem16(seg uint, off uint) uint16 {
 	if off >= 0x10000 {
 		glog.Warning("GetMem8: off >= 0x100: ", off)
 	}
-	pos := ((seg * 0x10) + (off & 0xffff))
-	return binary.LittleEndian.Uint16(m.mem[pos:])
+	lo, hi := m.Addr(seg, off), m.Addr(seg, off+1)
+	vlo, vhi := m.read8(lo), m.read8(hi)
+	if m.hookPages != nil {
+		m.runHooks(lo, AccessRead, vlo)
+		m.runHooks(hi, AccessRead, vhi)
+	}
+	return uint16(vlo) | uint16(vhi)<<8
 }
 
 func (m *Memory) SetMem16(seg uint, off uint, val uint16) {
 	if off >= 0x10000 {
 		glog.Warning("GetMem8: off >= 0x100: ", off)
 	}
-	pos := ((seg * 0x10) + (off & 0xffff))
-	binary.LittleEndian.PutUint16(m.mem[pos:], val)
+	lo, hi := m.Addr(seg, off), m.Addr(seg, off+1)
+	m.checkCode(lo, 1)
+	m.checkCode(hi, 1)
+	m.store8(lo, uint8(val))
+	m.store8(hi, uint8(val>>8))
+	if m.hookPages != nil {
+		m.runHooks(lo, AccessWrite, uint8(val))
+		m.runHooks(hi, AccessWrite, uint8(val>>8))
+	}
+}
+
+// Copy copies src to seg:off, for loading programs and the like which write
+// memory in bulk.  It carries on past the end of the segment.
+func (m *Memory) Copy(seg uint, off uint, src []byte) {
+	pos := m.Addr(seg, off)
+	if end := pos + uint(len(src)); end <= m.addrMask+1 {
+		m.checkCode(pos, len(src))
+	} else {
+		m.checkCode(pos, int(m.addrMask+1-pos))
+		m.checkCode(0, int(end-m.addrMask-1))
+	}
+	for i, b := range src {
+		p := (pos + uint(i)) & m.addrMask
+		m.store8(p, b)
+		if m.hookPages != nil {
+			m.runHooks(p, AccessWrite, b)
+		}
+	}
+}
+
+// Tells the CPU about writes to n bytes at pos which hit translated code.
+func (m *Memory) checkCode(pos uint, n int) {
+	if m.codePages == nil {
+		return
+	}
+	end := pos + uint(n)
+	for page := pos >> codePageShift; page<<codePageShift < end && page < uint(len(m.codePages)); page++ {
+		if m.codePages[page] {
+			m.codeWritten(max(pos, page<<codePageShift), min(end, (page+1)<<codePageShift))
+		}
+	}
 }
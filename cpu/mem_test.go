@@ -83,3 +83,129 @@ func TestMemAtAll8(t *testing.T) {
 		t.Errorf("Expected CAFEBEEF, got: %s", str)
 	}
 }
+
+func TestMemSegmentWrap(t *testing.T) {
+	m := NewMemory(1024 * 1024)
+	m.SetMem16(0x1000, 0xFFFF, 0xBEEF)
+	assert.Equal(t, m.GetMem8(0x1000, 0xFFFF), uint8(0xEF))
+	// The high byte goes to the start of the segment, not 0x20000
+	assert.Equal(t, m.GetMem8(0x1000, 0), uint8(0xBE))
+	assert.Equal(t, m.GetMem8(0x2000, 0), uint8(0))
+	assert.Equal(t, m.GetMem16(0x1000, 0xFFFF), uint16(0xBEEF))
+}
+
+func TestMemAddressWrap(t *testing.T) {
+	m := NewMemory(1024 * 1024)
+	// FFFF:0010 is 100000h which wraps to 0
+	m.SetMem16(0xFFFF, 0x10, 0x1234)
+	assert.Equal(t, m.GetMem16(0, 0), uint16(0x1234))
+	assert.Equal(t, m.Addr(0xFFFF, 0xFFFF), uint(0xFFEF))
+
+	m.SetA20(true)
+	assert.Equal(t, m.Addr(0xFFFF, 0xFFFF), uint(0x10FFEF))
+	// Past the end of RAM
+	m.SetMem8(0xFFFF, 0x10, 0x56)
+	assert.Equal(t, m.GetMem8(0xFFFF, 0x10), uint8(0xFF))
+	assert.Equal(t, len(m.At(0xFFFF, 0x10)), 0)
+}
+
+func TestMemOutOfRange(t *testing.T) {
+	m := NewMemory(0x1000)
+	m.SetMem16(0x100, 0, 0x1234)
+	assert.Equal(t, m.GetMem16(0x100, 0), uint16(0xFFFF))
+	m.Copy(0xFF, 0xE, []byte{1, 2, 3})
+	assert.Equal(t, m.GetMem16(0xFF, 0xE), uint16(0x0201))
+}
+
+func TestMemROM(t *testing.T) {
+	m := NewMemory(1024 * 1024)
+	assert.NilError(t, m.MapROM(0xF0000, []byte{0xEA, 0x5B, 0xE0}))
+	m.SetMem8(0xF000, 0, 0x90)
+	m.Copy(0xF000, 1, []byte{0, 0})
+	assert.Equal(t, m.GetMem8(0xF000, 0), uint8(0xEA))
+	assert.Equal(t, m.GetMem16(0xF000, 1), uint16(0xE05B))
+	// Only the ROM is read only
+	m.SetMem8(0xF000, 3, 0x90)
+	assert.Equal(t, m.GetMem8(0xF000, 3), uint8(0x90))
+
+	assert.ErrorContains(t, m.MapROM(0xF0002, []byte{0}), "overlaps")
+	assert.Assert(t, m.UnmapRegion(0xF0000))
+	m.SetMem8(0xF000, 0, 0x90)
+	assert.Equal(t, m.GetMem8(0xF000, 0), uint8(0x90))
+}
+
+func TestMemDeviceRegion(t *testing.T) {
+	m := NewMemory(1024 * 1024)
+	var writes []uint
+	err := m.MapRegion(Region{Start: 0xB8000, End: 0xBC000,
+		Read:  func(addr uint) uint8 { return uint8(addr) },
+		Write: func(addr uint, val uint8) { writes = append(writes, addr) },
+	})
+	assert.NilError(t, err)
+	m.SetMem16(0xB800, 0x10, 0x0741)
+	assert.DeepEqual(t, writes, []uint{0xB8010, 0xB8011})
+	assert.Equal(t, m.GetMem16(0xB800, 0x22), uint16(0x2322))
+	// Outside the region is RAM
+	m.SetMem8(0xBC00, 0, 0x12)
+	assert.Equal(t, m.GetMem8(0xBC00, 0), uint8(0x12))
+}
+
+func TestMemHooks(t *testing.T) {
+	m := NewMemory(1024 * 1024)
+	var got []string
+	record := func(addr uint, access Access, val uint8) {
+		got = append(got, fmt.Sprintf("%05X %v %02X", addr, access, val))
+	}
+	id := m.AddHook(0x10010, 0x10012, AccessWrite, record)
+	m.AddHook(0x10011, 0x10020, AccessRead, record)
+
+	m.SetMem16(0x1000, 0x0F, 0x1234)
+	m.SetMem8(0x1000, 0x12, 0x56)
+	m.GetMem16(0x1000, 0x11)
+	m.Copy(0x1001, 0, []byte{0x78})
+	// Not seen by hooks
+	m.AbsMem8(0x10011)
+	m.At(0x1000, 0x10)[0] = 0
+	assert.DeepEqual(t, got, []string{"10010 w 12", "10011 r 00", "10012 r 56", "10010 w 78"})
+
+	assert.Assert(t, m.RemoveHook(id))
+	assert.Assert(t, !m.RemoveHook(id))
+	got = nil
+	m.SetMem8(0x1000, 0x10, 0)
+	assert.Equal(t, len(got), 0)
+}
+
+func TestMemHookUntouched(t *testing.T) {
+	// MOV CX,4; MOV SI,0; MOV DI,0; REP MOVSB
+	cpu := SetupCPU(t, "B90400BE0000BF0000F3A4")
+	buf := cpu.Mem.Addr(DEFAULT_ES, 0x10)
+	touched := 0
+	cpu.Mem.AddHook(buf, buf+0x10, AccessAll, func(uint, Access, uint8) { touched++ })
+	written := 0
+	cpu.Mem.AddHook(cpu.Mem.Addr(DEFAULT_ES, 0), buf, AccessWrite, func(uint, Access, uint8) { written++ })
+	for i := 0; i < 4; i++ {
+		assert.NilError(t, cpu.RunOnce())
+	}
+	assert.Equal(t, touched, 0)
+	assert.Equal(t, written, 4)
+}
+
+func TestMemHookFetch(t *testing.T) {
+	// MOV CX,4 ; MOV SI,0
+	for _, cache := range []bool{true, false} {
+		cpu := SetupCPU(t, "B90400BE0000")
+		cpu.SetBlockCache(cache)
+		var fetched []uint
+		code := cpu.Mem.Addr(DEFAULT_CS, 0)
+		cpu.Mem.AddHook(code, code+3, AccessFetch, func(addr uint, _ Access, _ uint8) {
+			fetched = append(fetched, addr-code)
+		})
+		reads := 0
+		cpu.Mem.AddHook(code, code+6, AccessRead, func(uint, Access, uint8) { reads++ })
+		for i := 0; i < 2; i++ {
+			assert.NilError(t, cpu.RunOnce())
+		}
+		assert.DeepEqual(t, fetched, []uint{0, 1, 2})
+		assert.Equal(t, reads, 0, "cache %v", cache)
+	}
+}
@@ -0,0 +1,115 @@
+package go86
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Model is the CPU being emulated.  They all run the same 8086 instruction
+// set, but differ in the details.
+type Model int
+
+const (
+	Model8086 Model = iota
+	Model8088
+	Model80186
+	ModelV20
+	ModelV30
+)
+
+var modelNames = map[Model]string{
+	Model8086:  "8086",
+	Model8088:  "8088",
+	Model80186: "80186",
+	ModelV20:   "V20",
+	ModelV30:   "V30",
+}
+
+func (m Model) String() string {
+	if name, ok := modelNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("Model(%d)", int(m))
+}
+
+// ParseModel returns the model for a name like "8088" or "v20".
+func ParseModel(name string) (Model, error) {
+	for m, n := range modelNames {
+		if strings.EqualFold(n, name) {
+			return m, nil
+		}
+	}
+	return Model8086, fmt.Errorf("unknown CPU model: %q", name)
+}
+
+// Has the 80186 instructions (PUSHA, ENTER, BOUND, shifts by imm8, ...)
+func (m Model) Has186() bool {
+	return m != Model8086 && m != Model8088
+}
+
+// Is an NEC V20 or V30.
+func (m Model) IsNEC() bool {
+	return m == ModelV20 || m == ModelV30
+}
+
+// Has the 8-bit data bus of the 8088 and V20.
+func (m Model) Bus8() bool {
+	return m == Model8088 || m == ModelV20
+}
+
+// Size in bytes of the prefetch queue.
+func (m Model) PrefetchSize() int {
+	if m.Bus8() {
+		return 4
+	}
+	return 6
+}
+
+// Option configures a CPU created by NewCpu.
+type Option func(*CPU)
+
+// WithModel sets the CPU model to emulate, the default is the 80186.
+func WithModel(m Model) Option {
+	return func(cpu *CPU) {
+		cpu.SetModel(m)
+	}
+}
+
+// WithFPU fits fpu as the coprocessor, nil leaves the socket empty.
+func WithFPU(fpu *FPU) Option {
+	return func(cpu *CPU) {
+		cpu.FPU = fpu
+	}
+}
+
+// SetModel switches the CPU to model m, resetting the settings which depend
+// on it.
+func (cpu *CPU) SetModel(m Model) {
+	cpu.Model = m
+	cpu.MaskShiftCount = m.Has186()
+	cpu.Bus8 = m.Bus8()
+	cpu.queue = make([]byte, 0, m.PrefetchSize())
+	cpu.queueInMem = false
+	// What the opcodes mean may have changed.
+	cpu.clearBlocks()
+}
+
+// The 8086 and 8088 don't fully decode some opcodes, the ones later used for
+// the 80186 instructions run as others.
+func (m Model) aliasOpcode(op uint8) uint8 {
+	if m.Has186() {
+		return op
+	}
+	switch {
+	case op >= 0x60 && op <= 0x6F:
+		// Jcc
+		return op + 0x10
+	case op == 0xC0, op == 0xC1:
+		// RET imm16, RET
+		return op + 2
+	case op == 0xC8, op == 0xC9:
+		// RETF imm16, RETF
+		return op + 2
+	}
+	return op
+}
@@ -0,0 +1,117 @@
+package go86
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func setupModelCPU(t *testing.T, m Model, opcodes string) *CPU {
+	cpu := SetupCPU(t, opcodes)
+	cpu.SetModel(m)
+	return cpu
+}
+
+func TestParseModel(t *testing.T) {
+	m, err := ParseModel("v20")
+	assert.NilError(t, err)
+	assert.Equal(t, m, ModelV20)
+	assert.Equal(t, m.String(), "V20")
+
+	_, err = ParseModel("z80")
+	assert.ErrorContains(t, err, "unknown CPU model")
+}
+
+func TestModelAliasJcc(t *testing.T) {
+	// JO +2 on the 8086, PUSHA on the 80186
+	cpu := setupModelCPU(t, Model8086, "6002")
+	cpu.Flags.SetFlags(OF)
+	assert.NilError(t, cpu.RunOnce())
+	assert.Equal(t, cpu.Ip, uint16(4))
+	assert.Equal(t, cpu.Regs.SP(), uint(0xFF))
+
+	cpu = setupModelCPU(t, Model80186, "60")
+	assert.NilError(t, cpu.RunOnce())
+	assert.Equal(t, cpu.Ip, uint16(1))
+	assert.Equal(t, cpu.Regs.SP(), uint(0xFF-16))
+}
+
+func TestModelPopCS(t *testing.T) {
+	cpu := setupModelCPU(t, Model8086, "0F")
+	cpu.Regs.Push16(cpu.Mem, 0x3000)
+	assert.NilError(t, cpu.RunOnce())
+	assert.Equal(t, cpu.Regs.CS(), uint(0x3000))
+	assert.Equal(t, cpu.Ip, uint16(1))
+}
+
+func TestModelInvalidOpcode(t *testing.T) {
+	cpu := setupModelCPU(t, Model80186, "0F")
+	cpu.Mem.SetMem16(0, 6*4, 0x1234)
+	cpu.Mem.SetMem16(0, 6*4+2, 0x3000)
+	assert.NilError(t, cpu.RunOnce())
+	assert.Equal(t, cpu.Regs.CS(), uint(0x3000))
+	assert.Equal(t, cpu.Ip, uint16(0x1234))
+	// Returns to the faulting opcode.
+	assert.Equal(t, cpu.Regs.Pop16(cpu.Mem), uint16(0))
+}
+
+func TestModelPushSP(t *testing.T) {
+	for _, m := range []Model{Model8086, Model80186} {
+		cpu := setupModelCPU(t, m, "54")
+		assert.NilError(t, cpu.RunOnce())
+		assert.Equal(t, cpu.Mem.GetMem16(DEFAULT_SS, 0xFD), uint16(0xFD))
+	}
+}
+
+func TestModelShiftCount(t *testing.T) {
+	tests := []struct {
+		model Model
+		want  uint
+	}{
+		{Model8086, 0},
+		{Model80186, 2},
+		{ModelV30, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.model.String(), func(t *testing.T) {
+			// SHL AL,CL
+			cpu := setupModelCPU(t, test.model, "D2E0")
+			cpu.Regs.SetReg8(AL, 1)
+			cpu.Regs.SetReg8(CL, 0x21)
+			assert.NilError(t, cpu.RunOnce())
+			assert.Equal(t, cpu.Regs.GetReg8(AL), test.want)
+		})
+	}
+}
+
+func TestModelPrefetchQueue(t *testing.T) {
+	// MOV BYTE [000A],40 with DS=CS patches the last NOP to INC AX.  That
+	// byte is already in the 8086's queue but not the 8088's.
+	tests := []struct {
+		model Model
+		want  uint
+	}{
+		{Model8086, 0},
+		{Model8088, 1},
+	}
+	for _, test := range tests {
+		t.Run(test.model.String(), func(t *testing.T) {
+			cpu := setupModelCPU(t, test.model, "C6060A0040909090909090")
+			cpu.Regs.SetSeg16(DS, DEFAULT_CS)
+			for i := 0; i < 7; i++ {
+				assert.NilError(t, cpu.RunOnce())
+			}
+			assert.Equal(t, cpu.Regs.AX(), test.want)
+		})
+	}
+}
+
+func TestModelPrefetchFlush(t *testing.T) {
+	// Patch the byte following JMP $+2, which flushes the queue.
+	cpu := setupModelCPU(t, Model8086, "C606070040EB0090")
+	cpu.Regs.SetSeg16(DS, DEFAULT_CS)
+	for i := 0; i < 3; i++ {
+		assert.NilError(t, cpu.RunOnce())
+	}
+	assert.Equal(t, cpu.Regs.AX(), uint(1))
+}
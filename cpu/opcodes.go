@@ -102,22 +102,22 @@ var OpcodeTable = [256]OpcodeInfo{
 	{0x5D, "POP eBP"},
 	{0x5E, "POP eSI"},
 	{0x5F, "POP eDI"},
-	{0x60, "--"},
-	{0x61, "--"},
-	{0x62, "--"},
+	{0x60, "PUSHA"},
+	{0x61, "POPA"},
+	{0x62, "BOUND Gv Ma"},
 	{0x63, "--"},
 	{0x64, "--"},
 	{0x65, "--"},
 	{0x66, "--"},
 	{0x67, "--"},
-	{0x68, "--"},
-	{0x69, "--"},
-	{0x6A, "--"},
-	{0x6B, "--"},
-	{0x6C, "--"},
-	{0x6D, "--"},
-	{0x6E, "--"},
-	{0x6F, "--"},
+	{0x68, "PUSH Iv"},
+	{0x69, "IMUL Gv Ev Iv"},
+	{0x6A, "PUSH Ib"},
+	{0x6B, "IMUL Gv Ev Ib"},
+	{0x6C, "INSB"},
+	{0x6D, "INSW"},
+	{0x6E, "OUTSB"},
+	{0x6F, "OUTSW"},
 	{0x70, "JO Jb"},
 	{0x71, "JNO Jb"},
 	{0x72, "JB Jb"},
@@ -198,16 +198,16 @@ var OpcodeTable = [256]OpcodeInfo{
 	{0xBD, "MOV eBP Iv"},
 	{0xBE, "MOV eSI Iv"},
 	{0xBF, "MOV eDI Iv"},
-	{0xC0, "--"},
-	{0xC1, "--"},
+	{0xC0, "GRP2 Eb Ib"},
+	{0xC1, "GRP2 Ev Ib"},
 	{0xC2, "RET Iw"},
 	{0xC3, "RET"},
 	{0xC4, "LES Gv Mp"},
 	{0xC5, "LDS Gv Mp"},
 	{0xC6, "MOV Eb Ib"},
 	{0xC7, "MOV Ev Iv"},
-	{0xC8, "--"},
-	{0xC9, "--"},
+	{0xC8, "ENTER Iw Ib"},
+	{0xC9, "LEAVE"},
 	{0xCA, "RETF Iw"},
 	{0xCB, "RETF"},
 	{0xCC, "INT 3"},
@@ -222,14 +222,14 @@ var OpcodeTable = [256]OpcodeInfo{
 	{0xD5, "AAD I0"},
 	{0xD6, "--"},
 	{0xD7, "XLAT"},
-	{0xD8, "--"},
-	{0xD9, "--"},
-	{0xDA, "--"},
-	{0xDB, "--"},
-	{0xDC, "--"},
-	{0xDD, "--"},
-	{0xDE, "--"},
-	{0xDF, "--"},
+	{0xD8, "ESC M"},
+	{0xD9, "ESC M"},
+	{0xDA, "ESC M"},
+	{0xDB, "ESC M"},
+	{0xDC, "ESC M"},
+	{0xDD, "ESC M"},
+	{0xDE, "ESC M"},
+	{0xDF, "ESC M"},
 	{0xE0, "LOOPNZ Jb"},
 	{0xE1, "LOOPZ Jb"},
 	{0xE2, "LOOP Jb"},
@@ -1,11 +1,16 @@
 package go86
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 type Operand struct {
 	code     string
 	bits     int
 	hasModRM bool
+	// Bytes of immediate data following the opcode and ModRM.
+	imm int
 }
 
 type OperandPair struct {
@@ -29,22 +34,55 @@ func (r Operand) HasModRM() bool {
 }
 
 var (
-	Eb     = Operand{"Eb", 8, true}
-	Ev     = Operand{"Ev", 16, true}
-	Ew     = Operand{"Ee", 16, true}
-	Gb     = Operand{"Gb", 8, true}
-	Gv     = Operand{"Gv", 16, true}
-	Ib     = Operand{"Ib", 8, false}
-	Iv     = Operand{"Iv", 16, false}
-	Ob     = Operand{"Ob", 8, false}
-	Ov     = Operand{"Ob", 16, false}
-	Sw     = Operand{"Sw", 16, true}
-	RegAL  = Operand{"AL", 8, false}
-	RegAX  = Operand{"AX", 16, false}
-	RegCL  = Operand{"CL", 8, false}
-	ValOne = Operand{"1", 8, false}
+	Eb     = Operand{"Eb", 8, true, 0}
+	Ev     = Operand{"Ev", 16, true, 0}
+	Ew     = Operand{"Ew", 16, true, 0}
+	Gb     = Operand{"Gb", 8, true, 0}
+	Gv     = Operand{"Gv", 16, true, 0}
+	Ib     = Operand{"Ib", 8, false, 1}
+	Iv     = Operand{"Iv", 16, false, 2}
+	Iw     = Operand{"Iw", 16, false, 2}
+	I0     = Operand{"I0", 8, false, 1}
+	Jb     = Operand{"Jb", 8, false, 1}
+	Jv     = Operand{"Jv", 16, false, 2}
+	Ap     = Operand{"Ap", 32, false, 4}
+	M      = Operand{"M", 16, true, 0}
+	Ma     = Operand{"Ma", 32, true, 0}
+	Mp     = Operand{"Mp", 32, true, 0}
+	Ob     = Operand{"Ob", 8, false, 2}
+	Ov     = Operand{"Ov", 16, false, 2}
+	Sw     = Operand{"Sw", 16, true, 0}
+	RegAL  = Operand{"AL", 8, false, 0}
+	RegAX  = Operand{"AX", 16, false, 0}
+	RegCL  = Operand{"CL", 8, false, 0}
+	RegDX  = Operand{"DX", 16, false, 0}
+	SegCS  = Operand{"CS", 16, false, 0}
+	ValOne = Operand{"1", 8, false, 0}
 )
 
+var operandCodes = func() map[string]Operand {
+	codes := map[string]Operand{}
+	for _, op := range []Operand{Eb, Ev, Ew, Gb, Gv, Ib, Iv, Iw, I0, Jb, Jv, Ap, M, Ma, Mp, Ob, Ov, Sw,
+		RegAL, RegAX, RegCL, RegDX, SegCS, ValOne} {
+		codes[op.code] = op
+	}
+	return codes
+}()
+
+// Operand for a code in the OpcodeTable, the rest are registers and
+// constants.  The table's eAX style names are the 16-bit registers.
+func operandForCode(code string) Operand {
+	code = strings.TrimPrefix(code, "e")
+	if op, ok := operandCodes[code]; ok {
+		return op
+	}
+	bits := 16
+	if len(code) == 2 && (code[1] == 'L' || code[1] == 'H') || code == "3" {
+		bits = 8
+	}
+	return Operand{code, bits, false, 0}
+}
+
 var (
 	EbGb = OperandPair{Eb, Gb}
 	EvGv = OperandPair{Ev, Gv}
@@ -73,16 +111,10 @@ func (op Operand) GetByOperand(cpu *CPU, inst *Inst, mem *Memory, regs *Register
 		return inst.ModRM.R8(cpu), nil
 	case Gv:
 		return inst.ModRM.R16(cpu), nil
-	case Ib:
-		return inst.GetImm8(cpu)
-	case Iv:
-		return inst.GetImm16(cpu)
+	case Ib, Iv:
+		return inst.Imm, nil
 	case Ob:
-		imm16, err := inst.GetImm16(cpu)
-		if err != nil {
-			return 0, err
-		}
-
+		imm16 := inst.Imm
 		seg := DS
 		if inst.HasSegmentOverride {
 			seg = inst.SegmentOverride
@@ -92,10 +124,7 @@ func (op Operand) GetByOperand(cpu *CPU, inst *Inst, mem *Memory, regs *Register
 		return value, nil
 
 	case Ov:
-		imm16, err := inst.GetImm16(cpu)
-		if err != nil {
-			return 0, err
-		}
+		imm16 := inst.Imm
 		seg := DS
 		if inst.HasSegmentOverride {
 			seg = inst.SegmentOverride
@@ -135,10 +164,7 @@ func (op Operand) SetByOperand(cpu *CPU, inst *Inst, mem *Memory, regs *Register
 		return nil
 
 	case Ob:
-		imm16, err := inst.GetImm16(cpu)
-		if err != nil {
-			return err
-		}
+		imm16 := inst.Imm
 		// hamding override
 		seg := DS
 		if inst.HasSegmentOverride {
@@ -147,10 +173,7 @@ func (op Operand) SetByOperand(cpu *CPU, inst *Inst, mem *Memory, regs *Register
 		mem.SetMem8(regs.GetSeg16(seg), imm16, uint8(val))
 
 	case Ov:
-		imm16, err := inst.GetImm16(cpu)
-		if err != nil {
-			return err
-		}
+		imm16 := inst.Imm
 		// hamding override
 		seg := DS
 		if inst.HasSegmentOverride {
@@ -173,14 +196,6 @@ func (op Operand) SetByOperand(cpu *CPU, inst *Inst, mem *Memory, regs *Register
 }
 
 func ParseTwoOperands(cpu *CPU, inst *Inst, leftop, rightop Operand) (uint, uint, error) {
-	if leftop.HasModRM() || rightop.HasModRM() {
-		if inst.ModRM == nil {
-			err := inst.FetchModRM()
-			if err != nil {
-				return 0, 0, err
-			}
-		}
-	}
 	left, err := leftop.GetByOperand(cpu, inst, cpu.Mem, cpu.Regs)
 	if err != nil {
 		return 0, 0, err
@@ -0,0 +1,75 @@
+package go86
+
+// The bus unit keeps the prefetch queue topped up while instructions execute,
+// so code which modifies the bytes just ahead of IP won't see the change
+// until the queue is flushed by a jump.  The queue is refilled after every
+// byte is taken from it, as if it were always full.
+
+// Linear address of CS:IP.
+func (cpu *CPU) linearIp() uint {
+	return cpu.Mem.Addr(cpu.Regs.CS(), uint(cpu.Ip))
+}
+
+// Empties the prefetch queue, as any transfer of control does.
+func (cpu *CPU) flushQueue() {
+	cpu.queue = cpu.queue[:0]
+	cpu.queueInMem = false
+}
+
+// Fills the prefetch queue from memory following the bytes already queued.
+func (cpu *CPU) fillQueue() {
+	if len(cpu.queue) == 0 {
+		cpu.queueAddr = cpu.linearIp()
+	}
+	for len(cpu.queue) < cap(cpu.queue) {
+		cpu.queue = append(cpu.queue, cpu.Mem.AbsMem8(int((cpu.queueAddr+uint(len(cpu.queue)))&cpu.Mem.addrMask)))
+	}
+}
+
+// Takes the next instruction byte from the prefetch queue and advances IP.
+func (cpu *CPU) fetchQueued() uint8 {
+	if len(cpu.queue) == 0 || cpu.queueAddr != cpu.linearIp() {
+		// IP moved without going through the queue.
+		cpu.flushQueue()
+	}
+	if cap(cpu.queue) == 0 {
+		// No queue at all
+		b := cpu.Mem.GetMem8(cpu.Regs.CS(), uint(cpu.Ip))
+		cpu.Ip++
+		return b
+	}
+	cpu.fillQueue()
+	b := cpu.queue[0]
+	cpu.queue = append(cpu.queue[:0], cpu.queue[1:]...)
+	cpu.queueAddr++
+	cpu.Ip++
+	cpu.fillQueue()
+	return b
+}
+
+// Bytes at CS:IP as the decoder sees them, what is in the prefetch queue
+// followed by memory.
+func (cpu *CPU) peekQueued() []byte {
+	mem := cpu.Mem.At(cpu.Regs.CS(), uint(cpu.Ip))
+	if len(cpu.queue) == 0 || cpu.queueAddr != cpu.linearIp() {
+		return mem
+	}
+	n := len(cpu.queue)
+	if n > len(mem) {
+		n = len(mem)
+	}
+	src := append(cpu.peekBuf[:0], cpu.queue...)
+	return append(src, mem[n:min(len(mem), n+16)]...)
+}
+
+// Unconditional transfers flush the queue even when they land on the next
+// instruction, like the JMP $+2 used to flush it on purpose.
+func flushesQueue(inst *Inst) bool {
+	switch inst.OpCode {
+	case 0x9A, 0xC2, 0xC3, 0xCA, 0xCB, 0xCC, 0xCD, 0xCF, 0xE8, 0xE9, 0xEA, 0xEB:
+		return true
+	case 0xFF:
+		return inst.ModRM != nil && inst.ModRM.Reg >= 2 && inst.ModRM.Reg <= 5
+	}
+	return false
+}
@@ -49,7 +49,7 @@ func incCounters(cpu *CPU, count uint, regs ...Reg) {
 	}
 }
 
-func (cpu *CPU) cmps(bit int) error {
+func (cpu *CPU) cmpsOne(bit int) error {
 	left, err := getDSSI(cpu, bit, true)
 	if err != nil {
 		return err
@@ -61,7 +61,47 @@ func (cpu *CPU) cmps(bit int) error {
 
 	// Update the pointers
 	incCounters(cpu, uint(bit/8), SI, DI)
-	return cpu.compare(left, right, 8)
+	return cpu.compare(left, right, bit)
+}
+
+// CMPS - Compare String
+func (cpu *CPU) cmps(inst *Inst, bit int) error {
+	if !inst.Rep && !inst.RepNe {
+		return cpu.cmpsOne(bit)
+	}
+	return repeat(cpu, true, inst, func(cpu *CPU) error {
+		return cpu.cmpsOne(bit)
+	})
+}
+
+func (cpu *CPU) movsOne(bit int) error {
+	// N.B. Only the DS:SI source can be overridden, the destination is
+	// always ES:DI.
+	dssi, err := getDSSI(cpu, bit, true)
+	if err != nil {
+		return err
+	}
+
+	switch bit {
+	case 8:
+		cpu.Mem.SetMem8(cpu.Regs.GetSeg16(ES), cpu.Regs.GetReg16(DI), uint8(dssi))
+	case 16:
+		cpu.Mem.SetMem16(cpu.Regs.GetSeg16(ES), cpu.Regs.GetReg16(DI), uint16(dssi))
+	default:
+		panic("wrong bits")
+	}
+	incCounters(cpu, uint(bit/8), SI, DI)
+	return nil
+}
+
+// MOVS - Move String
+func (cpu *CPU) movs(inst *Inst, bit int) error {
+	if !inst.Rep && !inst.RepNe {
+		return cpu.movsOne(bit)
+	}
+	return repeat(cpu, false, inst, func(cpu *CPU) error {
+		return cpu.movsOne(bit)
+	})
 }
 
 func (cpu *CPU) scasOne(bit int) error {
@@ -86,17 +126,30 @@ func (cpu *CPU) scasOne(bit int) error {
 	return cpu.compare(reg, esdi, bit)
 }
 
-func repeat(cpu *CPU, usesRepE, usesRepNE bool, inst *Inst, f func(*CPU) error) error {
+// Runs f CX times for a REP prefixed string instruction.  Only CMPS and SCAS
+// compare, for those REPE stops when ZF is clear and REPNE when it is set,
+// otherwise both prefixes just repeat.
+//
+// Like the real thing the loop can be interrupted between iterations, IP is
+// moved back to the first prefix so the instruction restarts with what is
+// left of CX once the interrupt handler returns.
+func repeat(cpu *CPU, compares bool, inst *Inst, f func(*CPU) error) error {
 	cx := cpu.Regs.CX()
 	for cx != 0 {
 		if err := f(cpu); err != nil {
+			cpu.Regs.SetReg16(CX, cx)
 			return err
 		}
 		cx--
-		if usesRepE && inst.Rep && !cpu.Flags.IsEnabled(ZeroFlag) {
+		cpu.repCount++
+		if compares && inst.Rep && !cpu.Flags.IsEnabled(ZeroFlag) {
 			break
 		}
-		if usesRepNE && inst.RepNe && cpu.Flags.IsEnabled(ZeroFlag) {
+		if compares && inst.RepNe && cpu.Flags.IsEnabled(ZeroFlag) {
+			break
+		}
+		if cx != 0 && cpu.interruptPending() {
+			cpu.Ip = cpu.instIp
 			break
 		}
 	}
@@ -109,7 +162,7 @@ func (cpu *CPU) scas(inst *Inst, bit int) error {
 		return cpu.scasOne(bit)
 	}
 
-	return repeat(cpu, true, true, inst, func(cpu *CPU) error {
+	return repeat(cpu, true, inst, func(cpu *CPU) error {
 		return cpu.scasOne(bit)
 	})
 
@@ -136,7 +189,7 @@ func (cpu *CPU) stos(inst *Inst, bit int) error {
 	if !inst.Rep && !inst.RepNe {
 		return cpu.stosOne(bit)
 	}
-	return repeat(cpu, true, true, inst, func(cpu *CPU) error {
+	return repeat(cpu, false, inst, func(cpu *CPU) error {
 		return cpu.stosOne(bit)
 	})
 }
@@ -165,7 +218,65 @@ func (cpu *CPU) lods(inst *Inst, bit int) error {
 	if !inst.Rep && !inst.RepNe {
 		return cpu.lodsOne(bit)
 	}
-	return repeat(cpu, true, true, inst, func(cpu *CPU) error {
+	return repeat(cpu, false, inst, func(cpu *CPU) error {
 		return cpu.lodsOne(bit)
 	})
 }
+
+func (cpu *CPU) insOne(bit int) error {
+	// N.B. The ES segment cannot be overridden with a segment override prefix.
+	port := uint16(cpu.Regs.GetReg16(DX))
+	df := cpu.Flags.IsEnabled(DirectionFlag) // true == 1
+	switch bit {
+	case 8:
+		cpu.Mem.SetMem8(cpu.Regs.GetSeg16(ES), cpu.Regs.GetReg16(DI), cpu.Ports.In8(port))
+		incCounter(cpu, 1, df, DI)
+	case 16:
+		cpu.Mem.SetMem16(cpu.Regs.GetSeg16(ES), cpu.Regs.GetReg16(DI), cpu.Ports.In16(port))
+		incCounter(cpu, 2, df, DI)
+	default:
+		panic("wrong bits")
+	}
+	return nil
+}
+
+// INS - Input String from Port
+func (cpu *CPU) ins(inst *Inst, bit int) error {
+	if !inst.Rep && !inst.RepNe {
+		return cpu.insOne(bit)
+	}
+	return repeat(cpu, false, inst, func(cpu *CPU) error {
+		return cpu.insOne(bit)
+	})
+}
+
+func (cpu *CPU) outsOne(bit int) error {
+	dssi, err := getDSSI(cpu, bit, true)
+	if err != nil {
+		return err
+	}
+
+	port := uint16(cpu.Regs.GetReg16(DX))
+	df := cpu.Flags.IsEnabled(DirectionFlag) // true == 1
+	switch bit {
+	case 8:
+		cpu.Ports.Out8(port, uint8(dssi))
+		incCounter(cpu, 1, df, SI)
+	case 16:
+		cpu.Ports.Out16(port, uint16(dssi))
+		incCounter(cpu, 2, df, SI)
+	default:
+		panic("wrong bits")
+	}
+	return nil
+}
+
+// OUTS - Output String to Port
+func (cpu *CPU) outs(inst *Inst, bit int) error {
+	if !inst.Rep && !inst.RepNe {
+		return cpu.outsOne(bit)
+	}
+	return repeat(cpu, false, inst, func(cpu *CPU) error {
+		return cpu.outsOne(bit)
+	})
+}
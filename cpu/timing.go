@@ -0,0 +1,456 @@
+package go86
+
+import "time"
+
+// Clock counts from the Intel 8086 and 80186 datasheets.  Where the
+// datasheet gives a range (MUL, DIV) the middle of the range is used.
+
+// Cost of an instruction in clocks.
+type opTiming struct {
+	// Clocks when the operands are registers or immediates.
+	Reg uint16
+	// Clocks with a memory operand, not including the EA calculation.
+	Mem uint16
+	// Number of memory transfers, each word transfer pays the bus penalty.
+	Xfer uint8
+	// Operates on words.
+	Word bool
+}
+
+// Extra clocks for a word transfer on an odd address or the 8088's bus.
+const wordPenalty = 4
+
+// Clocks to acknowledge a hardware interrupt, before the handler runs.
+const intrAckCycles = 61
+
+var opTimings = [256]opTiming{
+	0x00: {3, 16, 2, false},  // ADD Eb Gb
+	0x01: {3, 16, 2, true},   // ADD Ev Gv
+	0x02: {3, 9, 1, false},   // ADD Gb Eb
+	0x03: {3, 9, 1, true},    // ADD Gv Ev
+	0x04: {4, 4, 0, false},   // ADD AL Ib
+	0x05: {4, 4, 0, true},    // ADD eAX Iv
+	0x06: {10, 10, 1, true},  // PUSH ES
+	0x07: {8, 8, 1, true},    // POP ES
+	0x08: {3, 16, 2, false},  // OR Eb Gb
+	0x09: {3, 16, 2, true},   // OR Ev Gv
+	0x0A: {3, 9, 1, false},   // OR Gb Eb
+	0x0B: {3, 9, 1, true},    // OR Gv Ev
+	0x0C: {4, 4, 0, false},   // OR AL Ib
+	0x0D: {4, 4, 0, true},    // OR eAX Iv
+	0x0E: {10, 10, 1, true},  // PUSH CS
+	0x0F: {8, 8, 1, true},    // --
+	0x10: {3, 16, 2, false},  // ADC Eb Gb
+	0x11: {3, 16, 2, true},   // ADC Ev Gv
+	0x12: {3, 9, 1, false},   // ADC Gb Eb
+	0x13: {3, 9, 1, true},    // ADC Gv Ev
+	0x14: {4, 4, 0, false},   // ADC AL Ib
+	0x15: {4, 4, 0, true},    // ADC eAX Iv
+	0x16: {10, 10, 1, true},  // PUSH SS
+	0x17: {8, 8, 1, true},    // POP SS
+	0x18: {3, 16, 2, false},  // SBB Eb Gb
+	0x19: {3, 16, 2, true},   // SBB Ev Gv
+	0x1A: {3, 9, 1, false},   // SBB Gb Eb
+	0x1B: {3, 9, 1, true},    // SBB Gv Ev
+	0x1C: {4, 4, 0, false},   // SBB AL Ib
+	0x1D: {4, 4, 0, true},    // SBB eAX Iv
+	0x1E: {10, 10, 1, true},  // PUSH DS
+	0x1F: {8, 8, 1, true},    // POP DS
+	0x20: {3, 16, 2, false},  // AND Eb Gb
+	0x21: {3, 16, 2, true},   // AND Ev Gv
+	0x22: {3, 9, 1, false},   // AND Gb Eb
+	0x23: {3, 9, 1, true},    // AND Gv Ev
+	0x24: {4, 4, 0, false},   // AND AL Ib
+	0x25: {4, 4, 0, true},    // AND eAX Iv
+	0x26: {2, 2, 0, false},   // ES:
+	0x27: {4, 4, 0, false},   // DAA
+	0x28: {3, 16, 2, false},  // SUB Eb Gb
+	0x29: {3, 16, 2, true},   // SUB Ev Gv
+	0x2A: {3, 9, 1, false},   // SUB Gb Eb
+	0x2B: {3, 9, 1, true},    // SUB Gv Ev
+	0x2C: {4, 4, 0, false},   // SUB AL Ib
+	0x2D: {4, 4, 0, true},    // SUB eAX Iv
+	0x2E: {2, 2, 0, false},   // CS:
+	0x2F: {4, 4, 0, false},   // DAS
+	0x30: {3, 16, 2, false},  // XOR Eb Gb
+	0x31: {3, 16, 2, true},   // XOR Ev Gv
+	0x32: {3, 9, 1, false},   // XOR Gb Eb
+	0x33: {3, 9, 1, true},    // XOR Gv Ev
+	0x34: {4, 4, 0, false},   // XOR AL Ib
+	0x35: {4, 4, 0, true},    // XOR eAX Iv
+	0x36: {2, 2, 0, false},   // SS:
+	0x37: {4, 4, 0, false},   // AAA
+	0x38: {3, 9, 1, false},   // CMP Eb Gb
+	0x39: {3, 9, 1, true},    // CMP Ev Gv
+	0x3A: {3, 9, 1, false},   // CMP Gb Eb
+	0x3B: {3, 9, 1, true},    // CMP Gv Ev
+	0x3C: {4, 4, 0, false},   // CMP AL Ib
+	0x3D: {4, 4, 0, true},    // CMP eAX Iv
+	0x3E: {2, 2, 0, false},   // DS:
+	0x3F: {4, 4, 0, false},   // AAS
+	0x40: {2, 2, 0, false},   // INC eAX
+	0x41: {2, 2, 0, false},   // INC eCX
+	0x42: {2, 2, 0, false},   // INC eDX
+	0x43: {2, 2, 0, false},   // INC eBX
+	0x44: {2, 2, 0, false},   // INC eSP
+	0x45: {2, 2, 0, false},   // INC eBP
+	0x46: {2, 2, 0, false},   // INC eSI
+	0x47: {2, 2, 0, false},   // INC eDI
+	0x48: {2, 2, 0, false},   // DEC eAX
+	0x49: {2, 2, 0, false},   // DEC eCX
+	0x4A: {2, 2, 0, false},   // DEC eDX
+	0x4B: {2, 2, 0, false},   // DEC eBX
+	0x4C: {2, 2, 0, false},   // DEC eSP
+	0x4D: {2, 2, 0, false},   // DEC eBP
+	0x4E: {2, 2, 0, false},   // DEC eSI
+	0x4F: {2, 2, 0, false},   // DEC eDI
+	0x50: {11, 11, 1, true},  // PUSH eAX
+	0x51: {11, 11, 1, true},  // PUSH eCX
+	0x52: {11, 11, 1, true},  // PUSH eDX
+	0x53: {11, 11, 1, true},  // PUSH eBX
+	0x54: {11, 11, 1, true},  // PUSH eSP
+	0x55: {11, 11, 1, true},  // PUSH eBP
+	0x56: {11, 11, 1, true},  // PUSH eSI
+	0x57: {11, 11, 1, true},  // PUSH eDI
+	0x58: {8, 8, 1, true},    // POP eAX
+	0x59: {8, 8, 1, true},    // POP eCX
+	0x5A: {8, 8, 1, true},    // POP eDX
+	0x5B: {8, 8, 1, true},    // POP eBX
+	0x5C: {8, 8, 1, true},    // POP eSP
+	0x5D: {8, 8, 1, true},    // POP eBP
+	0x5E: {8, 8, 1, true},    // POP eSI
+	0x5F: {8, 8, 1, true},    // POP eDI
+	0x60: {36, 36, 8, true},  // --
+	0x61: {51, 51, 8, true},  // --
+	0x62: {33, 35, 2, true},  // --
+	0x63: {0, 0, 0, false},   // --
+	0x64: {0, 0, 0, false},   // --
+	0x65: {0, 0, 0, false},   // --
+	0x66: {0, 0, 0, false},   // --
+	0x67: {0, 0, 0, false},   // --
+	0x68: {10, 10, 1, true},  // --
+	0x69: {22, 29, 1, true},  // --
+	0x6A: {10, 10, 1, true},  // --
+	0x6B: {22, 29, 1, true},  // --
+	0x6C: {14, 14, 1, false}, // INSB
+	0x6D: {14, 14, 1, true},  // INSW
+	0x6E: {14, 14, 1, false}, // OUTSB
+	0x6F: {14, 14, 1, true},  // OUTSW
+	0x70: {4, 4, 0, false},   // JO Jb
+	0x71: {4, 4, 0, false},   // JNO Jb
+	0x72: {4, 4, 0, false},   // JB Jb
+	0x73: {4, 4, 0, false},   // JNB Jb
+	0x74: {4, 4, 0, false},   // JZ Jb
+	0x75: {4, 4, 0, false},   // JNZ Jb
+	0x76: {4, 4, 0, false},   // JBE Jb
+	0x77: {4, 4, 0, false},   // JA Jb
+	0x78: {4, 4, 0, false},   // JS Jb
+	0x79: {4, 4, 0, false},   // JNS Jb
+	0x7A: {4, 4, 0, false},   // JPE Jb
+	0x7B: {4, 4, 0, false},   // JPO Jb
+	0x7C: {4, 4, 0, false},   // JL Jb
+	0x7D: {4, 4, 0, false},   // JGE Jb
+	0x7E: {4, 4, 0, false},   // JLE Jb
+	0x7F: {4, 4, 0, false},   // JG Jb
+	0x80: {4, 17, 2, false},  // GRP1 Eb Ib
+	0x81: {4, 17, 2, true},   // GRP1 Ev Iv
+	0x82: {4, 17, 2, false},  // GRP1 Eb Ib
+	0x83: {4, 17, 2, true},   // GRP1 Ev Ib
+	0x84: {3, 9, 1, false},   // TEST Gb Eb
+	0x85: {3, 9, 1, true},    // TEST Gv Ev
+	0x86: {4, 17, 2, false},  // XCHG Gb Eb
+	0x87: {4, 17, 2, true},   // XCHG Gv Ev
+	0x88: {2, 9, 1, false},   // MOV Eb Gb
+	0x89: {2, 9, 1, true},    // MOV Ev Gv
+	0x8A: {2, 8, 1, false},   // MOV Gb Eb
+	0x8B: {2, 8, 1, true},    // MOV Gv Ev
+	0x8C: {2, 9, 1, true},    // MOV Ew Sw
+	0x8D: {2, 2, 0, true},    // LEA Gv M
+	0x8E: {2, 8, 1, true},    // MOV Sw Ew
+	0x8F: {8, 17, 2, true},   // POP Ev
+	0x90: {3, 3, 0, false},   // NOP
+	0x91: {3, 3, 0, false},   // XCHG eCX eAX
+	0x92: {3, 3, 0, false},   // XCHG eDX eAX
+	0x93: {3, 3, 0, false},   // XCHG eBX eAX
+	0x94: {3, 3, 0, false},   // XCHG eSP eAX
+	0x95: {3, 3, 0, false},   // XCHG eBP eAX
+	0x96: {3, 3, 0, false},   // XCHG eSI eAX
+	0x97: {3, 3, 0, false},   // XCHG eDI eAX
+	0x98: {2, 2, 0, false},   // CBW
+	0x99: {5, 5, 0, false},   // CWD
+	0x9A: {28, 28, 2, true},  // CALL Ap
+	0x9B: {3, 3, 0, false},   // WAIT
+	0x9C: {10, 10, 1, true},  // PUSHF
+	0x9D: {8, 8, 1, true},    // POPF
+	0x9E: {4, 4, 0, false},   // SAHF
+	0x9F: {4, 4, 0, false},   // LAHF
+	0xA0: {10, 10, 1, false}, // MOV AL Ob
+	0xA1: {10, 10, 1, true},  // MOV eAX Ov
+	0xA2: {10, 10, 1, false}, // MOV Ob AL
+	0xA3: {10, 10, 1, true},  // MOV Ov eAX
+	0xA4: {18, 18, 2, false}, // MOVSB
+	0xA5: {18, 18, 2, true},  // MOVSW
+	0xA6: {22, 22, 2, false}, // CMPSB
+	0xA7: {22, 22, 2, true},  // CMPSW
+	0xA8: {4, 4, 0, false},   // TEST AL Ib
+	0xA9: {4, 4, 0, true},    // TEST eAX Iv
+	0xAA: {11, 11, 1, false}, // STOSB
+	0xAB: {11, 11, 1, true},  // STOSW
+	0xAC: {12, 12, 1, false}, // LODSB
+	0xAD: {12, 12, 1, true},  // LODSW
+	0xAE: {15, 15, 1, false}, // SCASB
+	0xAF: {15, 15, 1, true},  // SCASW
+	0xB0: {4, 4, 0, false},   // MOV AL Ib
+	0xB1: {4, 4, 0, false},   // MOV CL Ib
+	0xB2: {4, 4, 0, false},   // MOV DL Ib
+	0xB3: {4, 4, 0, false},   // MOV BL Ib
+	0xB4: {4, 4, 0, false},   // MOV AH Ib
+	0xB5: {4, 4, 0, false},   // MOV CH Ib
+	0xB6: {4, 4, 0, false},   // MOV DH Ib
+	0xB7: {4, 4, 0, false},   // MOV BH Ib
+	0xB8: {4, 4, 0, false},   // MOV eAX Iv
+	0xB9: {4, 4, 0, false},   // MOV eCX Iv
+	0xBA: {4, 4, 0, false},   // MOV eDX Iv
+	0xBB: {4, 4, 0, false},   // MOV eBX Iv
+	0xBC: {4, 4, 0, false},   // MOV eSP Iv
+	0xBD: {4, 4, 0, false},   // MOV eBP Iv
+	0xBE: {4, 4, 0, false},   // MOV eSI Iv
+	0xBF: {4, 4, 0, false},   // MOV eDI Iv
+	0xC0: {8, 20, 2, false},  // --
+	0xC1: {8, 20, 2, true},   // --
+	0xC2: {12, 12, 1, true},  // RET Iw
+	0xC3: {8, 8, 1, true},    // RET
+	0xC4: {16, 16, 2, true},  // LES Gv Mp
+	0xC5: {16, 16, 2, true},  // LDS Gv Mp
+	0xC6: {4, 10, 1, false},  // MOV Eb Ib
+	0xC7: {4, 10, 1, true},   // MOV Ev Iv
+	0xC8: {15, 15, 1, true},  // --
+	0xC9: {8, 8, 1, true},    // --
+	0xCA: {17, 17, 2, true},  // RETF Iw
+	0xCB: {18, 18, 2, true},  // RETF
+	0xCC: {52, 52, 5, true},  // INT 3
+	0xCD: {51, 51, 5, true},  // INT Ib
+	0xCE: {4, 4, 0, true},    // INTO
+	0xCF: {24, 24, 3, true},  // IRET
+	0xD0: {2, 15, 2, false},  // GRP2 Eb 1
+	0xD1: {2, 15, 2, true},   // GRP2 Ev 1
+	0xD2: {8, 20, 2, false},  // GRP2 Eb CL
+	0xD3: {8, 20, 2, true},   // GRP2 Ev CL
+	0xD4: {83, 83, 0, false}, // AAM I0
+	0xD5: {60, 60, 0, false}, // AAD I0
+	0xD6: {2, 2, 0, false},   // --
+	0xD7: {11, 11, 1, false}, // XLAT
+	0xD8: {2, 8, 1, true},    // --
+	0xD9: {2, 8, 1, true},    // --
+	0xDA: {2, 8, 1, true},    // --
+	0xDB: {2, 8, 1, true},    // --
+	0xDC: {2, 8, 1, true},    // --
+	0xDD: {2, 8, 1, true},    // --
+	0xDE: {2, 8, 1, true},    // --
+	0xDF: {2, 8, 1, true},    // --
+	0xE0: {5, 5, 0, false},   // LOOPNZ Jb
+	0xE1: {6, 6, 0, false},   // LOOPZ Jb
+	0xE2: {5, 5, 0, false},   // LOOP Jb
+	0xE3: {6, 6, 0, false},   // JCXZ Jb
+	0xE4: {10, 10, 1, false}, // IN AL Ib
+	0xE5: {10, 10, 1, true},  // IN eAX Ib
+	0xE6: {10, 10, 1, false}, // OUT Ib AL
+	0xE7: {10, 10, 1, true},  // OUT Ib eAX
+	0xE8: {19, 19, 1, true},  // CALL Jv
+	0xE9: {15, 15, 0, false}, // JMP Jv
+	0xEA: {15, 15, 0, false}, // JMP Ap
+	0xEB: {15, 15, 0, false}, // JMP Jb
+	0xEC: {8, 8, 1, false},   // IN AL DX
+	0xED: {8, 8, 1, true},    // IN eAX DX
+	0xEE: {8, 8, 1, false},   // OUT DX AL
+	0xEF: {8, 8, 1, true},    // OUT DX eAX
+	0xF0: {2, 2, 0, false},   // LOCK
+	0xF1: {2, 2, 0, false},   // --
+	0xF2: {2, 2, 0, false},   // REPNZ
+	0xF3: {2, 2, 0, false},   // REPZ
+	0xF4: {2, 2, 0, false},   // HLT
+	0xF5: {2, 2, 0, false},   // CMC
+	0xF6: {5, 11, 1, false},  // GRP3a Eb
+	0xF7: {5, 11, 1, true},   // GRP3b Ev
+	0xF8: {2, 2, 0, false},   // CLC
+	0xF9: {2, 2, 0, false},   // STC
+	0xFA: {2, 2, 0, false},   // CLI
+	0xFB: {2, 2, 0, false},   // STI
+	0xFC: {2, 2, 0, false},   // CLD
+	0xFD: {2, 2, 0, false},   // STD
+	0xFE: {3, 15, 2, false},  // GRP4 Eb
+	0xFF: {3, 15, 2, true},   // GRP5 Ev
+}
+
+// Per iteration clocks of the REP prefixed string instructions, on top of
+// the base cost of 9.
+var repTimings = map[uint8]uint16{
+	0x6C: 8, 0x6D: 8, 0x6E: 8, 0x6F: 8,
+	0xA4: 17, 0xA5: 17, 0xA6: 22, 0xA7: 22,
+	0xAA: 10, 0xAB: 10, 0xAC: 13, 0xAD: 13,
+	0xAE: 15, 0xAF: 15,
+}
+
+// GRP3 MUL, IMUL, DIV and IDIV, indexed by [Reg-4][word].
+var grp3Timings = [4][2]uint16{
+	{73, 126},  // MUL
+	{89, 141},  // IMUL
+	{85, 153},  // DIV
+	{106, 174}, // IDIV
+}
+
+// Clocks to calculate the effective address of a memory operand.
+func (m *ModRM) eaCycles() uint64 {
+	if m.Mod == 3 {
+		return 0
+	}
+	if m.Mod == 0 && m.Rm == 6 {
+		// Displacement only
+		return 6
+	}
+	var c uint64
+	switch m.Rm {
+	case 0, 3: // BX+SI, BP+DI
+		c = 7
+	case 1, 2: // BX+DI, BP+SI
+		c = 8
+	default: // SI, DI, BP, BX
+		c = 5
+	}
+	if m.Mod != 0 {
+		// Displacement
+		c += 4
+	}
+	return c
+}
+
+// Clocks taken by the instruction which has just executed.  shiftCount is
+// the value of CL before the instruction ran and next is the IP following
+// the instruction, used to tell if a branch was taken.
+func (cpu *CPU) instCycles(inst *Inst, shiftCount uint, next uint16) uint64 {
+	t := opTimings[inst.OpCode]
+	xfer := uint64(t.Xfer)
+	mem := inst.ModRM != nil && inst.ModRM.Mod != 3
+	var cycles uint64
+	if mem {
+		cycles = uint64(t.Mem) + inst.ModRM.eaCycles()
+	} else {
+		cycles = uint64(t.Reg)
+	}
+
+	taken := cpu.Ip != next
+	switch op := inst.OpCode; {
+	case op >= 0x70 && op <= 0x7F, op >= 0xE1 && op <= 0xE3:
+		if taken {
+			cycles += 12
+		}
+	case op == 0xE0:
+		// LOOPNE
+		if taken {
+			cycles += 14
+		}
+	case op == 0xCE:
+		// INTO
+		if taken {
+			cycles += 49
+		}
+	case op == 0xC0, op == 0xC1, op == 0xD2, op == 0xD3:
+		if op <= 0xC1 {
+			shiftCount = inst.Imm
+		}
+		cycles += 4 * uint64(shiftCount&0xFF)
+	case op == 0xF6, op == 0xF7:
+		switch r := inst.ModRM.Reg; {
+		case r >= 4:
+			// MUL, IMUL, DIV, IDIV
+			cycles = uint64(grp3Timings[r-4][op&1])
+			if mem {
+				cycles += 6 + inst.ModRM.eaCycles()
+			}
+		case r == 2, r == 3:
+			// NOT, NEG read and write their operand.
+			if mem {
+				cycles += 5
+				xfer = 2
+			} else {
+				cycles = 3
+			}
+		}
+	case op >= 0x80 && op <= 0x83:
+		if mem && inst.ModRM.Reg == 7 {
+			// CMP only reads memory.
+			cycles -= 7
+			xfer = 1
+		}
+	case op == 0xFF:
+		switch inst.ModRM.Reg {
+		case 2: // CALL near
+			cycles += 13
+			if mem {
+				cycles -= 7
+			}
+		case 3: // CALL far
+			cycles += 22
+			xfer = 4
+		case 4: // JMP near
+			cycles += 8
+			if mem {
+				cycles -= 5
+				xfer = 1
+			}
+		case 5: // JMP far
+			cycles += 9
+		case 6: // PUSH
+			cycles += 8
+			if mem {
+				cycles -= 7
+			}
+		}
+	}
+
+	if n, ok := repTimings[inst.OpCode]; ok && (inst.Rep || inst.RepNe) {
+		// The cost of a single iteration is replaced by the REP cost.
+		cycles = 9 + uint64(n)*cpu.repCount
+		xfer *= cpu.repCount
+	}
+
+	if t.Word && xfer > 0 && (cpu.Bus8 || (mem && inst.ModRM.effectiveAddressOffset16(cpu)&1 != 0)) {
+		// N.B. The address is calculated after the instruction has run,
+		// which is only wrong when it changed its own address registers.
+		cycles += xfer * wordPenalty
+	}
+	// Each prefix takes 2 clocks.
+	return cycles + uint64(2*inst.Prefixes)
+}
+
+// Sleeps whenever the emulation gets ahead of ClockHz.
+type pacer struct {
+	cpu         *CPU
+	start       time.Time
+	startCycles uint64
+	next        uint64
+}
+
+func newPacer(cpu *CPU) *pacer {
+	return &pacer{cpu: cpu, start: time.Now(), startCycles: cpu.Cycles}
+}
+
+func (p *pacer) wait() {
+	hz := p.cpu.ClockHz
+	if hz == 0 || p.cpu.Cycles < p.next {
+		return
+	}
+	// Check again after a millisecond of emulated time.
+	p.next = p.cpu.Cycles + hz/1000
+
+	cycles := p.cpu.Cycles - p.startCycles
+	emulated := time.Duration(cycles/hz)*time.Second + time.Duration(cycles%hz*uint64(time.Second)/hz)
+	ahead := emulated - time.Since(p.start)
+	if ahead > 0 {
+		time.Sleep(ahead)
+	} else if ahead < -100*time.Millisecond {
+		// Don't race to catch up after being stopped, i.e. in the debugger.
+		p.start = time.Now()
+		p.startCycles = p.cpu.Cycles
+	}
+}
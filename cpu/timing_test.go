@@ -0,0 +1,53 @@
+package go86
+
+import (
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestCycles(t *testing.T) {
+	tests := []struct {
+		descr   string
+		opcodes string
+		setup   func(*CPU)
+		cycles  uint64
+	}{
+		{"ADD reg,reg", "01D8", nil, 3},
+		{"ADD [BX],AX", "0107", nil, 16 + 5},
+		{"ADD [BX],AX 8088", "0107", func(c *CPU) { c.Bus8 = true }, 16 + 5 + 2*4},
+		{"MOV AX,[BX+1] odd", "8B4701", nil, 8 + 9 + 4},
+		{"MOV AL,[BX+1] odd", "8A4701", nil, 8 + 9},
+		{"CS: MOV AX,[BX]", "2E8B07", nil, 2 + 8 + 5},
+		{"MOV AX,[1234]", "8B063412", nil, 8 + 6},
+		{"MOV AX,[BP+SI+2]", "8B4202", nil, 8 + 12},
+		{"JZ not taken", "7402", nil, 4},
+		{"JZ taken", "7402", func(c *CPU) { c.Flags.SetFlags(ZF) }, 16},
+		{"SHL AX,CL", "D3E0", func(c *CPU) { c.Regs.SetReg8(CL, 3) }, 8 + 3*4},
+		{"SHL AX,3", "C1E003", nil, 8 + 3*4},
+		{"MUL BL", "F6E3", nil, 73},
+		{"NEG AX", "F7D8", nil, 3},
+		{"CMP [BX],1", "803F01", nil, 10 + 5},
+		{"REP INSB", "F36C", func(c *CPU) { c.Regs.SetReg16(CX, 3) }, 2 + 9 + 3*8},
+	}
+	for _, test := range tests {
+		t.Run(test.descr, func(t *testing.T) {
+			cpu := SetupCPU(t, test.opcodes)
+			if test.setup != nil {
+				test.setup(cpu)
+			}
+			assert.NilError(t, cpu.RunOnce())
+			assert.Equal(t, cpu.Cycles, test.cycles)
+		})
+	}
+}
+
+func TestCyclesAccumulate(t *testing.T) {
+	// NOP; NOP; MOV AX,1
+	cpu := SetupCPU(t, "9090B80100")
+	for i := 0; i < 3; i++ {
+		assert.NilError(t, cpu.RunOnce())
+	}
+	assert.Equal(t, cpu.Cycles, uint64(3+3+4))
+	assert.Equal(t, cpu.Instructions, uint64(3))
+}
@@ -1,40 +1,22 @@
 package go86
 
-import (
-	"fmt"
-
-	log "github.com/golang/glog"
-)
-
 // JMP REL8
 func (cpu *CPU) jmprel8(inst *Inst) error {
-	urel, err := inst.Fetch8()
-	if err != nil {
-		return err
-	}
+	urel := uint8(inst.Imm)
 	return cpu.jump8rel(int8(urel))
 }
 
 // JMP REL16 (note, this can be a negative displacement)
 func (cpu *CPU) jmprel16(inst *Inst) error {
-	urel, err := inst.Fetch16()
-	if err != nil {
-		return err
-	}
+	urel := uint16(inst.Imm)
 	return cpu.jump16rel(int16(urel))
 }
 
 // JMP far absolute (ptr16:16)
 // Example: 0000000E  EA45230000        jmp 0x0:0x2345
 func (cpu *CPU) jmpFarAbs(inst *Inst) error {
-	offset, err := inst.Fetch16()
-	if err != nil {
-		return err
-	}
-	seg, err := inst.Fetch16()
-	if err != nil {
-		return err
-	}
+	offset := uint16(inst.Imm)
+	seg := uint16(inst.Imm2)
 	cpu.Regs.SetSeg16(CS, uint(seg))
 	cpu.Ip = offset
 	return nil
@@ -107,10 +89,7 @@ func (cpu *CPU) jump16rel(rel int16) error {
 }
 
 func (cpu *CPU) jumpIfFlag8(inst *Inst, flag uint32) error {
-	rel, err := inst.Fetch8()
-	if err != nil {
-		return err
-	}
+	rel := uint8(inst.Imm)
 	if cpu.Flags.IsEnabled(flag) {
 		return cpu.jump8rel(int8(rel))
 	}
@@ -119,10 +98,7 @@ func (cpu *CPU) jumpIfFlag8(inst *Inst, flag uint32) error {
 
 // jumpIfNoFlag8 - jump if not flag
 func (cpu *CPU) jumpIfNoFlag8(inst *Inst, flag uint32) error {
-	rel, err := inst.Fetch8()
-	if err != nil {
-		return err
-	}
+	rel := uint8(inst.Imm)
 	if !cpu.Flags.IsEnabled(flag) {
 		return cpu.jump8rel(int8(rel))
 	}
@@ -166,10 +142,7 @@ func (cpu *CPU) jbe8(inst *Inst) error {
 
 // ja8 - jump if above
 func (cpu *CPU) ja8(inst *Inst) error {
-	rel, err := inst.Fetch8()
-	if err != nil {
-		return err
-	}
+	rel := uint8(inst.Imm)
 	if !cpu.Flags.IsEnabled(CarryFlag) && !cpu.Flags.IsEnabled(ZeroFlag) {
 		return cpu.jump8rel(int8(rel))
 	}
@@ -198,10 +171,7 @@ func (cpu *CPU) jpo8(inst *Inst) error {
 
 // jl8 - jump if less
 func (cpu *CPU) jl8(inst *Inst) error {
-	rel, err := inst.Fetch8()
-	if err != nil {
-		return err
-	}
+	rel := uint8(inst.Imm)
 	sf := cpu.Flags.IsEnabled(SignFlag)
 	of := cpu.Flags.IsEnabled(OverflowFlag)
 	if sf != of {
@@ -212,10 +182,7 @@ func (cpu *CPU) jl8(inst *Inst) error {
 
 // jle8 - jump if less or equal
 func (cpu *CPU) jle8(inst *Inst) error {
-	rel, err := inst.Fetch8()
-	if err != nil {
-		return err
-	}
+	rel := uint8(inst.Imm)
 	sf := cpu.Flags.IsEnabled(SignFlag)
 	of := cpu.Flags.IsEnabled(OverflowFlag)
 	zf := cpu.Flags.IsEnabled(ZeroFlag)
@@ -227,10 +194,7 @@ func (cpu *CPU) jle8(inst *Inst) error {
 
 // jg8 - jump if greater
 func (cpu *CPU) jg8(inst *Inst) error {
-	rel, err := inst.Fetch8()
-	if err != nil {
-		return err
-	}
+	rel := uint8(inst.Imm)
 	sf := cpu.Flags.IsEnabled(SignFlag)
 	of := cpu.Flags.IsEnabled(OverflowFlag)
 	zf := cpu.Flags.IsEnabled(ZeroFlag)
@@ -242,10 +206,7 @@ func (cpu *CPU) jg8(inst *Inst) error {
 
 // jge8 - jump if greater or equal
 func (cpu *CPU) jge8(inst *Inst) error {
-	rel, err := inst.Fetch8()
-	if err != nil {
-		return err
-	}
+	rel := uint8(inst.Imm)
 	sf := cpu.Flags.IsEnabled(SignFlag)
 	of := cpu.Flags.IsEnabled(OverflowFlag)
 	if sf == of {
@@ -256,24 +217,15 @@ func (cpu *CPU) jge8(inst *Inst) error {
 
 // callNear
 func (cpu *CPU) callNear(inst *Inst) error {
-	off, err := inst.Fetch16()
-	if err != nil {
-		return err
-	}
+	off := uint16(inst.Imm)
 	cpu.Regs.Push16(cpu.Mem, cpu.Ip)
 	return cpu.jump16rel(int16(off))
 }
 
 // callFar - call far
 func (cpu *CPU) callFar(inst *Inst) error {
-	off, err := inst.Fetch16()
-	if err != nil {
-		return err
-	}
-	seg, err := inst.Fetch16()
-	if err != nil {
-		return err
-	}
+	off := uint16(inst.Imm)
+	seg := uint16(inst.Imm2)
 	cpu.Regs.PushSeg16(CS, cpu.Mem)
 	cpu.Regs.Push16(cpu.Mem, cpu.Ip)
 	cpu.Regs.SetSeg16(CS, uint(seg))
@@ -284,10 +236,7 @@ func (cpu *CPU) callFar(inst *Inst) error {
 // jcxz - jump if cx is zero
 func (cpu *CPU) jcxz(inst *Inst) error {
 	// Need to fetch the next value before checking CX
-	urel, err := inst.Fetch8()
-	if err != nil {
-		return err
-	}
+	urel := uint8(inst.Imm)
 	if cpu.Regs.GetReg16(CX) == 0 {
 		return cpu.jump8rel(int8(urel))
 	}
@@ -295,10 +244,7 @@ func (cpu *CPU) jcxz(inst *Inst) error {
 }
 
 func (cpu *CPU) loopOnCondition(inst *Inst, cond bool) error {
-	urel, err := inst.Fetch8()
-	if err != nil {
-		return err
-	}
+	urel := uint8(inst.Imm)
 	cpu.Regs.Dec16(CX, 1)
 	if cpu.Regs.GetReg16(CX) != 0 && cond {
 		return cpu.jump8rel(int8(urel))
@@ -341,21 +287,38 @@ func (cpu *CPU) retFar(bytesToPop uint) error {
 }
 
 func (cpu *CPU) int(intrno int) error {
-	if cpu.Intrs[intrno] != nil {
-		log.V(4).Infof("Call Internal Interrupt # 0x%X", intrno)
-		cpu.Intrs[intrno](cpu, intrno)
+	if cpu.atIntrEntry(intrno) {
+		cpu.callIntrEntry(intrno)
 		return nil
-	} else {
-		// Call memory based x86 interrupt code
-		cpu.Regs.Push16(cpu.Mem, uint16(cpu.Flags.Value()))
-		cpu.Regs.PushSeg16(CS, cpu.Mem)
-		cpu.Regs.Push16(cpu.Mem, cpu.Ip)
-
-		// Update CS:IP from interrupt table
-		cpu.Ip = cpu.Mem.GetMem16(0x0000, uint(intrno*4))
-		cs := cpu.Mem.GetMem16(0x0000, 2+uint(intrno*4))
-		cpu.Regs.SetSeg16(CS, uint(cs))
 	}
+	cpu.interrupt(intrno)
+	return nil
+}
+
+// BOUND - Check Array Index Against Bounds
+func (cpu *CPU) bound(inst *Inst) error {
+	if inst.ModRM.Mod == 3 {
+		// The bounds have to be in memory.
+		return cpu.invalidOpcode()
+	}
+	seg, off, err := inst.ModRM.GetMemoryLocation(cpu, inst)
+	if err != nil {
+		return err
+	}
+	index := int16(inst.ModRM.R16(cpu))
+	lower := int16(cpu.Mem.GetMem16(seg, off))
+	upper := int16(cpu.Mem.GetMem16(seg, (off+2)&0xFFFF))
+	if index < lower || index > upper {
+		// Like a fault, the return address is the BOUND instruction.
+		cpu.Ip = cpu.instIp
+		return cpu.int(0x05)
+	}
+	return nil
+}
 
-	return fmt.Errorf("INT %d: Implement me", intrno)
+// Raises the 80186 invalid opcode exception, the return address is the
+// faulting instruction.
+func (cpu *CPU) invalidOpcode() error {
+	cpu.Ip = cpu.instIp
+	return cpu.int(0x06)
 }
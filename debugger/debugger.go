@@ -9,6 +9,7 @@ import (
 
 	log "github.com/golang/glog"
 	cpu "go86.org/go86/cpu"
+	disasm "go86.org/go86/disasm"
 )
 
 // Interface type for a breakpoint
@@ -31,6 +32,24 @@ func (b Breakpoint) ShouldBreak(c *cpu.CPU) bool {
 	return false
 }
 
+// Watchpoint breaks after an instruction touches memory in a range of
+// physical addresses, or before one is fetched from it.
+type Watchpoint struct {
+	Start, End uint
+	Access     cpu.Access
+	hook       int
+	hit        bool
+}
+
+func (w *Watchpoint) ShouldBreak(c *cpu.CPU) bool {
+	if w.hit {
+		w.hit = false
+		log.V(1).Infof("Watchpoint [%05X, %05X) %v hit at: [%04X:%04X]", w.Start, w.End, w.Access, c.Regs.CS(), c.Ip)
+		return true
+	}
+	return false
+}
+
 type DebugCommand int
 
 const (
@@ -140,31 +159,32 @@ func (d *DebuggerBackend) Interrupt() {
 
 func (d *DebuggerBackend) ShouldBreak() bool {
 	// Are we in single step mode?
-	if d.mode == STEPPING {
-		return true
-	}
+	stop := d.mode == STEPPING
 
-	// Now look for breakpoints to see if the debugger should break.
+	// Now look for breakpoints to see if the debugger should break.  They
+	// are all asked even when stepping, so watchpoints don't remember a hit
+	// for later.
 	for _, bp := range d.breakpoints {
 		if bp.ShouldBreak(d.cpu) {
-			return true
+			stop = true
 		}
 	}
 	d.mu.RLock()
 	defer d.mu.RUnlock()
-	return d.interrupted
+	return stop || d.interrupted
 }
 
 // Returns the next instruction as a disasmembled string
-// Example: 0E06:004E BE0010            MOV     SI,1000
+// Example: 0E06:004E be0010             mov si, 0x1000
 func DisasmString(c *cpu.CPU) string {
-	prefix := ""
-	//	if c.Inst.Prefix[0] != 0 {
-	//	prefix = fmt.Sprintf("[%v]", c.Inst.Prefix[0])
-	//}
-	disam := c.Mem.At(c.Regs.CS(), uint(c.Ip))[:c.Inst.Len]
-	return fmt.Sprintf("%04X:%04X %-18s %s %#v\n",
-		c.Regs.CS(), c.Ip, hex.EncodeToString(disam), prefix, c.Inst)
+	d := &disasm.Disassembler{Syntax: disasm.Intel, Model: c.Model}
+	code := c.Mem.At(c.Regs.CS(), uint(c.Ip))
+	text, n, err := d.Disasm(code, c.Ip)
+	if err != nil {
+		text, n = err.Error(), 0
+	}
+	return fmt.Sprintf("%04X:%04X %-18s %s\n",
+		c.Regs.CS(), c.Ip, hex.EncodeToString(code[:n]), text)
 }
 
 func (d *DebuggerBackend) Step() bool {
@@ -275,6 +295,28 @@ func (d *DebuggerBackend) RemoveBreakpoint(sb Breakpoint) bool {
 	return false
 }
 
+// AddWatchpoint breaks on the kinds of access in access to the physical
+// addresses [start, end).
+func (d *DebuggerBackend) AddWatchpoint(start, end uint, access cpu.Access) *Watchpoint {
+	w := &Watchpoint{Start: start, End: end, Access: access}
+	w.hook = d.cpu.Mem.AddHook(start, end, access, func(uint, cpu.Access, uint8) {
+		w.hit = true
+	})
+	d.breakpoints = append(d.breakpoints, w)
+	return w
+}
+
+func (d *DebuggerBackend) RemoveWatchpoint(w *Watchpoint) bool {
+	for i, rb := range d.breakpoints {
+		if rb == Breaker(w) {
+			d.cpu.Mem.RemoveHook(w.hook)
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
 func listen(port int, dbgtype string, request chan DebuggerRequest, response chan DebuggerResponse) error {
 	lsock, err := net.Listen("tcp4", ":"+strconv.Itoa(port))
 	if err != nil {
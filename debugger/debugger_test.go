@@ -84,3 +84,23 @@ func TestDebuggerShouldBreak(t *testing.T) {
 	c.Ip++
 	assert.Assert(t, b.ShouldBreak(c) == false)
 }
+
+func TestDebuggerWatchpoint(t *testing.T) {
+	c := cpu.NewCpu(1024 * 1024)
+	d := NewDebuggerBackend(c, nil, nil)
+	d.mode = RUNNING
+
+	w := d.AddWatchpoint(0x10000, 0x10002, cpu.AccessWrite)
+	assert.Assert(t, d.ShouldBreak() == false)
+	c.Mem.GetMem8(0x1000, 0)
+	assert.Assert(t, d.ShouldBreak() == false)
+	c.Mem.SetMem8(0x1000, 1, 0x12)
+	assert.Assert(t, d.ShouldBreak() == true)
+	// Only once per hit
+	assert.Assert(t, d.ShouldBreak() == false)
+
+	assert.Assert(t, d.RemoveWatchpoint(w) == true)
+	assert.Assert(t, d.RemoveWatchpoint(w) == false)
+	c.Mem.SetMem8(0x1000, 1, 0x12)
+	assert.Assert(t, d.ShouldBreak() == false)
+}
@@ -0,0 +1,43 @@
+package go86
+
+import (
+	log "github.com/golang/glog"
+	cpu "go86.org/go86/cpu"
+)
+
+const SystemControlPort = 0x92
+
+// A20Gate is the fast A20 gate in system control port A (92h) of the PS/2
+// and later PCs.  Bit 1 opens the gate, the rest of the port reads back what
+// was written.
+type A20Gate struct {
+	mem *cpu.Memory
+	val uint8
+}
+
+// NewA20Gate attaches the gate for c's memory to port 0x92.
+func NewA20Gate(c *cpu.CPU) *A20Gate {
+	g := &A20Gate{mem: c.Mem}
+	err := c.Ports.Register(SystemControlPort, SystemControlPort, cpu.PortHandler{
+		In8:  g.In8,
+		Out8: g.Out8,
+	})
+	if err != nil {
+		log.Warningf("Unable to register A20 gate: %v", err)
+	}
+	return g
+}
+
+func (g *A20Gate) In8(port uint16) uint8 {
+	v := g.val &^ 0x02
+	if g.mem.A20() {
+		v |= 0x02
+	}
+	return v
+}
+
+func (g *A20Gate) Out8(port uint16, val uint8) {
+	// Bit 0 resets the CPU, which isn't emulated.
+	g.val = val &^ 0x01
+	g.mem.SetA20(val&0x02 != 0)
+}
@@ -0,0 +1,28 @@
+package go86
+
+import (
+	"testing"
+
+	cpu "go86.org/go86/cpu"
+	"gotest.tools/v3/assert"
+)
+
+func TestA20Gate(t *testing.T) {
+	c := cpu.NewCpu(0x110000)
+	NewA20Gate(c)
+	c.Mem.SetMem8(0, 0x10, 0x12)
+	c.Mem.SetMem8(0xFFFF, 0x20, 0x34)
+	// Wraps around to 0000:0010
+	assert.Equal(t, c.Mem.GetMem8(0, 0x10), uint8(0x34))
+	assert.Equal(t, c.Ports.In8(SystemControlPort)&0x02, uint8(0))
+
+	c.Ports.Out8(SystemControlPort, 0x02)
+	assert.Assert(t, c.Mem.A20())
+	c.Mem.SetMem8(0xFFFF, 0x20, 0x56)
+	assert.Equal(t, c.Mem.GetMem8(0, 0x10), uint8(0x34))
+	assert.Equal(t, c.Mem.GetMem8(0xFFFF, 0x20), uint8(0x56))
+	assert.Equal(t, c.Ports.In8(SystemControlPort)&0x02, uint8(0x02))
+
+	c.Ports.Out8(SystemControlPort, 0x00)
+	assert.Assert(t, !c.Mem.A20())
+}
@@ -0,0 +1,85 @@
+package go86
+
+import (
+	"time"
+
+	cpu "go86.org/go86/cpu"
+)
+
+// Frequency of the PIT input clock in Hz, 14.31818 MHz / 12.
+const PitFrequency = 1193182
+
+// Frequency of the IBM PC's 8088 in Hz, 14.31818 MHz / 3.
+const PCClockHz = 4772727
+
+// Roughly an 8088 at 4.77 MHz, which averages around 12 clocks per
+// instruction, and the PIT runs at a quarter of the CPU clock.
+const DefaultTicksPerInstruction = 3
+
+// Clock is the time source for timer devices, measured in PIT input clock
+// ticks.
+type Clock interface {
+	Ticks() uint64
+}
+
+// InstructionClock derives time from the number of instructions the CPU has
+// executed.  Emulation is deterministic with this clock, which is what tests
+// want.
+type InstructionClock struct {
+	TicksPerInstruction uint64
+
+	cpu *cpu.CPU
+}
+
+func NewInstructionClock(c *cpu.CPU) *InstructionClock {
+	return &InstructionClock{
+		TicksPerInstruction: DefaultTicksPerInstruction,
+		cpu:                 c,
+	}
+}
+
+// Implements Clock
+func (ic *InstructionClock) Ticks() uint64 {
+	return ic.cpu.Instructions * ic.TicksPerInstruction
+}
+
+// CycleClock derives time from the CPU's cycle count, so timers keep in step
+// with the speed of the emulated code.  The CPU runs at CPUHz.
+type CycleClock struct {
+	CPUHz uint64
+
+	cpu *cpu.CPU
+}
+
+func NewCycleClock(c *cpu.CPU) *CycleClock {
+	return &CycleClock{
+		CPUHz: PCClockHz,
+		cpu:   c,
+	}
+}
+
+// Implements Clock
+func (cc *CycleClock) Ticks() uint64 {
+	// Split to avoid overflowing.
+	cycles := cc.cpu.Cycles
+	return cycles/cc.CPUHz*PitFrequency + cycles%cc.CPUHz*PitFrequency/cc.CPUHz
+}
+
+// WallClock derives time from the host's clock, so timers run in real time
+// no matter how fast the emulation is.
+type WallClock struct {
+	start time.Time
+}
+
+func NewWallClock() *WallClock {
+	return &WallClock{start: time.Now()}
+}
+
+// Implements Clock
+func (wc *WallClock) Ticks() uint64 {
+	elapsed := uint64(time.Since(wc.start).Nanoseconds())
+	// Split to avoid overflowing after a few hours.
+	secs := elapsed / uint64(time.Second)
+	nanos := elapsed % uint64(time.Second)
+	return secs*PitFrequency + nanos*PitFrequency/uint64(time.Second)
+}
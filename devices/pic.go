@@ -0,0 +1,267 @@
+package go86
+
+import (
+	"math/bits"
+
+	log "github.com/golang/glog"
+	cpu "go86.org/go86/cpu"
+)
+
+const (
+	PicCommandPort = 0x20
+	PicDataPort    = 0x21
+)
+
+// Initialization sequence state of the PIC, ICW1 is always written to the
+// command port and restarts the sequence.
+type picInitState int
+
+const (
+	picReady picInitState = iota
+	picWantICW2
+	picWantICW3
+	picWantICW4
+)
+
+// PIC emulates a master Intel 8259A programmable interrupt controller.
+type PIC struct {
+	// Interrupt request, in-service and mask registers.
+	irr uint8
+	isr uint8
+	imr uint8
+	// Current level of the IRQ lines, used for edge detection.
+	lines uint8
+
+	vectorBase uint8
+	// IRQ with the lowest priority, the one after it has the highest.
+	lowestPriority uint8
+
+	state       picInitState
+	needICW4    bool
+	single      bool
+	level       bool
+	autoEOI     bool
+	rotateOnAEO bool
+	specialMask bool
+	readISR     bool
+	poll        bool
+}
+
+// NewPIC creates a PIC, attaches it to the I/O ports 0x20-0x21 and makes it
+// the interrupt controller of c.
+func NewPIC(c *cpu.CPU) *PIC {
+	p := &PIC{
+		lowestPriority: 7,
+	}
+	err := c.Ports.Register(PicCommandPort, PicDataPort, cpu.PortHandler{
+		In8:  p.In8,
+		Out8: p.Out8,
+	})
+	if err != nil {
+		log.Warningf("Unable to register PIC: %v", err)
+	}
+	c.PIC = p
+	return p
+}
+
+// RaiseIRQ sets the IRQ line irq high.  In edge triggered mode a request is
+// only latched on the low to high transition.
+func (p *PIC) RaiseIRQ(irq int) {
+	bit := uint8(1) << (irq & 7)
+	if p.level || p.lines&bit == 0 {
+		p.irr |= bit
+	}
+	p.lines |= bit
+}
+
+// LowerIRQ sets the IRQ line irq low.
+func (p *PIC) LowerIRQ(irq int) {
+	bit := uint8(1) << (irq & 7)
+	p.lines &^= bit
+	if p.level {
+		p.irr &^= bit
+	}
+}
+
+// Rotates v so the highest priority IRQ is bit 0.
+func (p *PIC) byPriority(v uint8) uint8 {
+	return bits.RotateLeft8(v, -int((p.lowestPriority+1)&7))
+}
+
+// Returns the IRQ number with the highest priority in v or -1 if v is 0.
+func (p *PIC) highest(v uint8) int {
+	if v == 0 {
+		return -1
+	}
+	n := bits.TrailingZeros8(p.byPriority(v))
+	return (n + int(p.lowestPriority) + 1) & 7
+}
+
+// Returns the IRQ which would be delivered to the CPU next or -1 when none.
+func (p *PIC) next() int {
+	req := p.irr &^ p.imr
+	if req == 0 {
+		return -1
+	}
+	isr := p.isr
+	if p.specialMask {
+		// Only masked in-service levels are inhibited.
+		isr &^= p.imr
+	}
+	irq := p.highest(req)
+	if svc := p.highest(isr); svc >= 0 {
+		// Must be strictly higher priority than anything in service.
+		if p.byPriority(1<<irq) >= p.byPriority(1<<svc) {
+			return -1
+		}
+	}
+	return irq
+}
+
+// Implements cpu.InterruptController
+func (p *PIC) Pending() bool {
+	return p.state == picReady && p.next() >= 0
+}
+
+// Implements cpu.InterruptController
+func (p *PIC) Acknowledge() int {
+	irq := p.next()
+	if irq < 0 {
+		// Spurious interrupt, the 8259A responds with IRQ 7.
+		return int(p.vectorBase) + 7
+	}
+	bit := uint8(1) << irq
+	if !p.level {
+		p.irr &^= bit
+	}
+	if p.autoEOI {
+		if p.rotateOnAEO {
+			p.lowestPriority = uint8(irq)
+		}
+	} else {
+		p.isr |= bit
+	}
+	return int(p.vectorBase) + irq
+}
+
+// Ends the highest priority in-service interrupt, returning it or -1.
+func (p *PIC) nonSpecificEOI() int {
+	irq := p.highest(p.isr)
+	if irq >= 0 {
+		p.isr &^= 1 << irq
+	}
+	return irq
+}
+
+func (p *PIC) writeCommand(val uint8) {
+	switch {
+	case val&0x10 != 0: // ICW1
+		p.needICW4 = val&0x01 != 0
+		p.single = val&0x02 != 0
+		p.level = val&0x08 != 0
+		p.imr = 0
+		p.isr = 0
+		p.irr = 0
+		p.lowestPriority = 7
+		p.specialMask = false
+		p.readISR = false
+		p.poll = false
+		p.autoEOI = false
+		p.rotateOnAEO = false
+		p.state = picWantICW2
+	case val&0x08 != 0: // OCW3
+		if val&0x02 != 0 {
+			p.readISR = val&0x01 != 0
+		}
+		if val&0x40 != 0 {
+			p.specialMask = val&0x20 != 0
+		}
+		p.poll = val&0x04 != 0
+	default: // OCW2
+		level := val & 0x07
+		switch val >> 5 {
+		case 0: // Clear rotate in automatic EOI mode
+			p.rotateOnAEO = false
+		case 1: // Non-specific EOI
+			p.nonSpecificEOI()
+		case 2: // No operation
+		case 3: // Specific EOI
+			p.isr &^= 1 << level
+		case 4: // Set rotate in automatic EOI mode
+			p.rotateOnAEO = true
+		case 5: // Rotate on non-specific EOI
+			if irq := p.nonSpecificEOI(); irq >= 0 {
+				p.lowestPriority = uint8(irq)
+			}
+		case 6: // Set priority
+			p.lowestPriority = level
+		case 7: // Rotate on specific EOI
+			p.isr &^= 1 << level
+			p.lowestPriority = level
+		}
+	}
+}
+
+func (p *PIC) writeData(val uint8) {
+	switch p.state {
+	case picWantICW2:
+		p.vectorBase = val & 0xF8
+		switch {
+		case !p.single:
+			p.state = picWantICW3
+		case p.needICW4:
+			p.state = picWantICW4
+		default:
+			p.state = picReady
+		}
+	case picWantICW3:
+		// Cascading is not emulated, there is only a master PIC.
+		if p.needICW4 {
+			p.state = picWantICW4
+		} else {
+			p.state = picReady
+		}
+	case picWantICW4:
+		p.autoEOI = val&0x02 != 0
+		p.state = picReady
+	default: // OCW1
+		p.imr = val
+	}
+}
+
+// Polled mode returns 0x80 | IRQ of the highest priority request and
+// acknowledges it as if the CPU had.
+func (p *PIC) readPoll() uint8 {
+	p.poll = false
+	irq := p.next()
+	if irq < 0 {
+		return 0
+	}
+	p.Acknowledge()
+	return 0x80 | uint8(irq)
+}
+
+// In8 services reads of the PIC ports.
+func (p *PIC) In8(port uint16) uint8 {
+	if port == PicDataPort {
+		return p.imr
+	}
+	switch {
+	case p.poll:
+		return p.readPoll()
+	case p.readISR:
+		return p.isr
+	default:
+		return p.irr
+	}
+}
+
+// Out8 services writes of the PIC ports.
+func (p *PIC) Out8(port uint16, val uint8) {
+	log.V(3).Infof("PIC: OUT [0x%02X] = 0x%02X", port, val)
+	if port == PicDataPort {
+		p.writeData(val)
+		return
+	}
+	p.writeCommand(val)
+}
@@ -0,0 +1,146 @@
+package go86
+
+import (
+	"testing"
+
+	cpu "go86.org/go86/cpu"
+	"gotest.tools/v3/assert"
+)
+
+// Programs the PIC like the BIOS does with vectors at 0x08.
+func setupPIC(t *testing.T) (*cpu.CPU, *PIC) {
+	c := cpu.NewCpu(1024 * 1024)
+	p := NewPIC(c)
+	c.Ports.Out8(PicCommandPort, 0x13)
+	c.Ports.Out8(PicDataPort, 0x08)
+	c.Ports.Out8(PicDataPort, 0x01)
+	c.Ports.Out8(PicDataPort, 0x00)
+	return c, p
+}
+
+func TestPICSmoke(t *testing.T) {
+	c, p := setupPIC(t)
+	assert.Assert(t, c.PIC == p)
+	assert.Assert(t, !p.Pending())
+
+	p.RaiseIRQ(0)
+	assert.Assert(t, p.Pending())
+	assert.Equal(t, p.Acknowledge(), 0x08)
+	assert.Assert(t, !p.Pending())
+	assert.Equal(t, p.isr, uint8(0x01))
+	assert.Equal(t, p.irr, uint8(0x00))
+
+	// Non-specific EOI
+	c.Ports.Out8(PicCommandPort, 0x20)
+	assert.Equal(t, p.isr, uint8(0x00))
+}
+
+func TestPICEdgeTriggered(t *testing.T) {
+	_, p := setupPIC(t)
+	p.RaiseIRQ(1)
+	assert.Equal(t, p.Acknowledge(), 0x09)
+	// Line still high, no new edge.
+	p.RaiseIRQ(1)
+	assert.Equal(t, p.irr, uint8(0x00))
+	p.LowerIRQ(1)
+	p.RaiseIRQ(1)
+	assert.Equal(t, p.irr, uint8(0x02))
+}
+
+func TestPICPriority(t *testing.T) {
+	c, p := setupPIC(t)
+	p.RaiseIRQ(3)
+	p.RaiseIRQ(1)
+	assert.Equal(t, p.Acknowledge(), 0x09)
+
+	// IRQ 3 is lower priority than the in-service IRQ 1
+	assert.Assert(t, !p.Pending())
+	// IRQ 0 is higher priority so it nests.
+	p.RaiseIRQ(0)
+	assert.Assert(t, p.Pending())
+	assert.Equal(t, p.Acknowledge(), 0x08)
+
+	c.Ports.Out8(PicCommandPort, 0x20) // EOI IRQ 0
+	assert.Equal(t, p.isr, uint8(0x02))
+	c.Ports.Out8(PicCommandPort, 0x20) // EOI IRQ 1
+	assert.Equal(t, p.isr, uint8(0x00))
+	assert.Equal(t, p.Acknowledge(), 0x0B)
+}
+
+func TestPICMask(t *testing.T) {
+	c, p := setupPIC(t)
+	c.Ports.Out8(PicDataPort, 0x01)
+	assert.Equal(t, c.Ports.In8(PicDataPort), uint8(0x01))
+
+	p.RaiseIRQ(0)
+	assert.Assert(t, !p.Pending())
+	c.Ports.Out8(PicDataPort, 0x00)
+	assert.Assert(t, p.Pending())
+}
+
+func TestPICSpecificEOIAndRotate(t *testing.T) {
+	c, p := setupPIC(t)
+	p.RaiseIRQ(4)
+	p.Acknowledge()
+	c.Ports.Out8(PicCommandPort, 0x60|4) // Specific EOI IRQ 4
+	assert.Equal(t, p.isr, uint8(0x00))
+
+	// Make IRQ 4 the lowest priority, IRQ 5 is now the highest.
+	c.Ports.Out8(PicCommandPort, 0xC0|4)
+	p.RaiseIRQ(0)
+	p.RaiseIRQ(5)
+	assert.Equal(t, p.Acknowledge(), 0x0D)
+}
+
+func TestPICReadRegisters(t *testing.T) {
+	c, p := setupPIC(t)
+	p.RaiseIRQ(2)
+	p.RaiseIRQ(6)
+	// Default is to read IRR
+	assert.Equal(t, c.Ports.In8(PicCommandPort), uint8(0x44))
+	p.Acknowledge()
+	c.Ports.Out8(PicCommandPort, 0x0B) // OCW3: read ISR
+	assert.Equal(t, c.Ports.In8(PicCommandPort), uint8(0x04))
+	c.Ports.Out8(PicCommandPort, 0x0A) // OCW3: read IRR
+	assert.Equal(t, c.Ports.In8(PicCommandPort), uint8(0x40))
+}
+
+func TestPICPoll(t *testing.T) {
+	c, p := setupPIC(t)
+	p.RaiseIRQ(5)
+	c.Ports.Out8(PicCommandPort, 0x0C) // OCW3: poll
+	assert.Equal(t, c.Ports.In8(PicCommandPort), uint8(0x85))
+	assert.Equal(t, p.isr, uint8(0x20))
+}
+
+func TestPICAutoEOI(t *testing.T) {
+	c, p := setupPIC(t)
+	c.Ports.Out8(PicCommandPort, 0x13)
+	c.Ports.Out8(PicDataPort, 0x70)
+	c.Ports.Out8(PicDataPort, 0x03) // ICW4: auto EOI
+	p.RaiseIRQ(0)
+	assert.Equal(t, p.Acknowledge(), 0x70)
+	assert.Equal(t, p.isr, uint8(0x00))
+}
+
+func TestPICDeliversToCPU(t *testing.T) {
+	c, p := setupPIC(t)
+	c.Regs.SetSeg16(cpu.CS, 0x100)
+	c.Regs.SetSeg16(cpu.SS, 0x200)
+	c.Regs.SetReg16(cpu.SP, 0x100)
+	// IRQ 0 handler at 0x3000:0x0010
+	c.Mem.SetMem16(0, 0x08*4, 0x0010)
+	c.Mem.SetMem16(0, 0x08*4+2, 0x3000)
+	// STI; NOP; NOP
+	copy(c.Mem.At(0x100, 0), []byte{0xFB, 0x90, 0x90})
+
+	p.RaiseIRQ(0)
+	assert.NilError(t, c.RunOnce()) // STI
+	assert.NilError(t, c.RunOnce()) // NOP, shadowed by the STI
+	assert.Equal(t, c.Ip, uint16(2))
+	assert.NilError(t, c.RunOnce()) // Interrupt then the handler's first instruction
+	assert.Equal(t, c.Regs.CS(), uint(0x3000))
+	assert.Assert(t, !c.Flags.IsEnabled(cpu.InterruptFlag))
+	// IP of the interrupted instruction was pushed
+	assert.Equal(t, c.Mem.GetMem16(0x200, 0xFA), uint16(2))
+}
@@ -0,0 +1,483 @@
+package go86
+
+import (
+	log "github.com/golang/glog"
+	cpu "go86.org/go86/cpu"
+)
+
+const (
+	PitChannel0Port = 0x40
+	PitChannel1Port = 0x41
+	PitChannel2Port = 0x42
+	PitControlPort  = 0x43
+)
+
+// IRQLine is an interrupt request input, implemented by the PIC.
+type IRQLine interface {
+	RaiseIRQ(irq int)
+	LowerIRQ(irq int)
+}
+
+// Access modes from the RW bits of the control word.
+const (
+	pitLatch  = 0
+	pitLSB    = 1
+	pitMSB    = 2
+	pitLSBMSB = 3
+)
+
+type pitChannel struct {
+	mode uint8
+	rw   uint8
+	bcd  bool
+
+	// Last count written, already converted from BCD with 0 meaning the
+	// maximum count.
+	reload uint32
+	// Modes 2 and 3 pick up a new count at the end of the current period.
+	reloadPending bool
+	// Modes 0, 1, 4 and 5 count down from reload.
+	count uint32
+	// Modes 2 and 3 keep the number of ticks into the current period.
+	period  uint32
+	elapsed uint32
+
+	out     bool
+	gate    bool
+	running bool
+	// Only the first terminal count after loading changes OUT.
+	armed     bool
+	nullCount bool
+
+	// Write and read state for the two byte access mode.
+	writeMSB   bool
+	writeLow   uint8
+	readMSB    bool
+	latched    bool
+	latch      uint16
+	latchMSB   bool
+	statusSet  bool
+	statusByte uint8
+}
+
+func (ch *pitChannel) modulus() uint32 {
+	if ch.bcd {
+		return 10000
+	}
+	return 0x10000
+}
+
+func bcdToBinary(v uint16) uint32 {
+	return uint32(v>>12&0xF)*1000 + uint32(v>>8&0xF)*100 + uint32(v>>4&0xF)*10 + uint32(v&0xF)
+}
+
+func binaryToBCD(v uint32) uint16 {
+	return uint16((v/1000%10)<<12 | (v/100%10)<<8 | (v/10%10)<<4 | v%10)
+}
+
+func (ch *pitChannel) setControl(val uint8) {
+	ch.rw = (val >> 4) & 3
+	ch.mode = (val >> 1) & 7
+	if ch.mode > 5 {
+		// Modes 6 and 7 are aliases for 2 and 3.
+		ch.mode -= 4
+	}
+	ch.bcd = val&1 != 0
+	ch.out = ch.mode != 0
+	ch.running = false
+	ch.armed = false
+	ch.nullCount = true
+	ch.writeMSB = false
+	ch.readMSB = false
+	ch.latched = false
+	ch.statusSet = false
+}
+
+// Loads a complete count into the channel.
+func (ch *pitChannel) load(val uint16) {
+	if ch.bcd {
+		ch.reload = bcdToBinary(val)
+	} else {
+		ch.reload = uint32(val)
+	}
+	if ch.reload == 0 {
+		ch.reload = ch.modulus()
+	}
+	ch.nullCount = false
+
+	switch ch.mode {
+	case 0:
+		ch.count = ch.reload
+		ch.out = false
+		ch.running = true
+		ch.armed = true
+	case 4:
+		ch.count = ch.reload
+		ch.out = true
+		ch.running = true
+		ch.armed = true
+	case 2, 3:
+		if ch.running {
+			ch.reloadPending = true
+			return
+		}
+		ch.period = ch.reload
+		ch.elapsed = 0
+		ch.out = true
+		ch.running = true
+	case 1, 5:
+		// Waits for a trigger on the gate.
+	}
+}
+
+func (ch *pitChannel) write(val uint8) {
+	switch ch.rw {
+	case pitLSB:
+		ch.load(uint16(val))
+	case pitMSB:
+		ch.load(uint16(val) << 8)
+	case pitLSBMSB:
+		if !ch.writeMSB {
+			ch.writeLow = val
+			ch.writeMSB = true
+			if ch.mode == 0 {
+				// Writing the first byte stops the count in mode 0.
+				ch.running = false
+				ch.out = false
+			}
+			return
+		}
+		ch.writeMSB = false
+		ch.load(uint16(val)<<8 | uint16(ch.writeLow))
+	}
+}
+
+// Value of the counter as it would be read.
+func (ch *pitChannel) value() uint16 {
+	var v uint32
+	switch ch.mode {
+	case 2:
+		v = ch.period - ch.elapsed
+	case 3:
+		// Counts down by two each half of the period.
+		high := (ch.period + 1) / 2
+		if ch.elapsed < high {
+			v = ch.period - 2*ch.elapsed
+		} else {
+			v = ch.period - 2*(ch.elapsed-high)
+		}
+	default:
+		v = ch.count
+	}
+	v %= ch.modulus()
+	if ch.bcd {
+		return binaryToBCD(v)
+	}
+	return uint16(v)
+}
+
+func (ch *pitChannel) status() uint8 {
+	var s uint8
+	if ch.out {
+		s |= 0x80
+	}
+	if ch.nullCount {
+		s |= 0x40
+	}
+	s |= ch.rw<<4 | ch.mode<<1
+	if ch.bcd {
+		s |= 1
+	}
+	return s
+}
+
+func (ch *pitChannel) latchCount() {
+	if ch.latched {
+		// Further latches are ignored until the latch is read.
+		return
+	}
+	ch.latched = true
+	ch.latch = ch.value()
+	ch.latchMSB = false
+}
+
+func (ch *pitChannel) latchStatus() {
+	if ch.statusSet {
+		return
+	}
+	ch.statusSet = true
+	ch.statusByte = ch.status()
+}
+
+func (ch *pitChannel) read() uint8 {
+	if ch.statusSet {
+		ch.statusSet = false
+		return ch.statusByte
+	}
+
+	if ch.latched {
+		var b uint8
+		switch ch.rw {
+		case pitLSB:
+			b = uint8(ch.latch)
+			ch.latched = false
+		case pitMSB:
+			b = uint8(ch.latch >> 8)
+			ch.latched = false
+		default:
+			if ch.latchMSB {
+				b = uint8(ch.latch >> 8)
+				ch.latched = false
+			} else {
+				b = uint8(ch.latch)
+			}
+			ch.latchMSB = !ch.latchMSB
+		}
+		return b
+	}
+
+	v := ch.value()
+	switch ch.rw {
+	case pitLSB:
+		return uint8(v)
+	case pitMSB:
+		return uint8(v >> 8)
+	default:
+		ch.readMSB = !ch.readMSB
+		if ch.readMSB {
+			return uint8(v)
+		}
+		return uint8(v >> 8)
+	}
+}
+
+func (ch *pitChannel) setGate(gate bool) {
+	rising := gate && !ch.gate
+	ch.gate = gate
+	switch ch.mode {
+	case 1, 5:
+		if rising && !ch.nullCount {
+			ch.count = ch.reload
+			ch.running = true
+			ch.armed = true
+			ch.out = ch.mode == 5
+		}
+	case 2, 3:
+		if !gate {
+			ch.out = true
+		} else if rising && !ch.nullCount {
+			ch.period = ch.reload
+			ch.elapsed = 0
+			ch.out = true
+			ch.running = true
+		}
+	}
+}
+
+// Counts down for modes 0, 1, 4 and 5, returning the number of rising edges
+// of OUT.
+func (ch *pitChannel) advanceOneShot(n uint64) int {
+	rising := 0
+	if (ch.mode == 4 || ch.mode == 5) && !ch.out {
+		// End of the one tick strobe.
+		ch.out = true
+		rising++
+	}
+
+	if uint64(ch.count) > n {
+		ch.count -= uint32(n)
+		return rising
+	}
+
+	// Reached terminal count, the counter keeps wrapping around.
+	rem := n - uint64(ch.count)
+	mod := uint64(ch.modulus())
+	ch.count = uint32((mod - rem%mod) % mod)
+	if !ch.armed {
+		return rising
+	}
+	ch.armed = false
+	switch ch.mode {
+	case 0, 1:
+		if !ch.out {
+			ch.out = true
+			rising++
+		}
+	case 4, 5:
+		if rem > 0 {
+			rising++
+		} else {
+			ch.out = false
+		}
+	}
+	return rising
+}
+
+// Runs the periodic modes 2 and 3, returning the number of rising edges of
+// OUT.
+func (ch *pitChannel) advancePeriodic(n uint64) int {
+	rising := 0
+	total := uint64(ch.elapsed) + n
+	if ch.reloadPending && total >= uint64(ch.period) {
+		total -= uint64(ch.period)
+		ch.period = ch.reload
+		ch.reloadPending = false
+		rising++
+	}
+	period := uint64(ch.period)
+	if period >= 2 {
+		rising += int(total / period)
+	}
+	ch.elapsed = uint32(total % period)
+
+	if ch.mode == 2 {
+		// Low for the one tick before the count reloads.
+		ch.out = ch.elapsed != ch.period-1
+	} else {
+		ch.out = ch.elapsed < (ch.period+1)/2
+	}
+	return rising
+}
+
+// Advances the channel by n ticks, returning the number of rising edges of
+// OUT.
+func (ch *pitChannel) advance(n uint64) int {
+	if !ch.running || n == 0 {
+		return 0
+	}
+	switch ch.mode {
+	case 0, 4:
+		if !ch.gate {
+			return 0
+		}
+		return ch.advanceOneShot(n)
+	case 1, 5:
+		return ch.advanceOneShot(n)
+	default:
+		if !ch.gate {
+			return 0
+		}
+		return ch.advancePeriodic(n)
+	}
+}
+
+// PIT emulates an Intel 8253/8254 programmable interval timer.  Channel 0
+// is wired to IRQ 0, channel 1 would refresh DRAM and channel 2 drives the
+// speaker.
+type PIT struct {
+	channels [3]pitChannel
+	clock    Clock
+	irq      IRQLine
+	last     uint64
+}
+
+// NewPIT creates a PIT using clock as its time source, attaches it to the
+// I/O ports 0x40-0x43 and raises IRQ 0 on irq.  irq may be nil.
+func NewPIT(c *cpu.CPU, irq IRQLine, clock Clock) *PIT {
+	p := &PIT{
+		clock: clock,
+		irq:   irq,
+		last:  clock.Ticks(),
+	}
+	for i := range p.channels {
+		p.channels[i].reload = 0x10000
+		p.channels[i].out = true
+		p.channels[i].nullCount = true
+	}
+	// On the PC the gates of channels 0 and 1 are tied high, channel 2's
+	// is bit 0 of port 0x61.
+	p.channels[0].gate = true
+	p.channels[1].gate = true
+
+	err := c.Ports.Register(PitChannel0Port, PitControlPort, cpu.PortHandler{
+		In8:  p.In8,
+		Out8: p.Out8,
+	})
+	if err != nil {
+		log.Warningf("Unable to register PIT: %v", err)
+	}
+	c.Devices = append(c.Devices, p)
+	return p
+}
+
+// Implements cpu.Device
+func (p *PIT) Tick() {
+	now := p.clock.Ticks()
+	if now <= p.last {
+		return
+	}
+	n := now - p.last
+	p.last = now
+
+	for i := range p.channels {
+		rising := p.channels[i].advance(n)
+		if i != 0 || p.irq == nil {
+			continue
+		}
+		if rising > 0 {
+			p.irq.LowerIRQ(0)
+			p.irq.RaiseIRQ(0)
+		}
+		if !p.channels[0].out {
+			p.irq.LowerIRQ(0)
+		}
+	}
+}
+
+// SetGate sets the level of the gate input of channel ch.
+func (p *PIT) SetGate(ch int, gate bool) {
+	p.Tick()
+	p.channels[ch].setGate(gate)
+}
+
+// Out returns the level of the output of channel ch.
+func (p *PIT) Out(ch int) bool {
+	p.Tick()
+	return p.channels[ch].out
+}
+
+func (p *PIT) control(val uint8) {
+	sc := val >> 6
+	if sc == 3 {
+		// 8254 read-back command, bits 5 and 4 are active low.
+		for i := range p.channels {
+			if val&(2<<i) == 0 {
+				continue
+			}
+			if val&0x20 == 0 {
+				p.channels[i].latchCount()
+			}
+			if val&0x10 == 0 {
+				p.channels[i].latchStatus()
+			}
+		}
+		return
+	}
+	ch := &p.channels[sc]
+	if (val>>4)&3 == pitLatch {
+		ch.latchCount()
+		return
+	}
+	ch.setControl(val)
+}
+
+// In8 services reads of the PIT ports.
+func (p *PIT) In8(port uint16) uint8 {
+	p.Tick()
+	if port == PitControlPort {
+		// The control word register can't be read.
+		return 0xFF
+	}
+	return p.channels[port-PitChannel0Port].read()
+}
+
+// Out8 services writes of the PIT ports.
+func (p *PIT) Out8(port uint16, val uint8) {
+	log.V(3).Infof("PIT: OUT [0x%02X] = 0x%02X", port, val)
+	p.Tick()
+	if port == PitControlPort {
+		p.control(val)
+		return
+	}
+	p.channels[port-PitChannel0Port].write(val)
+}
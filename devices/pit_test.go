@@ -0,0 +1,221 @@
+package go86
+
+import (
+	"testing"
+
+	cpu "go86.org/go86/cpu"
+	"gotest.tools/v3/assert"
+)
+
+// Clock which only moves when the test says so.
+type manualClock struct {
+	ticks uint64
+}
+
+func (m *manualClock) Ticks() uint64 {
+	return m.ticks
+}
+
+// Counts the IRQ 0 edges latched by the PIC.
+type irqCounter struct {
+	line  bool
+	count int
+}
+
+func (i *irqCounter) RaiseIRQ(irq int) {
+	if !i.line {
+		i.count++
+	}
+	i.line = true
+}
+
+func (i *irqCounter) LowerIRQ(irq int) {
+	i.line = false
+}
+
+func setupPIT(t *testing.T) (*cpu.CPU, *PIT, *manualClock, *irqCounter) {
+	c := cpu.NewCpu(1024 * 1024)
+	clk := &manualClock{}
+	irq := &irqCounter{line: true}
+	p := NewPIT(c, irq, clk)
+	return c, p, clk, irq
+}
+
+func (m *manualClock) advance(p *PIT, n uint64) {
+	m.ticks += n
+	p.Tick()
+}
+
+func TestPITMode3SquareWave(t *testing.T) {
+	c, p, clk, irq := setupPIT(t)
+	c.Ports.Out8(PitControlPort, 0x36)
+	c.Ports.Out8(PitChannel0Port, 100)
+	c.Ports.Out8(PitChannel0Port, 0)
+
+	clk.advance(p, 49)
+	assert.Assert(t, p.Out(0))
+	clk.advance(p, 1)
+	assert.Assert(t, !p.Out(0))
+	assert.Equal(t, irq.count, 0)
+	clk.advance(p, 50)
+	assert.Assert(t, p.Out(0))
+	assert.Equal(t, irq.count, 1)
+
+	// Many periods at once coalesce into one request like a real PIC.
+	clk.advance(p, 1000)
+	assert.Equal(t, irq.count, 2)
+}
+
+func TestPITMode3Default(t *testing.T) {
+	c, p, clk, irq := setupPIT(t)
+	c.Ports.Out8(PitControlPort, 0x36)
+	c.Ports.Out8(PitChannel0Port, 0)
+	c.Ports.Out8(PitChannel0Port, 0)
+
+	clk.advance(p, 0xFFFF)
+	assert.Equal(t, irq.count, 0)
+	clk.advance(p, 1)
+	assert.Equal(t, irq.count, 1)
+}
+
+func TestPITMode0(t *testing.T) {
+	c, p, clk, irq := setupPIT(t)
+	c.Ports.Out8(PitControlPort, 0x30)
+	assert.Assert(t, !p.Out(0))
+	c.Ports.Out8(PitChannel0Port, 10)
+	c.Ports.Out8(PitChannel0Port, 0)
+
+	clk.advance(p, 9)
+	assert.Assert(t, !p.Out(0))
+	clk.advance(p, 1)
+	assert.Assert(t, p.Out(0))
+	assert.Equal(t, irq.count, 1)
+
+	// Stays high while the counter wraps.
+	clk.advance(p, 0x10000)
+	assert.Assert(t, p.Out(0))
+	assert.Equal(t, irq.count, 1)
+}
+
+func TestPITMode2(t *testing.T) {
+	c, p, clk, irq := setupPIT(t)
+	c.Ports.Out8(PitControlPort, 0x14) // Channel 0, LSB, mode 2
+	c.Ports.Out8(PitChannel0Port, 4)
+
+	clk.advance(p, 2)
+	assert.Assert(t, p.Out(0))
+	clk.advance(p, 1)
+	assert.Assert(t, !p.Out(0))
+	clk.advance(p, 1)
+	assert.Assert(t, p.Out(0))
+	assert.Equal(t, irq.count, 1)
+}
+
+func TestPITMode4Strobe(t *testing.T) {
+	c, p, clk, irq := setupPIT(t)
+	c.Ports.Out8(PitControlPort, 0x18) // Channel 0, LSB, mode 4
+	c.Ports.Out8(PitChannel0Port, 5)
+
+	clk.advance(p, 5)
+	assert.Assert(t, !p.Out(0))
+	clk.advance(p, 1)
+	assert.Assert(t, p.Out(0))
+	assert.Equal(t, irq.count, 1)
+	clk.advance(p, 100)
+	assert.Equal(t, irq.count, 1)
+}
+
+func TestPITReadCounter(t *testing.T) {
+	c, p, clk, _ := setupPIT(t)
+	c.Ports.Out8(PitControlPort, 0x70) // Channel 1, LSB/MSB, mode 0
+	c.Ports.Out8(PitChannel1Port, 0x34)
+	c.Ports.Out8(PitChannel1Port, 0x12)
+	clk.advance(p, 4)
+
+	lo := c.Ports.In8(PitChannel1Port)
+	hi := c.Ports.In8(PitChannel1Port)
+	assert.Equal(t, uint16(hi)<<8|uint16(lo), uint16(0x1230))
+
+	// Latched value doesn't change while time passes.
+	c.Ports.Out8(PitControlPort, 0x40)
+	clk.advance(p, 0x10)
+	lo = c.Ports.In8(PitChannel1Port)
+	hi = c.Ports.In8(PitChannel1Port)
+	assert.Equal(t, uint16(hi)<<8|uint16(lo), uint16(0x1230))
+	lo = c.Ports.In8(PitChannel1Port)
+	hi = c.Ports.In8(PitChannel1Port)
+	assert.Equal(t, uint16(hi)<<8|uint16(lo), uint16(0x1220))
+}
+
+func TestPITBCD(t *testing.T) {
+	c, p, clk, _ := setupPIT(t)
+	c.Ports.Out8(PitControlPort, 0x31) // Channel 0, LSB/MSB, mode 0, BCD
+	c.Ports.Out8(PitChannel0Port, 0x00)
+	c.Ports.Out8(PitChannel0Port, 0x10) // 1000
+	clk.advance(p, 1)
+
+	c.Ports.Out8(PitControlPort, 0x00)
+	lo := c.Ports.In8(PitChannel0Port)
+	hi := c.Ports.In8(PitChannel0Port)
+	assert.Equal(t, uint16(hi)<<8|uint16(lo), uint16(0x0999))
+}
+
+func TestPITReadBack(t *testing.T) {
+	c, p, clk, _ := setupPIT(t)
+	c.Ports.Out8(PitControlPort, 0xB6) // Channel 2, LSB/MSB, mode 3
+	// Null count until a count is written.
+	c.Ports.Out8(PitControlPort, 0xE8) // Read-back status of channel 2
+	assert.Equal(t, c.Ports.In8(PitChannel2Port), uint8(0xF6))
+
+	c.Ports.Out8(PitChannel2Port, 0x00)
+	c.Ports.Out8(PitChannel2Port, 0x01)
+	p.SetGate(2, true)
+	clk.advance(p, 0x10)
+	c.Ports.Out8(PitControlPort, 0xC8) // Read-back status and count of channel 2
+	assert.Equal(t, c.Ports.In8(PitChannel2Port), uint8(0xB6))
+	lo := c.Ports.In8(PitChannel2Port)
+	hi := c.Ports.In8(PitChannel2Port)
+	assert.Equal(t, uint16(hi)<<8|uint16(lo), uint16(0x100-0x20))
+}
+
+func TestPITGateChannel2(t *testing.T) {
+	c, p, clk, _ := setupPIT(t)
+	c.Ports.Out8(PitControlPort, 0xB2) // Channel 2, LSB/MSB, mode 1
+	c.Ports.Out8(PitChannel2Port, 10)
+	c.Ports.Out8(PitChannel2Port, 0)
+	clk.advance(p, 100)
+	assert.Assert(t, p.Out(2))
+
+	p.SetGate(2, true)
+	assert.Assert(t, !p.Out(2))
+	clk.advance(p, 10)
+	assert.Assert(t, p.Out(2))
+}
+
+func TestInstructionClock(t *testing.T) {
+	c := cpu.NewCpu(1024 * 1024)
+	clk := NewInstructionClock(c)
+	c.Instructions = 10
+	assert.Equal(t, clk.Ticks(), uint64(10*DefaultTicksPerInstruction))
+}
+
+func TestCycleClock(t *testing.T) {
+	c := cpu.NewCpu(1024 * 1024)
+	clk := NewCycleClock(c)
+	c.Cycles = PCClockHz
+	assert.Equal(t, clk.Ticks(), uint64(PitFrequency))
+	c.Cycles = 4
+	assert.Equal(t, clk.Ticks(), uint64(1))
+}
+
+func TestPITRaisesIRQ0ThroughPIC(t *testing.T) {
+	c, pic := setupPIC(t)
+	clk := &manualClock{}
+	p := NewPIT(c, pic, clk)
+	c.Ports.Out8(PitControlPort, 0x36)
+	c.Ports.Out8(PitChannel0Port, 0x10)
+	c.Ports.Out8(PitChannel0Port, 0x00)
+	clk.advance(p, 0x10)
+	assert.Assert(t, pic.Pending())
+	assert.Equal(t, pic.Acknowledge(), 0x08)
+}
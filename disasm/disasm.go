@@ -0,0 +1,404 @@
+package go86
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	cpu "go86.org/go86/cpu"
+)
+
+// Syntax is the assembler dialect instructions are written in.
+type Syntax int
+
+const (
+	// Lower case, "word ptr" and 0x hex like Intel's manuals and objdump.
+	Intel Syntax = iota
+	// What NASM assembles, segment overrides go inside the brackets.
+	NASM
+	// Upper case with 0FFh style hex.
+	MASM
+)
+
+var syntaxNames = map[Syntax]string{
+	Intel: "intel",
+	NASM:  "nasm",
+	MASM:  "masm",
+}
+
+func (s Syntax) String() string {
+	if name, ok := syntaxNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Syntax(%d)", int(s))
+}
+
+// ParseSyntax returns the syntax for a name like "nasm".
+func ParseSyntax(name string) (Syntax, error) {
+	for s, n := range syntaxNames {
+		if strings.EqualFold(n, name) {
+			return s, nil
+		}
+	}
+	return Intel, fmt.Errorf("unknown syntax: %q", name)
+}
+
+// Disassembler turns machine code back into assembly.
+type Disassembler struct {
+	Syntax Syntax
+	// Decides what the model specific opcodes mean.
+	Model cpu.Model
+	// Names for jump and call targets by offset, the rest are numbers.
+	Symbols map[uint16]string
+}
+
+// New returns a disassembler for the 80186 without any symbols.
+func New(syntax Syntax) *Disassembler {
+	return &Disassembler{Syntax: syntax, Model: cpu.Model80186}
+}
+
+// Disasm disassembles the instruction at the start of src, which is at
+// offset ip in the code segment, returning it and its length.
+func (d *Disassembler) Disasm(src []byte, ip uint16) (string, int, error) {
+	inst, err := d.Model.Decode(src)
+	if err != nil {
+		return "", 0, err
+	}
+	return d.Format(inst, ip), inst.Len, nil
+}
+
+// Format writes out an instruction decoded at offset ip.
+func (d *Disassembler) Format(inst *cpu.Inst, ip uint16) string {
+	f := formatter{d: d, inst: inst, ip: ip}
+	return f.format()
+}
+
+// Labels names every jump and call target in code, which starts at offset
+// org, so the disassembly reads like the source.  Names already in symbols
+// are kept.
+func Labels(model cpu.Model, code []byte, org uint16, symbols map[uint16]string) map[uint16]string {
+	labels := map[uint16]string{}
+	for k, v := range symbols {
+		labels[k] = v
+	}
+	for pos := 0; pos < len(code); {
+		inst, err := model.Decode(code[pos:])
+		if err != nil {
+			break
+		}
+		ip := org + uint16(pos)
+		if target, ok := jumpTarget(inst, ip); ok {
+			if _, named := labels[target]; !named {
+				labels[target] = fmt.Sprintf("L%04X", target)
+			}
+		}
+		pos += inst.Len
+	}
+	return labels
+}
+
+// SortedOffsets returns the offsets in symbols in order.
+func SortedOffsets(symbols map[uint16]string) []uint16 {
+	offs := make([]uint16, 0, len(symbols))
+	for off := range symbols {
+		offs = append(offs, off)
+	}
+	sort.Slice(offs, func(i, j int) bool { return offs[i] < offs[j] })
+	return offs
+}
+
+// Where a relative jump or call goes.
+func jumpTarget(inst *cpu.Inst, ip uint16) (uint16, bool) {
+	for _, arg := range inst.Args {
+		switch arg {
+		case cpu.Jb:
+			return ip + uint16(inst.Len) + uint16(int8(inst.Imm)), true
+		case cpu.Jv:
+			return ip + uint16(inst.Len) + uint16(inst.Imm), true
+		}
+	}
+	return 0, false
+}
+
+var (
+	regs8  = [8]string{"al", "cl", "dl", "bl", "ah", "ch", "dh", "bh"}
+	regs16 = [8]string{"ax", "cx", "dx", "bx", "sp", "bp", "si", "di"}
+	sregs  = [4]string{"es", "cs", "ss", "ds"}
+	// Base and index for each ModRM rm field.
+	memBases = [8]string{"bx+si", "bx+di", "bp+si", "bp+di", "si", "di", "bp", "bx"}
+)
+
+// String instructions and the like whose memory operands are implicit,
+// segment overrides on them are written as a prefix.
+var stringOps = map[string]bool{
+	"MOVSB": true, "MOVSW": true, "CMPSB": true, "CMPSW": true,
+	"STOSB": true, "STOSW": true, "LODSB": true, "LODSW": true,
+	"SCASB": true, "SCASW": true, "INSB": true, "INSW": true,
+	"OUTSB": true, "OUTSW": true, "XLAT": true,
+}
+
+type formatter struct {
+	d    *Disassembler
+	inst *cpu.Inst
+	ip   uint16
+}
+
+func (f *formatter) format() string {
+	inst := f.inst
+	var prefixes []string
+	if inst.Lock {
+		prefixes = append(prefixes, "lock")
+	}
+	if inst.Rep {
+		if inst.Name == "CMPSB" || inst.Name == "CMPSW" || inst.Name == "SCASB" || inst.Name == "SCASW" {
+			prefixes = append(prefixes, "repe")
+		} else {
+			prefixes = append(prefixes, "rep")
+		}
+	}
+	if inst.RepNe {
+		prefixes = append(prefixes, "repne")
+	}
+	if inst.HasSegmentOverride && !f.hasMemory() {
+		seg := sregs[inst.SegmentOverride]
+		if f.d.Syntax != NASM {
+			seg += ":"
+		}
+		prefixes = append(prefixes, seg)
+	}
+
+	var text string
+	switch inst.Name {
+	case "ESC":
+		text = f.esc()
+	case "--":
+		text = "db " + f.hex(uint(inst.OpCode))
+	default:
+		text = f.mnemonic()
+		if args := f.args(); len(args) > 0 {
+			text += " " + strings.Join(args, f.sep())
+		}
+	}
+	text = strings.Join(append(prefixes, text), " ")
+	if f.d.Syntax == MASM {
+		return masmCase(text)
+	}
+	return text
+}
+
+// Upper cases everything but the h on the end of hex numbers.
+func masmCase(s string) string {
+	b := []byte(strings.ToUpper(s))
+	for i := 1; i < len(b); i++ {
+		if b[i] == 'H' && isHexDigit(b[i-1]) && (i+1 == len(b) || !isAlnum(b[i+1])) && startsWithDigit(b[:i]) {
+			b[i] = 'h'
+		}
+	}
+	return string(b)
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'F'
+}
+
+func isAlnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '_'
+}
+
+// Whether the word ending at the end of b is a number.
+func startsWithDigit(b []byte) bool {
+	i := len(b)
+	for i > 0 && isAlnum(b[i-1]) {
+		i--
+	}
+	return b[i] >= '0' && b[i] <= '9'
+}
+
+func (f *formatter) sep() string {
+	if f.d.Syntax == NASM {
+		return ","
+	}
+	return ", "
+}
+
+func (f *formatter) hasMemory() bool {
+	for _, arg := range f.inst.Args {
+		if arg == cpu.Ob || arg == cpu.Ov {
+			return true
+		}
+	}
+	return f.inst.ModRM != nil && f.inst.ModRM.Mod != 3
+}
+
+func (f *formatter) mnemonic() string {
+	inst := f.inst
+	name := strings.ToLower(inst.Name)
+	switch {
+	case name == "xlat" && f.d.Syntax == NASM:
+		return "xlatb"
+	case name == "int" && len(inst.Args) == 1 && inst.Args[0].Code() == "3":
+		// CC rather than CD 03
+		if f.d.Syntax == NASM {
+			return "int3"
+		}
+	case name == "shl" && inst.ModRM != nil && inst.ModRM.Reg == 6:
+		// The undocumented alias
+		return "sal"
+	}
+	return name
+}
+
+func (f *formatter) args() []string {
+	inst := f.inst
+	if inst.Name == "INT" && len(inst.Args) == 1 && inst.Args[0].Code() == "3" && f.d.Syntax == NASM {
+		return nil
+	}
+	if (inst.Name == "AAM" || inst.Name == "AAD") && inst.Imm == 10 {
+		return nil
+	}
+
+	imms := []uint{inst.Imm, inst.Imm2}
+	var out []string
+	for i, arg := range inst.Args {
+		var imm uint
+		switch arg {
+		case cpu.Ib, cpu.I0, cpu.Jb, cpu.Iv, cpu.Iw, cpu.Jv, cpu.Ob, cpu.Ov:
+			imm, imms = imms[0], imms[1:]
+		}
+		out = append(out, f.arg(i, arg, imm))
+	}
+	return out
+}
+
+func (f *formatter) arg(i int, arg cpu.Operand, imm uint) string {
+	inst := f.inst
+	switch arg {
+	case cpu.Eb, cpu.Ev, cpu.Ew, cpu.M, cpu.Ma, cpu.Mp:
+		if inst.ModRM.Mod == 3 {
+			if arg == cpu.Eb {
+				return regs8[inst.ModRM.Rm]
+			}
+			return regs16[inst.ModRM.Rm]
+		}
+		return f.sizePtr(arg, i) + f.mem(f.modrmAddr())
+	case cpu.Gb:
+		return regs8[inst.ModRM.Reg]
+	case cpu.Gv:
+		return regs16[inst.ModRM.Reg]
+	case cpu.Sw:
+		return sregs[inst.ModRM.Reg&3]
+	case cpu.Ib:
+		if f.signExtended() {
+			return f.hex(uint(uint16(int8(imm))))
+		}
+		return f.hex(imm)
+	case cpu.I0, cpu.Iv, cpu.Iw:
+		return f.hex(imm)
+	case cpu.Jb, cpu.Jv:
+		target, _ := jumpTarget(inst, f.ip)
+		if name, ok := f.d.Symbols[target]; ok {
+			return name
+		}
+		return f.hex(uint(target))
+	case cpu.Ap:
+		far := f.hex(inst.Imm2) + ":" + f.hex(inst.Imm)
+		if f.d.Syntax == MASM {
+			return "far ptr " + far
+		}
+		return far
+	case cpu.Ob, cpu.Ov:
+		return f.mem(f.hex(imm))
+	}
+	// Registers and constants
+	return strings.ToLower(arg.Code())
+}
+
+// Byte immediates which the CPU sign extends to a word.
+func (f *formatter) signExtended() bool {
+	switch f.inst.OpCode {
+	case 0x83, 0x6A, 0x6B:
+		return true
+	}
+	return false
+}
+
+// Size of a memory operand when nothing else gives it away.
+func (f *formatter) sizePtr(arg cpu.Operand, i int) string {
+	inst := f.inst
+	far := (inst.Name == "CALL" || inst.Name == "JMP") && inst.OpCode == 0xFF &&
+		(inst.ModRM.Reg == 3 || inst.ModRM.Reg == 5)
+	var size string
+	switch {
+	case far && f.d.Syntax == NASM:
+		return "far "
+	case far:
+		size = "dword"
+	case arg == cpu.M || arg == cpu.Ma || arg == cpu.Mp:
+		return ""
+	default:
+		for j, other := range inst.Args {
+			if j == i {
+				continue
+			}
+			switch other {
+			case cpu.Gb, cpu.Gv, cpu.Sw, cpu.RegAL, cpu.RegAX:
+				return ""
+			}
+		}
+		size = "word"
+		if arg == cpu.Eb {
+			size = "byte"
+		}
+	}
+	return f.ptr(size)
+}
+
+func (f *formatter) ptr(size string) string {
+	if f.d.Syntax == NASM {
+		return size + " "
+	}
+	return size + " ptr "
+}
+
+// The address inside the brackets of a ModRM memory operand.
+func (f *formatter) modrmAddr() string {
+	m := f.inst.ModRM
+	switch {
+	case m.Mod == 0 && m.Rm == 6:
+		return f.hex(uint(uint16(m.Disp16)))
+	case m.Mod == 0:
+		return memBases[m.Rm]
+	case m.Mod == 1:
+		if m.Disp8 < 0 {
+			return memBases[m.Rm] + "-" + f.hex(uint(-int(m.Disp8)))
+		}
+		return memBases[m.Rm] + "+" + f.hex(uint(m.Disp8))
+	}
+	return memBases[m.Rm] + "+" + f.hex(uint(uint16(m.Disp16)))
+}
+
+// Wraps an address in brackets with any segment override.
+func (f *formatter) mem(addr string) string {
+	if !f.inst.HasSegmentOverride {
+		return "[" + addr + "]"
+	}
+	seg := sregs[f.inst.SegmentOverride]
+	if f.d.Syntax == NASM {
+		return "[" + seg + ":" + addr + "]"
+	}
+	return seg + ":[" + addr + "]"
+}
+
+func (f *formatter) hex(v uint) string {
+	if f.d.Syntax != MASM {
+		return fmt.Sprintf("0x%x", v)
+	}
+	if v < 10 {
+		return fmt.Sprint(v)
+	}
+	s := fmt.Sprintf("%xh", v)
+	if s[0] >= 'a' {
+		s = "0" + s
+	}
+	return s
+}
@@ -0,0 +1,326 @@
+package go86
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	cpu "go86.org/go86/cpu"
+	"gotest.tools/v3/assert"
+)
+
+func TestDisasm(t *testing.T) {
+	tests := []struct {
+		bytes string
+		intel string
+		nasm  string
+		masm  string
+	}{
+		{"89D8", "mov ax, bx", "mov ax,bx", "MOV AX, BX"},
+		{"B8FF00", "mov ax, 0xff", "mov ax,0xff", "MOV AX, 0FFh"},
+		{"8B4702", "mov ax, [bx+0x2]", "mov ax,[bx+0x2]", "MOV AX, [BX+2]"},
+		{"268B43FE", "mov ax, es:[bp+di-0x2]", "mov ax,[es:bp+di-0x2]", "MOV AX, ES:[BP+DI-2]"},
+		{"C70634127856", "mov word ptr [0x1234], 0x5678", "mov word [0x1234],0x5678", "MOV WORD PTR [1234h], 5678h"},
+		{"803F05", "cmp byte ptr [bx], 0x5", "cmp byte [bx],0x5", "CMP BYTE PTR [BX], 5"},
+		{"83C380", "add bx, 0xff80", "add bx,0xff80", "ADD BX, 0FF80h"},
+		{"2EA03412", "mov al, cs:[0x1234]", "mov al,[cs:0x1234]", "MOV AL, CS:[1234h]"},
+		{"D1E0", "shl ax, 1", "shl ax,1", "SHL AX, 1"},
+		{"D3E8", "shr ax, cl", "shr ax,cl", "SHR AX, CL"},
+		{"F3A4", "rep movsb", "rep movsb", "REP MOVSB"},
+		{"F3A6", "repe cmpsb", "repe cmpsb", "REPE CMPSB"},
+		{"2EA5", "cs: movsw", "cs movsw", "CS: MOVSW"},
+		{"EA34127856", "jmp 0x5678:0x1234", "jmp 0x5678:0x1234", "JMP FAR PTR 5678h:1234h"},
+		{"FF1E3412", "call dword ptr [0x1234]", "call far [0x1234]", "CALL DWORD PTR [1234h]"},
+		{"CC", "int 3", "int3", "INT 3"},
+		{"CD21", "int 0x21", "int 0x21", "INT 21h"},
+		{"D40A", "aam", "aam", "AAM"},
+		{"8CC0", "mov ax, es", "mov ax,es", "MOV AX, ES"},
+		{"C8100002", "enter 0x10, 0x2", "enter 0x10,0x2", "ENTER 10h, 2"},
+		{"6BC3FF", "imul ax, bx, 0xffff", "imul ax,bx,0xffff", "IMUL AX, BX, 0FFFFh"},
+		{"0F", "db 0xf", "db 0xf", "DB 0Fh"},
+		{"DD1E0000", "fstp qword ptr [0x0]", "fstp qword [0x0]", "FSTP QWORD PTR [0]"},
+		{"DB2E1000", "fld tbyte ptr [0x10]", "fld tword [0x10]", "FLD TBYTE PTR [10h]"},
+		{"DEC1", "faddp st(1), st", "faddp st1,st0", "FADDP ST(1), ST"},
+		{"D9E8", "fld1", "fld1", "FLD1"},
+		{"DCE9", "fsub st(1), st", "fsub st1,st0", "FSUB ST(1), ST"},
+	}
+	for _, test := range tests {
+		t.Run(test.nasm, func(t *testing.T) {
+			src, err := hex.DecodeString(test.bytes)
+			assert.NilError(t, err)
+			for syntax, want := range map[Syntax]string{Intel: test.intel, NASM: test.nasm, MASM: test.masm} {
+				got, n, err := New(syntax).Disasm(src, 0x100)
+				assert.NilError(t, err)
+				assert.Equal(t, got, want, syntax)
+				assert.Equal(t, n, len(src))
+			}
+		})
+	}
+}
+
+func TestDisasmJumps(t *testing.T) {
+	// JZ back to itself, CALL forwards
+	code := []byte{0x74, 0xFE, 0xE8, 0x01, 0x00, 0x90, 0xC3}
+	labels := Labels(cpu.Model80186, code, 0x100, map[uint16]string{0x106: "done"})
+	assert.DeepEqual(t, labels, map[uint16]string{0x100: "L0100", 0x106: "done"})
+
+	d := New(NASM)
+	got, _, err := d.Disasm(code, 0x100)
+	assert.NilError(t, err)
+	assert.Equal(t, got, "jz 0x100")
+
+	d.Symbols = labels
+	got, _, err = d.Disasm(code, 0x100)
+	assert.NilError(t, err)
+	assert.Equal(t, got, "jz L0100")
+	got, _, err = d.Disasm(code[2:], 0x102)
+	assert.NilError(t, err)
+	assert.Equal(t, got, "call done")
+}
+
+var (
+	labelRe  = regexp.MustCompile(`^([A-Za-z_.][A-Za-z0-9_.]*)(:|\s+(db|dw)\b)`)
+	numberRe = regexp.MustCompile(`\b(0x[0-9a-f]+|[01]+b|[0-9][0-9a-f]*h|[0-9]+)\b`)
+	sumRe    = regexp.MustCompile(`\b0x([0-9a-f]+)\+0x([0-9a-f]+)\b`)
+	spacesRe = regexp.MustCompile(`\s*,\s*|\s+`)
+)
+
+// NASM's bin format starts each segment on a 4 byte boundary.
+const segmentAlign = 4
+
+// Other names for the conditional jumps, and the one the disassembler uses.
+var jumpAliases = map[string]string{
+	"jc": "jb", "jnae": "jb", "jnc": "jnb", "jae": "jnb",
+	"je": "jz", "jne": "jnz", "jna": "jbe", "jnbe": "ja",
+	"jp": "jpe", "jnp": "jpo", "jnge": "jl", "jnl": "jge",
+	"jng": "jle", "jnle": "jg",
+}
+
+// A line of source without its comment or label, lower case.
+type srcLine struct {
+	n    int
+	text string
+}
+
+// Disassembles each .com in NASM syntax alongside its source, checking
+// every instruction comes out the same.
+func TestRoundTrip(t *testing.T) {
+	sources, err := filepath.Glob("../testdata/dos/*.asm")
+	assert.NilError(t, err)
+	assert.Assert(t, len(sources) > 0)
+	for _, source := range sources {
+		name := strings.TrimSuffix(filepath.Base(source), ".asm")
+		t.Run(name, func(t *testing.T) {
+			asm, err := os.ReadFile(source)
+			assert.NilError(t, err)
+			com, err := os.ReadFile(strings.TrimSuffix(source, ".asm") + ".com")
+			assert.NilError(t, err)
+
+			d := New(NASM)
+			d.Model = cpu.Model8086
+			lines, labels, org := parseSource(t, d, string(asm), com)
+			d.Symbols = map[uint16]string{}
+			for label, off := range labels {
+				d.Symbols[off] = label
+			}
+			pos := 0
+			for _, line := range lines {
+				if line.text == "" {
+					pos = align(pos)
+					continue
+				}
+				if size, ok := dataSize(line.text); ok {
+					pos += size
+					continue
+				}
+				got, n, err := disasmLine(d, com[pos:], org+uint16(pos))
+				assert.NilError(t, err, "line %d", line.n)
+				assert.Equal(t, normalize(got, labels), normalize(line.text, labels), "line %d", line.n)
+				pos += n
+			}
+			assert.Equal(t, pos, len(com))
+		})
+	}
+}
+
+// Disassembles the instruction at the start of code.  NASM assembled the
+// conditional jumps which don't reach as the 386's 0F 8x near jumps, which
+// no model here has, so they are decoded like the short jump they stand for.
+func disasmLine(d *Disassembler, code []byte, pc uint16) (string, int, error) {
+	if len(code) >= 4 && code[0] == 0x0F && code[1]&0xF0 == 0x80 {
+		short, _, err := New(NASM).Disasm([]byte{0x70 | code[1]&0x0F, 0}, 0)
+		if err != nil {
+			return "", 0, err
+		}
+		mnemonic, _, _ := strings.Cut(short, " ")
+		target := pc + 4 + (uint16(code[2]) | uint16(code[3])<<8)
+		return fmt.Sprintf("%s 0x%x", mnemonic, target), 4, nil
+	}
+	return d.Disasm(code, pc)
+}
+
+// The next segment's start after pos.
+func align(pos int) int {
+	return (pos + segmentAlign - 1) &^ (segmentAlign - 1)
+}
+
+// Works out the address of each label, using the disassembler for the
+// length of the instructions, and where the code is loaded: its org, or 0
+// without one.  A segment directive is an empty line.
+func parseSource(t *testing.T, d *Disassembler, asm string, com []byte) ([]srcLine, map[string]uint16, uint16) {
+	var lines []srcLine
+	labels := map[string]uint16{}
+	var org uint16
+	pos := 0
+	for i, text := range strings.Split(asm, "\n") {
+		if c := strings.IndexByte(text, ';'); c >= 0 {
+			text = text[:c]
+		}
+		text = strings.TrimSpace(text)
+		if m := labelRe.FindStringSubmatch(text); m != nil {
+			labels[strings.ToLower(m[1])] = uint16(pos)
+			if m[2] == ":" {
+				text = strings.TrimSpace(text[len(m[0]):])
+			} else {
+				text = strings.TrimSpace(text[len(m[1]):])
+			}
+		}
+		lower := strings.ToLower(text)
+		directive, arg, _ := strings.Cut(lower, " ")
+		switch directive {
+		case "", "bits":
+			continue
+		case "org":
+			v, err := parseNumber(strings.TrimSpace(arg))
+			assert.NilError(t, err, "line %d", i+1)
+			org = uint16(v)
+			continue
+		case "segment", "section":
+			lines = append(lines, srcLine{i + 1, ""})
+			pos = align(pos)
+			continue
+		}
+		lines = append(lines, srcLine{i + 1, text})
+		if size, ok := dataSize(text); ok {
+			pos += size
+			continue
+		}
+		_, n, err := disasmLine(d, com[pos:], 0)
+		assert.NilError(t, err, "line %d", i+1)
+		pos += n
+	}
+	for label := range labels {
+		labels[label] += org
+	}
+	return lines, labels, org
+}
+
+// Size of a db, dw, resb or resw line, which may be repeated with times.
+func dataSize(text string) (int, bool) {
+	fields := strings.SplitN(text, " ", 2)
+	switch directive := strings.ToLower(fields[0]); directive {
+	case "times":
+		count, data, _ := strings.Cut(strings.TrimSpace(fields[1]), " ")
+		n, err := parseNumber(strings.ToLower(count))
+		if err != nil {
+			return 0, false
+		}
+		size, ok := dataSize(strings.TrimSpace(data))
+		return int(n) * size, ok
+	case "resb", "resw":
+		n, err := parseNumber(strings.ToLower(strings.TrimSpace(fields[1])))
+		if err != nil {
+			return 0, false
+		}
+		return int(n) * map[string]int{"resb": 1, "resw": 2}[directive], true
+	}
+	unit := map[string]int{"db": 1, "dw": 2}[strings.ToLower(fields[0])]
+	if unit == 0 {
+		return 0, false
+	}
+	size := 0
+	for _, item := range splitData(fields[1]) {
+		item = strings.TrimSpace(item)
+		if len(item) > 1 && (item[0] == '\'' || item[0] == '"') {
+			size += len(item) - 2
+			continue
+		}
+		size += unit
+	}
+	return size, true
+}
+
+// Splits data items on commas outside quotes.
+func splitData(s string) []string {
+	var items []string
+	quote := byte(0)
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, s[start:])
+}
+
+// A number in NASM's 0x1F, 1Fh, 11111b or decimal forms.
+func parseNumber(n string) (uint64, error) {
+	switch {
+	case strings.HasPrefix(n, "0x"):
+		return strconv.ParseUint(n[2:], 16, 32)
+	case strings.HasSuffix(n, "h"):
+		return strconv.ParseUint(n[:len(n)-1], 16, 32)
+	case strings.HasSuffix(n, "b"):
+		return strconv.ParseUint(n[:len(n)-1], 2, 32)
+	}
+	return strconv.ParseUint(n, 10, 32)
+}
+
+// Lower cases, swaps labels for their addresses and jumps for the names the
+// disassembler uses, writes numbers in hex and tidies the spaces so the
+// source and disassembly compare.
+func normalize(s string, labels map[string]uint16) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if mnemonic, rest, ok := strings.Cut(s, " "); ok && jumpAliases[mnemonic] != "" {
+		s = jumpAliases[mnemonic] + " " + rest
+	}
+	s = regexp.MustCompile(`[a-z_.][a-z0-9_.]*`).ReplaceAllStringFunc(s, func(w string) string {
+		if off, ok := labels[w]; ok {
+			return fmt.Sprintf("0x%x", off)
+		}
+		return w
+	})
+	s = numberRe.ReplaceAllStringFunc(s, func(n string) string {
+		v, err := parseNumber(n)
+		if err != nil {
+			return n
+		}
+		return fmt.Sprintf("0x%x", v)
+	})
+	// label+1 as an immediate
+	s = sumRe.ReplaceAllStringFunc(s, func(sum string) string {
+		m := sumRe.FindStringSubmatch(sum)
+		a, _ := strconv.ParseUint(m[1], 16, 32)
+		b, _ := strconv.ParseUint(m[2], 16, 32)
+		return fmt.Sprintf("0x%x", a+b)
+	})
+	return spacesRe.ReplaceAllStringFunc(s, func(sp string) string {
+		if strings.Contains(sp, ",") {
+			return ","
+		}
+		return " "
+	})
+}
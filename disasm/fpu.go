@@ -0,0 +1,125 @@
+package go86
+
+import "fmt"
+
+// 8087 instructions with a memory operand by ESC opcode and ModRM reg
+// field, along with the size of the operand.
+var fpuMemOps = [8][8]struct{ name, size string }{
+	// D8
+	{{"fadd", "dword"}, {"fmul", "dword"}, {"fcom", "dword"}, {"fcomp", "dword"},
+		{"fsub", "dword"}, {"fsubr", "dword"}, {"fdiv", "dword"}, {"fdivr", "dword"}},
+	// D9
+	{{"fld", "dword"}, {}, {"fst", "dword"}, {"fstp", "dword"},
+		{"fldenv", ""}, {"fldcw", ""}, {"fnstenv", ""}, {"fnstcw", ""}},
+	// DA
+	{{"fiadd", "dword"}, {"fimul", "dword"}, {"ficom", "dword"}, {"ficomp", "dword"},
+		{"fisub", "dword"}, {"fisubr", "dword"}, {"fidiv", "dword"}, {"fidivr", "dword"}},
+	// DB
+	{{"fild", "dword"}, {}, {"fist", "dword"}, {"fistp", "dword"},
+		{}, {"fld", "tword"}, {}, {"fstp", "tword"}},
+	// DC
+	{{"fadd", "qword"}, {"fmul", "qword"}, {"fcom", "qword"}, {"fcomp", "qword"},
+		{"fsub", "qword"}, {"fsubr", "qword"}, {"fdiv", "qword"}, {"fdivr", "qword"}},
+	// DD
+	{{"fld", "qword"}, {}, {"fst", "qword"}, {"fstp", "qword"},
+		{"frstor", ""}, {}, {"fnsave", ""}, {"fnstsw", ""}},
+	// DE
+	{{"fiadd", "word"}, {"fimul", "word"}, {"ficom", "word"}, {"ficomp", "word"},
+		{"fisub", "word"}, {"fisubr", "word"}, {"fidiv", "word"}, {"fidivr", "word"}},
+	// DF
+	{{"fild", "word"}, {}, {"fist", "word"}, {"fistp", "word"},
+		{"fbld", "tword"}, {"fild", "qword"}, {"fbstp", "tword"}, {"fistp", "qword"}},
+}
+
+// Arithmetic with ST(i) by ModRM reg field for D8, DC and DE.
+var fpuArith = [8]string{"fadd", "fmul", "fcom", "fcomp", "fsub", "fsubr", "fdiv", "fdivr"}
+
+// D9 and DB instructions without operands by the ModRM byte.
+var fpuNoArgs = map[uint16]string{
+	0xD9D0: "fnop", 0xD9E0: "fchs", 0xD9E1: "fabs", 0xD9E4: "ftst", 0xD9E5: "fxam",
+	0xD9E8: "fld1", 0xD9E9: "fldl2t", 0xD9EA: "fldl2e", 0xD9EB: "fldpi",
+	0xD9EC: "fldlg2", 0xD9ED: "fldln2", 0xD9EE: "fldz",
+	0xD9F0: "f2xm1", 0xD9F1: "fyl2x", 0xD9F2: "fptan", 0xD9F3: "fpatan",
+	0xD9F4: "fxtract", 0xD9F6: "fdecstp", 0xD9F7: "fincstp", 0xD9F8: "fprem",
+	0xD9F9: "fyl2xp1", 0xD9FA: "fsqrt", 0xD9FC: "frndint", 0xD9FD: "fscale",
+	0xDBE0: "fneni", 0xDBE1: "fndisi", 0xDBE2: "fnclex", 0xDBE3: "fninit",
+	0xDED9: "fcompp",
+}
+
+// Writes out an ESC as the 8087 instruction it is.
+func (f *formatter) esc() string {
+	inst := f.inst
+	m := inst.ModRM
+	esc := inst.OpCode - 0xD8
+	if m.Mod != 3 {
+		op := fpuMemOps[esc][m.Reg]
+		if op.name == "" {
+			return f.escBytes()
+		}
+		arg := f.mem(f.modrmAddr())
+		if op.size != "" {
+			size := op.size
+			if size == "tword" && f.d.Syntax != NASM {
+				size = "tbyte"
+			}
+			arg = f.ptr(size) + arg
+		}
+		return op.name + " " + arg
+	}
+
+	if name, ok := fpuNoArgs[uint16(inst.OpCode)<<8|0xC0|uint16(m.Reg)<<3|uint16(m.Rm)]; ok {
+		return name
+	}
+	st0, sti := f.st(0), f.st(m.Rm)
+	switch inst.OpCode {
+	case 0xD8:
+		if m.Reg == 2 || m.Reg == 3 {
+			return fpuArith[m.Reg] + " " + sti
+		}
+		return fpuArith[m.Reg] + " " + st0 + f.sep() + sti
+	case 0xD9:
+		switch m.Reg {
+		case 0:
+			return "fld " + sti
+		case 1:
+			return "fxch " + sti
+		}
+	case 0xDC:
+		// With ST(i) as the destination reg 4 is FSUBR and 5 FSUB, as in
+		// Intel's manuals.
+		names := [8]string{"fadd", "fmul", "", "", "fsubr", "fsub", "fdivr", "fdiv"}
+		if names[m.Reg] != "" {
+			return names[m.Reg] + " " + sti + f.sep() + st0
+		}
+	case 0xDD:
+		switch m.Reg {
+		case 0:
+			return "ffree " + sti
+		case 2:
+			return "fst " + sti
+		case 3:
+			return "fstp " + sti
+		}
+	case 0xDE:
+		names := [8]string{"faddp", "fmulp", "", "", "fsubrp", "fsubp", "fdivrp", "fdivp"}
+		if names[m.Reg] != "" {
+			return names[m.Reg] + " " + sti + f.sep() + st0
+		}
+	}
+	return f.escBytes()
+}
+
+func (f *formatter) st(i uint8) string {
+	if f.d.Syntax == NASM {
+		return fmt.Sprintf("st%d", i)
+	}
+	if i == 0 {
+		return "st"
+	}
+	return fmt.Sprintf("st(%d)", i)
+}
+
+// ESCs the 8087 doesn't know, as the opcode and ModRM bytes.
+func (f *formatter) escBytes() string {
+	return "db " + f.hex(uint(f.inst.OpCode)) + f.sep() + f.hex(uint(f.inst.ModRM.Mod<<6|f.inst.ModRM.Reg<<3|f.inst.ModRM.Rm))
+}
@@ -0,0 +1,474 @@
+package go86
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	cpu "go86.org/go86/cpu"
+)
+
+// Directory and file system services.  Searches keep their place in the
+// reserved area at the start of the DTA like DOS does, with the host
+// directory being searched standing in for its starting cluster.
+
+// The DTA as FIND FIRST and FIND NEXT use it.
+const (
+	dtaDrive    = 0x00
+	dtaTemplate = 0x01
+	dtaSearch   = 0x0C
+	dtaNext     = 0x0D
+	dtaDir      = 0x0F
+	dtaAttr     = 0x15
+	dtaTime     = 0x16
+	dtaDate     = 0x18
+	dtaSize     = 0x1A
+	dtaName     = 0x1E
+)
+
+// A file or directory as DOS sees it.
+type dirEntry struct {
+	name string
+	host string
+	attr uint8
+	size int64
+	mod  time.Time
+}
+
+func hostEntry(name, host string, info fs.FileInfo) dirEntry {
+	e := dirEntry{name: name, host: host, size: info.Size(), mod: info.ModTime(), attr: attrArchive}
+	if info.IsDir() {
+		e.attr = attrDirectory
+		e.size = 0
+	}
+	if info.Mode().Perm()&0200 == 0 {
+		e.attr |= attrReadOnly
+	}
+	return e
+}
+
+// The entries in the host directory dir which have 8.3 names in order,
+// along with . and .. for directories other than the root.
+func listDir(dir string, root bool) ([]dirEntry, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, ErrPathNotFound
+	}
+	var list []dirEntry
+	for _, e := range entries {
+		name, ok := shortNameOf(e.Name())
+		if !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		list = append(list, hostEntry(name, filepath.Join(dir, e.Name()), info))
+	}
+	slices.SortStableFunc(list, func(a, b dirEntry) int {
+		return strings.Compare(a.name, b.name)
+	})
+	if !root {
+		if info, err := os.Stat(dir); err == nil {
+			list = append([]dirEntry{hostEntry(".", dir, info), hostEntry("..", filepath.Dir(dir), info)}, list...)
+		}
+	}
+	return list, nil
+}
+
+// Makes a name, which may have wildcards, into the 11 characters of an FCB
+// name, space padded with * filled out with ?.
+func fcbName(s string) ([11]byte, bool) {
+	var name [11]byte
+	for i := range name {
+		name[i] = ' '
+	}
+	if s == "." || s == ".." {
+		copy(name[:], s)
+		return name, true
+	}
+	base, ext, _ := strings.Cut(strings.ToUpper(s), ".")
+	if base == "" || strings.Contains(ext, ".") {
+		return name, false
+	}
+	for _, f := range []struct {
+		s   string
+		out []byte
+	}{{base, name[:8]}, {ext, name[8:]}} {
+		for i := 0; i < len(f.s) && i < len(f.out); i++ {
+			switch c := f.s[i]; {
+			case c == '*':
+				for ; i < len(f.out); i++ {
+					f.out[i] = '?'
+				}
+			case c == '?' || validNameChar(c):
+				f.out[i] = c
+			default:
+				return name, false
+			}
+		}
+	}
+	return name, true
+}
+
+// Does the name match template, where ? matches anything.
+func matchName(template [11]byte, name string) bool {
+	n, _ := fcbName(name)
+	for i, c := range template {
+		if c != '?' && c != n[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Hidden, system and directory entries are only found when searching for
+// them.
+func matchAttr(search, attr uint8) bool {
+	if search == attrVolume {
+		return false
+	}
+	return attr&^search&(attrHidden|attrSystem|attrDirectory) == 0
+}
+
+// Splits the last name, which may have wildcards, off a path.
+func splitPath(path string) (dir, name string) {
+	i := strings.LastIndexAny(path, "\\/:")
+	return path[:i+1], path[i+1:]
+}
+
+// The host directory p names, which has to exist.
+func (dos *Dos) hostDir(p dosPath) (string, error) {
+	host, err := dos.hostPath(p)
+	if err != nil {
+		return "", err
+	}
+	if info, err := os.Stat(host); err != nil || !info.IsDir() {
+		return "", ErrPathNotFound
+	}
+	return host, nil
+}
+
+// The existing file or directory named by the ASCIZ path at seg:off.
+func (dos *Dos) existingArg(seg, off uint) (dosPath, string, error) {
+	p, err := dos.parsePath(dos.asciiz(seg, off))
+	if err != nil {
+		return p, "", err
+	}
+	host, err := dos.existingPath(p)
+	return p, host, err
+}
+
+// INT 21h AH=1Ah, SET DISK TRANSFER AREA ADDRESS
+// DS:DX = DTA.
+func (dos *Dos) setDTA(c *cpu.CPU) {
+	dos.dtaSeg, dos.dtaOff = c.Regs.DS(), c.Regs.GetReg16(cpu.DX)
+}
+
+// INT 21h AH=2Fh, GET DISK TRANSFER AREA ADDRESS
+// Returns the DTA in ES:BX.
+func (dos *Dos) getDTA(c *cpu.CPU) {
+	c.Regs.SetSeg16(cpu.ES, dos.dtaSeg)
+	c.Regs.SetReg16(cpu.BX, dos.dtaOff)
+}
+
+// INT 21h AH=4Eh, FIND FIRST MATCHING FILE
+// CX = attributes, DS:DX = ASCIZ file specification with wildcards.  Fills
+// in the DTA with the first match.
+func (dos *Dos) findFirst(c *cpu.CPU) error {
+	dir, name := splitPath(dos.pathArg(c))
+	p, err := dos.parsePath(dir)
+	if err != nil {
+		return ErrPathNotFound
+	}
+	host, err := dos.hostDir(p)
+	if err != nil {
+		return err
+	}
+	template, ok := fcbName(name)
+	if !ok {
+		return ErrNoMoreFiles
+	}
+
+	id, ok := dos.searchIds[host]
+	if !ok {
+		id = uint16(len(dos.searches))
+		dos.searches = append(dos.searches, searchDir{host, len(p.names) == 0})
+		dos.searchIds[host] = id
+	}
+	mem := c.Mem
+	mem.SetMem8(dos.dtaSeg, dos.dtaOff+dtaDrive, uint8(p.drive+1))
+	mem.Copy(dos.dtaSeg, dos.dtaOff+dtaTemplate, template[:])
+	mem.SetMem8(dos.dtaSeg, dos.dtaOff+dtaSearch, uint8(c.Regs.GetReg16(cpu.CX)))
+	mem.SetMem16(dos.dtaSeg, dos.dtaOff+dtaNext, 0)
+	mem.SetMem16(dos.dtaSeg, dos.dtaOff+dtaDir, id)
+	return dos.findNext(c)
+}
+
+// INT 21h AH=4Fh, FIND NEXT MATCHING FILE
+// Carries on the search in the DTA.
+func (dos *Dos) findNext(c *cpu.CPU) error {
+	mem := c.Mem
+	seg, off := dos.dtaSeg, dos.dtaOff
+	id := mem.GetMem16(seg, off+dtaDir)
+	if int(id) >= len(dos.searches) {
+		return ErrNoMoreFiles
+	}
+	var template [11]byte
+	copy(template[:], dos.getBytes(seg, off+dtaTemplate, 11))
+	search := mem.GetMem8(seg, off+dtaSearch)
+	dir := dos.searches[id]
+	list, err := listDir(dir.host, dir.root)
+	if err != nil {
+		return ErrNoMoreFiles
+	}
+	for i := int(mem.GetMem16(seg, off+dtaNext)); i < len(list); i++ {
+		e := list[i]
+		if !matchName(template, e.name) || !matchAttr(search, e.attr) {
+			continue
+		}
+		mem.SetMem16(seg, off+dtaNext, uint16(i+1))
+		date, tm := dosDateTime(e.mod)
+		mem.SetMem8(seg, off+dtaAttr, e.attr)
+		mem.SetMem16(seg, off+dtaTime, tm)
+		mem.SetMem16(seg, off+dtaDate, date)
+		mem.SetMem16(seg, off+dtaSize, uint16(e.size))
+		mem.SetMem16(seg, off+dtaSize+2, uint16(min(e.size, 0xFFFFFFFF)>>16))
+		var name [13]byte
+		copy(name[:12], e.name)
+		mem.Copy(seg, off+dtaName, name[:])
+		return nil
+	}
+	mem.SetMem16(seg, off+dtaNext, uint16(len(list)))
+	return ErrNoMoreFiles
+}
+
+// A directory being searched.
+type searchDir struct {
+	host string
+	root bool
+}
+
+// INT 21h AH=39h, "MKDIR" - CREATE SUBDIRECTORY
+// DS:DX = ASCIZ path.
+func (dos *Dos) makeDir(c *cpu.CPU) error {
+	p, err := dos.parsePath(dos.pathArg(c))
+	if err != nil {
+		return ErrPathNotFound
+	}
+	host, err := dos.hostPath(p)
+	if err != nil {
+		return err
+	}
+	if p.name() == "" {
+		return ErrAccessDenied
+	}
+	if err := os.Mkdir(host, 0777); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return ErrPathNotFound
+		}
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+// INT 21h AH=3Ah, "RMDIR" - REMOVE SUBDIRECTORY
+// DS:DX = ASCIZ path.
+func (dos *Dos) removeDir(c *cpu.CPU) error {
+	p, err := dos.parsePath(dos.pathArg(c))
+	if err != nil {
+		return ErrPathNotFound
+	}
+	host, err := dos.hostDir(p)
+	if err != nil {
+		return err
+	}
+	switch {
+	case p.name() == "":
+		return ErrAccessDenied
+	case p.contains(dos.drives[p.drive].Cwd):
+		return ErrRemoveCurrentDir
+	}
+	if err := os.Remove(host); err != nil {
+		return ErrAccessDenied
+	}
+	return nil
+}
+
+// Is dir p or a directory in it.
+func (p dosPath) contains(dir []string) bool {
+	return len(dir) >= len(p.names) && strings.Join(dir[:len(p.names)], "\\") == strings.Join(p.names, "\\")
+}
+
+// INT 21h AH=3Bh, "CHDIR" - SET CURRENT DIRECTORY
+// DS:DX = ASCIZ path, which may be on another drive.
+func (dos *Dos) changeDir(c *cpu.CPU) error {
+	p, err := dos.parsePath(dos.pathArg(c))
+	if err != nil {
+		return ErrPathNotFound
+	}
+	if _, err := dos.hostDir(p); err != nil {
+		return err
+	}
+	dos.drives[p.drive].Cwd = p.names
+	return nil
+}
+
+// INT 21h AH=47h, "CWD" - GET CURRENT DIRECTORY
+// DL = drive, 0 for the current one, DS:SI = 64 byte buffer for the path
+// without the drive or leading backslash.
+func (dos *Dos) currentDir(c *cpu.CPU) error {
+	n := dos.curDrive
+	if dl := int(c.Regs.GetReg8(cpu.DL)); dl != 0 {
+		n = dl - 1
+	}
+	if n >= maxDrives || dos.drives[n] == nil {
+		return ErrInvalidDrive
+	}
+	path := strings.Join(dos.drives[n].Cwd, "\\")
+	c.Mem.Copy(c.Regs.DS(), c.Regs.GetReg16(cpu.SI), append([]byte(path), 0))
+	// Some versions of DOS return 0100h in AX
+	c.Regs.SetReg16(cpu.AX, 0x0100)
+	return nil
+}
+
+// INT 21h AH=41h, "UNLINK" - DELETE FILE
+// DS:DX = ASCIZ filename.
+func (dos *Dos) deleteFile(c *cpu.CPU) error {
+	_, host, err := dos.existingArg(c.Regs.DS(), c.Regs.GetReg16(cpu.DX))
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(host)
+	if err != nil || info.IsDir() || info.Mode().Perm()&0200 == 0 {
+		return ErrAccessDenied
+	}
+	return os.Remove(host)
+}
+
+// INT 21h AH=56h, RENAME FILE
+// DS:DX = ASCIZ old name, ES:DI = ASCIZ new name, on the same drive but
+// maybe in another directory.
+func (dos *Dos) renameFile(c *cpu.CPU) error {
+	from, host, err := dos.existingArg(c.Regs.DS(), c.Regs.GetReg16(cpu.DX))
+	if err != nil {
+		return err
+	}
+	to, err := dos.parsePath(dos.asciiz(c.Regs.ES(), c.Regs.GetReg16(cpu.DI)))
+	if err != nil {
+		return ErrPathNotFound
+	}
+	if to.drive != from.drive {
+		return ErrNotSameDevice
+	}
+	newHost, err := dos.hostPath(to)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(newHost); err == nil || to.name() == "" {
+		return ErrAccessDenied
+	}
+	return os.Rename(host, newHost)
+}
+
+// INT 21h AH=43h, GET/SET FILE ATTRIBUTES
+// AL = 00h to get them into CX, 01h to set them from CX, DS:DX = ASCIZ
+// filename.  Only read only is kept on the host.
+func (dos *Dos) fileAttributes(c *cpu.CPU) error {
+	p, host, err := dos.existingArg(c.Regs.DS(), c.Regs.GetReg16(cpu.DX))
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(host)
+	if err != nil {
+		return err
+	}
+	e := hostEntry(p.name(), host, info)
+	switch c.Regs.GetReg8(cpu.AL) {
+	case 0x00:
+		c.Regs.SetReg16(cpu.CX, uint(e.attr))
+	case 0x01:
+		attr := c.Regs.GetReg16(cpu.CX)
+		if attr&(attrVolume|attrDirectory) != 0 || e.attr&attrDirectory != 0 {
+			return ErrAccessDenied
+		}
+		mode := info.Mode().Perm() | 0200
+		if attr&attrReadOnly != 0 {
+			mode &^= 0222
+		}
+		return os.Chmod(host, mode)
+	default:
+		return ErrInvalidFunction
+	}
+	return nil
+}
+
+// INT 21h AH=57h, GET/SET FILE'S DATE AND TIME
+// AL = 00h to get them into CX and DX, 01h to set them from CX and DX,
+// BX = handle.
+func (dos *Dos) fileTime(c *cpu.CPU) error {
+	f, err := dos.handleFile(c.Regs.GetReg16(cpu.BX))
+	if err != nil {
+		return err
+	}
+	if f.file == nil {
+		// Devices have no time
+		return nil
+	}
+	switch c.Regs.GetReg8(cpu.AL) {
+	case 0x00:
+		info, err := f.file.Stat()
+		if err != nil {
+			return err
+		}
+		date, tm := dosDateTime(info.ModTime())
+		c.Regs.SetReg16(cpu.CX, uint(tm))
+		c.Regs.SetReg16(cpu.DX, uint(date))
+	case 0x01:
+		t := fromDosDateTime(uint16(c.Regs.GetReg16(cpu.DX)), uint16(c.Regs.GetReg16(cpu.CX)))
+		return os.Chtimes(f.file.Name(), t, t)
+	default:
+		return ErrInvalidFunction
+	}
+	return nil
+}
+
+// INT 21h AH=36h, GET FREE DISK SPACE
+// DL = drive, 0 for the current one.  Returns sectors per cluster in AX,
+// free clusters in BX, bytes per sector in CX and clusters in DX, or FFFFh
+// in AX for an invalid drive.  Mounted drives show the most DOS can, just
+// under 2 GiB free.
+func (dos *Dos) freeSpace(c *cpu.CPU) {
+	n := dos.curDrive
+	if dl := int(c.Regs.GetReg8(cpu.DL)); dl != 0 {
+		n = dl - 1
+	}
+	if n >= maxDrives || dos.drives[n] == nil {
+		c.Regs.SetReg16(cpu.AX, 0xFFFF)
+		return
+	}
+	c.Regs.SetReg16(cpu.AX, 64)
+	c.Regs.SetReg16(cpu.BX, 0xFFFF)
+	c.Regs.SetReg16(cpu.CX, 512)
+	c.Regs.SetReg16(cpu.DX, 0xFFFF)
+}
+
+// The DOS date and time of t, with 2 second resolution.
+func dosDateTime(t time.Time) (date, tm uint16) {
+	if t.Year() < 1980 {
+		return 1<<5 | 1, 0
+	}
+	date = uint16(t.Year()-1980)<<9 | uint16(t.Month())<<5 | uint16(t.Day())
+	tm = uint16(t.Hour())<<11 | uint16(t.Minute())<<5 | uint16(t.Second()/2)
+	return date, tm
+}
+
+func fromDosDateTime(date, tm uint16) time.Time {
+	return time.Date(int(date>>9)+1980, time.Month(date>>5&0xF), int(date&0x1F),
+		int(tm>>11), int(tm>>5&0x3F), int(tm&0x1F)*2, 0, time.Local)
+}
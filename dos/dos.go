@@ -1,8 +1,10 @@
 package go86
 
 import (
+	"bufio"
 	"bytes"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 
@@ -13,21 +15,113 @@ import (
 type Dos struct {
 	// TODO: Make a custom interface that also has this
 	Out io.Writer
-	In  io.Writer
+	In  io.Reader
 	Err io.Writer
 
 	Mem *DosMem
+	// How the last program ended and its return code, AH and AL from INT 21h
+	// AH=4Dh.
+	TermKind   TermKind
+	ReturnCode uint8
+	// Environment variables for programs, NAME=value.
+	Env []string
+
+	// Host directories mounted as drives, and the current drive.
+	drives   [maxDrives]*Drive
+	curDrive int
+	// Disk transfer area, and the directories FIND FIRST has searched.
+	dtaSeg, dtaOff uint
+	searches       []searchDir
+	searchIds      map[string]uint16
+	// Open files, the system file table.
+	sft []*sftEntry
+	// Segment of the current process's PSP, zero for a binary image which
+	// hasn't got one.  Its handles are in noPspJFT then.
+	psp      uint
+	noPspJFT [jftSize]uint8
+	// Processes waiting for the children they ran with EXEC, the innermost
+	// last.
+	parents []process
+	// In buffered for reading lines, and what's left of the last line.
+	conIn   *bufio.Reader
+	conSrc  io.Reader
+	conLine []byte
+
 	cpu *cpu.CPU
 }
 
+// TermKind is how a program ended.
+type TermKind uint8
+
+const (
+	TermNormal TermKind = iota
+	TermCtrlC
+	TermCriticalError
+	TermTSR
+)
+
+func (k TermKind) String() string {
+	switch k {
+	case TermNormal:
+		return "normal"
+	case TermCtrlC:
+		return "Ctrl-C"
+	case TermCriticalError:
+		return "critical error"
+	case TermTSR:
+		return "TSR"
+	}
+	return fmt.Sprintf("TermKind(%d)", k)
+}
+
+// Ends the program with code as its return code.  A child goes back to its
+// parent, the first program stops the CPU.
+func (dos *Dos) terminate(c *cpu.CPU, kind TermKind, code uint8) {
+	log.V(1).Infof("Program terminated: [%v, return code %d]", kind, code)
+	dos.TermKind = kind
+	dos.ReturnCode = code
+	// A resident program keeps its files open
+	if kind != TermTSR {
+		dos.closeAll()
+	}
+	if len(dos.parents) > 0 {
+		dos.returnToParent(c, kind == TermTSR)
+		return
+	}
+	c.Halt()
+}
+
 func (dos *Dos) Int20(c *cpu.CPU, intnum int) {
 	log.V(3).Infof("Dos.int%02x: [AX: %04X]", intnum, c.Regs.GetReg16(cpu.AX))
-	c.Halt()
+	dos.terminate(c, TermNormal, 0)
+}
+
+// Int23 is the default Ctrl-C handler, which ends the program.
+func (dos *Dos) Int23(c *cpu.CPU, intnum int) {
+	log.V(3).Infof("Dos.int%02x: [AX: %04X]", intnum, c.Regs.GetReg16(cpu.AX))
+	dos.terminate(c, TermCtrlC, 0)
+}
+
+// Int24 is the default critical error handler, which aborts the program.
+func (dos *Dos) Int24(c *cpu.CPU, intnum int) {
+	log.V(3).Infof("Dos.int%02x: [AX: %04X]", intnum, c.Regs.GetReg16(cpu.AX))
+	dos.terminate(c, TermCriticalError, 0)
 }
 
 func (dos *Dos) Int21(c *cpu.CPU, intnum int) {
 	log.V(3).Infof("Dos.int%02x: [AX: %04X]", intnum, c.Regs.GetReg16(cpu.AX))
+	if isCPMCall(c) {
+		dos.cpmCall(c)
+		return
+	}
+	dos.int21(c)
+}
+
+func (dos *Dos) int21(c *cpu.CPU) {
 	switch ah := c.Regs.GetReg8(cpu.AH); ah {
+	case 0x00:
+		// AH=00h - TERMINATE PROGRAM
+		dos.terminate(c, TermNormal, 0)
 	case 0x02: // Print Char
 		dl := c.Regs.GetReg8(cpu.DL)
 		s := []byte{byte(dl)}
@@ -41,50 +135,147 @@ func (dos *Dos) Int21(c *cpu.CPU, intnum int) {
 			s := b[:end]
 			dos.Out.Write(s)
 		}
+	case 0x0E:
+		// AH=0Eh - SELECT DEFAULT DRIVE
+		// Returns the number of drive letters in AL.
+		if n := int(c.Regs.GetReg8(cpu.DL)); n < maxDrives && dos.drives[n] != nil {
+			dos.curDrive = n
+		}
+		c.Regs.SetReg8(cpu.AL, maxDrives)
+	case 0x0F:
+		// AH=0Fh - OPEN FILE USING FCB
+		fcbResult(c, dos.fcbOpen(c, false))
+	case 0x10:
+		// AH=10h - CLOSE FILE USING FCB
+		fcbResult(c, dos.fcbClose(c))
+	case 0x14:
+		// AH=14h - SEQUENTIAL READ FROM FCB FILE
+		c.Regs.SetReg8(cpu.AL, uint(dos.fcbSequential(c, false)))
+	case 0x15:
+		// AH=15h - SEQUENTIAL WRITE TO FCB FILE
+		c.Regs.SetReg8(cpu.AL, uint(dos.fcbSequential(c, true)))
+	case 0x16:
+		// AH=16h - CREATE OR TRUNCATE FILE USING FCB
+		fcbResult(c, dos.fcbOpen(c, true))
+	case 0x19:
+		// AH=19h - GET CURRENT DEFAULT DRIVE
+		c.Regs.SetReg8(cpu.AL, uint(dos.curDrive))
+	case 0x1A:
+		// AH=1Ah - SET DISK TRANSFER AREA ADDRESS
+		dos.setDTA(c)
+	case 0x2F:
+		// AH=2Fh - GET DISK TRANSFER AREA ADDRESS
+		dos.getDTA(c)
+	case 0x21:
+		// AH=21h - READ RANDOM RECORD FROM FCB FILE
+		c.Regs.SetReg8(cpu.AL, uint(dos.fcbRandom(c, false)))
+	case 0x22:
+		// AH=22h - WRITE RANDOM RECORD TO FCB FILE
+		c.Regs.SetReg8(cpu.AL, uint(dos.fcbRandom(c, true)))
+	case 0x27:
+		// AH=27h - RANDOM BLOCK READ FROM FCB FILE
+		c.Regs.SetReg8(cpu.AL, uint(dos.fcbRandomBlock(c, false)))
+	case 0x28:
+		// AH=28h - RANDOM BLOCK WRITE TO FCB FILE
+		c.Regs.SetReg8(cpu.AL, uint(dos.fcbRandomBlock(c, true)))
+	case 0x29:
+		// AH=29h - PARSE FILENAME INTO FCB
+		dos.parseFilename(c)
 	case 0x30:
 		// AH=30h - GET DOS VERSION
 		c.Regs.SetReg16(cpu.AX, 0x0203) // 3.2
 	case 0x25:
 		// AH = 25h - SET INTERRUPT VECTOR
-		al := c.Regs.GetReg8(cpu.AL)
-		ds := c.Regs.DS()
-		dx := c.Regs.GetReg16(cpu.DX)
-		c.Mem.SetMem16(0, al, uint16(dx))
-		c.Mem.SetMem16(0, al+2, uint16(ds))
+		vec := uint(c.Regs.GetReg8(cpu.AL)) * 4
+		setFarPointer(c.Mem, 0, vec, c.Regs.DS(), uint(c.Regs.GetReg16(cpu.DX)))
+	case 0x31:
+		// AH=31h - TERMINATE AND STAY RESIDENT
+		dos.keep(c, uint(c.Regs.GetReg16(cpu.DX)), uint8(c.Regs.GetReg8(cpu.AL)))
 	case 0x35:
 		// AH=35h - GET INTERRUPT VECTOR
-		al := c.Regs.GetReg16(cpu.AX) & 0xFF
-		c.Regs.SetSeg16(cpu.ES, uint(c.Mem.GetMem16(0, al)))
-		c.Regs.SetReg16(cpu.BX, uint(c.Mem.GetMem16(0, al+2)))
+		seg, off := farPointer(c.Mem, 0, uint(c.Regs.GetReg8(cpu.AL))*4)
+		c.Regs.SetSeg16(cpu.ES, seg)
+		c.Regs.SetReg16(cpu.BX, off)
+	case 0x36:
+		// AH=36h - GET FREE DISK SPACE
+		dos.freeSpace(c)
+	case 0x39:
+		// AH=39h - "MKDIR" - CREATE SUBDIRECTORY
+		dos.result(c, dos.makeDir(c))
+	case 0x3A:
+		// AH=3Ah - "RMDIR" - REMOVE SUBDIRECTORY
+		dos.result(c, dos.removeDir(c))
+	case 0x3B:
+		// AH=3Bh - "CHDIR" - SET CURRENT DIRECTORY
+		dos.result(c, dos.changeDir(c))
+	case 0x3C:
+		// AH=3Ch - "CREAT" - CREATE OR TRUNCATE FILE
+		dos.result(c, dos.createFile(c))
+	case 0x3D:
+		// AH=3Dh - "OPEN" - OPEN EXISTING FILE
+		dos.result(c, dos.openFile(c))
+	case 0x3E:
+		// AH=3Eh - "CLOSE" - CLOSE FILE
+		dos.result(c, dos.closeFile(c))
+	case 0x3F:
+		// AH=3Fh - "READ" - READ FROM FILE OR DEVICE
+		dos.result(c, dos.readFile(c))
 	case 0x40:
 		// AH=40h - "WRITE" - WRITE TO FILE OR DEVICE
-		bx := c.Regs.GetReg16(cpu.BX)
-		cx := c.Regs.GetReg16(cpu.CX)
-		dx := c.Regs.GetReg16(cpu.DX)
-		s := c.Mem.At(c.Regs.DS(), dx)[:cx]
-		switch bx {
-		case 1:
-			dos.Out.Write(s)
-		case 2:
-			dos.Err.Write(s)
-		default:
-			// TODO: look up filehandle from JFT, map to SFT and write.
-		}
-	case 0x4a:
-		// INT 21 - AH = 4Ah DOS 2+ - ADJUST MEMORY BLOCK SIZE (SETBLOCK)
-		// ES = Segment address of block to change
-		// BX = New size in paragraphs
-		es := c.Regs.ES()
-		bx := c.Regs.GetReg16(cpu.BX)
-		log.V(3).Infof("INT21H: [4A] [BLOCK: 0x%04X, SIZE: %d paragraphs, %d bytes]", es, bx, bx*16)
-		newsize, err := dos.Mem.Resize(es, bx)
-		if err != nil {
-			dos.cpu.Flags.SetFlags(cpu.CF)
-			return
-		}
-		c.Regs.SetReg16(cpu.BX, uint(newsize))
+		dos.result(c, dos.writeFile(c))
+	case 0x41:
+		// AH=41h - "UNLINK" - DELETE FILE
+		dos.result(c, dos.deleteFile(c))
+	case 0x42:
+		// AH=42h - "LSEEK" - SET CURRENT FILE POSITION
+		dos.result(c, dos.seekFile(c))
+	case 0x43:
+		// AH=43h - GET/SET FILE ATTRIBUTES
+		dos.result(c, dos.fileAttributes(c))
+	case 0x44:
+		// AH=44h - IOCTL
+		dos.result(c, dos.ioctl(c))
+	case 0x47:
+		// AH=47h - "CWD" - GET CURRENT DIRECTORY
+		dos.result(c, dos.currentDir(c))
+	case 0x48:
+		// AH=48h - ALLOCATE MEMORY
+		dos.result(c, dos.allocateMemory(c))
+	case 0x49:
+		// AH=49h - FREE MEMORY
+		dos.result(c, dos.freeMemory(c))
+	case 0x4A:
+		// AH=4Ah - RESIZE MEMORY BLOCK
+		dos.result(c, dos.resizeMemory(c))
+	case 0x4E:
+		// AH=4Eh - "FINDFIRST" - FIND FIRST MATCHING FILE
+		dos.result(c, dos.findFirst(c))
+	case 0x4F:
+		// AH=4Fh - "FINDNEXT" - FIND NEXT MATCHING FILE
+		dos.result(c, dos.findNext(c))
+	case 0x52:
+		// AH=52h - SYSVARS - GET LIST OF LISTS
+		dos.listOfLists(c)
+	case 0x56:
+		// AH=56h - "RENAME" - RENAME FILE
+		dos.result(c, dos.renameFile(c))
+	case 0x57:
+		// AH=57h - GET/SET FILE'S DATE AND TIME
+		dos.result(c, dos.fileTime(c))
+	case 0x58:
+		// AH=58h - GET OR SET MEMORY ALLOCATION STRATEGY
+		dos.result(c, dos.allocStrategy(c))
+	case 0x4B:
+		// AH=4Bh - "EXEC" - LOAD AND/OR EXECUTE PROGRAM
+		dos.result(c, dos.exec(c))
 	case 0x4C:
-		c.Halt()
+		// AH=4Ch - "EXIT" - TERMINATE WITH RETURN CODE
+		dos.terminate(c, TermNormal, uint8(c.Regs.GetReg8(cpu.AL)))
+	case 0x4D:
+		// AH=4Dh - GET RETURN CODE (ERRORLEVEL)
+		// It can only be read once, after that it is zero.
+		c.Regs.SetReg16(cpu.AX, uint(dos.TermKind)<<8|uint(dos.ReturnCode))
+		dos.TermKind, dos.ReturnCode = TermNormal, 0
 	default:
 		log.Warningf("Unhandled DOS Interrupt Code: [%02x]\n", ah)
 	}
@@ -98,34 +289,25 @@ func NewDos(cpu *cpu.CPU) *Dos {
 		Err: os.Stderr,
 		// TODO: If end > c.Mem end, lower it.
 		// 0x800
-		Mem: NewDosMem(0x0C85, end),
-		cpu: cpu,
+		Mem:       NewDosMem(0x0C85, end),
+		Env:       []string{"PATH=C:\\"},
+		searchIds: map[string]uint16{},
+		dtaSeg:    dosCodeSeg,
+		dtaOff:    defaultDTA,
+		cpu:       cpu,
 	}
+	dos.Mem.mem = cpu.Mem
+	dos.initFiles()
 
 	cpu.Intrs[0x20] = (*dos).Int20
 	cpu.Intrs[0x21] = (*dos).Int21
+	cpu.Intrs[0x23] = (*dos).Int23
+	cpu.Intrs[0x24] = (*dos).Int24
+	cpu.Intrs[0x27] = (*dos).Int27
 
 	return dos
 }
 
-func (dos *Dos) createPsp(exe *Executable, seg_base *DosMemBlock, env_seg *DosMemBlock) {
-	log.V(1).Infof("Creating PSP at: 0x%04X\n", seg_base.Start)
-	log.V(4).Infof("Executable Type: %#v\n", exe.Etype)
-	start := seg_base.Start
-	dos.cpu.Mem.SetMem8(start, 0, 0xCD)
-	dos.cpu.Mem.SetMem8(start, 1, 0x20)
-	// First paragraph following this segment.
-	dos.cpu.Mem.SetMem16(start, 2, uint16(seg_base.End+1))
-
-	dos.cpu.Mem.SetMem8(start, 10, 0x22) // int22 handler
-	dos.cpu.Mem.SetMem8(start, 14, 0x23) // int23 handler
-	dos.cpu.Mem.SetMem8(start, 18, 0x24) // int24 handler
-	// FFFE means no parent DOS process
-	dos.cpu.Mem.SetMem16(start, 22, 0xFFFE)
-	dos.cpu.Mem.SetMem16(start, 44, uint16(env_seg.Start))
-	// TODO: Create rest
-}
-
 func (dos *Dos) LoadCom(exe *Executable, seg_base *DosMemBlock) (seg uint16, err error) {
 	// DS is what we allocated, for EXE, CS is 0x100 past it since the PSP goes first
 	seg_start := uint16(seg_base.Start)
@@ -140,7 +322,7 @@ func (dos *Dos) LoadCom(exe *Executable, seg_base *DosMemBlock) (seg uint16, err
 	dos.cpu.Ip = 0x100
 
 	// Copy data into memory at CS from the binary read from disk.
-	copy(dos.cpu.Mem.At(uint(image_start), 0), exe.Data)
+	dos.cpu.Mem.Copy(uint(image_start), 0, exe.Data)
 
 	return seg_start, nil
 }
@@ -159,7 +341,7 @@ func (dos *Dos) LoadImage(exe *Executable, seg_base *DosMemBlock) (seg uint16, e
 	dos.cpu.Ip = 0
 
 	// Copy data into memory at CS from the binary read from disk.
-	copy(dos.cpu.Mem.At(uint(image_start), 0), exe.Data)
+	dos.cpu.Mem.Copy(uint(image_start), 0, exe.Data)
 
 	return seg_start, nil
 }
@@ -179,7 +361,7 @@ func (dos *Dos) LoadExe(exe *Executable, seg_base *DosMemBlock) (seg uint16, err
 	dos.cpu.Ip = exe.Hdr.IP
 
 	// Copy data into memory at CS from the binary read from disk.
-	copy(dos.cpu.Mem.At(uint(cs), 0), exe.Data)
+	dos.cpu.Mem.Copy(uint(cs), 0, exe.Data)
 
 	log.V(1).Infof("EXE Values:\nCS: 0x%04X\nDS: 0x%04X\nES: 0x%04X\nSS: 0x%04X\nIP: 0x%04X\n\n",
 		cs, seg_start, seg_start, ss, dos.cpu.Ip)
@@ -195,35 +377,55 @@ func (dos *Dos) LoadExe(exe *Executable, seg_base *DosMemBlock) (seg uint16, err
 	return uint16(seg_start), nil
 }
 
-func (dos *Dos) Load(exe *Executable) (seg uint16, err error) {
+// Load loads a program with args as its command line, ready to run.
+func (dos *Dos) Load(exe *Executable, args ...string) (seg uint16, err error) {
 	if !exe.Exists || len(exe.Data) == 0 {
 		return 0, errors.New("executable not read")
 	}
-	// hack really look up environment
-	env_seg, err := dos.Mem.Allocate(10)
+	tail, err := commandTail(args)
 	if err != nil {
 		return 0, err
 	}
-	env_mem := dos.cpu.Mem.At(env_seg.Start, 0)
-	copy(env_mem, []byte("PATH=Z:\\\n"))
+	return dos.load(exe, tail, dos.Env)
+}
+
+// Loads a program with its command tail and environment variables, as the
+// current process.
+func (dos *Dos) load(exe *Executable, tail string, vars []string) (seg uint16, err error) {
+	path := dos.programPath(exe.Name)
+	env := environment(vars, path)
+	env_seg, err := dos.Mem.Allocate(uint(len(env)+15) / 16)
+	if err != nil {
+		return 0, err
+	}
+	env_start := env_seg.Start
+	dos.cpu.Mem.Copy(env_start, 0, env)
 
 	sn := exe.SegmentsNeeded()
 	seg_base, err := dos.Mem.Allocate(sn)
 	log.V(2).Infof("DOS Allocated [%d segments %d bytes]", sn, sn*0x10)
 	if err != nil {
+		dos.Mem.Free(env_start)
 		return 0, err
 	}
-	// We own our own memory block.
-
-	seg_base.Owner = seg_base.Start
-	// TODO: Create PSP
+	// We own our own memory block, and the environment.
+	psp := seg_base.Start
+	if err := dos.Mem.SetOwner(psp, psp, mcbProgramName(path)); err != nil {
+		return 0, err
+	}
+	if err := dos.Mem.SetOwner(env_start, psp, ""); err != nil {
+		return 0, err
+	}
+	if i, ok := dos.Mem.FindBlock(psp); ok {
+		seg_base = &dos.Mem.Blocks[i]
+	}
 
 	switch exe.Etype {
 	case EXE:
-		dos.createPsp(exe, seg_base, env_seg)
+		dos.createPsp(seg_base, env_start, tail)
 		return dos.LoadExe(exe, seg_base)
 	case COM:
-		dos.createPsp(exe, seg_base, env_seg)
+		dos.createPsp(seg_base, env_start, tail)
 		return dos.LoadCom(exe, seg_base)
 	case IMAGE:
 		return dos.LoadImage(exe, seg_base)
@@ -0,0 +1,780 @@
+package go86
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	cpu "go86.org/go86/cpu"
+	"gotest.tools/v3/assert"
+)
+
+func setupDos(t *testing.T) (*cpu.CPU, *Dos) {
+	t.Helper()
+	c := cpu.NewCpu(1024 * 1024)
+	return c, NewDos(c)
+}
+
+// Calls INT 21h with AX set to ax.
+func int21(c *cpu.CPU, dos *Dos, ax uint) {
+	c.Regs.SetReg16(cpu.AX, ax)
+	dos.Int21(c, 0x21)
+}
+
+func TestDosReturnCode(t *testing.T) {
+	c, dos := setupDos(t)
+	int21(c, dos, 0x4C07)
+	assert.Assert(t, !c.Running)
+	assert.Equal(t, dos.TermKind, TermNormal)
+	assert.Equal(t, dos.ReturnCode, uint8(7))
+
+	int21(c, dos, 0x4D00)
+	assert.Equal(t, c.Regs.AX(), uint(0x0007))
+	// Only the first time
+	int21(c, dos, 0x4D00)
+	assert.Equal(t, c.Regs.AX(), uint(0))
+}
+
+func TestDosTermKind(t *testing.T) {
+	for _, test := range []struct {
+		intnum int
+		kind   TermKind
+	}{
+		{0x20, TermNormal},
+		{0x23, TermCtrlC},
+		{0x24, TermCriticalError},
+	} {
+		c, dos := setupDos(t)
+		c.Intrs[test.intnum](c, test.intnum)
+		assert.Assert(t, !c.Running)
+		int21(c, dos, 0x4D00)
+		assert.Equal(t, c.Regs.AX(), uint(test.kind)<<8, "INT %02Xh", test.intnum)
+	}
+}
+
+func TestDosShortName(t *testing.T) {
+	for _, test := range []struct {
+		in, want string
+		ok       bool
+	}{
+		{"hello.txt", "HELLO.TXT", true},
+		{"LongFileName.text", "LONGFILE.TEX", true},
+		{"makefile", "MAKEFILE", true},
+		{"a.b.c", "", false},
+		{".git", "", false},
+		{"bad name", "", false},
+		{"*.txt", "", false},
+		{"~$(x)", "~$(X)", true},
+	} {
+		got, ok := shortName(test.in)
+		assert.Equal(t, ok, test.ok, test.in)
+		assert.Equal(t, got, test.want, test.in)
+	}
+	_, ok := shortNameOf("LongFileName.txt")
+	assert.Assert(t, !ok)
+}
+
+// Puts s at DS:DX as an ASCIZ string.
+func setPath(c *cpu.CPU, s string) {
+	c.Regs.SetSeg16(cpu.DS, 0x2000)
+	c.Regs.SetReg16(cpu.DX, 0x100)
+	c.Mem.Copy(0x2000, 0x100, append([]byte(s), 0))
+}
+
+// Calls INT 21h, failing the test if it returns an error.
+func call21(t *testing.T, c *cpu.CPU, dos *Dos, ax uint) uint {
+	t.Helper()
+	int21(c, dos, ax)
+	assert.Assert(t, !c.Flags.IsEnabled(cpu.CarryFlag), "AX=%04X error %02Xh", ax, c.Regs.AX())
+	return c.Regs.AX()
+}
+
+// Calls INT 21h, which should fail with want.
+func fail21(t *testing.T, c *cpu.CPU, dos *Dos, ax uint, want DosError) {
+	t.Helper()
+	int21(c, dos, ax)
+	assert.Assert(t, c.Flags.IsEnabled(cpu.CarryFlag), "AX=%04X", ax)
+	assert.Equal(t, DosError(c.Regs.AX()), want)
+}
+
+func setupDrive(t *testing.T) (*cpu.CPU, *Dos, string) {
+	t.Helper()
+	c, dos := setupDos(t)
+	dir := t.TempDir()
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "hello.txt"), []byte("Hello, World!"), 0666))
+	assert.NilError(t, os.Mkdir(filepath.Join(dir, "Sub"), 0777))
+	assert.NilError(t, dos.Mount('C', dir))
+	// A process with a JFT in its PSP
+	dos.initJFT(0x1000)
+	dos.psp = 0x1000
+	return c, dos, dir
+}
+
+func TestDosFileRead(t *testing.T) {
+	c, dos, _ := setupDrive(t)
+	setPath(c, "c:\\Hello.Txt")
+	h := call21(t, c, dos, 0x3D00)
+	assert.Equal(t, h, uint(5))
+	assert.Equal(t, c.Mem.GetMem8(0x1000, 0x18+5), uint8(4))
+
+	c.Regs.SetReg16(cpu.BX, h)
+	c.Regs.SetReg16(cpu.CX, 5)
+	assert.Equal(t, call21(t, c, dos, 0x3F00), uint(5))
+	assert.Equal(t, string(c.Mem.At(0x2000, 0x100)[:5]), "Hello")
+
+	// 2 before the end
+	c.Regs.SetReg16(cpu.CX, 0xFFFF)
+	c.Regs.SetReg16(cpu.DX, 0xFFFE)
+	assert.Equal(t, call21(t, c, dos, 0x4202), uint(11))
+	assert.Equal(t, c.Regs.GetReg16(cpu.DX), uint(0))
+	c.Regs.SetReg16(cpu.CX, 100)
+	c.Regs.SetReg16(cpu.DX, 0x100)
+	assert.Equal(t, call21(t, c, dos, 0x3F00), uint(2))
+	assert.Equal(t, call21(t, c, dos, 0x3F00), uint(0))
+	// Opened for reading
+	fail21(t, c, dos, 0x4000, ErrAccessDenied)
+
+	call21(t, c, dos, 0x3E00)
+	assert.Equal(t, c.Mem.GetMem8(0x1000, 0x18+5), uint8(0xFF))
+	fail21(t, c, dos, 0x3E00, ErrInvalidHandle)
+}
+
+func TestDosFileWrite(t *testing.T) {
+	c, dos, dir := setupDrive(t)
+	setPath(c, "sub\\newfile.dat")
+	c.Regs.SetReg16(cpu.CX, 0)
+	h := call21(t, c, dos, 0x3C00)
+
+	c.Regs.SetReg16(cpu.BX, h)
+	c.Regs.SetReg16(cpu.CX, 3)
+	assert.Equal(t, call21(t, c, dos, 0x4000), uint(3))
+	c.Regs.SetReg16(cpu.CX, 0)
+	c.Regs.SetReg16(cpu.DX, 1)
+	call21(t, c, dos, 0x4200)
+	// Writing nothing truncates
+	call21(t, c, dos, 0x4000)
+	call21(t, c, dos, 0x3E00)
+
+	b, err := os.ReadFile(filepath.Join(dir, "Sub", "NEWFILE.DAT"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "s")
+}
+
+func TestDosFileErrors(t *testing.T) {
+	c, dos, _ := setupDrive(t)
+	setPath(c, "missing.txt")
+	fail21(t, c, dos, 0x3D00, ErrFileNotFound)
+	setPath(c, "nodir\\hello.txt")
+	fail21(t, c, dos, 0x3D00, ErrPathNotFound)
+	setPath(c, "d:hello.txt")
+	fail21(t, c, dos, 0x3D00, ErrInvalidDrive)
+	setPath(c, "sub")
+	fail21(t, c, dos, 0x3D00, ErrAccessDenied)
+	setPath(c, "hello.txt")
+	fail21(t, c, dos, 0x3D07, ErrInvalidAccess)
+
+	c.Regs.SetReg16(cpu.BX, 19)
+	fail21(t, c, dos, 0x3F00, ErrInvalidHandle)
+	for h := 5; h < jftSize; h++ {
+		call21(t, c, dos, 0x3D00)
+	}
+	fail21(t, c, dos, 0x3D00, ErrTooManyOpenFiles)
+}
+
+func TestDosStdHandles(t *testing.T) {
+	c, dos := setupDos(t)
+	var out, errs bytes.Buffer
+	dos.Out, dos.Err = &out, &errs
+	dos.In = strings.NewReader("typed\r\n")
+
+	setPath(c, "hi")
+	c.Regs.SetReg16(cpu.CX, 2)
+	c.Regs.SetReg16(cpu.BX, 1)
+	call21(t, c, dos, 0x4000)
+	c.Regs.SetReg16(cpu.BX, 2)
+	call21(t, c, dos, 0x4000)
+	c.Regs.SetReg16(cpu.BX, 0)
+	c.Regs.SetReg16(cpu.CX, 10)
+	assert.Equal(t, call21(t, c, dos, 0x3F00), uint(7))
+	assert.Equal(t, out.String(), "hi")
+	assert.Equal(t, errs.String(), "hi")
+	c.Regs.SetReg16(cpu.BX, 1)
+	call21(t, c, dos, 0x4400)
+	assert.Equal(t, c.Regs.GetReg16(cpu.DX)&0x80, uint(0x80))
+
+	// Devices open without a drive
+	setPath(c, "NUL")
+	assert.Equal(t, call21(t, c, dos, 0x3D02), uint(5))
+}
+
+func TestDosConsoleRead(t *testing.T) {
+	c, dos := setupDos(t)
+	// Piped input comes in whatever pieces the pipe gives
+	dos.In = iotest.OneByteReader(strings.NewReader("one\ntwo\r\nthree"))
+	read := func(cx uint) string {
+		t.Helper()
+		c.Regs.SetReg16(cpu.BX, 0)
+		c.Regs.SetReg16(cpu.CX, cx)
+		c.Regs.SetSeg16(cpu.DS, 0x2000)
+		c.Regs.SetReg16(cpu.DX, 0)
+		n := call21(t, c, dos, 0x3F00)
+		return string(c.Mem.At(0x2000, 0)[:n])
+	}
+	assert.Equal(t, read(3), "one")
+	assert.Equal(t, read(10), "\r\n")
+	assert.Equal(t, read(10), "two\r\n")
+	assert.Equal(t, read(10), "three")
+	assert.Equal(t, read(10), "")
+}
+
+// Finds the files matching spec, with FIND FIRST and FIND NEXT.
+func findAll(t *testing.T, c *cpu.CPU, dos *Dos, spec string, attr uint) []string {
+	t.Helper()
+	setPath(c, spec)
+	c.Regs.SetReg16(cpu.CX, attr)
+	var names []string
+	for ax := uint(0x4E00); ; ax = 0x4F00 {
+		int21(c, dos, ax)
+		if c.Flags.IsEnabled(cpu.CarryFlag) {
+			assert.Equal(t, DosError(c.Regs.AX()), ErrNoMoreFiles)
+			return names
+		}
+		name := c.Mem.At(dos.dtaSeg, dos.dtaOff+dtaName)[:13]
+		names = append(names, string(name[:bytes.IndexByte(name, 0)]))
+	}
+}
+
+func TestDosFind(t *testing.T) {
+	c, dos, dir := setupDrive(t)
+	for _, name := range []string{"a.c", "b.c", "readme", "LongerName.txt"} {
+		assert.NilError(t, os.WriteFile(filepath.Join(dir, name), nil, 0666))
+	}
+	c.Regs.SetSeg16(cpu.DS, 0x3000)
+	c.Regs.SetReg16(cpu.DX, 0)
+	int21(c, dos, 0x1A00)
+
+	assert.DeepEqual(t, findAll(t, c, dos, "*.*", 0), []string{"A.C", "B.C", "HELLO.TXT", "README"})
+	assert.DeepEqual(t, findAll(t, c, dos, "*.*", attrDirectory), []string{"A.C", "B.C", "HELLO.TXT", "README", "SUB"})
+	assert.DeepEqual(t, findAll(t, c, dos, "?.C", 0), []string{"A.C", "B.C"})
+	assert.DeepEqual(t, findAll(t, c, dos, "*", 0), []string{"README"})
+	assert.DeepEqual(t, findAll(t, c, dos, "sub\\*.*", attrDirectory), []string{".", ".."})
+	assert.DeepEqual(t, findAll(t, c, dos, "x*.*", 0), []string(nil))
+
+	setPath(c, "hello.txt")
+	c.Regs.SetReg16(cpu.CX, 0)
+	call21(t, c, dos, 0x4E00)
+	assert.Equal(t, c.Mem.GetMem8(0x3000, dtaAttr), uint8(attrArchive))
+	assert.Equal(t, c.Mem.GetMem16(0x3000, dtaSize), uint16(13))
+
+	int21(c, dos, 0x2F00)
+	assert.Equal(t, c.Regs.ES(), uint(0x3000))
+	assert.Equal(t, c.Regs.GetReg16(cpu.BX), uint(0))
+}
+
+func TestDosDirs(t *testing.T) {
+	c, dos, dir := setupDrive(t)
+	setPath(c, "sub\\new")
+	call21(t, c, dos, 0x3900)
+	fail21(t, c, dos, 0x3900, ErrAccessDenied)
+	assert.Assert(t, fileExists(filepath.Join(dir, "Sub", "NEW")))
+
+	setPath(c, "\\SUB\\NEW")
+	call21(t, c, dos, 0x3B00)
+	c.Regs.SetReg16(cpu.DX, 0)
+	c.Regs.SetReg16(cpu.SI, 0x200)
+	call21(t, c, dos, 0x4700)
+	assert.Equal(t, string(c.Mem.At(0x2000, 0x200)[:8]), "SUB\\NEW\x00")
+	c.Regs.SetReg16(cpu.DX, 4)
+	fail21(t, c, dos, 0x4700, ErrInvalidDrive)
+
+	setPath(c, "..")
+	fail21(t, c, dos, 0x3A00, ErrRemoveCurrentDir)
+	setPath(c, "\\")
+	call21(t, c, dos, 0x3B00)
+	setPath(c, "sub\\new")
+	call21(t, c, dos, 0x3A00)
+	assert.Assert(t, !fileExists(filepath.Join(dir, "Sub", "NEW")))
+	setPath(c, "nothere")
+	fail21(t, c, dos, 0x3B00, ErrPathNotFound)
+
+	int21(c, dos, 0x1900)
+	assert.Equal(t, c.Regs.GetReg8(cpu.AL), uint(2))
+	c.Regs.SetReg16(cpu.DX, 0)
+	int21(c, dos, 0x3600)
+	assert.Equal(t, c.Regs.AX(), uint(64))
+	c.Regs.SetReg16(cpu.DX, 1)
+	int21(c, dos, 0x3600)
+	assert.Equal(t, c.Regs.AX(), uint(0xFFFF))
+}
+
+func TestDosRenameDelete(t *testing.T) {
+	c, dos, dir := setupDrive(t)
+	setPath(c, "hello.txt")
+	c.Regs.SetSeg16(cpu.ES, 0x2000)
+	c.Regs.SetReg16(cpu.DI, 0x200)
+	c.Mem.Copy(0x2000, 0x200, []byte("sub\\moved.txt\x00"))
+	call21(t, c, dos, 0x5600)
+	assert.Assert(t, fileExists(filepath.Join(dir, "Sub", "MOVED.TXT")))
+	fail21(t, c, dos, 0x5600, ErrFileNotFound)
+
+	assert.NilError(t, dos.Mount('D', t.TempDir()))
+	c.Mem.Copy(0x2000, 0x200, []byte("d:x.txt\x00"))
+	setPath(c, "sub\\moved.txt")
+	fail21(t, c, dos, 0x5600, ErrNotSameDevice)
+
+	// Read only files can't be deleted
+	c.Regs.SetReg16(cpu.CX, attrReadOnly)
+	call21(t, c, dos, 0x4301)
+	call21(t, c, dos, 0x4300)
+	assert.Equal(t, c.Regs.GetReg16(cpu.CX), uint(attrReadOnly|attrArchive))
+	fail21(t, c, dos, 0x4100, ErrAccessDenied)
+	c.Regs.SetReg16(cpu.CX, 0)
+	call21(t, c, dos, 0x4301)
+	call21(t, c, dos, 0x4100)
+	assert.Assert(t, !fileExists(filepath.Join(dir, "Sub", "MOVED.TXT")))
+	fail21(t, c, dos, 0x4100, ErrFileNotFound)
+}
+
+func TestDosFileTime(t *testing.T) {
+	c, dos, _ := setupDrive(t)
+	setPath(c, "hello.txt")
+	h := call21(t, c, dos, 0x3D02)
+	c.Regs.SetReg16(cpu.BX, h)
+	// 1994-06-15 12:34:56
+	c.Regs.SetReg16(cpu.DX, 14<<9|6<<5|15)
+	c.Regs.SetReg16(cpu.CX, 12<<11|34<<5|28)
+	call21(t, c, dos, 0x5701)
+	c.Regs.SetReg16(cpu.CX, 0)
+	c.Regs.SetReg16(cpu.DX, 0)
+	call21(t, c, dos, 0x5700)
+	assert.Equal(t, c.Regs.GetReg16(cpu.DX), uint(14<<9|6<<5|15))
+	assert.Equal(t, c.Regs.GetReg16(cpu.CX), uint(12<<11|34<<5|28))
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// Puts an FCB for name, in FCB format, at DS:DX and the DTA after it.
+func setFCB(c *cpu.CPU, dos *Dos, name string) fcb {
+	c.Regs.SetSeg16(cpu.DS, 0x2000)
+	c.Regs.SetReg16(cpu.DX, 0x200)
+	c.Mem.Copy(0x2000, 0x200, make([]byte, 0x25))
+	c.Mem.Copy(0x2000, 0x201, []byte(name))
+	dos.dtaSeg, dos.dtaOff = 0x2000, 0x400
+	return fcb{c.Mem, 0x2000, 0x200}
+}
+
+// Writes a COM which does nothing to name in dir and loads it, returning
+// its PSP.
+func loadProgram(t *testing.T, dos *Dos, dir, name string) uint {
+	t.Helper()
+	com := []byte{0x90, 0xC3} // NOP, RET
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, name), com, 0666))
+	exe, err := ReadExe(com)
+	assert.NilError(t, err)
+	seg, err := dos.Load(exe)
+	assert.NilError(t, err)
+	return uint(seg)
+}
+
+// Puts an EXEC parameter block at 2000:off, with the command tail after it,
+// and points ES:BX at it.
+func execParams(c *cpu.CPU, off uint, tail string) {
+	c.Mem.Copy(0x2000, off, make([]byte, 0x16))
+	c.Mem.SetMem16(0x2000, off+execTail, uint16(off+0x20))
+	c.Mem.SetMem16(0x2000, off+execTail+2, 0x2000)
+	c.Mem.Copy(0x2000, off+0x20, append([]byte{uint8(len(tail))}, tail+"\r"...))
+	c.Regs.SetSeg16(cpu.ES, 0x2000)
+	c.Regs.SetReg16(cpu.BX, off)
+}
+
+// Loads name without running it, with EXEC AL=01h and the parameter block
+// at 2000:params, returning the child's PSP.
+func execChild(t *testing.T, c *cpu.CPU, dos *Dos, name string, params uint) uint {
+	t.Helper()
+	c.Regs.SetSeg16(cpu.ES, 0x2000)
+	c.Regs.SetReg16(cpu.BX, params)
+	setPath(c, name)
+	call21(t, c, dos, 0x4B01)
+	return dos.psp
+}
+
+func TestDosDefaultDTA(t *testing.T) {
+	// A binary image has no PSP, so no DTA in one
+	c, dos, _ := setupDrive(t)
+	dos.psp = 0
+	setPath(c, "HELLO.TXT")
+	c.Regs.SetReg16(cpu.CX, 0)
+	call21(t, c, dos, 0x4E00)
+	name := c.Mem.At(dosCodeSeg, defaultDTA+dtaName)[:13]
+	assert.Equal(t, string(name[:bytes.IndexByte(name, 0)]), "HELLO.TXT")
+
+	seg, off := dos.dtaSeg, dos.dtaOff
+	f := setFCB(c, dos, "HELLO   TXT")
+	dos.dtaSeg, dos.dtaOff = seg, off
+	int21(c, dos, 0x0F00)
+	f.set16(fcbRecordSize, 5)
+	int21(c, dos, 0x1400)
+	assert.Equal(t, c.Regs.GetReg8(cpu.AL), uint(0))
+	assert.Equal(t, string(c.Mem.At(dosCodeSeg, defaultDTA)[:5]), "Hello")
+	// The interrupt vectors are left alone
+	assert.DeepEqual(t, c.Mem.At(0, 0)[:0x400], make([]byte, 0x400))
+}
+
+func TestDosFCBRead(t *testing.T) {
+	c, dos, _ := setupDrive(t)
+	f := setFCB(c, dos, "HELLO   TXT")
+	int21(c, dos, 0x0F00)
+	assert.Equal(t, c.Regs.GetReg8(cpu.AL), uint(0))
+	assert.Equal(t, f.get8(fcbDrive), uint8(3))
+	assert.Equal(t, f.get16(fcbRecordSize), uint16(0x80))
+	assert.Equal(t, f.get32(fcbFileSize), uint32(13))
+
+	f.set16(fcbRecordSize, 5)
+	int21(c, dos, 0x1400)
+	assert.Equal(t, c.Regs.GetReg8(cpu.AL), uint(0))
+	assert.Equal(t, string(c.Mem.At(0x2000, 0x400)[:5]), "Hello")
+	assert.Equal(t, f.get8(fcbRecord), uint8(1))
+
+	// Record 2 is partial and padded with zeros
+	f.set32(fcbRandom, 2)
+	int21(c, dos, 0x2100)
+	assert.Equal(t, c.Regs.GetReg8(cpu.AL), uint(3))
+	assert.Equal(t, string(c.Mem.At(0x2000, 0x400)[:5]), "ld!\x00\x00")
+	assert.Equal(t, f.get8(fcbRecord), uint8(2))
+	int21(c, dos, 0x1400)
+	int21(c, dos, 0x1400)
+	assert.Equal(t, c.Regs.GetReg8(cpu.AL), uint(1))
+
+	f.set32(fcbRandom, 0)
+	c.Regs.SetReg16(cpu.CX, 4)
+	int21(c, dos, 0x2700)
+	assert.Equal(t, c.Regs.GetReg8(cpu.AL), uint(3))
+	assert.Equal(t, c.Regs.GetReg16(cpu.CX), uint(3))
+	assert.Equal(t, f.get32(fcbRandom), uint32(3))
+	assert.Equal(t, string(c.Mem.At(0x2000, 0x400)[:13]), "Hello, World!")
+
+	int21(c, dos, 0x1000)
+	assert.Equal(t, c.Regs.GetReg8(cpu.AL), uint(0))
+	int21(c, dos, 0x1000)
+	assert.Equal(t, c.Regs.GetReg8(cpu.AL), uint(0xFF))
+
+	setFCB(c, dos, "MISSING    ")
+	int21(c, dos, 0x0F00)
+	assert.Equal(t, c.Regs.GetReg8(cpu.AL), uint(0xFF))
+}
+
+func TestDosFCBWrite(t *testing.T) {
+	c, dos, dir := setupDrive(t)
+	// An extended FCB
+	c.Mem.Copy(0x2000, 0x1F9, []byte{0xFF, 0, 0, 0, 0, 0, 0})
+	f := setFCB(c, dos, "NEW     DAT")
+	c.Regs.SetReg16(cpu.DX, 0x1F9)
+	int21(c, dos, 0x1600)
+	assert.Equal(t, c.Regs.GetReg8(cpu.AL), uint(0))
+
+	f.set16(fcbRecordSize, 4)
+	c.Mem.Copy(0x2000, 0x400, []byte("abcdefghijkl"))
+	int21(c, dos, 0x1500)
+	assert.Equal(t, c.Regs.GetReg8(cpu.AL), uint(0))
+	f.set32(fcbRandom, 2)
+	c.Regs.SetReg16(cpu.CX, 2)
+	int21(c, dos, 0x2800)
+	assert.Equal(t, c.Regs.GetReg16(cpu.CX), uint(2))
+	assert.Equal(t, f.get32(fcbFileSize), uint32(16))
+	f.set32(fcbRandom, 1)
+	int21(c, dos, 0x2200)
+	// No records sets the size
+	f.set32(fcbRandom, 3)
+	c.Regs.SetReg16(cpu.CX, 0)
+	int21(c, dos, 0x2800)
+	int21(c, dos, 0x1000)
+
+	b, err := os.ReadFile(filepath.Join(dir, "NEW.DAT"))
+	assert.NilError(t, err)
+	assert.Equal(t, string(b), "abcdabcdabcd")
+}
+
+func TestDosParseFilename(t *testing.T) {
+	c, dos, _ := setupDrive(t)
+	for _, test := range []struct {
+		in     string
+		flags  uint
+		name   string
+		drive  uint8
+		result uint
+		used   uint
+	}{
+		{"hello.txt", 0, "HELLO   TXT", 0, 0, 9},
+		{" ,c:Sub*.c x", 1, "SUB?????C  ", 3, 1, 10},
+		{"d:readme", 0, "README     ", 4, 0xFF, 8},
+		{"LongFileName.text", 0, "LONGFILETEX", 0, 0, 17},
+		{"a?.*", 0, "A?      ???", 0, 1, 4},
+		// Keep what is there
+		{".x", 0x0E, "ORIGINALX  ", 2, 0, 2},
+	} {
+		c.Mem.Copy(0x2000, 0x100, append([]byte(test.in), 0))
+		c.Mem.Copy(0x3000, 0, append([]byte{2}, "ORIGINALEXT"...))
+		c.Regs.SetSeg16(cpu.DS, 0x2000)
+		c.Regs.SetReg16(cpu.SI, 0x100)
+		c.Regs.SetSeg16(cpu.ES, 0x3000)
+		c.Regs.SetReg16(cpu.DI, 0)
+		int21(c, dos, 0x2900|test.flags)
+		assert.Equal(t, c.Regs.GetReg8(cpu.AL), test.result, test.in)
+		assert.Equal(t, c.Regs.GetReg16(cpu.SI), 0x100+test.used, test.in)
+		assert.Equal(t, c.Mem.GetMem8(0x3000, 0), test.drive, test.in)
+		assert.Equal(t, string(c.Mem.At(0x3000, 1)[:11]), test.name, test.in)
+	}
+}
+
+func TestDosDefaultFCBs(t *testing.T) {
+	c, dos, _ := setupDrive(t)
+	tail := " c:one.txt two"
+	c.Mem.SetMem8(0x1000, 0x80, uint8(len(tail)))
+	c.Mem.Copy(0x1000, 0x81, []byte(tail+"\r"))
+	dos.fillDefaultFCBs(0x1000)
+	assert.Equal(t, c.Mem.GetMem8(0x1000, 0x5C), uint8(3))
+	assert.Equal(t, string(c.Mem.At(0x1000, 0x5D)[:11]), "ONE     TXT")
+	assert.Equal(t, c.Mem.GetMem8(0x1000, 0x6C), uint8(0))
+	assert.Equal(t, string(c.Mem.At(0x1000, 0x6D)[:11]), "TWO        ")
+}
+
+func TestDosPsp(t *testing.T) {
+	c, dos, dir := setupDrive(t)
+	dos.psp = 0
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "Sub", "prog.com"), []byte{0x90, 0xC3}, 0666))
+	exe, err := ReadExe([]byte{0x90, 0xC3})
+	assert.NilError(t, err)
+	exe.Name = filepath.Join(dir, "Sub", "prog.com")
+	c.Mem.SetMem16(0, 0x22*4, 0x1234)
+	c.Mem.SetMem16(0, 0x22*4+2, 0x5678)
+
+	seg, err := dos.Load(exe, "one.txt", "x", "/y")
+	assert.NilError(t, err)
+	psp := uint(seg)
+	assert.Equal(t, dos.psp, psp)
+	assert.DeepEqual(t, c.Mem.At(psp, 0)[:2], []byte{0xCD, 0x20})
+	assert.DeepEqual(t, c.Mem.At(psp, 5)[:5], []byte{0x9A, 0xF0, 0xFE, 0x1D, 0xF0})
+	assert.Equal(t, c.Mem.GetMem16(psp, 0x0A), uint16(0x1234))
+	assert.Equal(t, c.Mem.GetMem16(psp, 0x0C), uint16(0x5678))
+	assert.Equal(t, c.Mem.GetMem16(psp, 0x16), uint16(0xFFFE))
+	assert.Equal(t, c.Mem.GetMem8(psp, 0x80), uint8(13))
+	assert.Equal(t, string(c.Mem.At(psp, 0x81)[:14]), " one.txt x /y\r")
+	assert.Equal(t, string(c.Mem.At(psp, 0x5D)[:11]), "ONE     TXT")
+	assert.Equal(t, string(c.Mem.At(psp, 0x6D)[:11]), "X          ")
+
+	env := uint(c.Mem.GetMem16(psp, 0x2C))
+	want := "PATH=C:\\\x00\x00\x01\x00C:\\SUB\\PROG.COM\x00"
+	assert.Equal(t, string(c.Mem.At(env, 0)[:len(want)]), want)
+
+	_, err = dos.Load(exe, strings.Repeat("x", 126))
+	assert.ErrorContains(t, err, "too long")
+}
+
+func TestDosExec(t *testing.T) {
+	c, dos, dir := setupDrive(t)
+	parent := loadProgram(t, dos, dir, "prog.com")
+	execParams(c, 0x200, "")
+	setPath(c, "missing.com")
+	fail21(t, c, dos, 0x4B00, ErrFileNotFound)
+	setPath(c, "prog.com")
+	fail21(t, c, dos, 0x4B02, ErrInvalidFunction)
+
+	// Load without running
+	c.Regs.SetSeg16(cpu.CS, 0x1234)
+	c.Ip = 0x10
+	child := execChild(t, c, dos, "prog.com", 0x200)
+	assert.Equal(t, c.Regs.CS(), uint(0x1234))
+	assert.Equal(t, c.Ip, uint16(0x10))
+	assert.Assert(t, child != parent)
+	assert.Equal(t, c.Mem.GetMem16(child, 0x16), uint16(parent))
+	assert.Equal(t, c.Mem.GetMem16(0x2000, 0x20E), uint16(0xFFFC))
+	assert.Equal(t, c.Mem.GetMem16(0x2000, 0x210), uint16(child))
+	assert.Equal(t, c.Mem.GetMem16(0x2000, 0x212), uint16(0x100))
+	assert.Equal(t, c.Mem.GetMem16(0x2000, 0x214), uint16(child))
+	blocks := len(dos.Mem.Blocks)
+
+	// The child ending goes back to the parent after its INT 21h
+	c.Regs.SetSeg16(cpu.CS, child)
+	int21(c, dos, 0x4C02)
+	assert.Assert(t, c.Running)
+	assert.Equal(t, c.Regs.CS(), uint(0x1234))
+	assert.Equal(t, c.Ip, uint16(0x10))
+	assert.Equal(t, dos.psp, parent)
+	assert.Assert(t, len(dos.Mem.Blocks) < blocks)
+	assert.Equal(t, call21(t, c, dos, 0x4D00), uint(0x0002))
+
+	// An overlay at 3000:0000
+	c.Mem.SetMem16(0x2000, 0x200, 0x3000)
+	call21(t, c, dos, 0x4B03)
+	assert.DeepEqual(t, c.Mem.At(0x3000, 0)[:2], []byte{0x90, 0xC3})
+	assert.Equal(t, dos.psp, parent)
+}
+
+func TestDosExecFCBs(t *testing.T) {
+	c, dos, dir := setupDrive(t)
+	loadProgram(t, dos, dir, "prog.com")
+	parent := setFCB(c, dos, "HELLO   TXT")
+	int21(c, dos, 0x0F00)
+	assert.Equal(t, c.Regs.GetReg8(cpu.AL), uint(0))
+
+	// Past the FCB at 2000:0200
+	execParams(c, 0x300, "")
+	execChild(t, c, dos, "prog.com", 0x300)
+
+	// The child opens an FCB and ends without closing it
+	child := fcb{c.Mem, 0x2000, 0x240}
+	c.Mem.Copy(0x2000, 0x240, make([]byte, 0x25))
+	c.Mem.Copy(0x2000, 0x241, []byte("HELLO   TXT"))
+	c.Regs.SetReg16(cpu.DX, 0x240)
+	int21(c, dos, 0x0F00)
+	assert.Equal(t, c.Regs.GetReg8(cpu.AL), uint(0))
+	n := child.get8(fcbSFT)
+	file := dos.sft[n].file
+	int21(c, dos, 0x4C00)
+	assert.Assert(t, dos.sft[n] == nil)
+	assert.Assert(t, file.Close() != nil, "the host file is closed")
+	// The parent's is still open
+	_, err := dos.fcbFile(parent)
+	assert.NilError(t, err)
+}
+
+func TestDosMemory(t *testing.T) {
+	c, dos := setupDos(t)
+	dos.psp = 0x0C85
+	c.Regs.SetReg16(cpu.BX, 0x100)
+	seg := call21(t, c, dos, 0x4800)
+	assert.Equal(t, dos.Mem.Blocks[0].Owner, uint(0x0C85))
+
+	c.Regs.SetReg16(cpu.BX, 0xFFFF)
+	fail21(t, c, dos, 0x4800, ErrInsufficientMemory)
+	largest := c.Regs.GetReg16(cpu.BX)
+	assert.Equal(t, largest, dos.Mem.Largest())
+
+	// Grow into the free memory after it, then shrink
+	c.Regs.SetSeg16(cpu.ES, seg)
+	c.Regs.SetReg16(cpu.BX, 0xFFFF)
+	fail21(t, c, dos, 0x4A00, ErrInsufficientMemory)
+	// With the free block's MCB
+	assert.Equal(t, c.Regs.GetReg16(cpu.BX), largest+0x101)
+	c.Regs.SetReg16(cpu.BX, 0x200)
+	call21(t, c, dos, 0x4A00)
+	c.Regs.SetReg16(cpu.BX, 0x10)
+	call21(t, c, dos, 0x4A00)
+
+	call21(t, c, dos, 0x4900)
+	fail21(t, c, dos, 0x4900, ErrInvalidBlock)
+	fail21(t, c, dos, 0x4A00, ErrInvalidBlock)
+
+	assert.Equal(t, call21(t, c, dos, 0x5800), uint(First))
+	c.Regs.SetReg16(cpu.BX, uint(Last))
+	call21(t, c, dos, 0x5801)
+	assert.Equal(t, dos.Mem.Fit, Last)
+	c.Regs.SetReg16(cpu.BX, 0x100)
+	assert.Equal(t, call21(t, c, dos, 0x4800), dos.Mem.EndSeg-0x100)
+	c.Regs.SetReg16(cpu.BX, 3)
+	fail21(t, c, dos, 0x5801, ErrInvalidFunction)
+}
+
+func TestDosMCB(t *testing.T) {
+	c, dos := setupDos(t)
+	exe, err := ReadExe([]byte{0x90, 0xC3})
+	assert.NilError(t, err)
+	exe.Name = "hello.com"
+	seg, err := dos.Load(exe)
+	assert.NilError(t, err)
+	psp := uint(seg)
+
+	// Walk the chain from the list of lists
+	int21(c, dos, 0x5200)
+	mcb := uint(c.Mem.GetMem16(c.Regs.ES(), c.Regs.GetReg16(cpu.BX)-2))
+	assert.Equal(t, mcb, dos.Mem.StartSeg)
+	var kinds string
+	for {
+		kind := c.Mem.GetMem8(mcb, 0)
+		kinds += string(rune(kind))
+		owner := uint(c.Mem.GetMem16(mcb, 1))
+		if mcb+1 == psp {
+			assert.Equal(t, owner, psp)
+			assert.Equal(t, c.Mem.GetMem16(mcb, 3), uint16(0x1000))
+			assert.Equal(t, string(c.Mem.At(mcb, 8)[:5]), "HELLO")
+		}
+		mcb += 1 + uint(c.Mem.GetMem16(mcb, 3))
+		if kind == 'Z' {
+			break
+		}
+	}
+	assert.Equal(t, kinds, "MMZ")
+	assert.Equal(t, mcb, dos.Mem.EndSeg)
+
+	// Programs can change the MCBs
+	c.Mem.Copy(psp-1, 8, []byte("RENAMED\x00"))
+	c.Regs.SetReg16(cpu.BX, 0x10)
+	call21(t, c, dos, 0x4800)
+	i, _ := dos.Mem.FindBlock(psp)
+	assert.Equal(t, dos.Mem.Blocks[i].ProgramName, "RENAMED")
+
+	c.Mem.SetMem8(psp-1, 0, 'X')
+	fail21(t, c, dos, 0x4800, ErrMCBDestroyed)
+	c.Regs.SetSeg16(cpu.ES, psp)
+	fail21(t, c, dos, 0x4900, ErrMCBDestroyed)
+	c.Mem.SetMem8(psp-1, 0, 'M')
+	c.Mem.SetMem16(psp-1, 3, 0xFFFF)
+	fail21(t, c, dos, 0x4A00, ErrMCBDestroyed)
+}
+
+func TestDosTSR(t *testing.T) {
+	c, dos, dir := setupDrive(t)
+	parent := loadProgram(t, dos, dir, "tsr.com")
+
+	// Vectors are at 4 bytes each
+	c.Regs.SetSeg16(cpu.DS, 0x1234)
+	c.Regs.SetReg16(cpu.DX, 0x5678)
+	call21(t, c, dos, 0x2560)
+	assert.Equal(t, c.Mem.GetMem16(0, 0x180), uint16(0x5678))
+	assert.Equal(t, c.Mem.GetMem16(0, 0x182), uint16(0x1234))
+	call21(t, c, dos, 0x3560)
+	assert.Equal(t, c.Regs.ES(), uint(0x1234))
+	assert.Equal(t, c.Regs.GetReg16(cpu.BX), uint(0x5678))
+
+	execParams(c, 0x200, "")
+	exec := func() uint {
+		c.Regs.SetSeg16(cpu.CS, 0x1234)
+		c.Ip = 0x10
+		return execChild(t, c, dos, "tsr.com", 0x200)
+	}
+
+	// The child keeps 20h paragraphs and its open file
+	child := exec()
+	setPath(c, "hello.txt")
+	handle := call21(t, c, dos, 0x3D00)
+	c.Regs.SetReg16(cpu.DX, 0x20)
+	int21(c, dos, 0x3103)
+	assert.Equal(t, dos.psp, parent)
+	assert.Equal(t, c.Regs.CS(), uint(0x1234))
+	assert.Equal(t, call21(t, c, dos, 0x4D00), uint(0x0303))
+	i, ok := dos.Mem.FindBlock(child)
+	assert.Assert(t, ok)
+	b := dos.Mem.Blocks[i]
+	assert.Equal(t, b.End-b.Start, uint(0x20))
+	assert.Equal(t, b.Owner, child)
+	assert.Assert(t, c.Mem.GetMem8(child, 0x18+handle) != 0xFF)
+	// 60h is still hooked
+	assert.Equal(t, c.Mem.GetMem16(0, 0x182), uint16(0x1234))
+
+	// INT 27h keeps up to the offset in DX
+	child = exec()
+	c.Regs.SetReg16(cpu.DX, 0x105)
+	dos.Int27(c, 0x27)
+	assert.Equal(t, dos.psp, parent)
+	assert.Equal(t, call21(t, c, dos, 0x4D00), uint(0x0300))
+	i, ok = dos.Mem.FindBlock(child)
+	assert.Assert(t, ok)
+	b = dos.Mem.Blocks[i]
+	assert.Equal(t, b.End-b.Start, uint(0x11))
+}
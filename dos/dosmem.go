@@ -4,6 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+
+	log "github.com/golang/glog"
+	cpu "go86.org/go86/cpu"
 )
 
 // Represents a DOS managed memory block, it may either be free to split
@@ -33,13 +36,16 @@ const (
 	Last
 )
 
-const allowedSlackSpace = 512 // 512 * 16 == 8k
-
+// DosMem is DOS's memory, from StartSeg up to EndSeg.  Each block has an MCB
+// in the paragraph before it, the first at StartSeg.
 type DosMem struct {
 	StartSeg uint
 	EndSeg   uint
 	Fit      FitStrategy
 	Blocks   []DosMemBlock
+
+	// Memory the MCBs are in, none for tests of the allocator alone.
+	mem *cpu.Memory
 }
 
 func NewDosMem(start uint, end uint) *DosMem {
@@ -69,54 +75,109 @@ func (m *DosMem) FindBlock(start uint) (blockNum int, found bool) {
 	return -1, false
 }
 
-// Resizes an existing allocated block.
+// Resizes an existing allocated block, growing into the free blocks after
+// it.  Returns the new size, or the most it could be with an error when it
+// can't grow that far.
 func (m *DosMem) Resize(start uint, needed uint) (uint, error) {
-	startBlock, found := m.FindBlock(start)
-	if !found {
-		return 0, errors.New("not found")
+	if err := m.readChain(); err != nil {
+		return 0, err
 	}
-	lastBlock := startBlock
-	for i := startBlock + 1; i < len(m.Blocks); i++ {
-		if !m.Blocks[i].Avail {
-			break
-		}
-		lastBlock = i
-		if m.Blocks[i].End-start >= needed {
-			break
-		}
+	i, found := m.FindBlock(start)
+	if !found || m.Blocks[i].Avail {
+		return 0, ErrInvalidBlock
+	}
+	end := m.Blocks[i].End
+	last := i
+	for last+1 < len(m.Blocks) && m.Blocks[last+1].Avail {
+		last++
+		end = m.Blocks[last].End
+	}
+	if end-start < needed {
+		return end - start, ErrInsufficientMemory
 	}
 
-	if startBlock == lastBlock {
-		// nothingn happened!
-		return 0, errors.New("unable to resize")
+	// Take the free blocks after it, and give back what isn't needed
+	m.Blocks = append(m.Blocks[:i+1], m.Blocks[last+1:]...)
+	m.Blocks[i].End = start + needed
+	if end > m.Blocks[i].End {
+		m.insert(i+1, DosMemBlock{Avail: true, Start: m.Blocks[i].End + mcbParagraphs, End: end})
 	}
-	// assign old start to last block
-	m.Blocks[lastBlock].Start = start
-	// remove [startBlock, .. )lastBlock
-	m.Blocks = append(m.Blocks[:startBlock], m.Blocks[lastBlock:]...)
+	m.writeChain()
+	return needed, nil
+}
 
-	// Split last block
-	lastBlock, found = m.FindBlock(start)
-	if !found {
-		panic("huh?? this was found once before")
+// The largest free block, the most that can be allocated.
+func (m *DosMem) Largest() uint {
+	m.init()
+	if err := m.readChain(); err != nil {
+		return 0
+	}
+	largest := uint(0)
+	for _, b := range m.Blocks {
+		if b.Avail {
+			largest = max(largest, b.Size())
+		}
 	}
+	return largest
+}
 
-	if m.Blocks[lastBlock].Size()+allowedSlackSpace > needed {
-		// Need to split last block
-		nb := DosMemBlock{
-			Avail:       true,
-			Start:       start + needed,
-			End:         m.Blocks[lastBlock].End,
-			Owner:       0,
-			ProgramName: "",
+// Frees the block at start, merging it with the free blocks either side.
+func (m *DosMem) Free(start uint) error {
+	if err := m.readChain(); err != nil {
+		return err
+	}
+	i, found := m.FindBlock(start)
+	if !found || m.Blocks[i].Avail {
+		return ErrInvalidBlock
+	}
+	m.Blocks[i] = DosMemBlock{Avail: true, Start: m.Blocks[i].Start, End: m.Blocks[i].End}
+	if i+1 < len(m.Blocks) && m.Blocks[i+1].Avail {
+		m.Blocks[i].End = m.Blocks[i+1].End
+		m.Blocks = append(m.Blocks[:i+1], m.Blocks[i+2:]...)
+	}
+	if i > 0 && m.Blocks[i-1].Avail {
+		m.Blocks[i-1].End = m.Blocks[i].End
+		m.Blocks = append(m.Blocks[:i], m.Blocks[i+1:]...)
+	}
+	m.writeChain()
+	return nil
+}
+
+// Frees all the blocks owned by the process with its PSP at owner.
+func (m *DosMem) FreeOwned(owner uint) error {
+	if err := m.readChain(); err != nil {
+		return err
+	}
+	for i := 0; i < len(m.Blocks); i++ {
+		if b := m.Blocks[i]; !b.Avail && b.Owner == owner {
+			m.Free(b.Start)
+			i = -1
 		}
-		m.Blocks[lastBlock].End = start + needed
-		m.Blocks = append(m.Blocks, DosMemBlock{})
-		copy(m.Blocks[lastBlock+1:], m.Blocks[lastBlock:])
-		m.Blocks[lastBlock+1] = nb
 	}
-	newSize := m.Blocks[lastBlock].Size()
-	return newSize, nil
+	return nil
+}
+
+// SetOwner gives the block at start to the process with its PSP at owner,
+// and the program name in its MCB.
+func (m *DosMem) SetOwner(start uint, owner uint, name string) error {
+	if err := m.readChain(); err != nil {
+		return err
+	}
+	i, found := m.FindBlock(start)
+	if !found || m.Blocks[i].Avail {
+		return ErrInvalidBlock
+	}
+	m.Blocks[i].Owner = owner
+	m.Blocks[i].ProgramName = name
+	m.writeChain()
+	return nil
+}
+
+// Puts b in the blocks at i.
+func (m *DosMem) insert(i int, b DosMemBlock) {
+	m.Blocks = append(m.Blocks, DosMemBlock{})
+	copy(m.Blocks[i+1:], m.Blocks[i:])
+	m.Blocks[i] = b
 }
 
 func (m *DosMem) AllocateFirst(size uint) (*DosMemBlock, error) {
@@ -129,27 +190,44 @@ func (m *DosMem) AllocateFirst(size uint) (*DosMemBlock, error) {
 		if cursize < size {
 			continue
 		}
-		// Allocate whole block if it's close (8k), otherwise we shall split it.
-		if cursize+allowedSlackSpace <= size {
-			m.Blocks[i].Avail = false
-			return &m.Blocks[i], nil
-		}
-		nb := DosMemBlock{
-			Avail:       false,
-			Start:       m.Blocks[i].Start,
-			End:         m.Blocks[i].Start + size,
-			Owner:       0,
-			ProgramName: "",
-		}
-		m.Blocks[i].Start = nb.End
-		m.Blocks = append(m.Blocks, DosMemBlock{})
-		copy(m.Blocks[i+1:], m.Blocks[i:])
-		m.Blocks[i] = nb
-		return &m.Blocks[i], nil
+		return m.allocateFront(i, size), nil
 	}
 	return nil, fmt.Errorf("unable to allocate memory of size: %d", size)
 }
 
+// Allocates the smallest free block which is big enough.
+func (m *DosMem) AllocateBest(size uint) (*DosMemBlock, error) {
+	best := -1
+	for i, b := range m.Blocks {
+		if b.Avail && b.Size() >= size && (best == -1 || b.Size() < m.Blocks[best].Size()) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil, fmt.Errorf("unable to allocate memory of size: %d", size)
+	}
+	return m.allocateFront(best, size), nil
+}
+
+// Allocates size paragraphs from the start of free block i, the rest stays
+// free after an MCB of its own.
+func (m *DosMem) allocateFront(i int, size uint) *DosMemBlock {
+	if m.Blocks[i].Size() == size {
+		m.Blocks[i].Avail = false
+		return &m.Blocks[i]
+	}
+	nb := DosMemBlock{
+		Avail:       false,
+		Start:       m.Blocks[i].Start,
+		End:         m.Blocks[i].Start + size,
+		Owner:       0,
+		ProgramName: "",
+	}
+	m.Blocks[i].Start = nb.End + mcbParagraphs
+	m.insert(i, nb)
+	return &m.Blocks[i]
+}
+
 func (m *DosMem) AllocateLast(size uint) (*DosMemBlock, error) {
 	for i := len(m.Blocks) - 1; i >= 0; i-- {
 		if !m.Blocks[i].Avail {
@@ -160,39 +238,110 @@ func (m *DosMem) AllocateLast(size uint) (*DosMemBlock, error) {
 		if cursize < size {
 			continue
 		}
-		// Allocate whole block if it's close (8k), otherwise we shall split it.
-		if cursize+allowedSlackSpace <= size {
+		if cursize == size {
 			m.Blocks[i].Avail = false
 			return &m.Blocks[i], nil
 		}
-		m.Blocks = append(m.Blocks, DosMemBlock{})
-		copy(m.Blocks[i+1:], m.Blocks[i:])
-		// i will be the old free block, shrink end
-		m.Blocks[i].End -= size
-
-		// Allocate i+1, so increase the start, leave end alone
-		m.Blocks[i+1].Start = m.Blocks[i].End
-		m.Blocks[i+1].Avail = false
+		// i will be the old free block, shrink end.  Allocate i+1 after
+		// its MCB.
+		end := m.Blocks[i].End
+		m.Blocks[i].End = end - size - mcbParagraphs
+		m.insert(i+1, DosMemBlock{Start: end - size, End: end})
 		return &m.Blocks[i+1], nil
 	}
 	return nil, errors.New("unable to allocate memory")
 }
 
-func (m *DosMem) Allocate(size uint) (*DosMemBlock, error) {
+// Starts with all the memory free.
+func (m *DosMem) init() {
 	if len(m.Blocks) == 0 {
 		m.Blocks = append(m.Blocks, DosMemBlock{
 			Avail: true,
-			Start: m.StartSeg,
+			Start: m.StartSeg + mcbParagraphs,
 			End:   m.EndSeg,
 		})
+		m.writeChain()
+	}
+}
+
+func (m *DosMem) Allocate(size uint) (b *DosMemBlock, err error) {
+	m.init()
+	if err := m.readChain(); err != nil {
+		return nil, err
 	}
 	switch m.Fit {
 	case Best:
-		return nil, errors.New("best fit not implemented")
+		b, err = m.AllocateBest(size)
 	case Last:
-		return m.AllocateLast(size)
+		b, err = m.AllocateLast(size)
 	case First:
-		return m.AllocateFirst(size)
+		b, err = m.AllocateFirst(size)
+	default:
+		return nil, errors.New("unknown allocation strategy")
+	}
+	if err == nil {
+		m.writeChain()
+	}
+	return b, err
+}
+
+// INT 21h AH=48h, ALLOCATE MEMORY
+// BX = paragraphs.  Returns the segment in AX, or the largest block there is
+// in BX when there isn't enough memory.
+func (dos *Dos) allocateMemory(c *cpu.CPU) error {
+	size := c.Regs.GetReg16(cpu.BX)
+	b, err := dos.Mem.Allocate(size)
+	if errors.Is(err, ErrMCBDestroyed) {
+		return err
+	} else if err != nil {
+		c.Regs.SetReg16(cpu.BX, dos.Mem.Largest())
+		return ErrInsufficientMemory
+	}
+	start := b.Start
+	if err := dos.Mem.SetOwner(start, dos.psp, ""); err != nil {
+		return err
+	}
+	log.V(3).Infof("INT21H: [48] [BLOCK: 0x%04X, SIZE: %d paragraphs]", start, size)
+	c.Regs.SetReg16(cpu.AX, start)
+	return nil
+}
+
+// INT 21h AH=49h, FREE MEMORY
+// ES = segment of the block.
+func (dos *Dos) freeMemory(c *cpu.CPU) error {
+	log.V(3).Infof("INT21H: [49] [BLOCK: 0x%04X]", c.Regs.ES())
+	return dos.Mem.Free(c.Regs.ES())
+}
+
+// INT 21h AH=4Ah, RESIZE MEMORY BLOCK
+// ES = segment of the block, BX = new size in paragraphs.  Returns the most
+// it could be in BX when it can't grow that far.
+func (dos *Dos) resizeMemory(c *cpu.CPU) error {
+	es := c.Regs.ES()
+	bx := c.Regs.GetReg16(cpu.BX)
+	log.V(3).Infof("INT21H: [4A] [BLOCK: 0x%04X, SIZE: %d paragraphs, %d bytes]", es, bx, bx*16)
+	size, err := dos.Mem.Resize(es, bx)
+	if errors.Is(err, ErrInsufficientMemory) {
+		c.Regs.SetReg16(cpu.BX, size)
+	}
+	return err
+}
+
+// INT 21h AH=58h, GET OR SET MEMORY ALLOCATION STRATEGY
+// AL = 00h get, the strategy in AX, or 01h set to BX.  00h is first fit,
+// 01h best fit and 02h last fit.
+func (dos *Dos) allocStrategy(c *cpu.CPU) error {
+	switch c.Regs.GetReg8(cpu.AL) {
+	case 0x00:
+		c.Regs.SetReg16(cpu.AX, uint(dos.Mem.Fit))
+		return nil
+	case 0x01:
+		fit := FitStrategy(c.Regs.GetReg16(cpu.BX))
+		if fit > Last {
+			return ErrInvalidFunction
+		}
+		dos.Mem.Fit = fit
+		return nil
 	}
-	return nil, errors.New("unknown allocation strategy")
+	return ErrInvalidFunction
 }
@@ -89,3 +89,56 @@ func TestDosMemReallocThree(t *testing.T) {
 	assert.Equal(t, newsize, uint(0x6400))
 	assert.Equal(t, len(m.Blocks), 2)
 }
+
+func TestDosMemFree(t *testing.T) {
+	m := NewDosMem(0x0800, 0x9FC0)
+	a, _ := m.Allocate(0x100)
+	a.Owner = 0x0800
+	b, _ := m.Allocate(0x100)
+	b.Owner = 0x0900
+	c, _ := m.Allocate(0x100)
+	c.Owner = 0x0800
+	assert.Equal(t, len(m.Blocks), 4)
+
+	m.FreeOwned(0x0800)
+	assert.Equal(t, len(m.Blocks), 3)
+	assert.Assert(t, m.Blocks[0].Avail)
+	// Each block is after its MCB
+	assert.Equal(t, m.Blocks[1].Start, uint(0x0902))
+	assert.Equal(t, m.Blocks[2].Start, uint(0x0A03))
+	assert.Equal(t, m.Blocks[2].End, uint(0x9FC0))
+
+	assert.NilError(t, m.Free(0x0902))
+	assert.Equal(t, len(m.Blocks), 1)
+	assert.Assert(t, m.Free(0x0902) != nil)
+}
+
+func TestDosMemBest(t *testing.T) {
+	m := NewDosMem(0x0800, 0x9FC0)
+	a, _ := m.Allocate(0x400)
+	m.Allocate(0x100)
+	b, _ := m.Allocate(0x200)
+	m.Allocate(0x100)
+	m.Free(a.Start)
+	m.Free(b.Start)
+
+	m.Fit = Best
+	c, err := m.Allocate(0x180)
+	assert.NilError(t, err)
+	assert.Equal(t, c.Start, uint(0x0D03))
+	assert.Equal(t, m.Largest(), uint(0x9FC0-0x1005))
+}
+
+func TestDosMemShrink(t *testing.T) {
+	m := NewDosMem(0x0800, 0x9FC0)
+	a, _ := m.Allocate(0x1000)
+	m.Allocate(0x100)
+	size, err := m.Resize(a.Start, 0x800)
+	assert.NilError(t, err)
+	assert.Equal(t, size, uint(0x800))
+	size, err = m.Resize(0x0801, 0x1001)
+	assert.ErrorIs(t, err, ErrInsufficientMemory)
+	assert.Equal(t, size, uint(0x1000))
+	_, err = m.Resize(0x0900, 0x10)
+	assert.ErrorIs(t, err, ErrInvalidBlock)
+}
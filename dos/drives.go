@@ -0,0 +1,220 @@
+package go86
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Number of drive letters, A to Z.
+const maxDrives = 26
+
+// File attributes.
+const (
+	attrReadOnly  = 0x01
+	attrHidden    = 0x02
+	attrSystem    = 0x04
+	attrVolume    = 0x08
+	attrDirectory = 0x10
+	attrArchive   = 0x20
+)
+
+// Drive is a DOS drive letter backed by a directory on the host.
+type Drive struct {
+	// Directory on the host which is the root of the drive.
+	Root string
+	// Current directory, the DOS names from the root down.
+	Cwd []string
+}
+
+// Mount makes the host directory dir drive letter.  The first drive mounted
+// becomes the current drive.
+func (dos *Dos) Mount(letter byte, dir string) error {
+	n, ok := driveNumber(letter)
+	if !ok {
+		return fmt.Errorf("invalid drive letter: '%c'", letter)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("not a directory: '%s'", dir)
+	}
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	dos.drives[n] = &Drive{Root: root}
+	if dos.drives[dos.curDrive] == nil {
+		dos.curDrive = n
+	}
+	return nil
+}
+
+// ParseMount splits a mount like "C=./work" into the drive letter and host
+// directory.
+func ParseMount(s string) (byte, string, error) {
+	letter, dir, ok := strings.Cut(s, "=")
+	if !ok || len(letter) != 1 || dir == "" {
+		return 0, "", fmt.Errorf("invalid mount, expected <drive>=<directory>: '%s'", s)
+	}
+	if _, ok := driveNumber(letter[0]); !ok {
+		return 0, "", fmt.Errorf("invalid drive letter: '%s'", letter)
+	}
+	return strings.ToUpper(letter)[0], dir, nil
+}
+
+// Drive number of letter, 0 for A.
+func driveNumber(letter byte) (int, bool) {
+	n := int(letter|0x20) - 'a'
+	return n, n >= 0 && n < maxDrives
+}
+
+// A DOS path resolved to a drive and the names from its root.
+type dosPath struct {
+	drive int
+	names []string
+}
+
+// The DOS name of the file, or "" for the root directory.
+func (p dosPath) name() string {
+	if len(p.names) == 0 {
+		return ""
+	}
+	return p.names[len(p.names)-1]
+}
+
+func (p dosPath) String() string {
+	return fmt.Sprintf("%c:\\%s", 'A'+p.drive, strings.Join(p.names, "\\"))
+}
+
+// Resolves a path from a program against the current drive and directory.
+// Names are upper cased and cut down to 8.3 like DOS does.
+func (dos *Dos) parsePath(path string) (dosPath, error) {
+	p := dosPath{drive: dos.curDrive}
+	if len(path) >= 2 && path[1] == ':' {
+		n, ok := driveNumber(path[0])
+		if !ok {
+			return p, ErrInvalidDrive
+		}
+		p.drive = n
+		path = path[2:]
+	}
+	d := dos.drives[p.drive]
+	if d == nil {
+		return p, ErrInvalidDrive
+	}
+	if !strings.HasPrefix(path, "\\") && !strings.HasPrefix(path, "/") {
+		p.names = append(p.names, d.Cwd...)
+	}
+	parts := strings.FieldsFunc(path, func(r rune) bool { return r == '\\' || r == '/' })
+	for i, part := range parts {
+		switch part {
+		case ".":
+			continue
+		case "..":
+			if len(p.names) == 0 {
+				return p, ErrPathNotFound
+			}
+			p.names = p.names[:len(p.names)-1]
+			continue
+		}
+		name, ok := shortName(part)
+		if !ok {
+			if i == len(parts)-1 {
+				return p, ErrFileNotFound
+			}
+			return p, ErrPathNotFound
+		}
+		p.names = append(p.names, name)
+	}
+	return p, nil
+}
+
+// The host path for p.  The file itself need not exist, for creating files,
+// in which case it has its DOS name.
+func (dos *Dos) hostPath(p dosPath) (string, error) {
+	host := dos.drives[p.drive].Root
+	for i, name := range p.names {
+		found, err := lookup(host, name)
+		if err != nil {
+			return "", err
+		}
+		if found == "" {
+			if i < len(p.names)-1 {
+				return "", ErrPathNotFound
+			}
+			found = name
+		}
+		host = filepath.Join(host, found)
+	}
+	return host, nil
+}
+
+// The host path for p, which has to exist.
+func (dos *Dos) existingPath(p dosPath) (string, error) {
+	host, err := dos.hostPath(p)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(host); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return "", ErrFileNotFound
+		}
+		return "", err
+	}
+	return host, nil
+}
+
+// Finds the entry in the host directory dir with the DOS name name, "" if
+// there isn't one.  Host names which aren't already 8.3 can't be seen.
+func lookup(dir string, name string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", ErrPathNotFound
+	}
+	for _, e := range entries {
+		if short, ok := shortNameOf(e.Name()); ok && short == name {
+			return e.Name(), nil
+		}
+	}
+	return "", nil
+}
+
+// Makes a name from a program into a DOS 8.3 name, upper cased with the
+// name and extension cut down to 8 and 3 characters.
+func shortName(s string) (string, bool) {
+	base, ext, _ := strings.Cut(strings.ToUpper(s), ".")
+	if base == "" || strings.Contains(ext, ".") {
+		return "", false
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '.' && !validNameChar(s[i]) {
+			return "", false
+		}
+	}
+	base = base[:min(len(base), 8)]
+	ext = ext[:min(len(ext), 3)]
+	if ext == "" {
+		return base, true
+	}
+	return base + "." + ext, true
+}
+
+// The DOS name of a file on the host, if it is already an 8.3 name.
+func shortNameOf(host string) (string, bool) {
+	name, ok := shortName(host)
+	return name, ok && name == strings.ToUpper(host)
+}
+
+func validNameChar(c byte) bool {
+	switch {
+	case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c >= 0x80:
+		return true
+	}
+	return strings.IndexByte("!#$%&'()-@^_`{}~", c) >= 0
+}
@@ -0,0 +1,76 @@
+package go86
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	log "github.com/golang/glog"
+	cpu "go86.org/go86/cpu"
+)
+
+// DosError is a DOS error code, INT 21h returns it in AX with CF set.
+type DosError uint16
+
+const (
+	ErrInvalidFunction    DosError = 0x01
+	ErrFileNotFound       DosError = 0x02
+	ErrPathNotFound       DosError = 0x03
+	ErrTooManyOpenFiles   DosError = 0x04
+	ErrAccessDenied       DosError = 0x05
+	ErrInvalidHandle      DosError = 0x06
+	ErrMCBDestroyed       DosError = 0x07
+	ErrInsufficientMemory DosError = 0x08
+	ErrInvalidBlock       DosError = 0x09
+	ErrInvalidEnvironment DosError = 0x0A
+	ErrInvalidFormat      DosError = 0x0B
+	ErrInvalidAccess      DosError = 0x0C
+	ErrInvalidData        DosError = 0x0D
+	ErrInvalidDrive       DosError = 0x0F
+	ErrRemoveCurrentDir   DosError = 0x10
+	ErrNotSameDevice      DosError = 0x11
+	ErrNoMoreFiles        DosError = 0x12
+	ErrFileExists         DosError = 0x50
+)
+
+func (e DosError) Error() string {
+	return fmt.Sprintf("DOS error %02Xh", uint16(e))
+}
+
+// The DOS error code for err, from the host file system for errors which
+// aren't DOS errors already.
+func dosError(err error) DosError {
+	var de DosError
+	switch {
+	case errors.As(err, &de):
+		return de
+	case errors.Is(err, fs.ErrNotExist):
+		return ErrFileNotFound
+	case errors.Is(err, fs.ErrExist):
+		return ErrFileExists
+	}
+	return ErrAccessDenied
+}
+
+// Returns err to the program, CF set and the DOS error code in AX.
+func (dos *Dos) fail(c *cpu.CPU, err error) {
+	code := dosError(err)
+	log.V(2).Infof("INT21H: [%02X] failed: %v (%v)", c.Regs.GetReg8(cpu.AH), code, err)
+	c.Regs.SetReg16(cpu.AX, uint(code))
+	c.Flags.SetFlags(cpu.CarryFlag)
+}
+
+// Tells the program the call worked, CF clear.
+func (dos *Dos) succeed(c *cpu.CPU) {
+	c.Flags.ClearFlag(cpu.CarryFlag)
+}
+
+// Returns err to the program if there is one, otherwise tells it the call
+// worked.
+func (dos *Dos) result(c *cpu.CPU, err error) {
+	if err != nil {
+		dos.fail(c, err)
+		return
+	}
+	dos.succeed(c)
+}
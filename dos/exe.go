@@ -45,6 +45,8 @@ const (
 )
 
 type Executable struct {
+	// The host file it was read from, if it was.
+	Name   string
 	Etype  ExeType
 	Exists bool
 	Hdr    ExeHeader
@@ -79,7 +81,12 @@ func ReadExeFromFile(filename string) (*Executable, error) {
 		return nil, errors.New("File header too small or size unknown for: " + filename)
 	}
 
-	return ReadExe(b)
+	exe, err := ReadExe(b)
+	if err != nil {
+		return nil, err
+	}
+	exe.Name = filename
+	return exe, nil
 }
 
 func ReadExe(bs []byte) (*Executable, error) {
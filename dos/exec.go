@@ -0,0 +1,225 @@
+package go86
+
+import (
+	"errors"
+	"os"
+
+	log "github.com/golang/glog"
+	cpu "go86.org/go86/cpu"
+)
+
+// Offsets in the EXEC parameter block.
+const (
+	execEnv   = 0x00
+	execTail  = 0x02
+	execFCB1  = 0x06
+	execFCB2  = 0x0A
+	execSSSP  = 0x0E
+	execCSIP  = 0x12
+	fcbCopied = 0x10
+
+	// The overlay parameter block, for AL=03h.
+	overlaySeg   = 0x00
+	overlayReloc = 0x02
+
+	// Environments are at most 32K.
+	maxEnvSize = 0x8000
+)
+
+// A process waiting for the child it ran with EXEC to end, and what to
+// give back to it when the child does.
+type process struct {
+	psp            uint
+	regs           cpu.Registers
+	flags          cpu.Flags
+	ip             uint16
+	dtaSeg, dtaOff uint
+}
+
+// Saves the current process before it runs a child.
+func (dos *Dos) saveProcess(c *cpu.CPU) process {
+	return process{
+		psp:    dos.psp,
+		regs:   *c.Regs,
+		flags:  c.Flags,
+		ip:     c.Ip,
+		dtaSeg: dos.dtaSeg,
+		dtaOff: dos.dtaOff,
+	}
+}
+
+// Goes back to the process p, with the registers it had when it called EXEC.
+func (dos *Dos) restoreProcess(c *cpu.CPU, p process) {
+	dos.psp = p.psp
+	dos.dtaSeg, dos.dtaOff = p.dtaSeg, p.dtaOff
+	*c.Regs = p.regs
+	c.Flags = p.flags
+	c.Ip = p.ip
+}
+
+// A far pointer in memory, offset then segment.
+func farPointer(mem *cpu.Memory, seg, off uint) (uint, uint) {
+	return uint(mem.GetMem16(seg, off+2)), uint(mem.GetMem16(seg, off))
+}
+
+func setFarPointer(mem *cpu.Memory, seg, off uint, ptrSeg, ptrOff uint) {
+	mem.SetMem16(seg, off, uint16(ptrOff))
+	mem.SetMem16(seg, off+2, uint16(ptrSeg))
+}
+
+// The variables in the environment block at seg.
+func (dos *Dos) envVars(seg uint) []string {
+	var vars []string
+	for off := uint(0); off < maxEnvSize; {
+		v := dos.asciiz(seg, off)
+		if v == "" {
+			break
+		}
+		vars = append(vars, v)
+		off += uint(len(v)) + 1
+	}
+	return vars
+}
+
+// Reads the program named by the ASCIZ path at DS:DX.
+func (dos *Dos) programArg(c *cpu.CPU) (*Executable, error) {
+	p, err := dos.parsePath(dos.pathArg(c))
+	if err != nil {
+		return nil, err
+	}
+	host, err := dos.existingPath(p)
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < 2 || (b[0] == 'M' && b[1] == 'Z' && len(b) < 28) {
+		return nil, ErrInvalidFormat
+	}
+	exe, err := ReadExe(b)
+	if err != nil {
+		return nil, ErrInvalidFormat
+	}
+	exe.Name = host
+	return exe, nil
+}
+
+// INT 21h AH=4Bh, "EXEC" - LOAD AND/OR EXECUTE PROGRAM
+// AL = 00h load and execute, 01h load but don't execute, 03h load overlay.
+// DS:DX = ASCIZ program name, ES:BX = parameter block.
+func (dos *Dos) exec(c *cpu.CPU) error {
+	switch al := c.Regs.GetReg8(cpu.AL); al {
+	case 0x00, 0x01:
+		return dos.execProgram(c, al == 0x01)
+	case 0x03:
+		return dos.loadOverlay(c)
+	}
+	return ErrInvalidFunction
+}
+
+// Loads a child program and runs it, or with loadOnly gives its start in
+// the parameter block for a debugger to run it.  The child's return goes
+// back to the parent after its INT 21h through INT 22h, like DOS does.
+func (dos *Dos) execProgram(c *cpu.CPU, loadOnly bool) error {
+	exe, err := dos.programArg(c)
+	if err != nil {
+		return err
+	}
+	mem := c.Mem
+	pseg, poff := c.Regs.ES(), c.Regs.GetReg16(cpu.BX)
+	env := uint(mem.GetMem16(pseg, poff+execEnv))
+	if env == 0 && dos.psp != 0 {
+		env = uint(mem.GetMem16(dos.psp, pspEnv))
+	}
+	var vars []string
+	if env != 0 {
+		vars = dos.envVars(env)
+	}
+	tseg, toff := farPointer(mem, pseg, poff+execTail)
+	tail := dos.getBytes(tseg, toff+1, uint(min(mem.GetMem8(tseg, toff), maxTailSize)))
+
+	parent := dos.saveProcess(c)
+	int22 := mem.GetMem16(0, 0x22*4)
+	int22seg := mem.GetMem16(0, 0x22*4+2)
+	mem.SetMem16(0, 0x22*4, c.Ip)
+	mem.SetMem16(0, 0x22*4+2, uint16(c.Regs.CS()))
+	if _, err := dos.load(exe, string(tail), vars); err != nil {
+		mem.SetMem16(0, 0x22*4, int22)
+		mem.SetMem16(0, 0x22*4+2, int22seg)
+		if errors.Is(err, ErrMCBDestroyed) {
+			return err
+		}
+		return ErrInsufficientMemory
+	}
+	for _, fcb := range []struct{ param, psp uint }{{execFCB1, pspFCB1}, {execFCB2, pspFCB2}} {
+		seg, off := farPointer(mem, pseg, poff+fcb.param)
+		mem.Copy(dos.psp, fcb.psp, dos.getBytes(seg, off, fcbCopied))
+	}
+	dos.parents = append(dos.parents, parent)
+	log.V(1).Infof("EXEC: [%s] PSP %04X, parent %04X", exe.Name, dos.psp, parent.psp)
+
+	if loadOnly {
+		// The child starts with AX on its stack
+		sp := c.Regs.GetReg16(cpu.SP) - 2
+		mem.SetMem16(c.Regs.SS(), sp, 0)
+		setFarPointer(mem, pseg, poff+execSSSP, c.Regs.SS(), sp)
+		setFarPointer(mem, pseg, poff+execCSIP, c.Regs.CS(), uint(c.Ip))
+		psp, dtaSeg, dtaOff := dos.psp, dos.dtaSeg, dos.dtaOff
+		dos.restoreProcess(c, parent)
+		// The child is the current process, for the debugger to run.
+		dos.psp, dos.dtaSeg, dos.dtaOff = psp, dtaSeg, dtaOff
+	}
+	return nil
+}
+
+// Ends the current child process and goes back to its parent at the INT 22h
+// address in the child's PSP, putting back the vectors the child's PSP
+// saved and freeing its memory unless it stays resident.
+func (dos *Dos) returnToParent(c *cpu.CPU, resident bool) {
+	mem := c.Mem
+	child := dos.psp
+	parent := dos.parents[len(dos.parents)-1]
+	dos.parents = dos.parents[:len(dos.parents)-1]
+	for i, off := range []uint{pspInt22, pspInt23, pspInt24} {
+		vec := uint(0x22+i) * 4
+		mem.SetMem16(0, vec, mem.GetMem16(child, off))
+		mem.SetMem16(0, vec+2, mem.GetMem16(child, off+2))
+	}
+	seg, off := farPointer(mem, child, pspInt22)
+	if !resident {
+		if err := dos.Mem.FreeOwned(child); err != nil {
+			log.Warningf("EXEC: memory of PSP %04X not freed: %v", child, err)
+		}
+	}
+	log.V(1).Infof("EXEC: PSP %04X returned to %04X at %04X:%04X", child, parent.psp, seg, off)
+
+	dos.restoreProcess(c, parent)
+	c.Regs.SetSeg16(cpu.CS, seg)
+	c.Ip = uint16(off)
+	c.Flags.ClearFlag(cpu.CarryFlag)
+}
+
+// Loads an overlay at the segment in the parameter block at ES:BX, with EXE
+// relocations adjusted by its relocation factor.  No PSP, and it doesn't
+// run.
+func (dos *Dos) loadOverlay(c *cpu.CPU) error {
+	exe, err := dos.programArg(c)
+	if err != nil {
+		return err
+	}
+	mem := c.Mem
+	pseg, poff := c.Regs.ES(), c.Regs.GetReg16(cpu.BX)
+	seg := uint(mem.GetMem16(pseg, poff+overlaySeg))
+	reloc := mem.GetMem16(pseg, poff+overlayReloc)
+	mem.Copy(seg, 0, exe.Data)
+	if exe.Etype == EXE {
+		for _, r := range exe.Hdr.Relos {
+			rseg := (seg + uint(r.Segment)) & 0xFFFF
+			mem.SetMem16(rseg, uint(r.Offset), mem.GetMem16(rseg, uint(r.Offset))+reloc)
+		}
+	}
+	log.V(1).Infof("EXEC: overlay [%s] at %04X", exe.Name, seg)
+	return nil
+}
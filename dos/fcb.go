@@ -0,0 +1,435 @@
+package go86
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/golang/glog"
+	cpu "go86.org/go86/cpu"
+)
+
+// File control blocks, the DOS 1 file API.  An open FCB keeps the number of
+// its SFT entry in the reserved area like DOS 3 does, so FCBs share open
+// files with handles.
+
+// Offsets in an FCB.
+const (
+	fcbDrive      = 0x00
+	fcbFileName   = 0x01
+	fcbBlock      = 0x0C
+	fcbRecordSize = 0x0E
+	fcbFileSize   = 0x10
+	fcbDate       = 0x14
+	fcbTime       = 0x16
+	fcbSFT        = 0x18
+	fcbRecord     = 0x20
+	fcbRandom     = 0x21
+
+	// Extended FCBs start with FFh and have the attributes at 06h, before
+	// the normal FCB.
+	extendedFCB     = 0xFF
+	extendedFCBSize = 7
+
+	// Records are 128 bytes unless the program changes it.
+	defaultRecordSize = 0x80
+)
+
+// FCB results in AL.
+const (
+	fcbOK       = 0x00
+	fcbEOF      = 0x01
+	fcbWrap     = 0x02
+	fcbPartial  = 0x03
+	fcbDiskFull = 0x01
+	fcbFailed   = 0xFF
+)
+
+// An FCB in memory.
+type fcb struct {
+	mem *cpu.Memory
+	seg uint
+	off uint
+}
+
+// The FCB at DS:DX, skipping the header of an extended FCB.
+func (dos *Dos) fcbArg(c *cpu.CPU) fcb {
+	f := fcb{c.Mem, c.Regs.DS(), c.Regs.GetReg16(cpu.DX)}
+	if f.mem.GetMem8(f.seg, f.off) == extendedFCB {
+		f.off += extendedFCBSize
+	}
+	return f
+}
+
+func (f fcb) get8(off uint) uint8      { return f.mem.GetMem8(f.seg, f.off+off) }
+func (f fcb) set8(off uint, v uint8)   { f.mem.SetMem8(f.seg, f.off+off, v) }
+func (f fcb) get16(off uint) uint16    { return f.mem.GetMem16(f.seg, f.off+off) }
+func (f fcb) set16(off uint, v uint16) { f.mem.SetMem16(f.seg, f.off+off, v) }
+
+func (f fcb) get32(off uint) uint32 {
+	return uint32(f.get16(off)) | uint32(f.get16(off+2))<<16
+}
+
+func (f fcb) set32(off uint, v uint32) {
+	f.set16(off, uint16(v))
+	f.set16(off+2, uint16(v>>16))
+}
+
+// The 11 byte name and extension, blank padded.
+func (f fcb) name() [11]byte {
+	var n [11]byte
+	for i := range n {
+		n[i] = f.get8(fcbFileName + uint(i))
+	}
+	return n
+}
+
+func (f fcb) setName(name [11]byte) {
+	f.mem.Copy(f.seg, f.off+fcbFileName, name[:])
+}
+
+// The record size, which DOS treats as 128 when it is 0.
+func (f fcb) recordSize() int64 {
+	if size := f.get16(fcbRecordSize); size != 0 {
+		return int64(size)
+	}
+	return defaultRecordSize
+}
+
+// The current record, from the current block and the record in it.
+func (f fcb) currentRecord() int64 {
+	return int64(f.get16(fcbBlock))*128 + int64(f.get8(fcbRecord)&0x7F)
+}
+
+func (f fcb) setCurrentRecord(rec int64) {
+	f.set16(fcbBlock, uint16(rec/128))
+	f.set8(fcbRecord, uint8(rec%128))
+}
+
+// The random record number, only 3 bytes of it with records of 64 bytes or
+// more.
+func (f fcb) randomRecord() int64 {
+	rec := f.get32(fcbRandom)
+	if f.recordSize() >= 64 {
+		rec &= 0xFFFFFF
+	}
+	return int64(rec)
+}
+
+func (f fcb) setRandomRecord(rec int64) {
+	if f.recordSize() >= 64 {
+		f.set32(fcbRandom, f.get32(fcbRandom)&0xFF000000|uint32(rec)&0xFFFFFF)
+		return
+	}
+	f.set32(fcbRandom, uint32(rec))
+}
+
+// The file an FCB names, in the current directory of its drive.
+func (dos *Dos) fcbPath(f fcb) (dosPath, error) {
+	n := dos.curDrive
+	if d := f.get8(fcbDrive); d != 0 {
+		n = int(d) - 1
+	}
+	if n >= maxDrives || dos.drives[n] == nil {
+		return dosPath{}, ErrInvalidDrive
+	}
+	raw := f.name()
+	name := strings.TrimRight(string(raw[:8]), " ")
+	if ext := strings.TrimRight(string(raw[8:]), " "); ext != "" {
+		name += "." + ext
+	}
+	short, ok := shortName(name)
+	if !ok {
+		return dosPath{}, ErrFileNotFound
+	}
+	names := append(append([]string{}, dos.drives[n].Cwd...), short)
+	return dosPath{drive: n, names: names}, nil
+}
+
+// Opens or creates the file an FCB names and fills in the FCB.
+func (dos *Dos) fcbOpen(c *cpu.CPU, create bool) error {
+	f := dos.fcbArg(c)
+	p, err := dos.fcbPath(f)
+	if err != nil {
+		return err
+	}
+	var file *os.File
+	if create {
+		host, err := dos.hostPath(p)
+		if err != nil {
+			return err
+		}
+		file, err = os.OpenFile(host, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return err
+		}
+	} else {
+		host, err := dos.existingPath(p)
+		if err != nil {
+			return err
+		}
+		if file, err = os.OpenFile(host, os.O_RDWR, 0); err != nil {
+			// Read only files can still be read
+			if file, err = os.Open(host); err != nil {
+				return err
+			}
+		}
+	}
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		return ErrAccessDenied
+	}
+	n, err := dos.newSFTEntry(&sftEntry{name: p.String(), mode: 2, file: file, drive: p.drive, forFCB: true, owner: dos.psp})
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	date, tm := dosDateTime(info.ModTime())
+	f.set8(fcbDrive, uint8(p.drive+1))
+	f.set16(fcbBlock, 0)
+	f.set16(fcbRecordSize, defaultRecordSize)
+	f.set32(fcbFileSize, uint32(info.Size()))
+	f.set16(fcbDate, date)
+	f.set16(fcbTime, tm)
+	f.set8(fcbSFT, n)
+	log.V(2).Infof("INT21H: [%02X] FCB opened %s as SFT entry %d", c.Regs.GetReg8(cpu.AH), p, n)
+	return nil
+}
+
+// The open file for an FCB.
+func (dos *Dos) fcbFile(f fcb) (*sftEntry, error) {
+	n := f.get8(fcbSFT)
+	if int(n) >= len(dos.sft) || dos.sft[n] == nil || dos.sft[n].file == nil {
+		return nil, ErrInvalidHandle
+	}
+	return dos.sft[n], nil
+}
+
+// INT 21h AH=10h, CLOSE FILE USING FCB
+func (dos *Dos) fcbClose(c *cpu.CPU) error {
+	f := dos.fcbArg(c)
+	if _, err := dos.fcbFile(f); err != nil {
+		return err
+	}
+	n := f.get8(fcbSFT)
+	f.set8(fcbSFT, closedEntry)
+	return dos.releaseSFTEntry(n)
+}
+
+// Reads count records at record rec into the DTA, returning the FCB result
+// and how many records were read.  The last record is padded with zeros.
+func (dos *Dos) fcbRead(f fcb, rec int64, count int64) (uint8, int64) {
+	file, err := dos.fcbFile(f)
+	if err != nil {
+		return fcbEOF, 0
+	}
+	size := f.recordSize()
+	if int64(dos.dtaOff)+size*count > 0x10000 {
+		return fcbWrap, 0
+	}
+	buf := make([]byte, size*count)
+	n, err := file.file.ReadAt(buf, rec*size)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fcbEOF, 0
+	}
+	read := (int64(n) + size - 1) / size
+	dos.cpu.Mem.Copy(dos.dtaSeg, dos.dtaOff, buf[:read*size])
+	switch {
+	case n == 0:
+		return fcbEOF, 0
+	case int64(n) < size*count:
+		return fcbPartial, read
+	}
+	return fcbOK, read
+}
+
+// Writes count records from the DTA at record rec, returning the FCB result
+// and how many records were written.  No records sets the file size.
+func (dos *Dos) fcbWrite(f fcb, rec int64, count int64) (uint8, int64) {
+	file, err := dos.fcbFile(f)
+	if err != nil {
+		return fcbDiskFull, 0
+	}
+	size := f.recordSize()
+	if int64(dos.dtaOff)+size*count > 0x10000 {
+		return fcbWrap, 0
+	}
+	if count == 0 {
+		if err := file.file.Truncate(rec * size); err != nil {
+			return fcbDiskFull, 0
+		}
+	} else {
+		buf := dos.getBytes(dos.dtaSeg, dos.dtaOff, uint(size*count))
+		if _, err := file.file.WriteAt(buf, rec*size); err != nil {
+			return fcbDiskFull, 0
+		}
+	}
+	if info, err := file.file.Stat(); err == nil {
+		f.set32(fcbFileSize, uint32(info.Size()))
+	}
+	return fcbOK, count
+}
+
+// INT 21h AH=14h and 15h, SEQUENTIAL READ and WRITE
+// Transfers the current record and moves on to the next one.
+func (dos *Dos) fcbSequential(c *cpu.CPU, write bool) uint8 {
+	f := dos.fcbArg(c)
+	rec := f.currentRecord()
+	var result uint8
+	var n int64
+	if write {
+		result, n = dos.fcbWrite(f, rec, 1)
+	} else {
+		result, n = dos.fcbRead(f, rec, 1)
+	}
+	f.setCurrentRecord(rec + n)
+	return result
+}
+
+// INT 21h AH=21h and 22h, RANDOM READ and WRITE
+// Transfers the random record, which becomes the current record.
+func (dos *Dos) fcbRandom(c *cpu.CPU, write bool) uint8 {
+	f := dos.fcbArg(c)
+	rec := f.randomRecord()
+	f.setCurrentRecord(rec)
+	if write {
+		result, _ := dos.fcbWrite(f, rec, 1)
+		return result
+	}
+	result, _ := dos.fcbRead(f, rec, 1)
+	return result
+}
+
+// INT 21h AH=27h and 28h, RANDOM BLOCK READ and WRITE
+// Transfers CX records from the random record on, returning how many were
+// transferred in CX and moving the random and current records past them.
+func (dos *Dos) fcbRandomBlock(c *cpu.CPU, write bool) uint8 {
+	f := dos.fcbArg(c)
+	rec := f.randomRecord()
+	count := int64(c.Regs.GetReg16(cpu.CX))
+	var result uint8
+	var n int64
+	if write {
+		result, n = dos.fcbWrite(f, rec, count)
+	} else {
+		result, n = dos.fcbRead(f, rec, count)
+	}
+	c.Regs.SetReg16(cpu.CX, uint(n))
+	f.setRandomRecord(rec + n)
+	f.setCurrentRecord(rec + n)
+	return result
+}
+
+// Characters which end a file name for PARSE FILENAME.
+func fcbTerminator(c byte) bool {
+	return c <= ' ' || strings.IndexByte("./\\\"[]:|<>+=;,", c) >= 0
+}
+
+// INT 21h AH=29h, PARSE FILENAME INTO FCB
+// AL = flags, DS:SI = string, ES:DI = FCB.  Returns 00h in AL, 01h if
+// there were wildcards or FFh for an invalid drive, and DS:SI past the
+// name.
+func (dos *Dos) parseFilename(c *cpu.CPU) {
+	flags := uint8(c.Regs.GetReg8(cpu.AL))
+	si := c.Regs.GetReg16(cpu.SI)
+	s := dos.getBytes(c.Regs.DS(), si, 0x80)
+	f := fcb{c.Mem, c.Regs.ES(), c.Regs.GetReg16(cpu.DI)}
+	n, result := dos.parseFCBName(s, flags, f)
+	c.Regs.SetReg16(cpu.SI, (si+uint(n))&0xFFFF)
+	c.Regs.SetReg8(cpu.AL, uint(result))
+}
+
+// Parses a file name from s into f like PARSE FILENAME does, returning how
+// much of s it used and the result for AL.
+func (dos *Dos) parseFCBName(s []byte, flags uint8, f fcb) (int, uint8) {
+	i := 0
+	skipSpace := func() {
+		for i < len(s) && (s[i] == ' ' || s[i] == '\t') {
+			i++
+		}
+	}
+	skipSpace()
+	if flags&0x01 != 0 && i < len(s) && strings.IndexByte(":.;,=+", s[i]) >= 0 {
+		i++
+		skipSpace()
+	}
+
+	result := uint8(fcbOK)
+	if i+1 < len(s) && s[i+1] == ':' && (s[i]|0x20) >= 'a' && (s[i]|0x20) <= 'z' {
+		n, _ := driveNumber(s[i])
+		if dos.drives[n] == nil {
+			result = fcbFailed
+		}
+		f.set8(fcbDrive, uint8(n+1))
+		i += 2
+	} else if flags&0x02 == 0 {
+		f.set8(fcbDrive, 0)
+	}
+
+	name := f.name()
+	field := func(out []byte, keep bool) {
+		start := i
+		filled := 0
+		for ; i < len(s) && !fcbTerminator(s[i]); i++ {
+			c := s[i]
+			if c == '*' {
+				for ; filled < len(out); filled++ {
+					out[filled] = '?'
+				}
+				continue
+			}
+			if filled < len(out) {
+				if c >= 'a' && c <= 'z' {
+					c -= 0x20
+				}
+				out[filled] = c
+				filled++
+			}
+		}
+		if i == start && keep {
+			return
+		}
+		for ; filled < len(out); filled++ {
+			out[filled] = ' '
+		}
+	}
+	field(name[:8], flags&0x04 != 0)
+	if i < len(s) && s[i] == '.' {
+		i++
+		field(name[8:], false)
+	} else if flags&0x08 == 0 {
+		copy(name[8:], "   ")
+	}
+	f.setName(name)
+
+	if result == fcbOK && strings.IndexByte(string(name[:]), '?') >= 0 {
+		result = 0x01
+	}
+	return i, result
+}
+
+// Fills in the two FCBs in a PSP from the first two arguments in its
+// command tail at 80h, like COMMAND.COM does.
+func (dos *Dos) fillDefaultFCBs(psp uint) {
+	size := uint(dos.cpu.Mem.GetMem8(psp, pspTail))
+	s := append(dos.getBytes(psp, pspTail+1, min(size, 0x7F)), '\r')
+	n, _ := dos.parseFCBName(s, 0x01, fcb{dos.cpu.Mem, psp, pspFCB1})
+	// Skip the rest of the first argument
+	for n < len(s) && s[n] != ' ' && s[n] != '\t' && s[n] != '\r' {
+		n++
+	}
+	dos.parseFCBName(s[n:], 0x01, fcb{dos.cpu.Mem, psp, pspFCB2})
+}
+
+// Sets AL to the result of an FCB call, 00h or FFh for errors.
+func fcbResult(c *cpu.CPU, err error) {
+	if err != nil {
+		log.V(2).Infof("INT21H: [%02X] FCB failed: %v", c.Regs.GetReg8(cpu.AH), err)
+		c.Regs.SetReg8(cpu.AL, fcbFailed)
+		return
+	}
+	c.Regs.SetReg8(cpu.AL, fcbOK)
+}
@@ -0,0 +1,483 @@
+package go86
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strings"
+
+	log "github.com/golang/glog"
+	cpu "go86.org/go86/cpu"
+)
+
+// File handles.  Each process has a job file table (JFT) in its PSP, which
+// maps its handles to entries in the system file table (SFT) shared by every
+// process.  Handles are inherited by pointing at the same SFT entry.
+
+const (
+	// Handles in the JFT of a PSP.
+	jftSize = 20
+	// Entries in the SFT, FFh in a JFT is a closed handle.
+	sftSize     = 0xFF
+	closedEntry = 0xFF
+	// Open mode bit for handles children don't inherit.
+	noInherit = 0x80
+)
+
+// Devices an SFT entry can be instead of a file.
+type device int
+
+const (
+	noDevice device = iota
+	// Console reading from In and writing to Out
+	conDevice
+	// Console writing to Err, for standard error
+	errDevice
+	nulDevice
+)
+
+// Device names which can be opened in any directory.
+var deviceNames = map[string]device{
+	"CON": conDevice,
+	"NUL": nulDevice,
+	"AUX": nulDevice,
+	"PRN": nulDevice,
+}
+
+// Device information word from INT 21h AX=4400h.
+var deviceInfo = map[device]uint16{
+	conDevice: 0x80D3,
+	errDevice: 0x80D3,
+	nulDevice: 0x8084,
+}
+
+// An SFT entry, an open file shared by the handles which refer to it.
+type sftEntry struct {
+	name string
+	refs int
+	// Access mode it was opened with, AL from AH=3Dh.
+	mode   uint8
+	device device
+	// Host file, nil for devices.
+	file  *os.File
+	drive int
+	// Opened for an FCB, which no handle refers to, by the process with the
+	// PSP owner.
+	forFCB bool
+	owner  uint
+}
+
+// Standard handles, stdin, stdout, stderr, stdaux and stdprn, and the SFT
+// entries they start out as.
+var stdHandles = [5]uint8{0, 0, 1, 2, 3}
+
+func (dos *Dos) initFiles() {
+	dos.sft = []*sftEntry{
+		{name: "CON", device: conDevice, mode: 2},
+		{name: "CON", device: errDevice, mode: 2},
+		{name: "AUX", device: nulDevice, mode: 2},
+		{name: "PRN", device: nulDevice, mode: 2},
+	}
+	dos.noPspJFT = [jftSize]uint8{}
+	for i := range dos.noPspJFT {
+		dos.noPspJFT[i] = closedEntry
+	}
+	for h, n := range stdHandles {
+		dos.noPspJFT[h] = n
+		dos.sft[n].refs++
+	}
+}
+
+// Sets up the JFT in a new PSP with the handles the current process lets
+// it inherit, the standard handles for the first program.
+func (dos *Dos) initJFT(psp uint) {
+	mem := dos.cpu.Mem
+	for h := uint(0); h < jftSize; h++ {
+		n := dos.jftEntry(h)
+		if f, err := dos.handleFile(h); err != nil || f.mode&noInherit != 0 {
+			n = closedEntry
+		} else {
+			f.refs++
+		}
+		mem.SetMem8(psp, 0x18+h, n)
+	}
+	mem.SetMem16(psp, 0x32, jftSize)
+	mem.SetMem16(psp, 0x34, 0x18)
+	mem.SetMem16(psp, 0x36, uint16(psp))
+}
+
+// Where the current process's JFT is and how many handles it has.
+func (dos *Dos) jft() (seg, off, size uint) {
+	if dos.psp == 0 {
+		return 0, 0, 0
+	}
+	mem := dos.cpu.Mem
+	size = uint(mem.GetMem16(dos.psp, 0x32))
+	off = uint(mem.GetMem16(dos.psp, 0x34))
+	seg = uint(mem.GetMem16(dos.psp, 0x36))
+	return seg, off, size
+}
+
+// The SFT entry number of handle h, closedEntry if it isn't open.
+func (dos *Dos) jftEntry(h uint) uint8 {
+	seg, off, size := dos.jft()
+	switch {
+	case dos.psp == 0 && h < jftSize:
+		return dos.noPspJFT[h]
+	case h >= size:
+		return closedEntry
+	}
+	return dos.cpu.Mem.GetMem8(seg, off+h)
+}
+
+func (dos *Dos) setJFTEntry(h uint, n uint8) {
+	if dos.psp == 0 {
+		dos.noPspJFT[h] = n
+		return
+	}
+	seg, off, _ := dos.jft()
+	dos.cpu.Mem.SetMem8(seg, off+h, n)
+}
+
+// The open file for handle h.
+func (dos *Dos) handleFile(h uint) (*sftEntry, error) {
+	n := dos.jftEntry(h)
+	if int(n) >= len(dos.sft) || dos.sft[n] == nil {
+		return nil, ErrInvalidHandle
+	}
+	return dos.sft[n], nil
+}
+
+// Puts f in the SFT and gives it the lowest free handle.
+func (dos *Dos) newHandle(f *sftEntry) (uint, error) {
+	size := uint(jftSize)
+	if dos.psp != 0 {
+		_, _, size = dos.jft()
+	}
+	h := uint(0)
+	for ; h < size && dos.jftEntry(h) != closedEntry; h++ {
+	}
+	if h == size {
+		return 0, ErrTooManyOpenFiles
+	}
+	n, err := dos.newSFTEntry(f)
+	if err != nil {
+		return 0, err
+	}
+	dos.setJFTEntry(h, n)
+	return h, nil
+}
+
+// Puts f in the first free SFT entry.
+func (dos *Dos) newSFTEntry(f *sftEntry) (uint8, error) {
+	n := 0
+	for ; n < len(dos.sft) && dos.sft[n] != nil; n++ {
+	}
+	if n == sftSize {
+		return 0, ErrTooManyOpenFiles
+	}
+	if n == len(dos.sft) {
+		dos.sft = append(dos.sft, nil)
+	}
+	f.refs = 1
+	dos.sft[n] = f
+	return uint8(n), nil
+}
+
+// Drops a reference to SFT entry n, closing the file after the last one.
+func (dos *Dos) releaseSFTEntry(n uint8) error {
+	f := dos.sft[n]
+	if f.refs--; f.refs > 0 {
+		return nil
+	}
+	dos.sft[n] = nil
+	if f.file != nil {
+		return f.file.Close()
+	}
+	return nil
+}
+
+// Closes handle h, and the file once no handles refer to it.
+func (dos *Dos) closeHandle(h uint) error {
+	if _, err := dos.handleFile(h); err != nil {
+		return err
+	}
+	n := dos.jftEntry(h)
+	dos.setJFTEntry(h, closedEntry)
+	return dos.releaseSFTEntry(n)
+}
+
+// Closes all the current process's handles and the files its FCBs left
+// open, when it ends.
+func (dos *Dos) closeAll() {
+	_, _, size := dos.jft()
+	if dos.psp == 0 {
+		size = jftSize
+	}
+	for h := uint(0); h < size; h++ {
+		if dos.jftEntry(h) != closedEntry {
+			dos.closeHandle(h)
+		}
+	}
+	for n, f := range dos.sft {
+		if f != nil && f.forFCB && f.owner == dos.psp {
+			dos.releaseSFTEntry(uint8(n))
+		}
+	}
+}
+
+// Opens a device for a name like CON or NUL.  DOS finds them in any
+// directory, with any extension.
+func openDevice(path string) *sftEntry {
+	name := path[strings.LastIndexAny(path, "\\/:")+1:]
+	base, _, _ := strings.Cut(strings.ToUpper(name), ".")
+	if dev, ok := deviceNames[base]; ok {
+		return &sftEntry{name: base, device: dev, mode: 2}
+	}
+	return nil
+}
+
+// Reads n bytes at seg:off, wrapping around in the segment.
+func (dos *Dos) getBytes(seg, off, n uint) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = dos.cpu.Mem.GetMem8(seg, (off+uint(i))&0xFFFF)
+	}
+	return b
+}
+
+// Reads the NUL terminated string at seg:off.
+func (dos *Dos) asciiz(seg, off uint) string {
+	var b []byte
+	for i := uint(0); i < 0x80; i++ {
+		c := dos.cpu.Mem.GetMem8(seg, (off+i)&0xFFFF)
+		if c == 0 {
+			break
+		}
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+// The ASCIZ path at DS:DX.
+func (dos *Dos) pathArg(c *cpu.CPU) string {
+	return dos.asciiz(c.Regs.DS(), c.Regs.GetReg16(cpu.DX))
+}
+
+// INT 21h AH=3Ch, CREATE OR TRUNCATE FILE
+// CX = attributes, DS:DX = ASCIZ filename.  Returns the handle in AX.
+func (dos *Dos) createFile(c *cpu.CPU) error {
+	attr := c.Regs.GetReg16(cpu.CX)
+	path := dos.pathArg(c)
+	f := openDevice(path)
+	if f == nil {
+		p, err := dos.parsePath(path)
+		if err != nil {
+			return err
+		}
+		if attr&(attrVolume|attrDirectory) != 0 || p.name() == "" {
+			return ErrAccessDenied
+		}
+		host, err := dos.hostPath(p)
+		if err != nil {
+			return err
+		}
+		file, err := os.OpenFile(host, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+		if err != nil {
+			return err
+		}
+		if attr&attrReadOnly != 0 {
+			os.Chmod(host, 0444)
+		}
+		f = &sftEntry{name: p.String(), mode: 2, file: file, drive: p.drive}
+	}
+	return dos.openResult(c, f)
+}
+
+// INT 21h AH=3Dh, OPEN EXISTING FILE
+// AL = access and sharing modes, DS:DX = ASCIZ filename.  Returns the
+// handle in AX.
+func (dos *Dos) openFile(c *cpu.CPU) error {
+	mode := uint8(c.Regs.GetReg8(cpu.AL))
+	flag := map[uint8]int{0: os.O_RDONLY, 1: os.O_WRONLY, 2: os.O_RDWR}
+	if _, ok := flag[mode&7]; !ok {
+		return ErrInvalidAccess
+	}
+	path := dos.pathArg(c)
+	f := openDevice(path)
+	if f == nil {
+		p, err := dos.parsePath(path)
+		if err != nil {
+			return err
+		}
+		host, err := dos.existingPath(p)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(host); err != nil || info.IsDir() {
+			return ErrAccessDenied
+		}
+		file, err := os.OpenFile(host, flag[mode&7], 0)
+		if err != nil {
+			return err
+		}
+		f = &sftEntry{name: p.String(), file: file, drive: p.drive}
+	}
+	f.mode = mode
+	return dos.openResult(c, f)
+}
+
+// Gives f a handle and returns it in AX.
+func (dos *Dos) openResult(c *cpu.CPU, f *sftEntry) error {
+	h, err := dos.newHandle(f)
+	if err != nil {
+		if f.file != nil {
+			f.file.Close()
+		}
+		return err
+	}
+	log.V(2).Infof("INT21H: [%02X] opened %s as handle %d", c.Regs.GetReg8(cpu.AH), f.name, h)
+	c.Regs.SetReg16(cpu.AX, h)
+	return nil
+}
+
+// INT 21h AH=3Eh, CLOSE FILE
+// BX = handle.
+func (dos *Dos) closeFile(c *cpu.CPU) error {
+	return dos.closeHandle(c.Regs.GetReg16(cpu.BX))
+}
+
+// INT 21h AH=3Fh, READ FROM FILE OR DEVICE
+// BX = handle, CX = bytes to read, DS:DX = buffer.  Returns the number of
+// bytes read in AX, zero at the end of the file.
+func (dos *Dos) readFile(c *cpu.CPU) error {
+	f, err := dos.handleFile(c.Regs.GetReg16(cpu.BX))
+	if err != nil {
+		return err
+	}
+	if f.mode&7 == 1 {
+		return ErrAccessDenied
+	}
+	buf := make([]byte, c.Regs.GetReg16(cpu.CX))
+	var n int
+	switch f.device {
+	case noDevice:
+		n, err = io.ReadFull(f.file, buf)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			err = nil
+		}
+	case conDevice, errDevice:
+		n, err = dos.readConsole(buf)
+	}
+	if err != nil {
+		return err
+	}
+	c.Mem.Copy(c.Regs.DS(), c.Regs.GetReg16(cpu.DX), buf[:n])
+	c.Regs.SetReg16(cpu.AX, uint(n))
+	return nil
+}
+
+// Reads a line at a time from In like the console does, ending with CR LF
+// whatever the host's line ending is.  A line longer than buf is returned
+// over the next reads.
+func (dos *Dos) readConsole(buf []byte) (int, error) {
+	if len(dos.conLine) == 0 {
+		if dos.conIn == nil || dos.conSrc != dos.In {
+			dos.conIn, dos.conSrc = bufio.NewReader(dos.In), dos.In
+		}
+		line, err := dos.conIn.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return 0, err
+		}
+		if strings.HasSuffix(line, "\n") {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r") + "\r\n"
+		}
+		dos.conLine = []byte(line)
+	}
+	n := copy(buf, dos.conLine)
+	dos.conLine = dos.conLine[n:]
+	return n, nil
+}
+
+// INT 21h AH=40h, WRITE TO FILE OR DEVICE
+// BX = handle, CX = bytes to write, DS:DX = data.  Returns the number of
+// bytes written in AX.  Writing no bytes truncates the file at the current
+// position.
+func (dos *Dos) writeFile(c *cpu.CPU) error {
+	f, err := dos.handleFile(c.Regs.GetReg16(cpu.BX))
+	if err != nil {
+		return err
+	}
+	if f.mode&7 == 0 {
+		return ErrAccessDenied
+	}
+	cx := c.Regs.GetReg16(cpu.CX)
+	s := dos.getBytes(c.Regs.DS(), c.Regs.GetReg16(cpu.DX), cx)
+	n := len(s)
+	switch f.device {
+	case noDevice:
+		if cx == 0 {
+			pos, err := f.file.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			if err := f.file.Truncate(pos); err != nil {
+				return err
+			}
+			break
+		}
+		if n, err = f.file.Write(s); err != nil {
+			return err
+		}
+	case conDevice:
+		dos.Out.Write(s)
+	case errDevice:
+		dos.Err.Write(s)
+	}
+	c.Regs.SetReg16(cpu.AX, uint(n))
+	return nil
+}
+
+// INT 21h AH=42h, SET CURRENT FILE POSITION
+// AL = origin, BX = handle, CX:DX = signed offset.  Returns the new
+// position in DX:AX.
+func (dos *Dos) seekFile(c *cpu.CPU) error {
+	f, err := dos.handleFile(c.Regs.GetReg16(cpu.BX))
+	if err != nil {
+		return err
+	}
+	whence := int(c.Regs.GetReg8(cpu.AL))
+	if whence > io.SeekEnd {
+		return ErrInvalidFunction
+	}
+	off := int32(c.Regs.GetReg16(cpu.CX)<<16 | c.Regs.GetReg16(cpu.DX))
+	var pos int64
+	if f.file != nil {
+		if pos, err = f.file.Seek(int64(off), whence); err != nil {
+			return err
+		}
+	}
+	c.Regs.SetReg16(cpu.DX, uint(pos>>16)&0xFFFF)
+	c.Regs.SetReg16(cpu.AX, uint(pos)&0xFFFF)
+	return nil
+}
+
+// INT 21h AH=44h, IOCTL
+// Only AL=00h, get device information for the handle in BX into DX.
+func (dos *Dos) ioctl(c *cpu.CPU) error {
+	if al := c.Regs.GetReg8(cpu.AL); al != 0x00 {
+		log.Warningf("Unhandled IOCTL: [%02X]", al)
+		return ErrInvalidFunction
+	}
+	f, err := dos.handleFile(c.Regs.GetReg16(cpu.BX))
+	if err != nil {
+		return err
+	}
+	info := uint16(f.drive)
+	if f.device != noDevice {
+		info = deviceInfo[f.device]
+	}
+	c.Regs.SetReg16(cpu.DX, uint(info))
+	return nil
+}
@@ -0,0 +1,151 @@
+package go86
+
+import (
+	"bytes"
+	"strings"
+
+	log "github.com/golang/glog"
+	cpu "go86.org/go86/cpu"
+)
+
+// Memory control blocks, the paragraph before each block of DOS memory.
+// Programs can walk and change them, so DosMem reads the chain back from
+// memory before it changes the blocks and writes it out after.
+const (
+	mcbParagraphs = 1
+
+	mcbType  = 0x00
+	mcbOwner = 0x01
+	mcbSize  = 0x03
+	mcbName  = 0x08
+
+	// 'M' for a block with more after it, 'Z' for the last.
+	mcbMore = 'M'
+	mcbLast = 'Z'
+	// Blocks DOS owns itself, and free ones.
+	mcbOwnerDOS  = 0x0008
+	mcbOwnerFree = 0x0000
+)
+
+// Writes the MCB of each block to memory.
+func (m *DosMem) writeChain() {
+	if m.mem == nil {
+		return
+	}
+	for i, b := range m.Blocks {
+		seg := b.Start - mcbParagraphs
+		kind := uint8(mcbMore)
+		if i == len(m.Blocks)-1 {
+			kind = mcbLast
+		}
+		owner := b.Owner
+		switch {
+		case b.Avail:
+			owner = mcbOwnerFree
+		case owner == mcbOwnerFree:
+			owner = mcbOwnerDOS
+		}
+		var name [8]byte
+		copy(name[:], b.ProgramName)
+		m.mem.SetMem8(seg, mcbType, kind)
+		m.mem.SetMem16(seg, mcbOwner, uint16(owner))
+		m.mem.SetMem16(seg, mcbSize, uint16(b.Size()))
+		m.mem.Copy(seg, mcbSize+2, make([]byte, mcbName-mcbSize-2))
+		m.mem.Copy(seg, mcbName, name[:])
+	}
+}
+
+// Reads the blocks back from the MCB chain in memory, with whatever changes
+// programs made to it.  The chain has to end with a 'Z' block at EndSeg.
+func (m *DosMem) readChain() error {
+	if m.mem == nil || len(m.Blocks) == 0 {
+		return nil
+	}
+	var blocks []DosMemBlock
+	for seg := m.StartSeg; ; {
+		kind := m.mem.GetMem8(seg, mcbType)
+		b := DosMemBlock{
+			Start: seg + mcbParagraphs,
+			Owner: uint(m.mem.GetMem16(seg, mcbOwner)),
+		}
+		b.End = b.Start + uint(m.mem.GetMem16(seg, mcbSize))
+		b.Avail = b.Owner == mcbOwnerFree
+		name := make([]byte, 8)
+		for i := range name {
+			name[i] = m.mem.GetMem8(seg, mcbName+uint(i))
+		}
+		if n := bytes.IndexByte(name, 0); n >= 0 {
+			name = name[:n]
+		}
+		b.ProgramName = string(name)
+		if (kind != mcbMore && kind != mcbLast) || b.End > m.EndSeg {
+			log.V(1).Infof("MCB chain destroyed at %04X: [%c %04X %04X]", seg, kind, b.Owner, b.Size())
+			return ErrMCBDestroyed
+		}
+		blocks = append(blocks, b)
+		if kind == mcbLast {
+			if b.End != m.EndSeg {
+				log.V(1).Infof("MCB chain ends early at %04X", seg)
+				return ErrMCBDestroyed
+			}
+			break
+		}
+		seg = b.End
+	}
+	m.Blocks = blocks
+	return nil
+}
+
+// The name of a program in its MCB, the DOS 4 way: its file name without
+// the extension.
+func mcbProgramName(path string) string {
+	name := path[strings.LastIndexByte(path, '\\')+1:]
+	name, _, _ = strings.Cut(name, ".")
+	return name
+}
+
+// Where the list of lists is, in DOS's own segment.  The first MCB's
+// segment is the word before it.
+const (
+	lolFirstMCB   = 0x0010
+	lolOff        = lolFirstMCB + 2
+	lolDPB        = 0x00
+	lolSFT        = 0x04
+	lolClock      = 0x08
+	lolCon        = 0x0C
+	lolSectorSize = 0x10
+	lolBuffers    = 0x12
+	lolCDS        = 0x16
+	lolFCBs       = 0x1A
+	lolBlockDevs  = 0x20
+	lolLastDrive  = 0x21
+	lolNul        = 0x22
+	lolSize       = 0x35
+)
+
+// INT 21h AH=52h, SYSVARS - GET LIST OF LISTS
+// Returns ES:BX pointing at it.  go86 has no DOS tables but the MCB chain
+// and the NUL device, so the other pointers are FFFF:FFFF.
+func (dos *Dos) listOfLists(c *cpu.CPU) {
+	mem := c.Mem
+	dos.Mem.init()
+	lol := make([]byte, lolSize)
+	for _, off := range []int{lolDPB, lolSFT, lolClock, lolCon, lolBuffers, lolCDS, lolFCBs} {
+		copy(lol[off:], []byte{0xFF, 0xFF, 0xFF, 0xFF})
+	}
+	lol[lolSectorSize], lol[lolSectorSize+1] = 0x00, 0x02
+	for _, d := range dos.drives {
+		if d != nil {
+			lol[lolBlockDevs]++
+		}
+	}
+	lol[lolLastDrive] = maxDrives
+	// The NUL device header, the last device
+	copy(lol[lolNul:], []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x04, 0x80, 0, 0, 0, 0})
+	copy(lol[lolNul+10:], "NUL     ")
+	mem.SetMem16(dosCodeSeg, lolFirstMCB, uint16(dos.Mem.StartSeg))
+	mem.Copy(dosCodeSeg, lolOff, lol)
+
+	c.Regs.SetSeg16(cpu.ES, dosCodeSeg)
+	c.Regs.SetReg16(cpu.BX, lolOff)
+}
@@ -0,0 +1,178 @@
+package go86
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	log "github.com/golang/glog"
+	cpu "go86.org/go86/cpu"
+)
+
+// Offsets in the program segment prefix.
+const (
+	pspInt20    = 0x00
+	pspMemTop   = 0x02
+	pspCPMCall  = 0x05
+	pspInt22    = 0x0A
+	pspInt23    = 0x0E
+	pspInt24    = 0x12
+	pspParent   = 0x16
+	pspEnv      = 0x2C
+	pspDosCall  = 0x50
+	pspFCB1     = 0x5C
+	pspFCB2     = 0x6C
+	pspTail     = 0x80
+	pspSize     = 0x100
+	maxTailSize = 126
+)
+
+// DOS keeps a little code of its own at 0070:0000, the entry point for CP/M
+// style calls.  PSP:05h far calls F01D:FEF0, which wraps around to the
+// INT 30h vector where DOS puts a far jump to the entry point, like DOS
+// does.  The offset doubles as the size of the program's segment for CP/M
+// programs.
+const (
+	dosCodeSeg = 0x0070
+	cpmEntry   = 0x0000
+	cpmJump    = 0x30 * 4
+	cpmCallSeg = 0xF01D
+	cpmCallOff = 0xFEF0
+
+	// The DTA for a binary image, which has no PSP to put one in.
+	defaultDTA = 0x80
+	// Entry points for the interrupts handled in Go, 4 bytes each.
+	intrEntries = 0x100
+)
+
+// Puts the CP/M entry point, an INT 21h which Int21 recognises, and the far
+// jump to it in low memory.
+func (dos *Dos) initCPMEntry() {
+	mem := dos.cpu.Mem
+	mem.Copy(dosCodeSeg, cpmEntry, []byte{0xCD, 0x21})
+	mem.Copy(0, cpmJump, []byte{0xEA, cpmEntry & 0xFF, cpmEntry >> 8, dosCodeSeg & 0xFF, dosCodeSeg >> 8})
+}
+
+// Whether INT 21h was called from the CP/M entry point.
+func isCPMCall(c *cpu.CPU) bool {
+	return c.Regs.CS() == dosCodeSeg && c.Ip == cpmEntry+2
+}
+
+// A CP/M style call, the function in CL.  The program near called PSP:05h
+// which far called here, so it returns straight to the program past the near
+// call.
+func (dos *Dos) cpmCall(c *cpu.CPU) {
+	fn := c.Regs.GetReg8(cpu.CL)
+	log.V(3).Infof("Dos.cpm: [CL: %02X]", fn)
+	if fn <= 0x24 {
+		c.Regs.SetReg8(cpu.AH, fn)
+		dos.int21(c)
+	} else {
+		c.Regs.SetReg8(cpu.AL, 0)
+	}
+	c.Regs.Pop16(c.Mem) // PSP:0Ah
+	cs := c.Regs.Pop16(c.Mem)
+	c.Ip = c.Regs.Pop16(c.Mem)
+	c.Regs.SetSeg16(cpu.CS, uint(cs))
+}
+
+// The command tail for args, as it goes in the PSP: a space before each
+// argument.
+func commandTail(args []string) (string, error) {
+	var tail string
+	for _, arg := range args {
+		tail += " " + arg
+	}
+	if len(tail) > maxTailSize {
+		return "", fmt.Errorf("command line too long, %d characters is the most: '%s'", maxTailSize, tail)
+	}
+	return tail, nil
+}
+
+// The DOS path of the program in the host file name, on the drive it is on
+// if it is on one or the current drive if not.
+func (dos *Dos) programPath(name string) string {
+	if abs, err := filepath.Abs(name); err == nil && name != "" {
+		for n, d := range dos.drives {
+			if d == nil {
+				continue
+			}
+			rel, err := filepath.Rel(d.Root, abs)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			if p, ok := shortPath(n, rel); ok {
+				return p.String()
+			}
+		}
+	}
+	short, ok := shortName(filepath.Base(name))
+	if !ok {
+		short = "PROGRAM"
+	}
+	return dosPath{drive: dos.curDrive, names: []string{short}}.String()
+}
+
+// The DOS path for rel on drive n, if every part of it has a DOS name.
+func shortPath(n int, rel string) (dosPath, bool) {
+	p := dosPath{drive: n}
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		short, ok := shortName(part)
+		if !ok {
+			return p, false
+		}
+		p.names = append(p.names, short)
+	}
+	return p, true
+}
+
+// The environment block for a program: the variables as NUL terminated
+// strings, an empty one, then a count of 1 and the program's path.
+func environment(vars []string, program string) []byte {
+	var b []byte
+	for _, v := range vars {
+		b = append(append(b, v...), 0)
+	}
+	if len(vars) == 0 {
+		b = append(b, 0)
+	}
+	b = append(b, 0, 1, 0)
+	return append(append(b, program...), 0)
+}
+
+// Creates the PSP for a program at the start of its memory block.
+func (dos *Dos) createPsp(block *DosMemBlock, env uint, tail string) {
+	log.V(1).Infof("Creating PSP at: 0x%04X\n", block.Start)
+	mem := dos.cpu.Mem
+	psp := block.Start
+	dos.initCPMEntry()
+	// Programs which hook the vectors DOS and the BIOS handle chain to these
+	dos.cpu.InstallIntrs(dosCodeSeg, intrEntries)
+	mem.Copy(psp, 0, make([]byte, pspSize))
+
+	mem.Copy(psp, pspInt20, []byte{0xCD, 0x20})
+	// First paragraph following this segment.
+	mem.SetMem16(psp, pspMemTop, uint16(block.End))
+	mem.Copy(psp, pspCPMCall, []byte{0x9A, cpmCallOff & 0xFF, cpmCallOff >> 8, cpmCallSeg & 0xFF, cpmCallSeg >> 8})
+	// Where to go when the program ends, Ctrl-C and critical errors
+	for i, off := range []uint{pspInt22, pspInt23, pspInt24} {
+		vec := uint(0x22+i) * 4
+		mem.SetMem16(psp, off, mem.GetMem16(0, vec))
+		mem.SetMem16(psp, off+2, mem.GetMem16(0, vec+2))
+	}
+	// FFFE means no parent DOS process
+	parent := uint16(0xFFFE)
+	if dos.psp != 0 {
+		parent = uint16(dos.psp)
+	}
+	mem.SetMem16(psp, pspParent, parent)
+	mem.SetMem16(psp, pspEnv, uint16(env))
+	mem.Copy(psp, pspDosCall, []byte{0xCD, 0x21, 0xCB}) // INT 21h, RETF
+	mem.SetMem8(psp, pspTail, uint8(len(tail)))
+	mem.Copy(psp, pspTail+1, append([]byte(tail), '\r'))
+
+	dos.initJFT(psp)
+	dos.psp = psp
+	dos.dtaSeg, dos.dtaOff = psp, pspTail
+	dos.fillDefaultFCBs(psp)
+}
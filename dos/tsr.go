@@ -0,0 +1,27 @@
+package go86
+
+import (
+	log "github.com/golang/glog"
+	cpu "go86.org/go86/cpu"
+)
+
+// DOS keeps at least this many paragraphs of a resident program.
+const minResident = 6
+
+// Ends the current program but keeps the first paragraphs of its memory
+// block, and its other blocks and open files, for the code it leaves
+// behind.  The vectors it hooked stay hooked.
+func (dos *Dos) keep(c *cpu.CPU, paragraphs uint, code uint8) {
+	paragraphs = max(paragraphs, minResident)
+	if size, err := dos.Mem.Resize(dos.psp, paragraphs); err != nil {
+		log.Warningf("TSR: PSP %04X keeps %04X paragraphs, not %04X: %v", dos.psp, size, paragraphs, err)
+	}
+	dos.terminate(c, TermTSR, code)
+}
+
+// Int27 terminates and stays resident, keeping the memory up to the offset
+// in DX from the start of the PSP.
+func (dos *Dos) Int27(c *cpu.CPU, intnum int) {
+	log.V(3).Infof("Dos.int%02x: [DX: %04X]", intnum, c.Regs.GetReg16(cpu.DX))
+	dos.keep(c, (uint(c.Regs.GetReg16(cpu.DX))+15)/16, 0)
+}
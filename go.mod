@@ -4,7 +4,6 @@ go 1.23
 
 require (
 	github.com/golang/glog v1.2.4
-	golang.org/x/arch v0.13.0
 	gotest.tools/v3 v3.5.1
 )
 
@@ -0,0 +1,306 @@
+package go86
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	bios "go86.org/go86/bios"
+	cpu "go86.org/go86/cpu"
+	devices "go86.org/go86/devices"
+	disasm "go86.org/go86/disasm"
+	dos "go86.org/go86/dos"
+)
+
+// ErrStopped is returned when Stop stops a machine before its program
+// exits.
+var ErrStopped = errors.New("machine stopped")
+
+// Machine states.
+const (
+	machineIdle int32 = iota
+	machineRunning
+	machineStopping
+)
+
+// Machine is a PC with the CPU, motherboard devices, BIOS and DOS wired
+// together, ready to load and run a program.  It is what the go86 command
+// runs, and what Go programs and tests embedding go86 use.
+type Machine struct {
+	CPU  *cpu.CPU
+	Bios *bios.Bios
+	Dos  *dos.Dos
+	// Motherboard devices, nil without them.
+	PIC *devices.PIC
+	PIT *devices.PIT
+
+	memSize  int
+	cpuOpts  []cpu.Option
+	devices  bool
+	newClock func(c *cpu.CPU) devices.Clock
+	clockHz  uint64
+	stdin    io.Reader
+	stdout   io.Writer
+	stderr   io.Writer
+	env      []string
+
+	// Idle, running or stopping, changed in one step so a Stop can't
+	// outlive the run it was for.
+	state atomic.Int32
+	// The run Start began last, set along with the state so Stop and Wait
+	// see it.
+	mu sync.Mutex
+	bg *backgroundRun
+}
+
+// A run in the background, done is closed once it is over with err.
+type backgroundRun struct {
+	done chan struct{}
+	err  error
+}
+
+type Option func(*Machine)
+
+// WithMemory gives the machine size bytes of RAM, 1 MiB by default.
+func WithMemory(size int) Option {
+	return func(m *Machine) {
+		m.memSize = size
+	}
+}
+
+// WithModel picks the CPU to emulate, an 80186 by default.
+func WithModel(model cpu.Model) Option {
+	return func(m *Machine) {
+		m.cpuOpts = append(m.cpuOpts, cpu.WithModel(model))
+	}
+}
+
+// WithFPU puts fpu in the coprocessor socket, nil leaves it empty.
+func WithFPU(fpu *cpu.FPU) Option {
+	return func(m *Machine) {
+		m.cpuOpts = append(m.cpuOpts, cpu.WithFPU(fpu))
+	}
+}
+
+// WithDevices adds the PIC and PIT, on by default.  Without them the BIOS
+// doesn't do its POST and leaves low memory alone, for running bare code.
+func WithDevices(on bool) Option {
+	return func(m *Machine) {
+		m.devices = on
+	}
+}
+
+// WithClock sets the time source for the timer, counting instructions by
+// default.
+func WithClock(newClock func(c *cpu.CPU) devices.Clock) Option {
+	return func(m *Machine) {
+		m.newClock = newClock
+	}
+}
+
+// WithClockHz paces the emulation at hz, i.e. 4772727.  Zero, the default,
+// runs as fast as possible.
+func WithClockHz(hz uint64) Option {
+	return func(m *Machine) {
+		m.clockHz = hz
+	}
+}
+
+// WithStdin is where the program's console input comes from, os.Stdin by
+// default.
+func WithStdin(r io.Reader) Option {
+	return func(m *Machine) {
+		m.stdin = r
+	}
+}
+
+// WithStdout is where the program's console output goes, os.Stdout by
+// default.
+func WithStdout(w io.Writer) Option {
+	return func(m *Machine) {
+		m.stdout = w
+	}
+}
+
+// WithStderr is where the program's standard error goes, os.Stderr by
+// default.
+func WithStderr(w io.Writer) Option {
+	return func(m *Machine) {
+		m.stderr = w
+	}
+}
+
+// WithEnv gives programs the environment variables vars, NAME=value, in
+// place of the default PATH=C:\.
+func WithEnv(vars ...string) Option {
+	return func(m *Machine) {
+		m.env = vars
+	}
+}
+
+// New creates a machine with the options in opts.
+func New(opts ...Option) *Machine {
+	m := &Machine{
+		memSize:  1024 * 1024,
+		devices:  true,
+		newClock: func(c *cpu.CPU) devices.Clock { return devices.NewInstructionClock(c) },
+		stdin:    os.Stdin,
+		stdout:   os.Stdout,
+		stderr:   os.Stderr,
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	c := cpu.NewCpu(m.memSize, m.cpuOpts...)
+	c.ClockHz = m.clockHz
+	if m.devices {
+		m.PIC = devices.NewPIC(c)
+		m.PIT = devices.NewPIT(c, m.PIC, m.newClock(c))
+	}
+	c.Disasm = disasm.New(disasm.Intel).Format
+	m.CPU = c
+
+	m.Bios = bios.NewBios(c)
+	m.Bios.In, m.Bios.Out = m.stdin, m.stdout
+	m.Dos = dos.NewDos(c)
+	m.Dos.In, m.Dos.Out, m.Dos.Err = m.stdin, m.stdout, m.stderr
+	if m.env != nil {
+		m.Dos.Env = m.env
+	}
+	return m
+}
+
+// Load loads a DOS program with the command line arguments args, ready to
+// run.
+func (m *Machine) Load(exe *dos.Executable, args ...string) error {
+	_, err := m.Dos.Load(exe, args...)
+	return err
+}
+
+// LoadFile loads the DOS program in the file name with the command line
+// arguments args, ready to run.
+func (m *Machine) LoadFile(name string, args ...string) error {
+	exe, err := dos.ReadExeFromFile(name)
+	if err != nil {
+		return fmt.Errorf("failed to read file header from: '%s'; error: %s", name, err)
+	}
+	return m.Load(exe, args...)
+}
+
+// LoadBinary copies code to seg:0000 and points CS:IP and DS at it, for
+// running code without DOS loading it.
+func (m *Machine) LoadBinary(seg uint, code []byte) {
+	m.CPU.Mem.Copy(seg, 0, code)
+	m.CPU.Regs.SetSeg16(cpu.CS, seg)
+	m.CPU.Regs.SetSeg16(cpu.DS, seg)
+	m.CPU.Ip = 0
+}
+
+// Mount makes the host directory dir DOS drive letter.
+func (m *Machine) Mount(letter byte, dir string) error {
+	return m.Dos.Mount(letter, dir)
+}
+
+// Run runs the program until it exits, returning its exit code.  It stops
+// early if ctx is cancelled or Stop is called.
+func (m *Machine) Run(ctx context.Context) (int, error) {
+	err := m.RunUntil(ctx, nil)
+	return m.ExitCode(), err
+}
+
+// RunUntil runs the program until done, which is asked before every
+// instruction, returns true or the program exits.  It stops early with an
+// error if ctx is cancelled or Stop is called.
+func (m *Machine) RunUntil(ctx context.Context, done func(m *Machine) bool) error {
+	if !m.state.CompareAndSwap(machineIdle, machineRunning) {
+		return fmt.Errorf("machine is already running")
+	}
+	return m.run(ctx, done)
+}
+
+func (m *Machine) run(ctx context.Context, done func(m *Machine) bool) error {
+	cancelled := ctx.Done()
+	m.CPU.RunUntil(func() bool {
+		select {
+		case <-cancelled:
+			return true
+		default:
+		}
+		return m.state.Load() == machineStopping || (done != nil && done(m))
+	})
+	if m.state.Swap(machineIdle) == machineStopping {
+		return ErrStopped
+	}
+	return ctx.Err()
+}
+
+// Start runs the program in the background, Wait waits for it to finish.
+func (m *Machine) Start(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.state.CompareAndSwap(machineIdle, machineRunning) {
+		return fmt.Errorf("machine is already running")
+	}
+	bg := &backgroundRun{done: make(chan struct{})}
+	m.bg = bg
+	go func() {
+		bg.err = m.run(ctx, nil)
+		close(bg.done)
+	}()
+	return nil
+}
+
+// The run Start began last, nil if it hasn't been called.
+func (m *Machine) background() *backgroundRun {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bg
+}
+
+// Wait waits for the program Start started to stop, returning its exit code.
+func (m *Machine) Wait() (int, error) {
+	bg := m.background()
+	if bg == nil {
+		return 0, fmt.Errorf("machine not started")
+	}
+	<-bg.done
+	return m.ExitCode(), bg.err
+}
+
+// Stop stops the running program before its next instruction, waiting for
+// it if Start started it.  It can be called from any goroutine.
+func (m *Machine) Stop() {
+	if !m.state.CompareAndSwap(machineRunning, machineStopping) {
+		return
+	}
+	// A run from RunUntil leaves the last Start's run, which is over.
+	if bg := m.background(); bg != nil {
+		<-bg.done
+	}
+}
+
+// Step runs one instruction.
+func (m *Machine) Step() error {
+	if m.state.Load() != machineIdle {
+		return fmt.Errorf("machine is already running")
+	}
+	if !m.CPU.Running {
+		return fmt.Errorf("program has exited")
+	}
+	return m.CPU.RunOnce()
+}
+
+// Exited is true once the program has exited.
+func (m *Machine) Exited() bool {
+	return !m.CPU.Running
+}
+
+// ExitCode is the program's return code once it has exited.
+func (m *Machine) ExitCode() int {
+	return int(m.Dos.ReturnCode)
+}
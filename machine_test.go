@@ -0,0 +1,234 @@
+package go86
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	cpu "go86.org/go86/cpu"
+	dos "go86.org/go86/dos"
+	"gotest.tools/v3/assert"
+)
+
+func newTestMachine(t *testing.T, code string) *Machine {
+	t.Helper()
+	b, err := hex.DecodeString(code)
+	assert.NilError(t, err)
+	m := New()
+	m.LoadBinary(0x1000, b)
+	return m
+}
+
+func TestMachineRun(t *testing.T) {
+	var out bytes.Buffer
+	m := New(WithStdout(&out))
+	assert.NilError(t, m.LoadFile("testdata/dos/hello.com"))
+	code, err := m.Run(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, code, 0)
+	assert.Assert(t, m.Exited())
+	assert.Equal(t, out.String(), "Hello again, World!\r\n")
+}
+
+func TestMachineCPMCall(t *testing.T) {
+	var out bytes.Buffer
+	m := New(WithStdout(&out))
+	// MOV CL,02; MOV DL,'A'; CALL 0005; MOV AX,4C00; INT 21
+	b, err := hex.DecodeString("B102B241E8FEFEB8004CCD21")
+	assert.NilError(t, err)
+	exe, err := dos.ReadExe(b)
+	assert.NilError(t, err)
+	assert.NilError(t, m.Load(exe))
+	code, err := m.Run(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, code, 0)
+	assert.Equal(t, out.String(), "A")
+}
+
+func TestMachineExec(t *testing.T) {
+	dir := t.TempDir()
+	// Writes its command tail to stdout and exits with 5:
+	// MOV AH,40; MOV BX,1; MOV CL,[80]; MOV CH,0; MOV DX,81; INT 21;
+	// MOV AX,4C05; INT 21
+	child, err := hex.DecodeString("B440BB01008A0E8000B500BA8100CD21B8054CCD21")
+	assert.NilError(t, err)
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "child.com"), child, 0666))
+
+	var out bytes.Buffer
+	m := New(WithStdout(&out))
+	assert.NilError(t, m.Mount('C', dir))
+	// Runs CHILD.COM with " hi" and exits with its return code:
+	// MOV DX,prog; MOV BX,params; MOV [params+4],CS; MOV AX,4B00; INT 21;
+	// JC fail; MOV AH,4D; INT 21; MOV AH,4C; INT 21;
+	// fail: MOV AX,4CFF; INT 21
+	parent, err := hex.DecodeString("BA1E01BB28018C0E2C01B8004BCD217208B44DCD21B44CCD21B8FF4CCD21" +
+		hex.EncodeToString([]byte("CHILD.COM\x00")) +
+		"0000360100000000000000000000" + hex.EncodeToString([]byte("\x03 hi\r")))
+	assert.NilError(t, err)
+	exe, err := dos.ReadExe(parent)
+	assert.NilError(t, err)
+	assert.NilError(t, m.Load(exe))
+	blocks := len(m.Dos.Mem.Blocks)
+
+	code, err := m.Run(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, code, 5)
+	assert.Equal(t, out.String(), " hi")
+	// The child's environment and program went back
+	assert.Equal(t, len(m.Dos.Mem.Blocks), blocks)
+}
+
+func TestMachineTSR(t *testing.T) {
+	dir := t.TempDir()
+	// Hooks INT 21h to answer AH=F0 with AL=42, chaining to DOS for the
+	// rest, and stays resident:
+	// JMP install; handler: CMP AH,F0; JNE chain; MOV AL,42; IRET;
+	// chain: JMP FAR 0000:0000;
+	// install: MOV AX,3521; INT 21; MOV [chain+1],BX; MOV [chain+3],ES;
+	// MOV DX,handler; MOV AX,2521; INT 21; MOV DX,20; MOV AX,3100; INT 21
+	tsr, err := hex.DecodeString("EB0D80FCF07503B042CFEA00000000B82135CD21891E0B018C060D01BA0201B82125CD21BA2000B80031CD21")
+	assert.NilError(t, err)
+	assert.NilError(t, os.WriteFile(filepath.Join(dir, "tsr.com"), tsr, 0666))
+
+	var out bytes.Buffer
+	// DOS's own memory is in the 640K
+	m := New(WithStdout(&out), WithMemory(640*1024))
+	assert.NilError(t, m.Mount('C', dir))
+	// Runs TSR.COM, then prints what AH=F0 gives and exits with the
+	// termination type:
+	// MOV DX,prog; MOV BX,params; MOV [params+4],CS; MOV AX,4B00; INT 21;
+	// MOV AH,F0; INT 21; MOV DL,AL; MOV AH,02; INT 21; MOV AH,4D; INT 21;
+	// MOV AL,AH; MOV AH,4C; INT 21
+	parent, err := hex.DecodeString("BA2301BB2B018C0E2F01B8004BCD21B4F0CD2188C2B402CD21B44DCD2188E0B44CCD21" +
+		hex.EncodeToString([]byte("TSR.COM\x00")) +
+		"0000390100000000000000000000" + hex.EncodeToString([]byte("\x00\r")))
+	assert.NilError(t, err)
+	exe, err := dos.ReadExe(parent)
+	assert.NilError(t, err)
+	assert.NilError(t, m.Load(exe))
+
+	code, err := m.Run(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, code, 3)
+	assert.Equal(t, out.String(), "B")
+}
+
+func TestMachineExitCode(t *testing.T) {
+	// MOV AX,4C03; INT 21
+	m := newTestMachine(t, "B8034CCD21")
+	code, err := m.Run(context.Background())
+	assert.NilError(t, err)
+	assert.Equal(t, code, 3)
+	assert.ErrorContains(t, m.Step(), "exited")
+}
+
+func TestMachineStep(t *testing.T) {
+	// L: INC AX; JMP L
+	m := newTestMachine(t, "40EBFD")
+	for i := 0; i < 4; i++ {
+		assert.NilError(t, m.Step())
+	}
+	assert.Equal(t, m.CPU.Regs.AX(), uint(2))
+
+	err := m.RunUntil(context.Background(), func(m *Machine) bool {
+		return m.CPU.Regs.AX() == 10
+	})
+	assert.NilError(t, err)
+	assert.Equal(t, m.CPU.Regs.AX(), uint(10))
+	assert.Equal(t, m.CPU.Ip, uint16(1))
+}
+
+func TestMachineCancel(t *testing.T) {
+	// JMP $
+	m := newTestMachine(t, "EBFE")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := m.Run(ctx)
+	assert.Equal(t, err, context.DeadlineExceeded)
+	assert.Assert(t, !m.Exited())
+}
+
+func TestMachineStartStop(t *testing.T) {
+	m := newTestMachine(t, "EBFE")
+	assert.NilError(t, m.Start(context.Background()))
+	assert.ErrorContains(t, m.Start(context.Background()), "already running")
+	assert.ErrorContains(t, m.Step(), "already running")
+	m.Stop()
+	_, err := m.Wait()
+	assert.Equal(t, err, ErrStopped)
+
+	// It carries on from where it stopped
+	assert.NilError(t, m.Step())
+	assert.Equal(t, m.CPU.Regs.CS(), uint(0x1000))
+}
+
+func TestMachineStopAfterExit(t *testing.T) {
+	// L: INC AX; JMP L
+	m := newTestMachine(t, "40EBFD")
+	for i := uint(1); i <= 100; i++ {
+		want := i * 10
+		ended, stopped := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(stopped)
+			for {
+				select {
+				case <-ended:
+					return
+				default:
+					m.Stop()
+				}
+			}
+		}()
+		// Stops land while the run is ending too
+		err := m.RunUntil(context.Background(), func(m *Machine) bool {
+			return m.CPU.Regs.AX() >= want-5
+		})
+		close(ended)
+		<-stopped
+		if err != nil {
+			assert.Equal(t, err, ErrStopped)
+		}
+		// A Stop from the last run doesn't stop this one
+		err = m.RunUntil(context.Background(), func(m *Machine) bool {
+			return m.CPU.Regs.AX() == want
+		})
+		assert.NilError(t, err)
+		assert.Equal(t, m.CPU.Regs.AX(), want)
+	}
+}
+
+func TestMachineStopWhileStarting(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		// JMP $
+		m := newTestMachine(t, "EBFE")
+		started := make(chan error)
+		go func() { started <- m.Start(context.Background()) }()
+		// Stop as soon as Start has changed the state, maybe before it has
+		// the run for Stop to wait for
+		for m.state.Load() == machineIdle {
+			runtime.Gosched()
+		}
+		m.Stop()
+		assert.NilError(t, <-started)
+		select {
+		case <-m.background().done:
+		default:
+			t.Fatal("Stop returned before the run ended")
+		}
+		_, err := m.Wait()
+		assert.Equal(t, err, ErrStopped)
+	}
+}
+
+func TestMachineOptions(t *testing.T) {
+	m := New(WithModel(cpu.Model8086), WithFPU(nil), WithDevices(false), WithMemory(64*1024))
+	assert.Equal(t, m.CPU.Model, cpu.Model8086)
+	assert.Assert(t, m.CPU.FPU == nil)
+	assert.Assert(t, m.PIC == nil && m.PIT == nil)
+	assert.Equal(t, len(m.CPU.Mem.AtAbs(0)), 64*1024)
+}